@@ -3,6 +3,7 @@ package operations
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -10,7 +11,8 @@ import (
 	"time"
 
 	"github.com/evergreen-ci/bond"
-	"github.com/evergreen-ci/bond/recall"
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
@@ -32,6 +34,29 @@ func Artifacts() cli.Command {
 						Name:  "timeout",
 						Value: "no-timeout",
 						Usage: "maximum duration for operation, defaults to no time out",
+					},
+					cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "print the selected versions without downloading them",
+					},
+					cli.IntFlag{
+						Name:  "attempts",
+						Value: defaultArtifactDownloadAttempts,
+						Usage: "number of times to download an archive before giving up",
+					},
+					cli.IntFlag{
+						Name:  "workers",
+						Value: 4,
+						Usage: "number of archives to download in parallel",
+					},
+					cli.DurationFlag{
+						Name:  "progress-interval",
+						Value: 10 * time.Second,
+						Usage: "how often to log download progress, or 0 to disable progress logging",
+					},
+					cli.StringFlag{
+						Name:  "summary",
+						Usage: "write a JSON summary of the archives downloaded and already cached to this file",
 					})...),
 				Action: func(c *cli.Context) error {
 					var cancel context.CancelFunc
@@ -62,7 +87,53 @@ func Artifacts() cli.Command {
 						Debug:   c.Bool("debug"),
 					}
 
-					err := recall.FetchReleases(ctx, c.StringSlice("version"), c.String("path"), opts)
+					if err := opts.Validate(); err != nil {
+						return errors.Wrap(err, "invalid build options")
+					}
+
+					feed, err := getArtifactsFeed(ctx, c.String("path"), c.String("feed-url"))
+					if err != nil {
+						return errors.Wrap(err, "fetching artifacts feed")
+					}
+
+					versions, err := resolveArtifactVersions(feed, c.StringSlice("version"), opts)
+					if err != nil {
+						return errors.Wrap(err, "selecting versions")
+					}
+
+					grip.Notice(message.Fields{
+						"message":  "selected versions",
+						"versions": versions,
+						"build":    opts.String(),
+					})
+					if c.Bool("dry-run") {
+						for _, version := range versions {
+							fmt.Println(version)
+						}
+						return nil
+					}
+
+					urls, err := resolveArtifactURLs(feed, versions, opts)
+					if err != nil {
+						return errors.Wrap(err, "resolving releases")
+					}
+
+					checksums, err := loadArtifactChecksums(artifactsFeedPath(c.String("path"), c.String("feed-url")))
+					if err != nil {
+						return errors.Wrap(err, "reading feed checksums")
+					}
+
+					summary, err := fetchArtifacts(ctx, urls, checksums, artifactDownloadOptions{
+						Path:             c.String("path"),
+						Attempts:         c.Int("attempts"),
+						Workers:          c.Int("workers"),
+						ProgressInterval: c.Duration("progress-interval"),
+					})
+					if fn := c.String("summary"); fn != "" && summary != nil {
+						if writeErr := writeArtifactDownloadSummary(fn, summary); writeErr != nil {
+							return errors.Wrap(writeErr, "writing download summary")
+						}
+					}
 					if err != nil {
 						return errors.Wrap(err, "fetching releases")
 					}
@@ -70,65 +141,115 @@ func Artifacts() cli.Command {
 					return nil
 				},
 			},
+			artifactsMirrorCmd(),
+			artifactsGCCmd(),
 			{
 				Name:  "list-variants",
 				Usage: "find all targets, editions and architectures for a version",
-				Flags: baseDlFlags(false),
+				Flags: artifactsFormatFlag(baseDlFlags(false)...),
 				Action: func(c *cli.Context) error {
 					ctx, cancel := context.WithCancel(context.Background())
 					defer cancel()
 
-					version, err := getVersionForListing(ctx, c.String("version"), c.String("path"))
+					if err := validateArtifactsFormat(c.String("format")); err != nil {
+						return errors.WithStack(err)
+					}
+
+					version, err := getVersionForListing(ctx, c.String("version"), c.String("path"), c.String("feed-url"))
 					if err != nil {
 						return errors.Wrap(err, "fetching version")
 					}
 
-					fmt.Println(version.GetBuildTypes())
-					return nil
+					if c.String("format") == "" {
+						fmt.Println(version.GetBuildTypes())
+						return nil
+					}
+
+					variants := newArtifactVariants(version)
+					return writeArtifactsOutput(os.Stdout, c.String("format"), variants, func(w io.Writer) error {
+						return writeArtifactVariantsTable(w, variants)
+					})
 				},
 			},
 			{
 				Name:  "list-map",
 				Usage: "find targets/edition/architecture mappings for a version",
-				Flags: baseDlFlags(false),
+				Flags: artifactsFormatFlag(baseDlFlags(false)...),
 				Action: func(c *cli.Context) error {
 					ctx, cancel := context.WithCancel(context.Background())
 					defer cancel()
 
-					version, err := getVersionForListing(ctx, c.String("version"), c.String("path"))
+					if err := validateArtifactsFormat(c.String("format")); err != nil {
+						return errors.WithStack(err)
+					}
+
+					version, err := getVersionForListing(ctx, c.String("version"), c.String("path"), c.String("feed-url"))
 					if err != nil {
 						return errors.Wrap(err, "fetching version")
 					}
 
-					fmt.Println(version)
-					return nil
+					if c.String("format") == "" {
+						fmt.Println(version)
+						return nil
+					}
+
+					builds := artifactBuildsForVersion(version, c.String("path"))
+					return writeArtifactsOutput(os.Stdout, c.String("format"), builds, func(w io.Writer) error {
+						return writeArtifactBuildTable(w, builds)
+					})
 				},
 			},
 			{
 				Name:  "list-all",
 				Usage: "prints a listing of the current contents of the version cache",
-				Flags: baseDlFlags(false),
+				Flags: artifactsFormatFlag(baseDlFlags(false)...),
 				Action: func(c *cli.Context) error {
 					ctx, cancel := context.WithCancel(context.Background())
 					defer cancel()
 
-					catalog, err := bond.NewCatalog(ctx, c.String("path"))
+					if err := validateArtifactsFormat(c.String("format")); err != nil {
+						return errors.WithStack(err)
+					}
+
+					feed, err := getArtifactsFeed(ctx, c.String("path"), c.String("feed-url"))
+					if err != nil {
+						return errors.Wrap(err, "fetching artifacts feed")
+					}
+
+					catalog, err := newArtifactCatalog(c.String("path"), feed)
 					if err != nil {
 						return errors.Wrap(err, "building catalog")
 					}
-					fmt.Println(catalog)
-					return nil
+
+					if c.String("format") == "" {
+						fmt.Println(catalog)
+						return nil
+					}
+
+					builds := artifactBuildsFromCatalog(catalog.Contents(), feed)
+					return writeArtifactsOutput(os.Stdout, c.String("format"), builds, func(w io.Writer) error {
+						return writeArtifactBuildTable(w, builds)
+					})
 				},
 			},
 			{
 				Name:  "get-path",
 				Usage: "get path to a build",
-				Flags: buildInfoFlags(baseDlFlags(false)...),
+				Flags: artifactsFormatFlag(buildInfoFlags(baseDlFlags(false)...)...),
 				Action: func(c *cli.Context) error {
 					ctx, cancel := context.WithCancel(context.Background())
 					defer cancel()
 
-					catalog, err := bond.NewCatalog(ctx, c.String("path"))
+					if err := validateArtifactsFormat(c.String("format")); err != nil {
+						return errors.WithStack(err)
+					}
+
+					feed, err := getArtifactsFeed(ctx, c.String("path"), c.String("feed-url"))
+					if err != nil {
+						return errors.Wrap(err, "fetching artifacts feed")
+					}
+
+					catalog, err := newArtifactCatalog(c.String("path"), feed)
 					if err != nil {
 						return errors.Wrap(err, "building catalog")
 					}
@@ -140,44 +261,54 @@ func Artifacts() cli.Command {
 						return errors.Wrap(err, "finding build")
 					}
 
-					fmt.Println(path)
+					if c.String("format") == "" {
+						fmt.Println(path)
+						return nil
+					}
 
-					return nil
+					info, err := bond.GetInfoFromFileName(path)
+					if err != nil {
+						return errors.Wrapf(err, "parsing build information from '%s'", path)
+					}
+
+					build := newArtifactBuild(info, path, feed)
+					return writeArtifactsOutput(os.Stdout, c.String("format"), build, func(w io.Writer) error {
+						return writeArtifactBuildTable(w, []artifactBuild{build})
+					})
 				},
 			},
 		},
 	}
 }
 
-func buildInfoFlags(flags ...cli.Flag) []cli.Flag {
-	var target string
-	var arch string
-
+func defaultBuildTarget() string {
 	if runtime.GOOS == "darwin" {
-		target = "osx"
-	} else {
-		target = runtime.GOOS
+		return "osx"
 	}
+	return runtime.GOOS
+}
 
+func defaultBuildArch() string {
 	if runtime.GOARCH == "amd64" {
-		arch = "x86_64"
+		return "x86_64"
 	} else if runtime.GOARCH == "386" {
-		arch = "i686"
+		return "i686"
 	} else if runtime.GOARCH == "arm" {
-		arch = "arm64"
-	} else {
-		arch = runtime.GOARCH
+		return "arm64"
 	}
+	return runtime.GOARCH
+}
 
+func buildInfoFlags(flags ...cli.Flag) []cli.Flag {
 	return append(flags,
 		cli.StringFlag{
 			Name:  "target",
-			Value: target,
+			Value: defaultBuildTarget(),
 			Usage: "name of target platform or operating system",
 		},
 		cli.StringFlag{
 			Name:  "arch",
-			Value: arch,
+			Value: defaultBuildArch(),
 			Usage: "name of target architecture",
 		},
 		cli.StringFlag{
@@ -195,8 +326,9 @@ func baseDlFlags(versionSlice bool, flags ...cli.Flag) []cli.Flag {
 	if versionSlice {
 		flags = append(flags,
 			cli.StringSliceFlag{
-				Name:  "version",
-				Usage: "specify a version (may specify multiple times)",
+				Name: "version",
+				Usage: "specify a version, or a selector such as '>=6.0 <7.1', '7.0.x', " +
+					"'latest-patch:6.x' or 'latest-stable:3' (may specify multiple times)",
 			})
 	} else {
 		flags = append(flags,
@@ -212,11 +344,85 @@ func baseDlFlags(versionSlice bool, flags ...cli.Flag) []cli.Flag {
 			EnvVar: "CURATOR_ARTIFACTS_DIRECTORY",
 			Value:  filepath.Join(os.TempDir(), "curator-artifact-cache"),
 			Usage:  "path to top level of cache directory",
+		},
+		cli.StringFlag{
+			Name:   "feed-url",
+			EnvVar: "CURATOR_ARTIFACTS_FEED_URL",
+			Usage:  "URL or path of a release feed to use instead of downloads.mongodb.org, such as one written by 'artifacts mirror'",
 		})
 }
 
-func getVersionForListing(ctx context.Context, release, path string) (*bond.ArtifactVersion, error) {
-	feed, err := bond.GetArtifactsFeed(ctx, path)
+// populateArtifactsFeed downloads the feed at the URL, which may be a
+// local path, into the cache. The feed is cached under its own name,
+// so that it doesn't replace the feed bond caches from
+// downloads.mongodb.org. It returns the path of the cached feed.
+func populateArtifactsFeed(ctx context.Context, path, feedURL string) (string, error) {
+	if !strings.Contains(feedURL, "://") {
+		abs, err := filepath.Abs(feedURL)
+		if err != nil {
+			return "", errors.Wrapf(err, "resolving feed path '%s'", feedURL)
+		}
+		feedURL = "file://" + filepath.ToSlash(artifactsFeedFile(abs))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(artifactsFeedFile(path)), 0755); err != nil {
+		return "", errors.Wrap(err, "creating cache directory")
+	}
+
+	fn := artifactsFeedPath(path, feedURL)
+	tmp := fn + ".download"
+	for _, fn := range []string{tmp, tmp + artifactPartialSuffix} {
+		if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+			return "", errors.Wrapf(err, "removing '%s'", fn)
+		}
+	}
+
+	if _, err := downloadArtifactFile(ctx, feedURL, tmp, nil); err != nil {
+		return "", errors.Wrapf(err, "downloading feed from '%s'", feedURL)
+	}
+
+	return fn, errors.Wrap(os.Rename(tmp, fn), "replacing cached feed")
+}
+
+// artifactsFeedPath returns the path of the cached feed to use: the
+// mirror's feed if there is a feed URL, and otherwise bond's.
+func artifactsFeedPath(path, feedURL string) string {
+	fn := artifactsFeedFile(path)
+	if feedURL == "" {
+		return fn
+	}
+
+	return filepath.Join(filepath.Dir(fn), artifactsMirrorFeedName)
+}
+
+// getArtifactsFeed returns the feed cached at the path, from the feed
+// URL if there is one.
+func getArtifactsFeed(ctx context.Context, path, feedURL string) (*bond.ArtifactsFeed, error) {
+	if feedURL == "" {
+		return bond.GetArtifactsFeed(ctx, path)
+	}
+
+	fn, err := populateArtifactsFeed(ctx, path, feedURL)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading artifacts feed")
+	}
+
+	// load the feed directly, since bond would replace a stale feed
+	// with the one from downloads.mongodb.org.
+	feed, err := bond.NewArtifactsFeed(fn)
+	if err != nil {
+		return nil, errors.Wrap(err, "building feed")
+	}
+
+	return feed, errors.Wrap(feed.Reload(data), "reloading feed")
+}
+
+func getVersionForListing(ctx context.Context, release, path, feedURL string) (*bond.ArtifactVersion, error) {
+	feed, err := getArtifactsFeed(ctx, path, feedURL)
 	if err != nil {
 		return nil, errors.Wrap(err, "fetching artifacts feed")
 	}
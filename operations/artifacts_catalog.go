@@ -0,0 +1,148 @@
+package operations
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/evergreen-ci/bond"
+	"github.com/mongodb/grip"
+	"github.com/pkg/errors"
+)
+
+// artifactCatalog finds the builds in a cache directory the way bond's
+// catalog does. Unlike bond's catalog, it resolves versions with the
+// given feed, rather than the one cached in the directory, so that it
+// works with a mirror's feed and without network access.
+type artifactCatalog struct {
+	Path   string
+	builds map[bond.BuildInfo]string
+	feed   *bond.ArtifactsFeed
+}
+
+func newArtifactCatalog(path string, feed *bond.ArtifactsFeed) (*artifactCatalog, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolving absolute path")
+	}
+
+	contents, err := os.ReadDir(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading contents of '%s'", path)
+	}
+
+	catalog := &artifactCatalog{Path: path, builds: map[bond.BuildInfo]string{}, feed: feed}
+	catcher := grip.NewBasicCatcher()
+	for _, obj := range contents {
+		if !obj.IsDir() || !strings.HasPrefix(obj.Name(), "mongodb-") {
+			continue
+		}
+
+		catcher.Add(catalog.add(filepath.Join(path, obj.Name())))
+	}
+	if catcher.HasErrors() {
+		return nil, errors.Wrapf(catcher.Resolve(), "building build catalog from path '%s'", path)
+	}
+
+	return catalog, nil
+}
+
+func (c *artifactCatalog) add(fn string) error {
+	info, err := bond.GetInfoFromFileName(fn)
+	if err != nil {
+		return errors.Wrap(err, "collecting information about build")
+	}
+
+	catcher := grip.NewBasicCatcher()
+	for _, bin := range []string{"mongod", "mongos"} {
+		if runtime.GOOS == "windows" {
+			bin += ".exe"
+		}
+		if _, err = os.Stat(filepath.Join(fn, "bin", bin)); err != nil {
+			catcher.Errorf("binary '%s' is missing from path '%s' for version '%s'", bin, fn, info.Version)
+		}
+	}
+	if catcher.HasErrors() {
+		return catcher.Resolve()
+	}
+
+	if _, ok := c.builds[info]; ok {
+		return errors.Errorf("path '%s' exists in cache", fn)
+	}
+	c.builds[info] = fn
+
+	return nil
+}
+
+// Contents returns a copy of the builds in the catalog.
+func (c *artifactCatalog) Contents() map[bond.BuildInfo]string {
+	out := make(map[bond.BuildInfo]string, len(c.builds))
+	for info, fn := range c.builds {
+		out[info] = fn
+	}
+
+	return out
+}
+
+// String returns the builds keyed by path, in the same form as bond's
+// catalog.
+func (c *artifactCatalog) String() string {
+	inverted := make(map[string]bond.BuildInfo, len(c.builds))
+	for info, fn := range c.builds {
+		inverted[fn] = info
+	}
+
+	out, err := json.MarshalIndent(inverted, "", "   ")
+	if err != nil {
+		return fmt.Sprintf("%+v", inverted)
+	}
+
+	return string(out)
+}
+
+// Get returns the path of the build in the catalog. As with bond's
+// catalog, "X.Y-current" names the newest stable release of the series
+// and "X.Y-latest" the series' nightly build.
+func (c *artifactCatalog) Get(version, edition, target, arch string, debug bool) (string, error) {
+	switch {
+	case strings.Contains(version, "current"):
+		if c.feed == nil {
+			return "", errors.Errorf("cannot resolve '%s' without a feed", version)
+		}
+		release, err := c.feed.GetLatestRelease(version)
+		if err != nil {
+			return "", errors.Wrapf(err, "determining current stable release for series '%s'", version)
+		}
+		version = release.Version
+	case strings.Contains(version, "latest"):
+		series := strings.TrimPrefix(version, "v")
+		if len(series) > 3 {
+			series = series[:3]
+		}
+		version = series + "-latest"
+	}
+
+	if strings.Contains(target, "auto") {
+		target = bond.GetTargetDistro()
+	}
+
+	info := bond.BuildInfo{
+		Version: version,
+		Options: bond.BuildOptions{
+			Target:  target,
+			Arch:    bond.MongoDBArch(arch),
+			Edition: bond.MongoDBEdition(edition),
+			Debug:   debug,
+		},
+	}
+	fn, ok := c.builds[info]
+	if !ok {
+		return "", errors.Errorf("could not find version '%s', edition '%s', target '%s', arch '%s' in path '%s'",
+			version, edition, target, arch, c.Path)
+	}
+
+	return fn, nil
+}
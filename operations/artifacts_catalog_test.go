@@ -0,0 +1,56 @@
+package operations
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArtifactCatalog(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"mongodb-linux-x86_64-enterprise-ubuntu2204-7.0.12",
+		"mongodb-linux-x86_64-enterprise-ubuntu2204-7.0.11",
+		"mongodb-linux-x86_64-enterprise-ubuntu2204-v7.0-latest",
+	} {
+		for _, bin := range []string{"mongod", "mongos"} {
+			require.NoError(t, os.MkdirAll(filepath.Join(dir, name, "bin"), 0755))
+			require.NoError(t, os.WriteFile(filepath.Join(dir, name, "bin", bin), []byte(bin), 0755))
+		}
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, artifactsMirrorFeedName), []byte("{}"), 0644))
+
+	feed := newTestArtifactsFeed(t, "7.0.12", "7.0.11", "7.0.0")
+	for _, version := range feed.Versions {
+		version.Current = version.Version == "7.0.11"
+	}
+
+	catalog, err := newArtifactCatalog(dir, feed)
+	require.NoError(t, err)
+	assert.Len(t, catalog.Contents(), 3)
+	assert.Contains(t, catalog.String(), filepath.Join(dir, "mongodb-linux-x86_64-enterprise-ubuntu2204-7.0.12"))
+
+	for version, expected := range map[string]string{
+		"7.0.12":      "mongodb-linux-x86_64-enterprise-ubuntu2204-7.0.12",
+		"7.0-current": "mongodb-linux-x86_64-enterprise-ubuntu2204-7.0.11",
+		"7.0-latest":  "mongodb-linux-x86_64-enterprise-ubuntu2204-v7.0-latest",
+	} {
+		fn, err := catalog.Get(version, "enterprise", "ubuntu2204", "x86_64", false)
+		require.NoError(t, err, version)
+		assert.Equal(t, filepath.Join(dir, expected), fn, version)
+	}
+
+	_, err = catalog.Get("6.0.15", "enterprise", "ubuntu2204", "x86_64", false)
+	assert.Error(t, err)
+	_, err = catalog.Get("7.0.12", "enterprise", "ubuntu2204", "x86_64", true)
+	assert.Error(t, err)
+
+	t.Run("IncompleteBuild", func(t *testing.T) {
+		require.NoError(t, os.Remove(filepath.Join(dir, "mongodb-linux-x86_64-enterprise-ubuntu2204-7.0.11", "bin", "mongos")))
+		_, err := newArtifactCatalog(dir, feed)
+		assert.Error(t, err)
+	})
+}
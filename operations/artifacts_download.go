@@ -0,0 +1,509 @@
+package operations
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/evergreen-ci/bond"
+	"github.com/mholt/archiver/v3"
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+)
+
+const defaultArtifactDownloadAttempts = 3
+
+// artifactChecksum is the checksum that the release feed publishes
+// for an archive.
+type artifactChecksum struct {
+	Algorithm string
+	Value     string
+}
+
+func (c artifactChecksum) isZero() bool { return c.Value == "" }
+
+func (c artifactChecksum) newHash() (hash.Hash, error) {
+	switch c.Algorithm {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "md5":
+		return md5.New(), nil
+	default:
+		return nil, errors.Errorf("unsupported checksum algorithm '%s'", c.Algorithm)
+	}
+}
+
+// artifactsMirrorFeedName is the name of the feed downloaded from a
+// feed URL in an artifacts cache.
+const artifactsMirrorFeedName = "mirror-full.json"
+
+// artifactsFeedFile returns the path of the release feed within an
+// artifacts cache, following bond's conventions.
+func artifactsFeedFile(path string) string {
+	if strings.HasSuffix(path, ".json") {
+		return path
+	}
+	return filepath.Join(path, "full.json")
+}
+
+// loadArtifactChecksums reads the strongest checksum the release feed
+// publishes for every archive, keyed by the archive's URL. bond does
+// not retain the md5 values, so this reads the cached feed directly.
+func loadArtifactChecksums(path string) (map[string]artifactChecksum, error) {
+	data, err := os.ReadFile(artifactsFeedFile(path))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading artifacts feed")
+	}
+
+	return artifactChecksumsFromFeed(data)
+}
+
+// artifactChecksumsFromFeed parses the checksums in the feed's content.
+func artifactChecksumsFromFeed(data []byte) (map[string]artifactChecksum, error) {
+	feed := struct {
+		Versions []struct {
+			Downloads []struct {
+				Archive struct {
+					URL    string `json:"url"`
+					SHA256 string `json:"sha256"`
+					SHA1   string `json:"sha1"`
+					MD5    string `json:"md5"`
+				} `json:"archive"`
+			} `json:"downloads"`
+		} `json:"versions"`
+	}{}
+	if err := json.Unmarshal(data, &feed); err != nil {
+		return nil, errors.Wrap(err, "parsing artifacts feed")
+	}
+
+	out := map[string]artifactChecksum{}
+	for _, version := range feed.Versions {
+		for _, dl := range version.Downloads {
+			archive := dl.Archive
+			switch {
+			case archive.URL == "":
+				continue
+			case archive.SHA256 != "":
+				out[archive.URL] = artifactChecksum{Algorithm: "sha256", Value: archive.SHA256}
+			case archive.SHA1 != "":
+				out[archive.URL] = artifactChecksum{Algorithm: "sha1", Value: archive.SHA1}
+			case archive.MD5 != "":
+				out[archive.URL] = artifactChecksum{Algorithm: "md5", Value: archive.MD5}
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// resolveArtifactURLs returns the archive URLs for the releases, in
+// the same way that bond resolves them for its own downloads.
+func resolveArtifactURLs(feed *bond.ArtifactsFeed, releases []string, opts bond.BuildOptions) ([]string, error) {
+	urls, errs := feed.GetArchives(releases, opts)
+
+	out := []string{}
+	for url := range urls {
+		out = append(out, url)
+	}
+
+	catcher := grip.NewBasicCatcher()
+	for err := range errs {
+		catcher.Add(err)
+	}
+
+	return out, catcher.Resolve()
+}
+
+// artifactArchiveName returns the file name of an archive in the
+// cache, using the names that bond's catalog expects.
+func artifactArchiveName(url string) string {
+	name := path.Base(url)
+	if strings.HasSuffix(name, ".tar.gz") {
+		name = strings.TrimSuffix(name, ".tar.gz") + ".tgz"
+	}
+
+	return name
+}
+
+// artifactArchivePath returns the location of an archive in the cache.
+func artifactArchivePath(dir, url string) string {
+	return filepath.Join(dir, artifactArchiveName(url))
+}
+
+// verifyArtifactChecksum returns an error if the file's contents do not
+// match the checksum.
+func verifyArtifactChecksum(fn string, checksum artifactChecksum) error {
+	h, err := checksum.newHash()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		return errors.Wrapf(err, "opening '%s'", fn)
+	}
+	defer f.Close()
+
+	if _, err = io.Copy(h, f); err != nil {
+		return errors.Wrapf(err, "reading '%s'", fn)
+	}
+
+	if actual := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(actual, checksum.Value) {
+		return errors.Errorf("%s checksum of '%s' is '%s', but the feed publishes '%s'",
+			checksum.Algorithm, fn, actual, checksum.Value)
+	}
+
+	return nil
+}
+
+type artifactDownloadOptions struct {
+	Path             string
+	Attempts         int
+	Workers          int
+	SkipExtract      bool
+	ProgressInterval time.Duration
+}
+
+func (opts *artifactDownloadOptions) validate() error {
+	catcher := grip.NewBasicCatcher()
+	catcher.NewWhen(opts.Path == "", "must specify a cache path")
+	catcher.NewWhen(opts.Attempts < 0, "number of attempts must not be negative")
+	catcher.NewWhen(opts.ProgressInterval < 0, "progress interval must not be negative")
+
+	if opts.Attempts == 0 {
+		opts.Attempts = defaultArtifactDownloadAttempts
+	}
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+
+	return catcher.Resolve()
+}
+
+const (
+	artifactDownloaded = "downloaded"
+	artifactCached     = "cached"
+	artifactFailed     = "failed"
+)
+
+// artifactDownloadResult describes what fetching one archive did.
+type artifactDownloadResult struct {
+	URL       string `json:"url"`
+	File      string `json:"file"`
+	Status    string `json:"status"`
+	Resumed   bool   `json:"resumed"`
+	Verified  bool   `json:"verified"`
+	Extracted bool   `json:"extracted"`
+	Size      int64  `json:"size"`
+	Attempts  int    `json:"attempts"`
+	Error     string `json:"error,omitempty"`
+}
+
+// artifactDownloadSummary describes what fetching a group of archives
+// did, distinguishing archives downloaded from those already cached.
+type artifactDownloadSummary struct {
+	Path       string                   `json:"path"`
+	Archives   []artifactDownloadResult `json:"archives"`
+	Downloaded int                      `json:"downloaded"`
+	Cached     int                      `json:"cached"`
+	Failed     int                      `json:"failed"`
+	Bytes      int64                    `json:"bytes"`
+	Duration   float64                  `json:"duration_secs"`
+}
+
+func writeArtifactDownloadSummary(fn string, summary *artifactDownloadSummary) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return errors.Wrapf(err, "creating '%s'", fn)
+	}
+
+	if err = writeJSON(f, summary); err != nil {
+		grip.Warning(f.Close())
+		return errors.WithStack(err)
+	}
+
+	return errors.Wrapf(f.Close(), "closing '%s'", fn)
+}
+
+// fetchArtifacts downloads, verifies, and extracts the archives into
+// the cache in parallel. Every archive is attempted even if others
+// fail, and the summary includes the failures.
+func fetchArtifacts(ctx context.Context, urls []string, checksums map[string]artifactChecksum, opts artifactDownloadOptions) (*artifactDownloadSummary, error) {
+	if err := opts.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid download options")
+	}
+
+	progress := newArtifactProgress()
+	if opts.ProgressInterval > 0 {
+		progressCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go progress.log(progressCtx, opts.ProgressInterval)
+	}
+
+	summary := &artifactDownloadSummary{Path: opts.Path, Archives: []artifactDownloadResult{}}
+	mu := &sync.Mutex{}
+	catcher := grip.NewBasicCatcher()
+	_ = runS3SyncWorkers(ctx, opts.Workers, urls, func(ctx context.Context, url string) error {
+		result, err := fetchArtifact(ctx, url, checksums[url], opts, progress)
+		if err != nil {
+			result.Status = artifactFailed
+			result.Error = err.Error()
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		catcher.Add(err)
+		summary.Archives = append(summary.Archives, result)
+		switch result.Status {
+		case artifactDownloaded:
+			summary.Downloaded++
+		case artifactCached:
+			summary.Cached++
+		default:
+			summary.Failed++
+		}
+		return nil
+	})
+	catcher.Add(ctx.Err())
+
+	sort.Slice(summary.Archives, func(i, j int) bool { return summary.Archives[i].URL < summary.Archives[j].URL })
+	summary.Bytes = atomic.LoadInt64(&progress.received)
+	summary.Duration = time.Since(progress.started).Seconds()
+
+	msg := message.Fields{
+		"message":    "fetched artifacts",
+		"path":       opts.Path,
+		"downloaded": summary.Downloaded,
+		"cached":     summary.Cached,
+		"failed":     summary.Failed,
+		"bytes":      summary.Bytes,
+		"duration":   summary.Duration,
+	}
+	err := catcher.Resolve()
+	grip.InfoWhen(err == nil, msg)
+	grip.Error(message.WrapError(err, msg))
+
+	return summary, err
+}
+
+// fetchArtifact downloads an archive into the cache unless it is
+// already there, and verifies it against the feed's checksum before
+// extracting it. Failed downloads resume and archives that fail
+// verification are removed and downloaded again, up to the configured
+// number of attempts.
+func fetchArtifact(ctx context.Context, url string, checksum artifactChecksum, opts artifactDownloadOptions, progress *artifactProgress) (artifactDownloadResult, error) {
+	fn := artifactArchivePath(opts.Path, url)
+	dir := strings.TrimSuffix(fn, filepath.Ext(fn))
+	result := artifactDownloadResult{URL: url, File: fn, Status: artifactCached}
+
+	if strings.Contains(fn, "latest") {
+		// nightly builds reuse their names, so never trust the cache
+		grip.Warning(message.WrapError(removeArtifact(fn), "removing cached nightly archive"))
+	}
+
+	if checksum.isZero() {
+		grip.Warning(message.Fields{
+			"message": "feed does not publish a checksum for archive, skipping verification",
+			"url":     url,
+		})
+	}
+
+	attempts := opts.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	for {
+		result.Attempts++
+		if _, err := os.Stat(fn); os.IsNotExist(err) {
+			result.Status = artifactDownloaded
+			resumed, err := downloadArtifactFile(ctx, url, fn, progress)
+			result.Resumed = result.Resumed || resumed
+			if err != nil {
+				err = errors.Wrapf(err, "downloading '%s'", url)
+				if ctx.Err() != nil || result.Attempts >= attempts {
+					return result, errors.Wrapf(err, "after %d attempts", result.Attempts)
+				}
+
+				grip.Warning(message.WrapError(err, message.Fields{
+					"message":  "retrying download",
+					"url":      url,
+					"attempt":  result.Attempts,
+					"attempts": attempts,
+				}))
+				continue
+			}
+		}
+
+		if checksum.isZero() {
+			break
+		}
+
+		err := verifyArtifactChecksum(fn, checksum)
+		if err == nil {
+			grip.Debug(message.Fields{
+				"message":   "verified archive",
+				"file":      fn,
+				"algorithm": checksum.Algorithm,
+			})
+			result.Verified = true
+			break
+		}
+
+		grip.Warning(message.WrapError(err, message.Fields{
+			"message":  "removing archive that failed verification",
+			"url":      url,
+			"file":     fn,
+			"attempt":  result.Attempts,
+			"attempts": attempts,
+		}))
+		if rmErr := removeArtifact(fn); rmErr != nil {
+			return result, errors.Wrapf(rmErr, "removing archive '%s' that failed verification", fn)
+		}
+
+		if result.Attempts >= attempts {
+			return result, errors.Wrapf(err, "verifying '%s' after %d attempts", url, result.Attempts)
+		}
+	}
+
+	if stat, err := os.Stat(fn); err == nil {
+		result.Size = stat.Size()
+	}
+
+	if opts.SkipExtract {
+		touchArtifact(fn)
+		return result, nil
+	}
+
+	if stat, err := os.Stat(dir); err == nil && stat.IsDir() {
+		grip.Debug(message.Fields{
+			"message": "archive is already extracted",
+			"dir":     dir,
+		})
+		touchArtifact(fn)
+		return result, nil
+	}
+
+	if err := extractArtifact(fn); err != nil {
+		return result, errors.Wrapf(err, "extracting '%s'", fn)
+	}
+	result.Extracted = true
+	touchArtifact(fn)
+
+	return result, nil
+}
+
+// touchArtifact updates the modification times of an archive and its
+// extracted contents to now, so that pruning the cache by age and
+// least recent use keeps the artifacts that are still in use. Failing
+// to update them is only logged.
+func touchArtifact(fn string) {
+	now := time.Now()
+	for _, path := range []string{fn, strings.TrimSuffix(fn, filepath.Ext(fn))} {
+		if err := os.Chtimes(path, now, now); err != nil && !os.IsNotExist(err) {
+			grip.Warning(message.WrapError(err, message.Fields{
+				"message": "problem updating artifact timestamp",
+				"path":    path,
+			}))
+		}
+	}
+}
+
+// removeArtifact removes an archive and its extracted contents.
+func removeArtifact(fn string) error {
+	catcher := grip.NewBasicCatcher()
+	for _, path := range []string{fn, fn + artifactPartialSuffix} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			catcher.Add(err)
+		}
+	}
+	catcher.Add(os.RemoveAll(strings.TrimSuffix(fn, filepath.Ext(fn))))
+
+	return catcher.Resolve()
+}
+
+// extractArtifact extracts an archive next to it, renaming the top
+// level directory to match the archive's name as bond's catalog
+// expects.
+func extractArtifact(fn string) error {
+	dir := filepath.Dir(fn)
+	name := strings.TrimSuffix(filepath.Base(fn), filepath.Ext(fn))
+
+	var unarchiver archiver.Unarchiver
+	switch filepath.Ext(fn) {
+	case ".tgz":
+		tgz := archiver.NewTarGz()
+		tgz.OverwriteExisting = true
+		unarchiver = tgz
+	case ".zip":
+		z := archiver.NewZip()
+		z.OverwriteExisting = true
+		unarchiver = z
+	default:
+		return errors.Errorf("file '%s' is in an unsupported archive format", fn)
+	}
+
+	root, err := artifactArchiveRoot(fn)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = unarchiver.Unarchive(fn, dir); err != nil {
+		return errors.Wrap(err, "extracting archive")
+	}
+
+	if root != "" && root != name {
+		if err = os.Rename(filepath.Join(dir, root), filepath.Join(dir, name)); err != nil {
+			return errors.Wrapf(err, "renaming directory '%s' to '%s'", root, name)
+		}
+	}
+
+	grip.Debug(message.Fields{
+		"message": "extracted archive",
+		"file":    fn,
+	})
+
+	return nil
+}
+
+// artifactArchiveRoot returns the top level directory of the first
+// entry in the archive, or an empty string if it has none.
+func artifactArchiveRoot(fn string) (string, error) {
+	var root string
+	err := archiver.Walk(fn, func(f archiver.File) error {
+		switch h := f.Header.(type) {
+		case *tar.Header:
+			root = h.Name
+		case zip.FileHeader:
+			root = h.Name
+		}
+		return archiver.ErrStopWalk
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "reading contents of '%s'", fn)
+	}
+
+	root = strings.TrimPrefix(filepath.ToSlash(root), "./")
+	if idx := strings.Index(root, "/"); idx > 0 {
+		return root[:idx], nil
+	}
+
+	return "", nil
+}
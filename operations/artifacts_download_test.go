@@ -0,0 +1,256 @@
+package operations
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestArtifactArchive(t *testing.T, root string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: root + "/", Typeflag: tar.TypeDir, Mode: 0755}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: root + "/bin/", Typeflag: tar.TypeDir, Mode: 0755}))
+	content := []byte("mongod")
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: root + "/bin/mongod", Typeflag: tar.TypeReg, Mode: 0755, Size: int64(len(content))}))
+	_, err := tw.Write(content)
+	require.NoError(t, err)
+
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func sha256Checksum(data []byte) artifactChecksum {
+	sum := sha256.Sum256(data)
+	return artifactChecksum{Algorithm: "sha256", Value: hex.EncodeToString(sum[:])}
+}
+
+func TestLoadArtifactChecksums(t *testing.T) {
+	dir := t.TempDir()
+	feed := `{"versions": [{"version": "6.0.1", "downloads": [
+		{"archive": {"url": "https://example.com/a.tgz", "sha1": "s1", "sha256": "s256", "md5": "m5"}},
+		{"archive": {"url": "https://example.com/b.tgz", "sha1": "s1"}},
+		{"archive": {"url": "https://example.com/c.zip", "md5": "m5"}},
+		{"archive": {"url": "https://example.com/d.tgz"}}
+	]}]}`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "full.json"), []byte(feed), 0644))
+
+	checksums, err := loadArtifactChecksums(dir)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]artifactChecksum{
+		"https://example.com/a.tgz": {Algorithm: "sha256", Value: "s256"},
+		"https://example.com/b.tgz": {Algorithm: "sha1", Value: "s1"},
+		"https://example.com/c.zip": {Algorithm: "md5", Value: "m5"},
+	}, checksums)
+
+	_, err = loadArtifactChecksums(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestArtifactArchivePath(t *testing.T) {
+	assert.Equal(t, filepath.Join("cache", "mongodb-linux-x86_64-6.0.1.tgz"),
+		artifactArchivePath("cache", "https://fastdl.mongodb.org/linux/mongodb-linux-x86_64-6.0.1.tar.gz"))
+	assert.Equal(t, filepath.Join("cache", "mongodb-windows-x86_64-6.0.1.zip"),
+		artifactArchivePath("cache", "https://fastdl.mongodb.org/windows/mongodb-windows-x86_64-6.0.1.zip"))
+}
+
+func TestFetchArtifact(t *testing.T) {
+	ctx := context.Background()
+	archive := newTestArtifactArchive(t, "mongodb-linux-x86_64-6.0.1-abc")
+	checksum := sha256Checksum(archive)
+
+	var requests int32
+	var corrupt int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		if strings.HasPrefix(r.URL.Path, "/missing") {
+			http.NotFound(w, r)
+			return
+		}
+		if n <= atomic.LoadInt32(&corrupt) {
+			_, _ = w.Write(archive[:len(archive)/2])
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(archive))
+	}))
+	defer srv.Close()
+	url := srv.URL + "/linux/mongodb-linux-x86_64-6.0.1.tar.gz"
+
+	reset := func(corruptions int32) {
+		atomic.StoreInt32(&requests, 0)
+		atomic.StoreInt32(&corrupt, corruptions)
+	}
+
+	t.Run("Verified", func(t *testing.T) {
+		reset(0)
+		opts := artifactDownloadOptions{Path: t.TempDir()}
+		_, err := fetchArtifact(ctx, url, checksum, opts, nil)
+		require.NoError(t, err)
+
+		data, err := os.ReadFile(filepath.Join(opts.Path, "mongodb-linux-x86_64-6.0.1", "bin", "mongod"))
+		require.NoError(t, err)
+		assert.Equal(t, "mongod", string(data))
+
+		result, err := fetchArtifact(ctx, url, checksum, opts, nil)
+		require.NoError(t, err)
+		assert.Equal(t, artifactCached, result.Status)
+		assert.True(t, result.Verified)
+		assert.EqualValues(t, 1, atomic.LoadInt32(&requests), "verified archives are not downloaded again")
+	})
+	t.Run("UpdatesTimestamps", func(t *testing.T) {
+		reset(0)
+		opts := artifactDownloadOptions{Path: t.TempDir()}
+		fn := filepath.Join(opts.Path, "mongodb-linux-x86_64-6.0.1.tgz")
+		dir := filepath.Join(opts.Path, "mongodb-linux-x86_64-6.0.1")
+		old := time.Now().Add(-48 * time.Hour)
+
+		_, err := fetchArtifact(ctx, url, checksum, opts, nil)
+		require.NoError(t, err)
+		for _, path := range []string{fn, dir} {
+			stat, err := os.Stat(path)
+			require.NoError(t, err)
+			assert.True(t, stat.ModTime().After(old), "downloads are fresh")
+			require.NoError(t, os.Chtimes(path, old, old))
+		}
+
+		result, err := fetchArtifact(ctx, url, checksum, opts, nil)
+		require.NoError(t, err)
+		assert.Equal(t, artifactCached, result.Status)
+		for _, path := range []string{fn, dir} {
+			stat, err := os.Stat(path)
+			require.NoError(t, err)
+			assert.True(t, stat.ModTime().After(old.Add(time.Hour)), "cache hits move the modification time forward")
+		}
+	})
+	t.Run("RetriesMismatch", func(t *testing.T) {
+		reset(1)
+		opts := artifactDownloadOptions{Path: t.TempDir(), Attempts: 2}
+		require.NoError(t, opts.validate())
+		_, err := fetchArtifact(ctx, url, checksum, opts, nil)
+		require.NoError(t, err)
+		assert.EqualValues(t, 2, atomic.LoadInt32(&requests))
+		assert.DirExists(t, filepath.Join(opts.Path, "mongodb-linux-x86_64-6.0.1"))
+	})
+	t.Run("ReplacesCorruptCache", func(t *testing.T) {
+		reset(0)
+		opts := artifactDownloadOptions{Path: t.TempDir(), Attempts: 1}
+		fn := filepath.Join(opts.Path, "mongodb-linux-x86_64-6.0.1.tgz")
+		require.NoError(t, os.WriteFile(fn, []byte("corrupt"), 0644))
+
+		_, err := fetchArtifact(ctx, url, checksum, opts, nil)
+		assert.Error(t, err, "the corrupt archive uses up the only attempt")
+		assert.NoFileExists(t, fn)
+
+		_, err = fetchArtifact(ctx, url, checksum, opts, nil)
+		require.NoError(t, err)
+		assert.FileExists(t, fn)
+	})
+	t.Run("FailsAfterAttempts", func(t *testing.T) {
+		reset(10)
+		opts := artifactDownloadOptions{Path: t.TempDir(), Attempts: 3}
+		_, err := fetchArtifact(ctx, url, checksum, opts, nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "after 3 attempts")
+		assert.EqualValues(t, 3, atomic.LoadInt32(&requests))
+		assert.NoFileExists(t, filepath.Join(opts.Path, "mongodb-linux-x86_64-6.0.1.tgz"))
+		assert.NoDirExists(t, filepath.Join(opts.Path, "mongodb-linux-x86_64-6.0.1"))
+	})
+	t.Run("NoChecksum", func(t *testing.T) {
+		reset(0)
+		opts := artifactDownloadOptions{Path: t.TempDir()}
+		_, err := fetchArtifacts(ctx, []string{url}, map[string]artifactChecksum{}, opts)
+		require.NoError(t, err)
+		assert.DirExists(t, filepath.Join(opts.Path, "mongodb-linux-x86_64-6.0.1"))
+	})
+	t.Run("ResumesPartialDownload", func(t *testing.T) {
+		reset(0)
+		opts := artifactDownloadOptions{Path: t.TempDir(), Attempts: 1}
+		fn := filepath.Join(opts.Path, "mongodb-linux-x86_64-6.0.1.tgz")
+		require.NoError(t, os.WriteFile(fn+artifactPartialSuffix, archive[:100], 0644))
+
+		progress := newArtifactProgress()
+		result, err := fetchArtifact(ctx, url, checksum, opts, progress)
+		require.NoError(t, err)
+		assert.True(t, result.Resumed)
+		assert.True(t, result.Verified)
+		assert.Equal(t, artifactDownloaded, result.Status)
+		assert.EqualValues(t, len(archive), result.Size)
+		assert.EqualValues(t, len(archive)-100, atomic.LoadInt64(&progress.received), "only the remainder is downloaded")
+		assert.NoFileExists(t, fn+artifactPartialSuffix)
+	})
+	t.Run("RetriesFailedDownload", func(t *testing.T) {
+		reset(0)
+		opts := artifactDownloadOptions{Path: t.TempDir(), Attempts: 2}
+		result, err := fetchArtifact(ctx, srv.URL+"/missing/mongodb-linux-x86_64-6.0.2.tgz", checksum, opts, nil)
+		require.Error(t, err)
+		assert.Equal(t, 2, result.Attempts)
+	})
+	t.Run("Summary", func(t *testing.T) {
+		reset(0)
+		opts := artifactDownloadOptions{Path: t.TempDir(), Workers: 2}
+		other := srv.URL + "/linux/mongodb-linux-x86_64-6.0.2.tgz"
+		urls := []string{url, other, srv.URL + "/missing"}
+		checksums := map[string]artifactChecksum{url: checksum, other: checksum}
+
+		summary, err := fetchArtifacts(ctx, urls[:2], checksums, opts)
+		require.NoError(t, err)
+		assert.Equal(t, 2, summary.Downloaded)
+		assert.EqualValues(t, 2*len(archive), summary.Bytes)
+
+		summary, err = fetchArtifacts(ctx, urls, checksums, opts)
+		require.Error(t, err, "failures do not stop the other downloads")
+		require.Len(t, summary.Archives, 3)
+		assert.Equal(t, 0, summary.Downloaded)
+		assert.Equal(t, 2, summary.Cached)
+		assert.Equal(t, 1, summary.Failed)
+		assert.Zero(t, summary.Bytes)
+		for _, result := range summary.Archives {
+			if result.Status == artifactFailed {
+				assert.Equal(t, urls[2], result.URL)
+				assert.NotEmpty(t, result.Error)
+			}
+		}
+
+		fn := filepath.Join(t.TempDir(), "summary.json")
+		require.NoError(t, writeArtifactDownloadSummary(fn, summary))
+		data, err := os.ReadFile(fn)
+		require.NoError(t, err)
+		assert.Contains(t, string(data), `"cached": 2`)
+	})
+}
+
+func TestArtifactProgress(t *testing.T) {
+	progress := newArtifactProgress()
+	progress.started = time.Now().Add(-10 * time.Second)
+	progress.expect(2000)
+	_, err := io.Copy(io.Discard, progress.reader(bytes.NewReader(make([]byte, 1000))))
+	require.NoError(t, err)
+
+	msg := progress.message()
+	assert.EqualValues(t, 1000, msg["received"])
+	assert.EqualValues(t, 2000, msg["expected"])
+	assert.InDelta(t, 100, msg["rate_bytes_per_sec"], 1)
+	assert.Equal(t, "10s", msg["eta"])
+
+	var nilProgress *artifactProgress
+	nilProgress.expect(10)
+	assert.NotNil(t, nilProgress.reader(bytes.NewReader(nil)))
+}
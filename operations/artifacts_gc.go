@@ -0,0 +1,498 @@
+package operations
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/evergreen-ci/bond"
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+func artifactsGCCmd() cli.Command {
+	return cli.Command{
+		Name:  "gc",
+		Usage: "removes builds from the cache based on their versions, rather than their modification times as prune does",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "path",
+				EnvVar: "CURATOR_ARTIFACTS_DIRECTORY",
+				Value:  filepath.Join(os.TempDir(), "curator-artifact-cache"),
+				Usage:  "path to top level of cache directory",
+			},
+			cli.IntFlag{
+				Name:  "max-size",
+				Usage: "remove builds until the cache is smaller than this many megabytes; without it, removes every build that --keep-latest-patch and --pin-file don't keep, one of which is required",
+			},
+			cli.BoolFlag{
+				Name:  "keep-latest-patch",
+				Usage: "keep the newest patch release of each series for every edition, target and architecture",
+			},
+			cli.StringFlag{
+				Name: "pin-file",
+				Usage: "file listing versions to keep, one per line, which may be ranges such as '7.0.x' or '>=6.0 <7.0', " +
+					"or the same '7.0-latest' and '7.0-current' forms as download",
+			},
+			cli.BoolTFlag{
+				Name:  "debug-first",
+				Usage: "remove debug symbols before any builds; specify --debug-first=false to treat them like builds",
+			},
+			cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "report the builds that would be removed without removing them",
+			},
+			cli.BoolFlag{
+				Name:  "json",
+				Usage: "specify this option to output the builds removed as JSON",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			opts := artifactGCOptions{
+				Path:            c.String("path"),
+				MaxSize:         int64(c.Int("max-size")) * 1024 * 1024,
+				KeepLatestPatch: c.Bool("keep-latest-patch"),
+				DebugFirst:      c.BoolT("debug-first"),
+				DryRun:          c.Bool("dry-run"),
+			}
+			if fn := c.String("pin-file"); fn != "" {
+				pins, err := readArtifactPins(fn)
+				if err != nil {
+					return errors.Wrapf(err, "reading pin file '%s'", fn)
+				}
+				opts.Pins = pins
+			}
+
+			result, err := gcArtifactCache(opts)
+			if err != nil {
+				return errors.Wrapf(err, "collecting garbage in '%s'", opts.Path)
+			}
+
+			if c.Bool("json") {
+				return errors.WithStack(writeJSON(os.Stdout, result))
+			}
+			return nil
+		},
+	}
+}
+
+type artifactGCOptions struct {
+	Path            string
+	MaxSize         int64
+	KeepLatestPatch bool
+	Pins            []string
+	DebugFirst      bool
+	DryRun          bool
+}
+
+func (opts *artifactGCOptions) validate() error {
+	catcher := grip.NewBasicCatcher()
+	catcher.NewWhen(opts.Path == "", "must specify a cache path")
+	catcher.NewWhen(opts.MaxSize < 0, "maximum size must not be negative")
+	catcher.NewWhen(opts.MaxSize == 0 && !opts.KeepLatestPatch && len(opts.Pins) == 0,
+		"must specify a maximum size, keep the latest patches or pin versions, rather than removing every build")
+	_, err := newArtifactPins(opts.Pins)
+	catcher.Add(err)
+
+	return catcher.Resolve()
+}
+
+// readArtifactPins reads the versions in a pin file, ignoring blank
+// lines and comments.
+func readArtifactPins(fn string) ([]string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	out := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = strings.TrimSpace(line[:idx])
+		}
+		if line != "" {
+			out = append(out, line)
+		}
+	}
+
+	return out, errors.WithStack(scanner.Err())
+}
+
+// artifactCacheEntry is a build in the cache: the directory that an
+// archive is extracted to, and the archive itself if it is still there.
+type artifactCacheEntry struct {
+	Name    string
+	Paths   []string
+	Info    bond.BuildInfo
+	Version bond.MongoDBVersion
+	Size    int64
+	ModTime time.Time
+}
+
+func (e *artifactCacheEntry) variant() string {
+	series := e.Info.Version
+	if e.Version != nil {
+		series = e.Version.Series()
+	}
+	return strings.Join([]string{series, string(e.Info.Options.Edition), e.Info.Options.Target,
+		string(e.Info.Options.Arch), strconv.FormatBool(e.Info.Options.Debug)}, "|")
+}
+
+// scanArtifactCache finds the builds in the cache, using the same file
+// names as bond's catalog. Files that aren't builds are ignored.
+func scanArtifactCache(path string) ([]*artifactCacheEntry, error) {
+	contents, err := os.ReadDir(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading contents of '%s'", path)
+	}
+
+	entries := map[string]*artifactCacheEntry{}
+	for _, obj := range contents {
+		name := obj.Name()
+		if !strings.HasPrefix(name, "mongodb-") {
+			continue
+		}
+		if !obj.IsDir() {
+			ext := filepath.Ext(name)
+			if ext != ".tgz" && ext != ".zip" {
+				continue
+			}
+			name = strings.TrimSuffix(name, ext)
+		}
+
+		entry, ok := entries[name]
+		if !ok {
+			info, err := bond.GetInfoFromFileName(name)
+			if err != nil {
+				grip.Debug(message.WrapError(err, message.Fields{
+					"message": "skipping file that is not a build",
+					"name":    obj.Name(),
+				}))
+				continue
+			}
+
+			entry = &artifactCacheEntry{Name: name, Info: info}
+			if v, err := bond.CreateMongoDBVersion(info.Version); err == nil {
+				entry.Version = v
+			}
+			entries[name] = entry
+		}
+
+		fn := filepath.Join(path, obj.Name())
+		size, modTime, err := artifactCacheUsage(fn)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		entry.Paths = append(entry.Paths, fn)
+		entry.Size += size
+		if modTime.After(entry.ModTime) {
+			entry.ModTime = modTime
+		}
+	}
+
+	out := make([]*artifactCacheEntry, 0, len(entries))
+	for _, entry := range entries {
+		out = append(out, entry)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+
+	return out, nil
+}
+
+// artifactCacheUsage returns the total size of a file or directory, and
+// the newest modification time in it.
+func artifactCacheUsage(path string) (int64, time.Time, error) {
+	var size int64
+	var modTime time.Time
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+		return nil
+	})
+
+	return size, modTime, errors.Wrapf(err, "finding size of '%s'", path)
+}
+
+// artifactGCResult describes the builds that garbage collection
+// removed, or would remove in dry-run mode.
+type artifactGCResult struct {
+	Path      string              `json:"path"`
+	DryRun    bool                `json:"dry_run"`
+	Builds    int                 `json:"builds"`
+	Size      int64               `json:"size"`
+	Kept      int                 `json:"kept"`
+	Removed   []artifactGCRemoval `json:"removed"`
+	Reclaimed int64               `json:"reclaimed"`
+}
+
+type artifactGCRemoval struct {
+	artifactBuild
+	Size   int64  `json:"size"`
+	Reason string `json:"reason"`
+}
+
+// selectArtifactGCCandidates returns the builds to remove, in the order
+// to remove them, with the reason each may be removed. Pinned builds,
+// and with KeepLatestPatch the newest patch of each variant, are never
+// picked.
+func selectArtifactGCCandidates(entries []*artifactCacheEntry, opts artifactGCOptions) ([]*artifactCacheEntry, map[string]string, error) {
+	pins, err := newArtifactPins(opts.Pins)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	latest := map[string]*artifactCacheEntry{}
+	for _, entry := range entries {
+		if entry.Version == nil {
+			continue
+		}
+		if cur, ok := latest[entry.variant()]; !ok || entry.Version.IsGreaterThan(cur.Version) {
+			latest[entry.variant()] = entry
+		}
+	}
+
+	current := map[string]*artifactCacheEntry{}
+	for _, entry := range entries {
+		if entry.Version == nil || !isStableArtifactVersion(entry.Version) {
+			continue
+		}
+		if cur, ok := current[entry.variant()]; !ok || entry.Version.IsGreaterThan(cur.Version) {
+			current[entry.variant()] = entry
+		}
+	}
+
+	reasons := map[string]string{}
+	candidates := []*artifactCacheEntry{}
+	for _, entry := range entries {
+		if pins.matches(entry, current[entry.variant()] == entry) {
+			continue
+		}
+
+		isLatest := latest[entry.variant()] == entry
+		if opts.KeepLatestPatch && isLatest {
+			continue
+		}
+
+		switch {
+		case opts.DebugFirst && entry.Info.Options.Debug:
+			reasons[entry.Name] = "debug-symbols"
+		case !isLatest && entry.Version != nil:
+			reasons[entry.Name] = "superseded"
+		default:
+			reasons[entry.Name] = "unpinned"
+		}
+		candidates = append(candidates, entry)
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if opts.DebugFirst && a.Info.Options.Debug != b.Info.Options.Debug {
+			return a.Info.Options.Debug
+		}
+		switch {
+		case a.Version != nil && b.Version != nil && !a.Version.IsEqualTo(b.Version):
+			return a.Version.IsLessThan(b.Version)
+		case (a.Version == nil) != (b.Version == nil):
+			// builds without release versions, like nightlies, are
+			// treated as newer than any release.
+			return a.Version != nil
+		default:
+			return a.ModTime.Before(b.ModTime)
+		}
+	})
+
+	return candidates, reasons, nil
+}
+
+// artifactPins are the versions that garbage collection keeps: exact
+// versions, ranges of release versions, or the current release of a
+// series.
+type artifactPins struct {
+	exact   map[string]bool
+	ranges  [][]artifactVersionConstraint
+	current map[string]bool
+}
+
+func newArtifactPins(pins []string) (*artifactPins, error) {
+	out := &artifactPins{exact: map[string]bool{}, current: map[string]bool{}}
+	for _, pin := range pins {
+		// download resolves bond's "7.0-current" form to a release,
+		// so keep the newest stable release of the series in the
+		// cache. Nightly "7.0-latest" builds keep that name in the
+		// cache, so they match exactly.
+		if series, ok := artifactCurrentSeries(pin); ok {
+			if _, err := parseArtifactVersion(series); err != nil {
+				return nil, errors.Wrapf(err, "parsing pin '%s'", pin)
+			}
+			out.current[series] = true
+			continue
+		}
+		if !isArtifactVersionSelector(pin) {
+			out.exact[pin] = true
+			continue
+		}
+
+		constraints, err := parseArtifactVersionConstraints(pin)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing pin '%s'", pin)
+		}
+		out.ranges = append(out.ranges, constraints)
+	}
+
+	return out, nil
+}
+
+// artifactCurrentSeries returns the series of bond's "7.0-current" and
+// "7.0-stable" forms.
+func artifactCurrentSeries(pin string) (string, bool) {
+	for _, suffix := range []string{"-current", "-stable"} {
+		if strings.HasSuffix(pin, suffix) {
+			return strings.TrimSuffix(pin, suffix), true
+		}
+	}
+	return "", false
+}
+
+// matches reports whether a pin keeps the entry. The entry is current
+// if it is the newest stable release of its series and variant in the
+// cache.
+func (p *artifactPins) matches(entry *artifactCacheEntry, current bool) bool {
+	if p.exact[entry.Info.Version] {
+		return true
+	}
+	if entry.Version == nil {
+		return false
+	}
+	if current && p.current[entry.Version.Series()] {
+		return true
+	}
+
+	for _, constraints := range p.ranges {
+		matches := true
+		for _, c := range constraints {
+			if !c.matches(entry.Version) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+
+	return false
+}
+
+// gcArtifactCache removes builds from the cache according to the rules
+// in the options: until the cache is under the maximum size if there
+// is one, or otherwise every build that no rule keeps. There must be a
+// maximum size or at least one rule.
+func gcArtifactCache(opts artifactGCOptions) (*artifactGCResult, error) {
+	if err := opts.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid gc options")
+	}
+
+	entries, err := scanArtifactCache(opts.Path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	candidates, reasons, err := selectArtifactGCCandidates(entries, opts)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	result := &artifactGCResult{
+		Path:    opts.Path,
+		DryRun:  opts.DryRun,
+		Builds:  len(entries),
+		Removed: []artifactGCRemoval{},
+	}
+	for _, entry := range entries {
+		result.Size += entry.Size
+	}
+
+	total := result.Size
+	catcher := grip.NewBasicCatcher()
+	for _, entry := range candidates {
+		if opts.MaxSize > 0 && total <= opts.MaxSize {
+			break
+		}
+
+		removal := artifactGCRemoval{
+			artifactBuild: newArtifactBuild(entry.Info, filepath.Join(opts.Path, entry.Name), nil),
+			Size:          entry.Size,
+			Reason:        reasons[entry.Name],
+		}
+
+		if opts.DryRun {
+			grip.Notice(message.Fields{
+				"message": "would remove build",
+				"build":   entry.Name,
+				"size":    entry.Size,
+				"reason":  removal.Reason,
+			})
+		} else {
+			var failed bool
+			for _, path := range entry.Paths {
+				if err := os.RemoveAll(path); err != nil {
+					catcher.Wrapf(err, "removing '%s'", path)
+					failed = true
+				}
+			}
+			if failed {
+				continue
+			}
+
+			grip.Info(message.Fields{
+				"message": "removed build",
+				"build":   entry.Name,
+				"size":    entry.Size,
+				"reason":  removal.Reason,
+			})
+		}
+
+		total -= entry.Size
+		result.Removed = append(result.Removed, removal)
+		result.Reclaimed += entry.Size
+	}
+	result.Kept = result.Builds - len(result.Removed)
+
+	grip.WarningWhen(opts.MaxSize > 0 && total > opts.MaxSize, message.Fields{
+		"message":  "cache is still larger than the maximum size after removing every build that no rule keeps",
+		"path":     opts.Path,
+		"size":     total,
+		"max_size": opts.MaxSize,
+	})
+
+	msg := message.Fields{
+		"message":   "collected garbage in artifact cache",
+		"path":      opts.Path,
+		"dry_run":   opts.DryRun,
+		"builds":    result.Builds,
+		"size":      result.Size,
+		"removed":   len(result.Removed),
+		"reclaimed": result.Reclaimed,
+	}
+	err = catcher.Resolve()
+	grip.InfoWhen(err == nil, msg)
+	grip.Error(message.WrapError(err, msg))
+
+	return result, err
+}
@@ -0,0 +1,182 @@
+package operations
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestArtifactCache(t *testing.T) string {
+	dir := t.TempDir()
+	for name, size := range map[string]int{
+		"mongodb-linux-x86_64-enterprise-ubuntu2204-7.0.12":              100,
+		"mongodb-linux-x86_64-enterprise-ubuntu2204-7.0.11":              100,
+		"mongodb-linux-x86_64-enterprise-ubuntu2204-6.0.15":              100,
+		"mongodb-linux-x86_64-enterprise-ubuntu2204-6.0.14":              100,
+		"mongodb-linux-x86_64-enterprise-ubuntu2204-debugsymbols-7.0.12": 300,
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, name, "bin"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name, "bin", "mongod"), []byte(strings.Repeat("x", size)), 0644))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "mongodb-linux-x86_64-enterprise-ubuntu2204-7.0.11.tgz"), []byte(strings.Repeat("x", 50)), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "full.json"), []byte("{}"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "mongodb-unknown"), 0755))
+
+	return dir
+}
+
+func gcRemovedVersions(result *artifactGCResult) []string {
+	out := []string{}
+	for _, removal := range result.Removed {
+		version := removal.Version
+		if removal.Debug {
+			version += "-debug"
+		}
+		out = append(out, version)
+	}
+	return out
+}
+
+func TestScanArtifactCache(t *testing.T) {
+	entries, err := scanArtifactCache(newTestArtifactCache(t))
+	require.NoError(t, err)
+	require.Len(t, entries, 5, "files that aren't builds are ignored")
+
+	for _, entry := range entries {
+		if entry.Info.Version == "7.0.11" {
+			assert.Len(t, entry.Paths, 2, "archives belong to the build they were extracted to")
+			assert.EqualValues(t, 150, entry.Size)
+		}
+	}
+}
+
+func TestGCArtifactCache(t *testing.T) {
+	for name, test := range map[string]struct {
+		opts     artifactGCOptions
+		expected []string
+	}{
+		"RemoveUnkept": {
+			opts:     artifactGCOptions{KeepLatestPatch: true, DebugFirst: true},
+			expected: []string{"6.0.14", "7.0.11"},
+		},
+		"Pins": {
+			opts:     artifactGCOptions{KeepLatestPatch: true, Pins: []string{"6.0.x", "7.0.11"}},
+			expected: []string{},
+		},
+		"MaxSizeDebugFirst": {
+			opts:     artifactGCOptions{MaxSize: 500, DebugFirst: true},
+			expected: []string{"7.0.12-debug"},
+		},
+		"MaxSizeByVersion": {
+			opts:     artifactGCOptions{MaxSize: 500},
+			expected: []string{"6.0.14", "6.0.15", "7.0.11"},
+		},
+		"MaxSizeUnreachable": {
+			opts:     artifactGCOptions{MaxSize: 1, KeepLatestPatch: true, Pins: []string{">=7.0"}},
+			expected: []string{"6.0.14"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := newTestArtifactCache(t)
+			test.opts.Path = dir
+
+			dryRun := test.opts
+			dryRun.DryRun = true
+			result, err := gcArtifactCache(dryRun)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, gcRemovedVersions(result))
+			entries, err := scanArtifactCache(dir)
+			require.NoError(t, err)
+			assert.Len(t, entries, 5)
+
+			result, err = gcArtifactCache(test.opts)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, gcRemovedVersions(result))
+			assert.Equal(t, 5, result.Builds)
+			assert.Equal(t, 5-len(test.expected), result.Kept)
+
+			var reclaimed int64
+			for _, removal := range result.Removed {
+				reclaimed += removal.Size
+				assert.NoDirExists(t, removal.Path)
+			}
+			assert.Equal(t, reclaimed, result.Reclaimed)
+
+			entries, err = scanArtifactCache(dir)
+			require.NoError(t, err)
+			assert.Len(t, entries, 5-len(test.expected))
+			assert.FileExists(t, filepath.Join(dir, "full.json"))
+		})
+	}
+
+	t.Run("Reasons", func(t *testing.T) {
+		result, err := gcArtifactCache(artifactGCOptions{Path: newTestArtifactCache(t), Pins: []string{"1.0.0"}, DebugFirst: true, DryRun: true})
+		require.NoError(t, err)
+		require.Len(t, result.Removed, 5)
+		assert.Equal(t, "debug-symbols", result.Removed[0].Reason)
+		assert.Equal(t, "superseded", result.Removed[1].Reason)
+		assert.Equal(t, "unpinned", result.Removed[4].Reason)
+	})
+	t.Run("NoRules", func(t *testing.T) {
+		dir := newTestArtifactCache(t)
+		_, err := gcArtifactCache(artifactGCOptions{Path: dir, DebugFirst: true})
+		assert.Error(t, err)
+		entries, err := scanArtifactCache(dir)
+		require.NoError(t, err)
+		assert.Len(t, entries, 5, "nothing is removed")
+	})
+	t.Run("InvalidPin", func(t *testing.T) {
+		_, err := gcArtifactCache(artifactGCOptions{Path: newTestArtifactCache(t), Pins: []string{">=seven"}})
+		assert.Error(t, err)
+	})
+}
+
+func TestGCArtifactCacheDownloads(t *testing.T) {
+	ctx := context.Background()
+	archive := newTestArtifactArchive(t, "mongodb")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(archive))
+	}))
+	defer srv.Close()
+
+	feed := newTestArtifactsFeed(t, "7.0.12", "7.0.11", "7.0.0", "6.0.15")
+	for _, version := range feed.Versions {
+		version.Current = version.Version == "7.0.12"
+	}
+
+	// download with the same versions that the pins name
+	pins := []string{"7.0-current", "7.0-latest"}
+	urls, err := resolveArtifactURLs(feed, append([]string{"7.0.11", "6.0.15"}, pins...), testArtifactBuild)
+	require.NoError(t, err)
+	for idx := range urls {
+		urls[idx] = strings.Replace(urls[idx], "https://fastdl.mongodb.org", srv.URL, 1)
+	}
+	dir := t.TempDir()
+	_, err = fetchArtifacts(ctx, urls, map[string]artifactChecksum{}, artifactDownloadOptions{Path: dir})
+	require.NoError(t, err)
+
+	result, err := gcArtifactCache(artifactGCOptions{Path: dir, Pins: pins})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"6.0.15", "7.0.11"}, gcRemovedVersions(result))
+	assert.Equal(t, 2, result.Kept)
+	assert.DirExists(t, filepath.Join(dir, "mongodb-linux-x86_64-enterprise-ubuntu2204-7.0.12"))
+	assert.DirExists(t, filepath.Join(dir, "mongodb-linux-x86_64-enterprise-ubuntu2204-v7.0-latest"))
+}
+
+func TestReadArtifactPins(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "pins")
+	require.NoError(t, os.WriteFile(fn, []byte("# pinned for compatibility tests\n7.0.12\n\n6.0.x  # the 6.0 series\n"), 0644))
+
+	pins, err := readArtifactPins(fn)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"7.0.12", "6.0.x"}, pins)
+}
@@ -0,0 +1,225 @@
+package operations
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/evergreen-ci/bond"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+)
+
+func artifactsFormatFlag(flags ...cli.Flag) []cli.Flag {
+	return append(flags,
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "output format: 'json', 'yaml' or 'table'. Defaults to bond's plain output",
+		})
+}
+
+// artifactBuild describes a single build in the feed or the cache. The
+// JSON and YAML forms are stable for use in scripts.
+type artifactBuild struct {
+	Version string `json:"version" yaml:"version"`
+	Edition string `json:"edition" yaml:"edition"`
+	Target  string `json:"target" yaml:"target"`
+	Arch    string `json:"arch" yaml:"arch"`
+	Debug   bool   `json:"debug" yaml:"debug"`
+	URL     string `json:"url,omitempty" yaml:"url,omitempty"`
+	Path    string `json:"path,omitempty" yaml:"path,omitempty"`
+}
+
+// artifactVariants describes the builds that the feed has for a
+// version.
+type artifactVariants struct {
+	Version  string   `json:"version" yaml:"version"`
+	Targets  []string `json:"targets" yaml:"targets"`
+	Editions []string `json:"editions" yaml:"editions"`
+	Arches   []string `json:"arches" yaml:"arches"`
+}
+
+func newArtifactVariants(version *bond.ArtifactVersion) artifactVariants {
+	types := version.GetBuildTypes()
+	out := artifactVariants{
+		Version:  version.Version,
+		Targets:  append([]string{}, types.Targets...),
+		Editions: []string{},
+		Arches:   []string{},
+	}
+	for _, edition := range types.Editions {
+		out.Editions = append(out.Editions, string(edition))
+	}
+	for _, arch := range types.Architectures {
+		out.Arches = append(out.Arches, string(arch))
+	}
+	sort.Strings(out.Targets)
+	sort.Strings(out.Editions)
+	sort.Strings(out.Arches)
+
+	return out
+}
+
+// cachedArtifactPath returns the directory that the archive at the URL
+// is extracted to in the cache, or an empty string if it isn't cached.
+func cachedArtifactPath(cache, url string) string {
+	if cache == "" || url == "" {
+		return ""
+	}
+
+	fn := artifactArchivePath(cache, url)
+	dir := strings.TrimSuffix(fn, ".tgz")
+	dir = strings.TrimSuffix(dir, ".zip")
+	if stat, err := os.Stat(dir); err == nil && stat.IsDir() {
+		return dir
+	}
+
+	return ""
+}
+
+// artifactBuildsForVersion returns every build of the version in the
+// feed, including debug symbols, noting those that are in the cache.
+func artifactBuildsForVersion(version *bond.ArtifactVersion, cache string) []artifactBuild {
+	out := []artifactBuild{}
+	for _, dl := range version.Downloads {
+		if dl.Edition == "source" {
+			continue
+		}
+
+		build := artifactBuild{
+			Version: version.Version,
+			Edition: string(dl.Edition),
+			Target:  dl.Target,
+			Arch:    string(dl.Arch),
+			URL:     dl.Archive.URL,
+			Path:    cachedArtifactPath(cache, dl.Archive.URL),
+		}
+		out = append(out, build)
+
+		if dl.Archive.Debug != "" {
+			build.Debug = true
+			build.URL = dl.Archive.Debug
+			build.Path = cachedArtifactPath(cache, dl.Archive.Debug)
+			out = append(out, build)
+		}
+	}
+	sortArtifactBuilds(out)
+
+	return out
+}
+
+// artifactBuildsFromCatalog returns the builds in the cache, using the
+// feed, if there is one, to fill in their URLs.
+func artifactBuildsFromCatalog(contents map[bond.BuildInfo]string, feed *bond.ArtifactsFeed) []artifactBuild {
+	out := make([]artifactBuild, 0, len(contents))
+	for info, path := range contents {
+		out = append(out, newArtifactBuild(info, path, feed))
+	}
+	sortArtifactBuilds(out)
+
+	return out
+}
+
+func newArtifactBuild(info bond.BuildInfo, path string, feed *bond.ArtifactsFeed) artifactBuild {
+	build := artifactBuild{
+		Version: info.Version,
+		Edition: string(info.Options.Edition),
+		Target:  info.Options.Target,
+		Arch:    string(info.Options.Arch),
+		Debug:   info.Options.Debug,
+		Path:    path,
+	}
+
+	if feed == nil {
+		return build
+	}
+	version, ok := feed.GetVersion(info.Version)
+	if !ok {
+		return build
+	}
+	dl, err := version.GetDownload(info.Options)
+	if err != nil {
+		return build
+	}
+
+	if info.Options.Debug {
+		build.URL = dl.Archive.Debug
+	} else {
+		build.URL = dl.Archive.URL
+	}
+
+	return build
+}
+
+func sortArtifactBuilds(builds []artifactBuild) {
+	sort.SliceStable(builds, func(i, j int) bool {
+		a, b := builds[i], builds[j]
+		switch {
+		case a.Version != b.Version:
+			return a.Version < b.Version
+		case a.Edition != b.Edition:
+			return a.Edition < b.Edition
+		case a.Target != b.Target:
+			return a.Target < b.Target
+		case a.Arch != b.Arch:
+			return a.Arch < b.Arch
+		default:
+			return !a.Debug && b.Debug
+		}
+	})
+}
+
+// validateArtifactsFormat checks the output format before any command
+// fetches the feed. An empty format is bond's plain output.
+func validateArtifactsFormat(format string) error {
+	switch format {
+	case "", "json", "yaml", "table":
+		return nil
+	default:
+		return errors.Errorf("'%s' is not a valid output format", format)
+	}
+}
+
+// writeArtifactsOutput writes the data in the format, using the table
+// function for the table format.
+func writeArtifactsOutput(w io.Writer, format string, data interface{}, table func(io.Writer) error) error {
+	switch format {
+	case "json":
+		return writeJSON(w, data)
+	case "yaml":
+		out, err := yaml.Marshal(data)
+		if err != nil {
+			return errors.Wrap(err, "marshalling YAML")
+		}
+		_, err = fmt.Fprint(w, string(out))
+		return errors.WithStack(err)
+	case "table":
+		return table(w)
+	default:
+		return errors.Errorf("'%s' is not a valid output format", format)
+	}
+}
+
+func writeArtifactBuildTable(w io.Writer, builds []artifactBuild) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tEDITION\tTARGET\tARCH\tDEBUG\tPATH\tURL")
+	for _, build := range builds {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%t\t%s\t%s\n",
+			build.Version, build.Edition, build.Target, build.Arch, build.Debug, build.Path, build.URL)
+	}
+
+	return errors.WithStack(tw.Flush())
+}
+
+func writeArtifactVariantsTable(w io.Writer, variants artifactVariants) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tTARGETS\tEDITIONS\tARCHES")
+	fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", variants.Version,
+		strings.Join(variants.Targets, ","), strings.Join(variants.Editions, ","), strings.Join(variants.Arches, ","))
+
+	return errors.WithStack(tw.Flush())
+}
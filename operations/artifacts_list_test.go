@@ -0,0 +1,122 @@
+package operations
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/evergreen-ci/bond"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func newTestListingFeed(t *testing.T) *bond.ArtifactsFeed {
+	data := `{"versions": [{"version": "7.0.12", "downloads": [
+		{"target": "ubuntu2204", "arch": "x86_64", "edition": "enterprise", "archive": {
+			"url": "https://fastdl.mongodb.org/linux/mongodb-linux-x86_64-enterprise-ubuntu2204-7.0.12.tgz",
+			"debug_symbols": "https://fastdl.mongodb.org/linux/mongodb-linux-x86_64-enterprise-ubuntu2204-debugsymbols-7.0.12.tgz"}},
+		{"target": "windows", "arch": "x86_64", "edition": "base", "archive": {
+			"url": "https://fastdl.mongodb.org/windows/mongodb-windows-x86_64-7.0.12.zip"}},
+		{"target": "src", "arch": "", "edition": "source", "archive": {
+			"url": "https://fastdl.mongodb.org/src/mongodb-src-r7.0.12.tar.gz"}}
+	]}]}`
+
+	feed, err := bond.NewArtifactsFeed(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, feed.Reload([]byte(data)))
+	return feed
+}
+
+func TestArtifactListings(t *testing.T) {
+	feed := newTestListingFeed(t)
+	version, ok := feed.GetVersion("7.0.12")
+	require.True(t, ok)
+
+	t.Run("Variants", func(t *testing.T) {
+		variants := newArtifactVariants(version)
+		assert.Equal(t, "7.0.12", variants.Version)
+		assert.Contains(t, variants.Targets, "ubuntu2204")
+		assert.Contains(t, variants.Editions, "enterprise")
+		assert.Contains(t, variants.Arches, "x86_64")
+	})
+	t.Run("BuildsForVersion", func(t *testing.T) {
+		cache := t.TempDir()
+		cached := filepath.Join(cache, "mongodb-windows-x86_64-7.0.12")
+		require.NoError(t, os.MkdirAll(cached, 0755))
+
+		builds := artifactBuildsForVersion(version, cache)
+		require.Len(t, builds, 3, "source builds are not listed")
+		assert.Equal(t, artifactBuild{
+			Version: "7.0.12",
+			Edition: "base",
+			Target:  "windows",
+			Arch:    "x86_64",
+			URL:     "https://fastdl.mongodb.org/windows/mongodb-windows-x86_64-7.0.12.zip",
+			Path:    cached,
+		}, builds[0])
+		assert.Equal(t, "enterprise", builds[1].Edition)
+		assert.False(t, builds[1].Debug)
+		assert.Empty(t, builds[1].Path)
+		assert.True(t, builds[2].Debug)
+		assert.Contains(t, builds[2].URL, "debugsymbols")
+	})
+	t.Run("BuildsFromCatalog", func(t *testing.T) {
+		contents := map[bond.BuildInfo]string{
+			{Version: "7.0.12", Options: bond.BuildOptions{Target: "ubuntu2204", Arch: bond.AMD64, Edition: bond.Enterprise, Debug: true}}: "/cache/b",
+			{Version: "7.0.12", Options: bond.BuildOptions{Target: "ubuntu2204", Arch: bond.AMD64, Edition: bond.Enterprise}}:              "/cache/a",
+			{Version: "6.0.1", Options: bond.BuildOptions{Target: "ubuntu2204", Arch: bond.AMD64, Edition: bond.Enterprise}}:               "/cache/c",
+		}
+
+		builds := artifactBuildsFromCatalog(contents, feed)
+		require.Len(t, builds, 3)
+		assert.Equal(t, "6.0.1", builds[0].Version)
+		assert.Empty(t, builds[0].URL, "versions not in the feed have no URL")
+		assert.Equal(t, "/cache/a", builds[1].Path)
+		assert.Equal(t, "https://fastdl.mongodb.org/linux/mongodb-linux-x86_64-enterprise-ubuntu2204-7.0.12.tgz", builds[1].URL)
+		assert.True(t, builds[2].Debug)
+		assert.Contains(t, builds[2].URL, "debugsymbols")
+	})
+}
+
+func TestWriteArtifactsOutput(t *testing.T) {
+	builds := []artifactBuild{{Version: "7.0.12", Edition: "enterprise", Target: "ubuntu2204", Arch: "x86_64", URL: "https://example.com/a.tgz"}}
+	var buf bytes.Buffer
+	require.NoError(t, writeArtifactsOutput(&buf, "json", builds, nil))
+	decoded := []map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, map[string]interface{}{
+		"version": "7.0.12",
+		"edition": "enterprise",
+		"target":  "ubuntu2204",
+		"arch":    "x86_64",
+		"debug":   false,
+		"url":     "https://example.com/a.tgz",
+	}, decoded[0])
+
+	buf.Reset()
+	require.NoError(t, writeArtifactsOutput(&buf, "yaml", builds, nil))
+	fromYAML := []artifactBuild{}
+	require.NoError(t, yaml.Unmarshal(buf.Bytes(), &fromYAML))
+	assert.Equal(t, builds, fromYAML)
+
+	buf.Reset()
+	require.NoError(t, writeArtifactsOutput(&buf, "table", builds, func(w io.Writer) error {
+		return writeArtifactBuildTable(w, builds)
+	}))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(lines[0], "VERSION"))
+	assert.Contains(t, lines[1], "enterprise")
+
+	assert.Error(t, writeArtifactsOutput(&buf, "xml", builds, nil))
+
+	for _, format := range []string{"", "json", "yaml", "table"} {
+		assert.NoError(t, validateArtifactsFormat(format), format)
+	}
+	assert.Error(t, validateArtifactsFormat("xml"))
+}
@@ -0,0 +1,391 @@
+package operations
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/evergreen-ci/bond"
+	"github.com/evergreen-ci/pail"
+	"github.com/evergreen-ci/utility"
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+func artifactsMirrorCmd() cli.Command {
+	return cli.Command{
+		Name:  "mirror",
+		Usage: "download builds and a feed that refers to them into a directory or s3 prefix, for use with --feed-url",
+		Flags: baseS3Flags(baseDlFlags(true,
+			cli.StringFlag{
+				Name:  "output",
+				Usage: "directory to write the mirror into",
+			},
+			cli.StringFlag{
+				Name:  "base-url",
+				Usage: "URL that the mirror is served from; defaults to the output directory, and is required when uploading unless --public-url is set",
+			},
+			cli.BoolFlag{
+				Name:  "public-url",
+				Usage: "when uploading without --base-url, serve the mirror from the s3 prefix's object URLs, which only works for public buckets",
+			},
+			cli.StringFlag{
+				Name:  "prefix",
+				Usage: "prefix of s3 key names to upload the mirror to, when a bucket is specified",
+			},
+			cli.StringSliceFlag{
+				Name:  "target",
+				Usage: "name of target platform or operating system (may specify multiple times)",
+			},
+			cli.StringSliceFlag{
+				Name:  "arch",
+				Usage: "name of target architecture (may specify multiple times)",
+			},
+			cli.StringSliceFlag{
+				Name:  "edition",
+				Usage: "name of build edition (may specify multiple times)",
+			},
+			cli.BoolFlag{
+				Name:  "debug",
+				Usage: "specify to mirror debug symbols as well as builds",
+			},
+			cli.IntFlag{
+				Name:  "attempts",
+				Value: defaultArtifactDownloadAttempts,
+				Usage: "number of times to download an archive that fails checksum verification before giving up",
+			},
+			cli.IntFlag{
+				Name:  "workers",
+				Value: 4,
+				Usage: "number of archives to download in parallel",
+			})...),
+		Action: func(c *cli.Context) error {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			if err := setVerboseLogging(c.Bool("verbose")); err != nil {
+				return err
+			}
+
+			opts := artifactMirrorOptions{
+				Output:   c.String("output"),
+				BaseURL:  c.String("base-url"),
+				Versions: c.StringSlice("version"),
+				Builds:   artifactMirrorBuilds(c.StringSlice("target"), c.StringSlice("arch"), c.StringSlice("edition")),
+				Debug:    c.Bool("debug"),
+				Attempts: c.Int("attempts"),
+				Workers:  c.Int("workers"),
+				DryRun:   c.Bool("dry-run"),
+			}
+			if opts.BaseURL == "" && c.String("bucket") != "" {
+				if !c.Bool("public-url") {
+					return errors.New("must specify --base-url when uploading a mirror, or --public-url to serve it from a public bucket")
+				}
+				endpoint, err := s3EndpointFromFlags(c)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				opts.BaseURL = endpoint.objectURL(c.String("bucket"), strings.Trim(c.String("prefix"), "/"))
+			}
+
+			feed, err := getArtifactsFeed(ctx, c.String("path"), c.String("feed-url"))
+			if err != nil {
+				return errors.Wrap(err, "fetching artifacts feed")
+			}
+			data, err := os.ReadFile(artifactsFeedPath(c.String("path"), c.String("feed-url")))
+			if err != nil {
+				return errors.Wrap(err, "reading artifacts feed")
+			}
+
+			result, err := buildArtifactMirror(ctx, feed, data, opts)
+			if err != nil {
+				return errors.Wrap(err, "building mirror")
+			}
+
+			if c.String("bucket") == "" || opts.DryRun {
+				return nil
+			}
+
+			bucket, err := s3BucketFromFlags(ctx, c, pail.S3Options{
+				SharedCredentialsProfile: c.String("profile"),
+				Region:                   c.String("region"),
+				Name:                     c.String("bucket"),
+				MaxRetries:               utility.ToIntPtr(c.Int("retries")),
+				Verbose:                  c.Bool("verbose"),
+			})
+			if err != nil {
+				return errors.Wrap(err, "getting new bucket")
+			}
+
+			if err = bucket.Push(ctx, pail.SyncOptions{Local: result.Output, Remote: c.String("prefix")}); err != nil {
+				return errors.Wrapf(err, "uploading mirror to '%s'", opts.BaseURL)
+			}
+
+			grip.Info(message.Fields{
+				"message":  "uploaded mirror",
+				"bucket":   c.String("bucket"),
+				"prefix":   c.String("prefix"),
+				"base_url": opts.BaseURL,
+			})
+			return nil
+		},
+	}
+}
+
+// artifactMirrorBuilds returns every combination of the targets,
+// architectures and editions, defaulting to the current platform's
+// base edition.
+func artifactMirrorBuilds(targets, arches, editions []string) []bond.BuildOptions {
+	if len(targets) == 0 {
+		targets = []string{defaultBuildTarget()}
+	}
+	if len(arches) == 0 {
+		arches = []string{defaultBuildArch()}
+	}
+	if len(editions) == 0 {
+		editions = []string{string(bond.Base)}
+	}
+
+	out := []bond.BuildOptions{}
+	for _, target := range targets {
+		if strings.Contains(target, "auto") {
+			target = bond.GetTargetDistro()
+		}
+		for _, arch := range arches {
+			for _, edition := range editions {
+				out = append(out, bond.BuildOptions{
+					Target:  target,
+					Arch:    bond.MongoDBArch(arch),
+					Edition: bond.MongoDBEdition(edition),
+				})
+			}
+		}
+	}
+
+	return out
+}
+
+type artifactMirrorOptions struct {
+	Output   string
+	BaseURL  string
+	Versions []string
+	Builds   []bond.BuildOptions
+	Debug    bool
+	Attempts int
+	Workers  int
+	DryRun   bool
+}
+
+func (opts *artifactMirrorOptions) validate() error {
+	catcher := grip.NewBasicCatcher()
+	catcher.NewWhen(opts.Output == "", "must specify an output directory")
+	catcher.NewWhen(len(opts.Versions) == 0, "must specify at least one version")
+	catcher.NewWhen(len(opts.Builds) == 0, "must specify at least one build")
+	for _, build := range opts.Builds {
+		catcher.Wrapf(build.Validate(), "invalid build '%s'", build)
+	}
+	for _, version := range opts.Versions {
+		if isArtifactVersionSelector(version) {
+			_, err := parseArtifactVersionSelector(version)
+			catcher.Add(err)
+		}
+	}
+
+	if opts.Output != "" {
+		output, err := filepath.Abs(opts.Output)
+		catcher.Wrap(err, "resolving output directory")
+		opts.Output = output
+	}
+	if opts.BaseURL == "" {
+		opts.BaseURL = "file://" + filepath.ToSlash(opts.Output)
+	}
+	opts.BaseURL = strings.TrimSuffix(opts.BaseURL, "/")
+
+	return catcher.Resolve()
+}
+
+// artifactMirrorResult describes the contents of a mirror.
+type artifactMirrorResult struct {
+	Output   string   `json:"output"`
+	BaseURL  string   `json:"base_url"`
+	Versions []string `json:"versions"`
+	Archives []string `json:"archives"`
+}
+
+// buildArtifactMirror downloads and verifies the selected archives into
+// the output directory, and writes a copy of the feed that contains
+// only those archives, with their URLs rewritten to the mirror.
+func buildArtifactMirror(ctx context.Context, feed *bond.ArtifactsFeed, feedData []byte, opts artifactMirrorOptions) (*artifactMirrorResult, error) {
+	if err := opts.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid mirror options")
+	}
+
+	result := &artifactMirrorResult{Output: opts.Output, BaseURL: opts.BaseURL}
+	mirrored := map[string]bool{}
+	selected := map[string]bool{}
+	for _, build := range opts.Builds {
+		versions, err := resolveArtifactVersions(feed, opts.Versions, build)
+		if err != nil {
+			grip.Warning(message.WrapError(err, message.Fields{
+				"message": "skipping build with no matching versions",
+				"build":   build.String(),
+			}))
+			continue
+		}
+
+		for _, release := range versions {
+			version, ok := feed.GetVersion(release)
+			if !ok {
+				return nil, errors.Errorf("'%s' is not a release in the feed, so cannot be mirrored", release)
+			}
+
+			dl, err := version.GetDownload(build)
+			if err != nil {
+				grip.Warning(message.WrapError(err, message.Fields{
+					"message": "skipping build that the feed does not have",
+					"version": release,
+					"build":   build.String(),
+				}))
+				continue
+			}
+
+			if !selected[release] {
+				selected[release] = true
+				result.Versions = append(result.Versions, release)
+			}
+			urls := []string{dl.Archive.URL}
+			if opts.Debug && dl.Archive.Debug != "" {
+				urls = append(urls, dl.Archive.Debug)
+			}
+			for _, url := range urls {
+				if mirrored[url] {
+					continue
+				}
+				mirrored[url] = true
+				result.Archives = append(result.Archives, url)
+			}
+		}
+	}
+
+	if len(result.Archives) == 0 {
+		return nil, errors.New("no builds in the feed match the versions and builds")
+	}
+	sort.Strings(result.Archives)
+
+	grip.Notice(message.Fields{
+		"message":  "selected builds to mirror",
+		"versions": result.Versions,
+		"archives": len(result.Archives),
+		"output":   opts.Output,
+		"dry_run":  opts.DryRun,
+	})
+	if opts.DryRun {
+		return result, nil
+	}
+
+	checksums, err := artifactChecksumsFromFeed(feedData)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	_, err = fetchArtifacts(ctx, result.Archives, checksums, artifactDownloadOptions{
+		Path:        opts.Output,
+		Attempts:    opts.Attempts,
+		Workers:     opts.Workers,
+		SkipExtract: true,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "downloading archives")
+	}
+
+	data, err := rewriteArtifactsFeed(feedData, mirrored, opts.BaseURL)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err = os.WriteFile(artifactsFeedFile(opts.Output), data, 0644); err != nil {
+		return nil, errors.Wrap(err, "writing mirror feed")
+	}
+
+	grip.Info(message.Fields{
+		"message":  "built mirror",
+		"versions": result.Versions,
+		"archives": len(result.Archives),
+		"output":   opts.Output,
+		"base_url": opts.BaseURL,
+	})
+
+	return result, nil
+}
+
+// rewriteArtifactsFeed returns a copy of the feed with only the
+// mirrored archives, whose URLs point to the base URL. Other fields are
+// copied as they are, including the checksums.
+func rewriteArtifactsFeed(data []byte, mirrored map[string]bool, baseURL string) ([]byte, error) {
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, errors.Wrap(err, "parsing artifacts feed")
+	}
+
+	mirrorURL := func(url string) string {
+		return strings.TrimSuffix(baseURL, "/") + "/" + artifactArchiveName(url)
+	}
+
+	versions, _ := doc["versions"].([]interface{})
+	keptVersions := []interface{}{}
+	for _, v := range versions {
+		version, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		downloads, _ := version["downloads"].([]interface{})
+		keptDownloads := []interface{}{}
+		for _, d := range downloads {
+			dl, ok := d.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			archive, ok := dl["archive"].(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			url, _ := archive["url"].(string)
+			if !mirrored[url] {
+				continue
+			}
+			archive["url"] = mirrorURL(url)
+
+			if debug, _ := archive["debug_symbols"].(string); mirrored[debug] {
+				archive["debug_symbols"] = mirrorURL(debug)
+			} else {
+				delete(archive, "debug_symbols")
+			}
+
+			// packages are not mirrored
+			delete(dl, "packages")
+			delete(dl, "msi")
+
+			keptDownloads = append(keptDownloads, dl)
+		}
+
+		if len(keptDownloads) == 0 {
+			continue
+		}
+		version["downloads"] = keptDownloads
+		keptVersions = append(keptVersions, version)
+	}
+	doc["versions"] = keptVersions
+
+	out, err := json.MarshalIndent(doc, "", "   ")
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding mirror feed")
+	}
+
+	return out, nil
+}
@@ -0,0 +1,136 @@
+package operations
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/evergreen-ci/bond"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArtifactMirror(t *testing.T) {
+	ctx := context.Background()
+	archive := newTestArtifactArchive(t, "mongodb-linux-x86_64-enterprise-ubuntu2204-7.0.12")
+	checksum := sha256Checksum(archive)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(archive)
+	}))
+	defer srv.Close()
+
+	download := func(version, edition string) map[string]interface{} {
+		return map[string]interface{}{
+			"target":   "ubuntu2204",
+			"arch":     "x86_64",
+			"edition":  edition,
+			"packages": []string{srv.URL + "/mongodb.deb"},
+			"archive": map[string]interface{}{
+				"url":           fmt.Sprintf("%s/linux/mongodb-linux-x86_64-%s-ubuntu2204-%s.tgz", srv.URL, edition, version),
+				"debug_symbols": fmt.Sprintf("%s/linux/mongodb-linux-x86_64-%s-ubuntu2204-debugsymbols-%s.tgz", srv.URL, edition, version),
+				"sha256":        checksum.Value,
+			},
+		}
+	}
+	upstream, err := json.Marshal(map[string]interface{}{
+		"versions": []interface{}{
+			map[string]interface{}{"version": "7.0.12", "githash": "abc", "downloads": []interface{}{download("7.0.12", "enterprise"), download("7.0.12", "targeted")}},
+			map[string]interface{}{"version": "7.0.11", "downloads": []interface{}{download("7.0.11", "enterprise")}},
+			map[string]interface{}{"version": "6.0.15", "downloads": []interface{}{download("6.0.15", "enterprise")}},
+		},
+	})
+	require.NoError(t, err)
+
+	feed, err := bond.NewArtifactsFeed(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, feed.Reload(upstream))
+
+	builds := artifactMirrorBuilds([]string{"ubuntu2204"}, []string{"x86_64"}, []string{"enterprise"})
+	output := t.TempDir()
+
+	t.Run("DryRun", func(t *testing.T) {
+		dir := t.TempDir()
+		result, err := buildArtifactMirror(ctx, feed, upstream, artifactMirrorOptions{Output: dir, Versions: []string{"7.0.x"}, Builds: builds, DryRun: true})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"7.0.11", "7.0.12"}, result.Versions)
+		assert.Len(t, result.Archives, 2)
+		assert.NoFileExists(t, filepath.Join(dir, "full.json"))
+	})
+	t.Run("Build", func(t *testing.T) {
+		result, err := buildArtifactMirror(ctx, feed, upstream, artifactMirrorOptions{Output: output, Versions: []string{"latest-patch:7.x"}, Builds: builds})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"7.0.12"}, result.Versions)
+		assert.Equal(t, "file://"+filepath.ToSlash(output), result.BaseURL)
+		assert.FileExists(t, filepath.Join(output, "mongodb-linux-x86_64-enterprise-ubuntu2204-7.0.12.tgz"))
+		assert.NoDirExists(t, filepath.Join(output, "mongodb-linux-x86_64-enterprise-ubuntu2204-7.0.12"), "mirrors are not extracted")
+
+		data, err := os.ReadFile(filepath.Join(output, "full.json"))
+		require.NoError(t, err)
+		mirror := struct {
+			Versions []struct {
+				Version   string                   `json:"version"`
+				GitHash   string                   `json:"githash"`
+				Downloads []map[string]interface{} `json:"downloads"`
+			} `json:"versions"`
+		}{}
+		require.NoError(t, json.Unmarshal(data, &mirror))
+		require.Len(t, mirror.Versions, 1)
+		assert.Equal(t, "abc", mirror.Versions[0].GitHash)
+		require.Len(t, mirror.Versions[0].Downloads, 1)
+		dl := mirror.Versions[0].Downloads[0]
+		assert.NotContains(t, dl, "packages")
+		archive := dl["archive"].(map[string]interface{})
+		assert.Equal(t, result.BaseURL+"/mongodb-linux-x86_64-enterprise-ubuntu2204-7.0.12.tgz", archive["url"])
+		assert.Equal(t, checksum.Value, archive["sha256"])
+		assert.NotContains(t, archive, "debug_symbols")
+	})
+	t.Run("UseMirror", func(t *testing.T) {
+		srv.Close()
+		cache := t.TempDir()
+
+		feed, err := getArtifactsFeed(ctx, cache, output)
+		require.NoError(t, err)
+		build := builds[0]
+		urls, err := resolveArtifactURLs(feed, []string{"7.0.12"}, build)
+		require.NoError(t, err)
+		checksums, err := loadArtifactChecksums(artifactsFeedPath(cache, output))
+		require.NoError(t, err)
+		assert.FileExists(t, filepath.Join(cache, artifactsMirrorFeedName))
+		assert.NoFileExists(t, filepath.Join(cache, "full.json"), "the mirror's feed doesn't replace bond's")
+		_, err = fetchArtifacts(ctx, urls, checksums, artifactDownloadOptions{Path: cache})
+		require.NoError(t, err)
+		assert.FileExists(t, filepath.Join(cache, "mongodb-linux-x86_64-enterprise-ubuntu2204-7.0.12", "bin", "mongod"))
+
+		_, err = getVersionForListing(ctx, "6.0.15", cache, output)
+		assert.Error(t, err, "the mirror only has the mirrored versions")
+
+		extracted := filepath.Join(cache, "mongodb-linux-x86_64-enterprise-ubuntu2204-7.0.12")
+		require.NoError(t, os.WriteFile(filepath.Join(extracted, "bin", "mongos"), []byte("mongos"), 0755))
+		catalog, err := newArtifactCatalog(cache, feed)
+		require.NoError(t, err, "catalogs don't need downloads.mongodb.org")
+		path, err := catalog.Get("7.0.12", "enterprise", "ubuntu2204", "x86_64", false)
+		require.NoError(t, err)
+		assert.Equal(t, extracted, path)
+		assert.NoFileExists(t, filepath.Join(cache, "full.json"))
+	})
+	t.Run("Validation", func(t *testing.T) {
+		for name, opts := range map[string]artifactMirrorOptions{
+			"NoOutput":     {Versions: []string{"7.0.12"}, Builds: builds},
+			"NoVersions":   {Output: output, Builds: builds},
+			"BadSelector":  {Output: output, Versions: []string{">=seven"}, Builds: builds},
+			"BadBuild":     {Output: output, Versions: []string{"7.0.12"}, Builds: []bond.BuildOptions{{Target: "ubuntu2204", Arch: "x86_64", Edition: "unknown"}}},
+			"NoSuchBuilds": {Output: output, Versions: []string{"7.0.12"}, Builds: artifactMirrorBuilds([]string{"windows"}, nil, []string{"enterprise"})},
+		} {
+			t.Run(name, func(t *testing.T) {
+				_, err := buildArtifactMirror(ctx, feed, upstream, opts)
+				assert.Error(t, err)
+			})
+		}
+	})
+}
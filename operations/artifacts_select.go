@@ -0,0 +1,301 @@
+package operations
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/evergreen-ci/bond"
+	"github.com/pkg/errors"
+)
+
+const (
+	artifactLatestStablePrefix = "latest-stable"
+	artifactLatestPatchPrefix  = "latest-patch:"
+)
+
+// artifactVersionSelector is a parsed version selector, which resolves
+// to a set of concrete releases in the feed. Selectors are:
+//
+//	>=6.0 <7.1       every stable release matching all of the comparisons
+//	6.x, 7.0.x       every stable release in a major or minor series
+//	latest-patch:EXP the newest patch release of each series matching EXP
+//	latest-stable:N  the N most recent stable releases
+//
+// Anything else, including bond's own "7.0-latest" (nightly) and
+// "7.0-current" (newest stable patch) forms, is passed through to bond
+// unchanged.
+type artifactVersionSelector struct {
+	constraints []artifactVersionConstraint
+	latestPatch bool
+	limit       int
+}
+
+type artifactVersionConstraint struct {
+	op      string
+	version bond.MongoDBVersion
+}
+
+func (c artifactVersionConstraint) matches(v bond.MongoDBVersion) bool {
+	cmp := v.Parsed().Compare(c.version.Parsed())
+	switch c.op {
+	case ">=":
+		return cmp >= 0
+	case ">":
+		return cmp > 0
+	case "<=":
+		return cmp <= 0
+	case "<":
+		return cmp < 0
+	case "!=":
+		return cmp != 0
+	default:
+		return cmp == 0
+	}
+}
+
+// isArtifactVersionSelector reports whether the version flag value is
+// a selector rather than a version that bond resolves on its own.
+func isArtifactVersionSelector(value string) bool {
+	value = strings.TrimSpace(value)
+	return strings.HasPrefix(value, artifactLatestStablePrefix) ||
+		strings.HasPrefix(value, artifactLatestPatchPrefix) ||
+		strings.ContainsAny(value, "<>=! ") ||
+		strings.HasSuffix(value, ".x")
+}
+
+func parseArtifactVersionSelector(value string) (*artifactVersionSelector, error) {
+	value = strings.TrimSpace(value)
+
+	switch {
+	case strings.HasPrefix(value, artifactLatestStablePrefix):
+		sel := &artifactVersionSelector{limit: 1}
+		rest := strings.TrimPrefix(value, artifactLatestStablePrefix)
+		if rest == "" {
+			return sel, nil
+		}
+		if !strings.HasPrefix(rest, ":") {
+			return nil, errors.Errorf("invalid selector '%s'", value)
+		}
+
+		limit, err := strconv.Atoi(rest[1:])
+		if err != nil || limit < 1 {
+			return nil, errors.Errorf("'%s' is not a positive number of releases", rest[1:])
+		}
+		sel.limit = limit
+		return sel, nil
+	case strings.HasPrefix(value, artifactLatestPatchPrefix):
+		constraints, err := parseArtifactVersionConstraints(strings.TrimPrefix(value, artifactLatestPatchPrefix))
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing selector '%s'", value)
+		}
+		return &artifactVersionSelector{constraints: constraints, latestPatch: true}, nil
+	default:
+		constraints, err := parseArtifactVersionConstraints(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing selector '%s'", value)
+		}
+		return &artifactVersionSelector{constraints: constraints}, nil
+	}
+}
+
+func parseArtifactVersionConstraints(expr string) ([]artifactVersionConstraint, error) {
+	out := []artifactVersionConstraint{}
+
+	fields := strings.Fields(expr)
+	for i := 0; i < len(fields); i++ {
+		term := fields[i]
+
+		if strings.HasSuffix(term, ".x") {
+			constraints, err := parseArtifactSeriesWildcard(term)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			out = append(out, constraints...)
+			continue
+		}
+
+		version := strings.TrimLeft(term, "<>=!")
+		op := term[:len(term)-len(version)]
+		if version == "" && i+1 < len(fields) {
+			// allow a space between the operator and the version
+			i++
+			version = fields[i]
+		}
+
+		switch op {
+		case "":
+			op = "="
+		case ">=", ">", "<=", "<", "=", "==", "!=":
+		default:
+			return nil, errors.Errorf("invalid comparison '%s'", op)
+		}
+		if op == "==" {
+			op = "="
+		}
+
+		v, err := parseArtifactVersion(version)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		out = append(out, artifactVersionConstraint{op: op, version: v})
+	}
+
+	if len(out) == 0 {
+		return nil, errors.New("selector has no version comparisons")
+	}
+
+	return out, nil
+}
+
+// parseArtifactSeriesWildcard converts "6.x" and "6.0.x" into a
+// bounded range.
+func parseArtifactSeriesWildcard(term string) ([]artifactVersionConstraint, error) {
+	parts := strings.Split(strings.TrimSuffix(term, ".x"), ".")
+	nums := make([]int, len(parts))
+	for idx, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, errors.Errorf("invalid series wildcard '%s'", term)
+		}
+		nums[idx] = n
+	}
+
+	var lower, upper string
+	switch len(nums) {
+	case 1:
+		lower = strconv.Itoa(nums[0]) + ".0.0"
+		upper = strconv.Itoa(nums[0]+1) + ".0.0"
+	case 2:
+		lower = strconv.Itoa(nums[0]) + "." + strconv.Itoa(nums[1]) + ".0"
+		upper = strconv.Itoa(nums[0]) + "." + strconv.Itoa(nums[1]+1) + ".0"
+	default:
+		return nil, errors.Errorf("invalid series wildcard '%s'", term)
+	}
+
+	lowerVersion, err := bond.CreateMongoDBVersion(lower)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	upperVersion, err := bond.CreateMongoDBVersion(upper)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return []artifactVersionConstraint{
+		{op: ">=", version: lowerVersion},
+		{op: "<", version: upperVersion},
+	}, nil
+}
+
+// parseArtifactVersion parses a version, allowing the patch component
+// to be omitted.
+func parseArtifactVersion(version string) (bond.MongoDBVersion, error) {
+	if strings.Count(strings.SplitN(version, "-", 2)[0], ".") == 1 {
+		parts := strings.SplitN(version, "-", 2)
+		parts[0] += ".0"
+		version = strings.Join(parts, "-")
+	}
+
+	v, err := bond.CreateMongoDBVersion(version)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing version '%s'", version)
+	}
+
+	return v, nil
+}
+
+// isStableArtifactVersion returns true for generally available
+// releases, excluding release candidates, development releases and
+// nightly builds.
+func isStableArtifactVersion(v bond.MongoDBVersion) bool {
+	return v.IsRelease() && !v.IsReleaseCandidate() && !v.IsDevelopmentRelease() && !v.IsDevelopmentSeries()
+}
+
+// resolve returns the releases in the feed that match the selector and
+// have a build for the options, newest first.
+func (sel *artifactVersionSelector) resolve(feed *bond.ArtifactsFeed, opts bond.BuildOptions) []string {
+	candidates := []bond.MongoDBVersion{}
+	for _, version := range feed.Versions {
+		v, err := bond.CreateMongoDBVersion(version.Version)
+		if err != nil || !isStableArtifactVersion(v) {
+			continue
+		}
+
+		matches := true
+		for _, c := range sel.constraints {
+			if !c.matches(v) {
+				matches = false
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+
+		if _, err = version.GetDownload(opts); err != nil {
+			continue
+		}
+
+		candidates = append(candidates, v)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Parsed().GT(candidates[j].Parsed())
+	})
+
+	out := []string{}
+	seen := map[string]bool{}
+	for _, v := range candidates {
+		if sel.latestPatch {
+			if seen[v.Series()] {
+				continue
+			}
+			seen[v.Series()] = true
+		}
+
+		out = append(out, v.String())
+		if sel.limit > 0 && len(out) >= sel.limit {
+			break
+		}
+	}
+
+	return out
+}
+
+// resolveArtifactVersions expands any selectors in the version flag
+// values into concrete releases, and leaves other values for bond to
+// resolve. The output has no duplicates and preserves the order of the
+// values.
+func resolveArtifactVersions(feed *bond.ArtifactsFeed, values []string, opts bond.BuildOptions) ([]string, error) {
+	out := []string{}
+	seen := map[string]bool{}
+	add := func(version string) {
+		if !seen[version] {
+			seen[version] = true
+			out = append(out, version)
+		}
+	}
+
+	for _, value := range values {
+		if !isArtifactVersionSelector(value) {
+			add(value)
+			continue
+		}
+
+		sel, err := parseArtifactVersionSelector(value)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		versions := sel.resolve(feed, opts)
+		if len(versions) == 0 {
+			return nil, errors.Errorf("no releases in the feed match '%s' for %s", value, opts)
+		}
+
+		for idx := len(versions) - 1; idx >= 0; idx-- {
+			add(versions[idx])
+		}
+	}
+
+	return out, nil
+}
@@ -0,0 +1,111 @@
+package operations
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/evergreen-ci/bond"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testArtifactBuild = bond.BuildOptions{Target: "ubuntu2204", Arch: bond.AMD64, Edition: bond.Enterprise}
+
+func newTestArtifactsFeed(t *testing.T, versions ...string) *bond.ArtifactsFeed {
+	type download struct {
+		Target  string `json:"target"`
+		Arch    string `json:"arch"`
+		Edition string `json:"edition"`
+		Archive struct {
+			URL string `json:"url"`
+		} `json:"archive"`
+	}
+	type version struct {
+		Version   string     `json:"version"`
+		Downloads []download `json:"downloads"`
+	}
+
+	data := struct {
+		Versions []version `json:"versions"`
+	}{}
+	for _, v := range versions {
+		dl := download{Target: testArtifactBuild.Target, Arch: string(testArtifactBuild.Arch), Edition: string(testArtifactBuild.Edition)}
+		dl.Archive.URL = fmt.Sprintf("https://fastdl.mongodb.org/linux/mongodb-linux-x86_64-enterprise-ubuntu2204-%s.tgz", v)
+		data.Versions = append(data.Versions, version{Version: v, Downloads: []download{dl}})
+	}
+	// a version without a build for the test options
+	data.Versions = append(data.Versions, version{Version: "7.0.20"})
+
+	raw, err := json.Marshal(data)
+	require.NoError(t, err)
+
+	feed, err := bond.NewArtifactsFeed(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, feed.Reload(raw))
+	return feed
+}
+
+func TestResolveArtifactVersions(t *testing.T) {
+	feed := newTestArtifactsFeed(t,
+		"7.2.1", "7.2.0", "7.1.1", "7.0.12", "7.0.11", "7.0.0-rc1", "7.0.0",
+		"6.3.0-alpha1", "6.0.15", "6.0.14", "5.0.26", "3.3.1", "3.2.22")
+
+	for name, test := range map[string]struct {
+		values   []string
+		expected []string
+	}{
+		"Range": {
+			values:   []string{">=6.0 <7.1"},
+			expected: []string{"6.0.14", "6.0.15", "7.0.0", "7.0.11", "7.0.12"},
+		},
+		"SpacedRange": {
+			values:   []string{">= 7.1 <= 7.2.0"},
+			expected: []string{"7.1.1", "7.2.0"},
+		},
+		"Wildcard": {
+			values:   []string{"6.x"},
+			expected: []string{"6.0.14", "6.0.15"},
+		},
+		"LatestPatch": {
+			values:   []string{"latest-patch:>=6.0 <8.0"},
+			expected: []string{"6.0.15", "7.0.12", "7.1.1", "7.2.1"},
+		},
+		"LatestStable": {
+			values:   []string{"latest-stable:4"},
+			expected: []string{"7.0.12", "7.1.1", "7.2.0", "7.2.1"},
+		},
+
+		"LatestStableDefault": {
+			values:   []string{"latest-stable"},
+			expected: []string{"7.2.1"},
+		},
+		"LegacyDevelopmentSeries": {
+			values:   []string{"3.x"},
+			expected: []string{"3.2.22"},
+		},
+		"PassThrough": {
+			values:   []string{"7.0-latest", "7.0-current", "5.0.26", "latest-stable", "7.2.1"},
+			expected: []string{"7.0-latest", "7.0-current", "5.0.26", "7.2.1"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			versions, err := resolveArtifactVersions(feed, test.values, testArtifactBuild)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, versions)
+		})
+	}
+
+	for name, value := range map[string]string{
+		"NoMatches":   ">=9.0",
+		"BadOperator": "=>6.0",
+		"BadVersion":  ">=six",
+		"BadLimit":    "latest-stable:0",
+		"BadWildcard": "6.0.1.x",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := resolveArtifactVersions(feed, []string{value}, testArtifactBuild)
+			assert.Error(t, err)
+		})
+	}
+}
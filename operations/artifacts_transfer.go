@@ -0,0 +1,195 @@
+package operations
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/evergreen-ci/bond"
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+)
+
+// artifactPartialSuffix names the file that a download writes to until
+// it is complete, so that an interrupted download can resume.
+const artifactPartialSuffix = ".partial"
+
+// artifactProgress counts the bytes that downloads expect and have
+// received across all workers, for periodic progress logging.
+type artifactProgress struct {
+	expected int64
+	received int64
+	started  time.Time
+}
+
+func newArtifactProgress() *artifactProgress {
+	return &artifactProgress{started: time.Now()}
+}
+
+func (p *artifactProgress) expect(n int64) {
+	if p != nil && n > 0 {
+		atomic.AddInt64(&p.expected, n)
+	}
+}
+
+func (p *artifactProgress) Write(b []byte) (int, error) {
+	atomic.AddInt64(&p.received, int64(len(b)))
+	return len(b), nil
+}
+
+// reader counts the bytes read from r as received.
+func (p *artifactProgress) reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return io.TeeReader(r, p)
+}
+
+func (p *artifactProgress) message() message.Fields {
+	received := atomic.LoadInt64(&p.received)
+	expected := atomic.LoadInt64(&p.expected)
+	elapsed := time.Since(p.started)
+
+	msg := message.Fields{
+		"message":  "artifact download progress",
+		"received": received,
+		"expected": expected,
+		"elapsed":  elapsed.Round(time.Second).String(),
+	}
+
+	if secs := elapsed.Seconds(); secs > 0 {
+		rate := float64(received) / secs
+		msg["rate_bytes_per_sec"] = int64(rate)
+		if rate > 0 && expected > received {
+			msg["eta"] = time.Duration(float64(expected-received) / rate * float64(time.Second)).Round(time.Second).String()
+		}
+	}
+
+	return msg
+}
+
+// log logs the progress at every interval until the context is done.
+func (p *artifactProgress) log(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			grip.Info(p.message())
+		}
+	}
+}
+
+// downloadArtifactFile downloads a URL to a file, supporting file://
+// URLs for archives in local mirrors as well as HTTP. HTTP downloads
+// resume from a partial download of a previous attempt, if there is
+// one, and report whether they did.
+func downloadArtifactFile(ctx context.Context, url, fn string, progress *artifactProgress) (bool, error) {
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return false, errors.Wrapf(err, "creating enclosing directory for file '%s'", fn)
+	}
+
+	if strings.HasPrefix(url, "file://") {
+		return false, errors.WithStack(copyArtifactFile(url, fn, progress))
+	}
+
+	partial := fn + artifactPartialSuffix
+	var offset int64
+	if stat, err := os.Stat(partial); err == nil {
+		offset = stat.Size()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, errors.Wrap(err, "building request")
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	client := bond.GetHTTPClient()
+	defer bond.PutHTTPClient(client)
+
+	grip.Noticeln("downloading:", fn)
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, errors.Wrap(err, "downloading file")
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE
+	resumed := false
+	switch {
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent:
+		flags |= os.O_APPEND
+		resumed = true
+	case offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// the previous attempt received the whole file, and
+		// verification will catch it if it did not.
+		return true, errors.Wrap(os.Rename(partial, fn), "completing download")
+	case resp.StatusCode < 300:
+		flags |= os.O_TRUNC
+	default:
+		return false, errors.Errorf("received status code %d (%s) for request to URL '%s'", resp.StatusCode, resp.Status, url)
+	}
+	progress.expect(resp.ContentLength)
+
+	f, err := os.OpenFile(partial, flags, 0644)
+	if err != nil {
+		return false, errors.Wrapf(err, "opening file '%s'", partial)
+	}
+
+	n, err := io.Copy(f, progress.reader(resp.Body))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// keep the partial download so the next attempt can resume
+		return resumed, errors.Wrapf(err, "writing URL '%s' to file '%s'", url, partial)
+	}
+
+	grip.Debug(message.Fields{
+		"message": "downloaded file",
+		"file":    fn,
+		"bytes":   n,
+		"resumed": resumed,
+		"offset":  offset,
+	})
+
+	return resumed, errors.Wrap(os.Rename(partial, fn), "completing download")
+}
+
+func copyArtifactFile(url, fn string, progress *artifactProgress) error {
+	src, err := os.Open(filepath.FromSlash(strings.TrimPrefix(url, "file://")))
+	if err != nil {
+		return errors.Wrapf(err, "opening '%s'", url)
+	}
+	defer src.Close()
+
+	if stat, err := src.Stat(); err == nil {
+		progress.expect(stat.Size())
+	}
+
+	dst, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "creating file '%s'", fn)
+	}
+
+	if _, err = io.Copy(dst, progress.reader(src)); err != nil {
+		grip.Warning(dst.Close())
+		grip.Warning(os.Remove(fn))
+		return errors.Wrapf(err, "copying '%s' to '%s'", url, fn)
+	}
+
+	return errors.Wrapf(dst.Close(), "closing file '%s'", fn)
+}
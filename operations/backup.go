@@ -73,9 +73,14 @@ func Backup() cli.Command {
 			if err = client.Connect(ctx); err != nil {
 				return errors.Wrap(err, "connecting client")
 			}
+			endpoint, err := s3EndpointFromFlags(c)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
 			httpClient := utility.GetHTTPClient()
 			defer utility.PutHTTPClient(httpClient)
-			bucket, err := pail.NewS3BucketWithHTTPClient(ctx, httpClient,
+			bucket, err := newS3Bucket(ctx, httpClient, endpoint,
 				pail.S3Options{
 					SharedCredentialsProfile: c.String("profile"),
 					Region:                   c.String("region"),
@@ -1,11 +1,17 @@
 package operations
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"text/tabwriter"
+	"time"
 
 	"github.com/evergreen-ci/lru"
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
@@ -19,8 +25,22 @@ func PruneCache() cli.Command {
 		Usage: "prunes contents of a filesystem based on modification time. Follows symlinks.",
 		Flags: []cli.Flag{
 			cli.IntFlag{
-				Name:  "max-size",
-				Usage: "specify the max size of the cache to prune to in megabytes",
+				Name: "max-size",
+				Usage: "specify the max size of the cache to prune to in megabytes. " +
+					"Without any other policy, defaults to 0, which removes everything that isn't kept",
+			},
+			cli.DurationFlag{
+				Name:  "max-age",
+				Usage: "remove everything last modified longer ago than this, such as '336h' for 14 days",
+			},
+			cli.IntFlag{
+				Name:  "max-count",
+				Usage: "keep at most this many of the most recently modified objects, not counting the objects that are kept",
+			},
+			cli.StringSliceFlag{
+				Name: "keep",
+				Usage: "glob patterns, matched against the path relative to the cache and the base name, " +
+					"of objects never to remove (may specify multiple times; defaults to 'full.json')",
 			},
 			cli.StringFlag{
 				Name:   "path",
@@ -35,29 +55,320 @@ func PruneCache() cli.Command {
 			},
 			cli.BoolFlag{
 				Name:  "dry-run",
-				Usage: "dry run mode does not remove files from the file system.",
+				Usage: "dry run mode does not remove files from the file system, and reports what it would remove.",
+			},
+			cli.BoolFlag{
+				Name:  "json",
+				Usage: "specify this option to output the objects removed, and the rules that removed them, as JSON",
+			},
+			cli.BoolFlag{
+				Name: "watch",
+				Usage: "keep running, and prune the cache whenever usage of the filesystem that holds it " +
+					"crosses the high watermark, until it's below the low watermark. Exits on SIGTERM.",
+			},
+			cli.Float64Flag{
+				Name:  "high-watermark",
+				Value: 90,
+				Usage: "percent of the filesystem in use at which to start pruning, in watch mode",
+			},
+			cli.Float64Flag{
+				Name:  "low-watermark",
+				Value: 80,
+				Usage: "percent of the filesystem in use to prune down to, in watch mode",
+			},
+			cli.DurationFlag{
+				Name:  "interval",
+				Value: time.Minute,
+				Usage: "how often to check usage of the filesystem, in watch mode",
 			},
 		},
 		Action: func(c *cli.Context) error {
-			maxSize := c.Int("max-size") * 1024 * 1024
-			return pruneCache(c.String("path"), maxSize, c.Bool("recursive"), c.Bool("dry-run"))
+			opts := pruneCacheOptions{
+				Path:      c.String("path"),
+				MaxSize:   int64(c.Int("max-size")) * 1024 * 1024,
+				MaxAge:    c.Duration("max-age"),
+				MaxCount:  c.Int("max-count"),
+				Keep:      c.StringSlice("keep"),
+				Recursive: c.Bool("recursive"),
+				DryRun:    c.Bool("dry-run"),
+			}
+			if !c.IsSet("max-size") && (opts.MaxAge > 0 || opts.MaxCount > 0 || c.Bool("watch")) {
+				opts.MaxSize = -1
+			}
+
+			if c.Bool("watch") {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				go signalListener(ctx, cancel)
+
+				return errors.WithStack(watchCache(ctx, pruneWatchOptions{
+					Prune:         opts,
+					HighWatermark: c.Float64("high-watermark"),
+					LowWatermark:  c.Float64("low-watermark"),
+					Interval:      c.Duration("interval"),
+				}))
+			}
+
+			result, err := pruneCache(opts)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			switch {
+			case c.Bool("json"):
+				return errors.WithStack(writeJSON(os.Stdout, result))
+			case opts.DryRun:
+				return errors.WithStack(writePruneTable(os.Stdout, result))
+			default:
+				return nil
+			}
 		},
 	}
 }
 
-func pruneCache(path string, maxSize int, recursive, dryRun bool) error {
+// defaultPruneKeep is the keep list when there isn't one, which keeps
+// the artifacts feed that the artifacts commands cache.
+var defaultPruneKeep = []string{"full.json"}
+
+const (
+	pruneRuleMaxAge   = "max-age"
+	pruneRuleMaxCount = "max-count"
+	pruneRuleMaxSize  = "max-size"
+	pruneRuleReclaim  = "watermark"
+)
+
+type pruneCacheOptions struct {
+	Path string
+	// MaxSize is the size in bytes to prune the cache to, or a
+	// negative number not to limit the size.
+	MaxSize int64
+	// MaxAge removes objects last modified longer ago than this, if
+	// it's greater than 0.
+	MaxAge time.Duration
+	// MaxCount keeps at most this many objects, apart from the kept
+	// objects, if it's greater than 0.
+	MaxCount int
+	// Keep is glob patterns of objects never to remove, which
+	// defaults to defaultPruneKeep.
+	Keep []string
+	// Reclaim removes objects until pruning has reclaimed at least
+	// this many bytes, if it's greater than 0.
+	Reclaim   int64
+	Recursive bool
+	DryRun    bool
+}
+
+func (opts *pruneCacheOptions) validate() error {
+	catcher := grip.NewBasicCatcher()
+	catcher.NewWhen(opts.Path == "", "must specify a cache path")
+	catcher.NewWhen(opts.MaxAge < 0, "maximum age must not be negative")
+	catcher.NewWhen(opts.MaxCount < 0, "maximum count must not be negative")
+	catcher.NewWhen(opts.Reclaim < 0, "bytes to reclaim must not be negative")
+
+	if len(opts.Keep) == 0 {
+		opts.Keep = defaultPruneKeep
+	}
+	for _, pattern := range opts.Keep {
+		_, err := filepath.Match(pattern, "")
+		catcher.Wrapf(err, "invalid keep pattern '%s'", pattern)
+	}
+
+	return catcher.Resolve()
+}
+
+// keeps reports whether the object at the path, relative to the cache,
+// matches a keep pattern.
+func (opts *pruneCacheOptions) keeps(rel string) bool {
+	for _, pattern := range opts.Keep {
+		if ok, _ := filepath.Match(pattern, rel); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, filepath.Base(rel)); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pruneCandidate is an object that a prune rule selected for removal.
+type pruneCandidate struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Rule    string    `json:"rule"`
+}
+
+type pruneCacheResult struct {
+	Path      string           `json:"path"`
+	DryRun    bool             `json:"dry_run"`
+	Objects   int              `json:"objects"`
+	Size      int64            `json:"size"`
+	Kept      int              `json:"kept"`
+	Removed   []pruneCandidate `json:"removed"`
+	Reclaimed int64            `json:"reclaimed"`
+}
+
+// buildPruneCache returns the objects in the cache in least recently
+// used order.
+func buildPruneCache(path string, recursive bool) ([]*lru.FileObject, error) {
 	var cache *lru.Cache
 	var err error
 
 	if recursive {
-		cache, err = lru.TreeContents(path)
+		cache, err = treePruneCache(path)
 	} else {
 		cache, err = lru.DirectoryContents(path, false)
 	}
 
 	if err != nil {
-		return errors.Wrapf(err, "building cache for '%s'", path)
+		return nil, errors.Wrapf(err, "building cache for '%s'", path)
+	}
+
+	objects := make([]*lru.FileObject, 0, cache.Count())
+	for cache.Count() > 0 {
+		obj, err := cache.Pop()
+		if err != nil {
+			return nil, errors.Wrap(err, "ordering cache")
+		}
+		objects = append(objects, obj)
+	}
+
+	return objects, nil
+}
+
+// treePruneCache adds every file in the tree to a cache, like
+// lru.TreeContents, which records the wrong paths.
+func treePruneCache(root string) (*lru.Cache, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting absolute path for path '%s'", root)
+	}
+
+	cache := lru.NewCache()
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		return errors.WithStack(cache.AddStat(path, info))
+	})
+
+	return cache, errors.WithStack(err)
+}
+
+// pruneCache removes the least recently used objects in the cache that
+// any of the policies select, and reports which rule selected each.
+func pruneCache(opts pruneCacheOptions) (*pruneCacheResult, error) {
+	if err := opts.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid prune options")
+	}
+
+	objects, err := buildPruneCache(opts.Path, opts.Recursive)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	root, err := filepath.Abs(opts.Path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting absolute path for path '%s'", opts.Path)
+	}
+
+	result := &pruneCacheResult{
+		Path:    opts.Path,
+		DryRun:  opts.DryRun,
+		Objects: len(objects),
+		Removed: []pruneCandidate{},
+	}
+
+	candidates := make([]*lru.FileObject, 0, len(objects))
+	for _, obj := range objects {
+		result.Size += int64(obj.Size)
+
+		rel, err := filepath.Rel(root, obj.Path)
+		if err != nil {
+			rel = obj.Path
+		}
+		if opts.keeps(rel) {
+			grip.Infof("file '%s' is excluded from pruning", obj.Path)
+			result.Kept++
+			continue
+		}
+		candidates = append(candidates, obj)
+	}
+
+	// the objects are in least recently used order, so the count
+	// and size rules remove the oldest objects first. Kept objects
+	// don't count towards the size, since pruning can't remove them.
+	var size int64
+	for _, obj := range candidates {
+		size += int64(obj.Size)
+	}
+	count := len(candidates)
+	now := time.Now()
+	catcher := grip.NewBasicCatcher()
+	for _, obj := range candidates {
+		var rule string
+		switch {
+		case opts.MaxAge > 0 && now.Sub(obj.Time) > opts.MaxAge:
+			rule = pruneRuleMaxAge
+		case opts.MaxCount > 0 && count > opts.MaxCount:
+			rule = pruneRuleMaxCount
+		case opts.MaxSize >= 0 && size > opts.MaxSize:
+			rule = pruneRuleMaxSize
+		case opts.Reclaim > 0 && result.Reclaimed < opts.Reclaim:
+			rule = pruneRuleReclaim
+		default:
+			result.Kept++
+			continue
+		}
+
+		candidate := pruneCandidate{
+			Path:    obj.Path,
+			Size:    int64(obj.Size),
+			ModTime: obj.Time,
+			Rule:    rule,
+		}
+		size -= candidate.Size
+		count--
+
+		if opts.DryRun {
+			grip.Noticef("[dry-run]: would delete '%s' (%dMB) by %s", obj.Path, obj.Size/1024/1024, rule)
+		} else {
+			if err := obj.Remove(); err != nil {
+				catcher.Wrapf(err, "removing '%s'", obj.Path)
+				continue
+			}
+			grip.Infof("removed '%s' (%dMB) from the cache by %s", obj.Path, obj.Size/1024/1024, rule)
+		}
+
+		result.Removed = append(result.Removed, candidate)
+		result.Reclaimed += candidate.Size
+	}
+
+	grip.Info(message.Fields{
+		"message":   "pruned cache",
+		"path":      opts.Path,
+		"dry_run":   opts.DryRun,
+		"objects":   result.Objects,
+		"kept":      result.Kept,
+		"removed":   len(result.Removed),
+		"reclaimed": result.Reclaimed,
+	})
+
+	return result, errors.Wrap(catcher.Resolve(), "pruning cache")
+}
+
+func writePruneTable(w io.Writer, result *pruneCacheResult) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RULE\tSIZE\tMODIFIED\tPATH")
+	for _, candidate := range result.Removed {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", candidate.Rule, candidate.Size, candidate.ModTime.Format(time.RFC3339), candidate.Path)
 	}
 
-	return errors.Wrap(cache.Prune(maxSize, []string{"full.json"}, dryRun), "pruning cache")
+	return errors.WithStack(tw.Flush())
 }
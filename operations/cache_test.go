@@ -0,0 +1,256 @@
+package operations
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestPruneCache creates a cache with an object modified each day,
+// where "day-N" was modified N days ago and has N*100 bytes.
+func newTestPruneCache(t *testing.T) string {
+	dir := t.TempDir()
+	now := time.Now()
+	for days := 1; days <= 5; days++ {
+		name := "day-" + string(rune('0'+days))
+		fn := filepath.Join(dir, name)
+		if days%2 == 0 {
+			require.NoError(t, os.MkdirAll(fn, 0755))
+			fn = filepath.Join(fn, "contents")
+		}
+		require.NoError(t, os.WriteFile(fn, []byte(strings.Repeat("x", days*100)), 0644))
+
+		mtime := now.Add(-time.Duration(days) * 24 * time.Hour)
+		require.NoError(t, os.Chtimes(fn, mtime, mtime))
+		require.NoError(t, os.Chtimes(filepath.Join(dir, name), mtime, mtime))
+	}
+
+	old := now.Add(-30 * 24 * time.Hour)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "full.json"), []byte("{}"), 0644))
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "full.json"), old, old))
+
+	return dir
+}
+
+func prunedNames(result *pruneCacheResult) map[string]string {
+	out := map[string]string{}
+	for _, candidate := range result.Removed {
+		out[filepath.Base(candidate.Path)] = candidate.Rule
+	}
+	return out
+}
+
+func TestPruneCache(t *testing.T) {
+	for name, test := range map[string]struct {
+		opts     pruneCacheOptions
+		expected map[string]string
+	}{
+		"MaxSizeZeroRemovesAllButKept": {
+			opts: pruneCacheOptions{},
+			expected: map[string]string{
+				"day-1": pruneRuleMaxSize, "day-2": pruneRuleMaxSize, "day-3": pruneRuleMaxSize,
+				"day-4": pruneRuleMaxSize, "day-5": pruneRuleMaxSize,
+			},
+		},
+		"MaxSize": {
+			opts:     pruneCacheOptions{MaxSize: 700},
+			expected: map[string]string{"day-5": pruneRuleMaxSize, "day-4": pruneRuleMaxSize},
+		},
+		"MaxAge": {
+			opts:     pruneCacheOptions{MaxSize: -1, MaxAge: 60 * time.Hour},
+			expected: map[string]string{"day-3": pruneRuleMaxAge, "day-4": pruneRuleMaxAge, "day-5": pruneRuleMaxAge},
+		},
+		"MaxCount": {
+			opts:     pruneCacheOptions{MaxSize: -1, MaxCount: 3},
+			expected: map[string]string{"day-4": pruneRuleMaxCount, "day-5": pruneRuleMaxCount},
+		},
+		"Combined": {
+			opts: pruneCacheOptions{MaxSize: 100, MaxAge: 108 * time.Hour, MaxCount: 3},
+			expected: map[string]string{
+				"day-5": pruneRuleMaxAge, "day-4": pruneRuleMaxCount,
+				"day-3": pruneRuleMaxSize, "day-2": pruneRuleMaxSize,
+			},
+		},
+		"Reclaim": {
+			opts:     pruneCacheOptions{MaxSize: -1, Reclaim: 600},
+			expected: map[string]string{"day-5": pruneRuleReclaim, "day-4": pruneRuleReclaim},
+		},
+		"Keep": {
+			opts:     pruneCacheOptions{MaxSize: -1, MaxCount: 1, Keep: []string{"day-[45]"}},
+			expected: map[string]string{"day-3": pruneRuleMaxCount, "day-2": pruneRuleMaxCount, "full.json": pruneRuleMaxCount},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := newTestPruneCache(t)
+			test.opts.Path = dir
+
+			dryRun := test.opts
+			dryRun.DryRun = true
+			result, err := pruneCache(dryRun)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, prunedNames(result))
+			assert.Equal(t, 6, result.Objects)
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			assert.Len(t, entries, 6, "dry runs don't remove anything")
+
+			result, err = pruneCache(test.opts)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, prunedNames(result))
+			assert.Equal(t, 6-len(test.expected), result.Kept)
+
+			var reclaimed int64
+			for _, candidate := range result.Removed {
+				reclaimed += candidate.Size
+				_, err := os.Stat(candidate.Path)
+				assert.True(t, os.IsNotExist(err))
+			}
+			assert.Equal(t, reclaimed, result.Reclaimed)
+			entries, err = os.ReadDir(dir)
+			require.NoError(t, err)
+			assert.Len(t, entries, 6-len(test.expected))
+		})
+	}
+
+	t.Run("Recursive", func(t *testing.T) {
+		dir := newTestPruneCache(t)
+		result, err := pruneCache(pruneCacheOptions{Path: dir, MaxSize: 500, Recursive: true})
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"day-5": pruneRuleMaxSize, "contents": pruneRuleMaxSize, "day-3": pruneRuleMaxSize}, prunedNames(result))
+		assert.NoFileExists(t, filepath.Join(dir, "day-4", "contents"))
+		assert.DirExists(t, filepath.Join(dir, "day-4"))
+	})
+	t.Run("InvalidKeep", func(t *testing.T) {
+		_, err := pruneCache(pruneCacheOptions{Path: newTestPruneCache(t), Keep: []string{"[day"}})
+		assert.Error(t, err)
+	})
+	t.Run("Table", func(t *testing.T) {
+		result, err := pruneCache(pruneCacheOptions{Path: newTestPruneCache(t), MaxSize: -1, MaxCount: 4, DryRun: true})
+		require.NoError(t, err)
+
+		var buf bytes.Buffer
+		require.NoError(t, writePruneTable(&buf, result))
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		require.Len(t, lines, 2)
+		assert.True(t, strings.HasPrefix(lines[1], pruneRuleMaxCount))
+		assert.Contains(t, lines[1], "day-5")
+	})
+}
+
+// testCacheUsage reports the filesystem as 10000 bytes, with 8000 bytes
+// in use apart from the cache.
+func testCacheUsage(calls *int) func(string) (uint64, uint64, error) {
+	return func(path string) (uint64, uint64, error) {
+		*calls++
+		objects, err := buildPruneCache(path, false)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		used := uint64(8000)
+		for _, obj := range objects {
+			used += uint64(obj.Size)
+		}
+		return used, 10000, nil
+	}
+}
+
+func TestWatchCache(t *testing.T) {
+	t.Run("AboveHighWatermark", func(t *testing.T) {
+		var calls int
+		opts := pruneWatchOptions{
+			Prune:         pruneCacheOptions{Path: newTestPruneCache(t), MaxSize: -1},
+			HighWatermark: 90,
+			LowWatermark:  85,
+			Interval:      time.Millisecond,
+			usage:         testCacheUsage(&calls),
+		}
+		require.NoError(t, opts.validate())
+
+		result, err := pruneToWatermark(opts)
+		require.NoError(t, err)
+		require.NotNil(t, result)
+		assert.Equal(t, map[string]string{
+			"day-5": pruneRuleReclaim, "day-4": pruneRuleReclaim, "day-3": pruneRuleReclaim,
+		}, prunedNames(result))
+
+		result, err = pruneToWatermark(opts)
+		require.NoError(t, err)
+		assert.Nil(t, result, "usage is below the high watermark")
+	})
+	t.Run("BelowHighWatermarkAppliesPolicies", func(t *testing.T) {
+		var calls int
+		opts := pruneWatchOptions{
+			Prune:         pruneCacheOptions{Path: newTestPruneCache(t), MaxSize: -1, MaxCount: 4},
+			HighWatermark: 99,
+			LowWatermark:  85,
+			Interval:      time.Millisecond,
+			usage:         testCacheUsage(&calls),
+		}
+		require.NoError(t, opts.validate())
+
+		result, err := pruneToWatermark(opts)
+		require.NoError(t, err)
+		require.NotNil(t, result)
+		assert.Equal(t, map[string]string{"day-5": pruneRuleMaxCount}, prunedNames(result))
+	})
+	t.Run("StopsWhenCanceled", func(t *testing.T) {
+		dir := newTestPruneCache(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		var calls int
+		usage := testCacheUsage(&calls)
+		opts := pruneWatchOptions{
+			Prune:         pruneCacheOptions{Path: dir, MaxSize: -1},
+			HighWatermark: 90,
+			LowWatermark:  85,
+			Interval:      time.Millisecond,
+			usage: func(path string) (uint64, uint64, error) {
+				if calls >= 3 {
+					cancel()
+				}
+				return usage(path)
+			},
+		}
+
+		require.NoError(t, watchCache(ctx, opts))
+		assert.GreaterOrEqual(t, calls, 3)
+		assert.NoDirExists(t, filepath.Join(dir, "day-4"))
+		assert.FileExists(t, filepath.Join(dir, "day-1"))
+		assert.FileExists(t, filepath.Join(dir, "full.json"))
+	})
+	t.Run("InvalidWatermarks", func(t *testing.T) {
+		for _, marks := range [][2]float64{{0, 80}, {90, 95}, {101, 80}, {90, 0}} {
+			opts := pruneWatchOptions{
+				Prune:         pruneCacheOptions{Path: newTestPruneCache(t), MaxSize: -1},
+				HighWatermark: marks[0],
+				LowWatermark:  marks[1],
+				Interval:      time.Minute,
+			}
+			assert.Error(t, watchCache(context.Background(), opts), "%v", marks)
+		}
+	})
+}
+
+func TestFilesystemUsage(t *testing.T) {
+	dir := t.TempDir()
+	used, total, err := filesystemUsage(dir)
+	require.NoError(t, err)
+	require.NotZero(t, total)
+
+	stat, err := disk.Usage(dir)
+	require.NoError(t, err)
+	assert.InDelta(t, stat.UsedPercent, float64(used)/float64(total)*100, 1, "reserved blocks don't count toward the capacity")
+
+	_, _, err = filesystemUsage(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
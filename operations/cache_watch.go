@@ -0,0 +1,138 @@
+package operations
+
+import (
+	"context"
+	"time"
+
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+	"github.com/shirou/gopsutil/v3/disk"
+)
+
+type pruneWatchOptions struct {
+	Prune pruneCacheOptions
+	// HighWatermark is the percent of the filesystem in use at which
+	// to prune the cache, and LowWatermark is the percent to prune it
+	// down to.
+	HighWatermark float64
+	LowWatermark  float64
+	Interval      time.Duration
+
+	// usage reports the bytes in use and the capacity of the
+	// filesystem that holds the path, which defaults to the usage
+	// that the operating system reports.
+	usage func(path string) (used, total uint64, err error)
+}
+
+func (opts *pruneWatchOptions) validate() error {
+	catcher := grip.NewBasicCatcher()
+	catcher.Add(opts.Prune.validate())
+	catcher.NewWhen(opts.HighWatermark <= 0 || opts.HighWatermark > 100, "high watermark must be a percentage greater than 0 and at most 100")
+	catcher.NewWhen(opts.LowWatermark <= 0 || opts.LowWatermark >= opts.HighWatermark, "low watermark must be a percentage greater than 0 and less than the high watermark")
+	catcher.NewWhen(opts.Interval <= 0, "interval must be greater than 0")
+
+	if opts.usage == nil {
+		opts.usage = filesystemUsage
+	}
+
+	return catcher.Resolve()
+}
+
+// filesystemUsage returns the bytes in use on the filesystem and its
+// capacity as the used and free bytes, which leaves out the blocks
+// reserved for the root user, matching the usage that df reports.
+func filesystemUsage(path string) (uint64, uint64, error) {
+	stat, err := disk.Usage(path)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "getting filesystem usage for '%s'", path)
+	}
+
+	return stat.Used, stat.Used + stat.Free, nil
+}
+
+// watchCache checks usage of the filesystem that holds the cache every
+// interval, and prunes the cache when usage is above the high
+// watermark, until the context is canceled. Failing to check or prune
+// the cache doesn't stop watching it.
+func watchCache(ctx context.Context, opts pruneWatchOptions) error {
+	if err := opts.validate(); err != nil {
+		return errors.Wrap(err, "invalid watch options")
+	}
+
+	grip.Info(message.Fields{
+		"message":        "watching cache",
+		"path":           opts.Prune.Path,
+		"high_watermark": opts.HighWatermark,
+		"low_watermark":  opts.LowWatermark,
+		"interval":       opts.Interval.String(),
+	})
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			grip.Info(message.Fields{
+				"message": "stopped watching cache",
+				"path":    opts.Prune.Path,
+			})
+			return nil
+		case <-timer.C:
+			_, err := pruneToWatermark(opts)
+			grip.Error(message.WrapError(err, message.Fields{
+				"message": "problem pruning cache",
+				"path":    opts.Prune.Path,
+			}))
+			timer.Reset(opts.Interval)
+		}
+	}
+}
+
+// pruneToWatermark prunes the cache once, removing enough of it to
+// bring usage of the filesystem down to the low watermark if usage is
+// above the high watermark. The age and count policies apply whatever
+// the usage is. It returns a nil result when there was nothing to do.
+func pruneToWatermark(opts pruneWatchOptions) (*pruneCacheResult, error) {
+	used, total, err := opts.usage(opts.Prune.Path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if total == 0 {
+		return nil, errors.Errorf("filesystem that holds '%s' has no capacity", opts.Prune.Path)
+	}
+
+	percent := float64(used) / float64(total) * 100
+	prune := opts.Prune
+	if percent > opts.HighWatermark {
+		prune.Reclaim = int64(used) - int64(opts.LowWatermark/100*float64(total))
+
+		grip.Notice(message.Fields{
+			"message":        "filesystem usage is above the high watermark",
+			"path":           opts.Prune.Path,
+			"used_percent":   percent,
+			"high_watermark": opts.HighWatermark,
+			"low_watermark":  opts.LowWatermark,
+			"reclaim":        prune.Reclaim,
+		})
+	} else if prune.MaxAge <= 0 && prune.MaxCount <= 0 && prune.MaxSize < 0 {
+		return nil, nil
+	}
+
+	result, err := pruneCache(prune)
+	if err != nil {
+		return result, errors.WithStack(err)
+	}
+
+	if prune.Reclaim > 0 && result.Reclaimed < prune.Reclaim {
+		grip.Warning(message.Fields{
+			"message":   "could not prune enough of the cache to reach the low watermark",
+			"path":      opts.Prune.Path,
+			"reclaim":   prune.Reclaim,
+			"reclaimed": result.Reclaimed,
+		})
+	}
+
+	return result, nil
+}
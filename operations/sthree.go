@@ -12,6 +12,13 @@ sub-command, for example:
    curator s3 delete-prefix --bucket <bucket> --prefix <remote>
    curator s3 put --bucket <bucket> --file <local> --name <remote>
    curator s3 get --bucket <bucket> --file <local> --name <remote>
+   curator s3 ls --bucket <bucket> --prefix <remote> [--match <regex>] [--json]
+   curator s3 du --bucket <bucket> --prefix <remote> [--depth <int>] [--json]
+   curator s3 copy --bucket <bucket> --name <remote> --dest-bucket <bucket> [--dest-name <remote>]
+   curator s3 move --bucket <bucket> --prefix <remote> --dest-bucket <bucket> [--dest-prefix <remote>]
+   curator s3 prune --bucket <bucket> --prefix <remote> [--max-size <MB>] [--max-age <duration>] [--keep-latest <int>]
+   curator s3 versions list|restore|purge --bucket <bucket> --prefix <remote> [--at <time>]
+   curator s3 presign --bucket <bucket> --name <remote> [--expires <duration>] [--put] [--json]
 
 For sync commands, the "prefix" argument allows
 you to sync only a portion of the bucket (e.g. all items with
@@ -23,12 +30,103 @@ end with a "/", though the prefix and filename will be combined with a
 
 Sync operations first compare file names and then compare MD5
 checksums, and upload only differing content. Unlike rsync, file sizes
-and timestamps are *not* considered. Also there is no "delete" or
-"mirror" operation.
+and timestamps are *not* considered. Objects uploaded in parts have
+ETags that are not MD5 checksums, so for those the local file is
+checksummed part by part, using the part sizes of common S3 clients.
+With "--delete", objects in the target that do not exist in the source
+are removed. Sync from S3 refuses keys that would be written outside
+of the local directory, such as "../name".
+
+The "--include" and "--exclude-glob" options take gitignore-style
+globs, such as "*.log" or "build/debug-*", and may be repeated; a key
+is synced if it matches any include pattern (or none are given) and no
+exclude pattern. "--exclude" excludes keys matching a regular
+expression. "--min-size" and "--max-size" limit the sync to files in a
+size range, with units such as "512k", "10MB" or "1G", and
+"--newer-than" and "--older-than" limit it by modification time. With
+"--delete", only keys that pass these filters are deleted.
+
+The "--max-bandwidth" option limits the combined transfer rate of all
+workers, in bytes per second with units such as "512k" or "10MB", so
+that a sync does not saturate the network of a shared host. With
+"--adaptive", the number of concurrent transfers is scaled between one
+and "--workers" (16 if unset): it halves whenever S3 responds with a
+503 SlowDown, including to requests that the S3 client retries, and
+otherwise moves in whichever direction last improved throughput. A
+transfer that still fails with SlowDown is retried.
+
+When a sync finishes, curator logs a summary of the number of keys and
+bytes uploaded, downloaded, skipped, deleted and failed. The
+"--report" option writes the action, size and duration for every key,
+along with these totals, to a JSON file.
+
+With the "--manifest" option, sync operations instead maintain a JSON
+manifest of the size, MD5 checksum and modification time of every
+file, stored as ".curator-manifest.json" under the prefix. Changes are
+found by comparing the local tree against this single object, which
+avoids a request per key for large trees. Objects in a prefix should
+be written only by manifest-mode syncs, as other writes are not
+reflected in the manifest.
 
 Put and get operations perform simple copy operations. You can specify
 long path names, with prefix/directories in the remote name.
 
+Get operations download into a partial file next to the target, and
+resume an interrupted download of the same object with ranged
+requests. The file is only moved into place after it is verified
+against the object's ETag or, with "--verify sha256", against the
+checksum in a sidecar "<name>.sha256" object. When verification
+fails, curator exits with status 3. Partial files left by an earlier
+version of the object are removed. Objects stored with gzip content
+encoding, such as the ones "put" compresses, are decoded: the ETag is
+verified before decoding, and the sidecar checksum after.
+
+The ls and du operations inspect the contents of a bucket. ls lists
+the size, modification time and etag of each key, while du totals
+object sizes grouped by the first "depth" path components after the
+prefix. Both accept the same "--match" regular expression as
+delete-match, which makes it possible to preview a deletion.
+
+The copy and move operations copy objects within S3 without
+downloading them, either for a single key ("--name") or for every key
+under a prefix ("--prefix"). Prefixes are directories: "--prefix
+build" copies "build/..." but not "build2/...". The move operation
+removes the source objects once all copies succeed.
+
+The prune operation keeps a prefix bounded in the same way that the
+top-level prune command keeps local caches bounded. Objects are
+removed least recently modified first: every object older than
+"--max-age", and then as many as needed to bring the prefix under
+"--max-size" megabytes. The "--keep-latest" most recently modified
+objects, and objects whose keys end with "full.json" or an
+"--exclude" suffix, are never removed. With "--dry-run", prune only
+reports what it would remove.
+
+The delete commands only affect the current version of objects in a
+bucket with versioning enabled. The versions commands operate on every
+version of a single object ("--name") or of the objects under a prefix
+("--prefix"): "versions list" shows each version and delete marker,
+"versions restore --at <time>" makes the version that was current at
+an RFC 3339 time current again (deleting objects that did not exist
+yet), and "versions purge" permanently deletes noncurrent versions and
+delete markers, optionally only those from "--before" a time, and with
+"--all" current versions too. Restore and purge report what they
+change, or with "--dry-run" what they would change.
+
+The object URL printed by put is only useful for public objects. The
+presign operation instead generates URLs that grant anyone access to
+download ("GET") a single object ("--name") or every object under a
+prefix ("--prefix") until they expire, one hour by default and at most
+seven days ("--expires"). With "--put", it also generates URLs to
+upload to each key. "--json" writes the key, method, URL and
+expiration time of each URL for use by other tools.
+
+The "--endpoint" option points any s3 command, as well as backup, at
+an S3-compatible service such as MinIO (e.g. "http://localhost:9000")
+instead of AWS, and "--path-style" addresses buckets in the URL path
+("<endpoint>/<bucket>/<key>") rather than the host name, which most
+such services require.
+
 By default curator attempts to read AWS credentials from the
 "AWS_ACCESS_KEY" and "AWS_SECRET_KEY" environment variables (if set),
 or the standard "$HOME/.aws/credentials" file or a file specified in
@@ -44,13 +142,14 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"strings"
 	"time"
 
+	"github.com/docker/go-units"
 	"github.com/evergreen-ci/pail"
 	"github.com/evergreen-ci/utility"
 	"github.com/mongodb/grip"
 	"github.com/mongodb/grip/level"
+	"github.com/mongodb/grip/message"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
@@ -74,6 +173,13 @@ func S3() cli.Command {
 			s3DeleteMatchingCmd(),
 			s3SyncToCmd(),
 			s3SyncFromCmd(),
+			s3ListCmd(),
+			s3DiskUsageCmd(),
+			s3CopyCmd(),
+			s3MoveCmd(),
+			s3PresignCmd(),
+			s3PruneCmd(),
+			s3VersionsCmd(),
 		},
 	}
 
@@ -111,7 +217,7 @@ func s3PutCmd() cli.Command {
 				MaxRetries:               utility.ToIntPtr(c.Int("retries")),
 				Verbose:                  c.Bool("verbose"),
 			}
-			bucket, err := pail.NewS3Bucket(ctx, opts)
+			bucket, err := s3BucketFromFlags(ctx, c, opts)
 			if err != nil {
 				return errors.Wrap(err, "getting new bucket")
 			}
@@ -121,14 +227,11 @@ func s3PutCmd() cli.Command {
 				return errors.Wrapf(err, "putting file '%s' in S3", c.String("file"))
 			}
 
-			var baseURL string
-			if strings.Contains(bucketName, ".") {
-				baseURL = fmt.Sprintf("https://s3.amazonaws.com/%s", bucketName)
-			} else {
-				baseURL = fmt.Sprintf("https://%s.s3.amazonaws.com", bucketName)
+			endpoint, err := s3EndpointFromFlags(c)
+			if err != nil {
+				return errors.WithStack(err)
 			}
-			url := strings.Join([]string{baseURL, objectKey}, "/")
-			fmt.Println("Object URL: ", url)
+			fmt.Println("Object URL: ", endpoint.objectURL(bucketName, objectKey))
 
 			return nil
 		},
@@ -139,7 +242,7 @@ func s3GetCmd() cli.Command {
 	return cli.Command{
 		Name:  "get",
 		Usage: "download a local file object from s3",
-		Flags: baseS3Flags(s3opFlags()...),
+		Flags: baseS3Flags(s3opFlags(s3getFlags()...)...),
 		Action: func(c *cli.Context) error {
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
@@ -148,24 +251,25 @@ func s3GetCmd() cli.Command {
 				return err
 			}
 
-			opts := pail.S3Options{
-				SharedCredentialsProfile: c.String("profile"),
-				Region:                   c.String("region"),
-				Name:                     c.String("bucket"),
-				DryRun:                   c.Bool("dry-run"),
-				MaxRetries:               utility.ToIntPtr(c.Int("retries")),
-				Verbose:                  c.Bool("verbose"),
-			}
-			bucket, err := pail.NewS3Bucket(ctx, opts)
+			client, err := s3ClientFromFlags(ctx, c)
 			if err != nil {
-				return errors.Wrap(err, "getting new bucket")
+				return errors.Wrap(err, "getting S3 client")
 			}
 
-			return errors.Wrapf(
-				bucket.Download(ctx, c.String("name"), c.String("file")),
-				"getting object '%s' from S3",
-				c.String("name"),
-			)
+			opts := s3DownloadOptions{
+				Bucket: c.String("bucket"),
+				Key:    c.String("name"),
+				Path:   c.String("file"),
+				Verify: c.String("verify"),
+				Resume: c.BoolT("resume"),
+				DryRun: c.Bool("dry-run"),
+			}
+			err = verifiedS3Download(ctx, client, opts)
+			if _, ok := errors.Cause(err).(*checksumMismatchError); ok {
+				return cli.NewExitError(err.Error(), s3ChecksumMismatchExitCode)
+			}
+
+			return errors.Wrapf(err, "getting object '%s' from S3", c.String("name"))
 		},
 	}
 }
@@ -195,7 +299,7 @@ func s3DeleteCmd() cli.Command {
 				MaxRetries:               utility.ToIntPtr(c.Int("retries")),
 				Verbose:                  c.Bool("verbose"),
 			}
-			bucket, err := pail.NewS3Bucket(ctx, opts)
+			bucket, err := s3BucketFromFlags(ctx, c, opts)
 			if err != nil {
 				return errors.Wrap(err, "getting new bucket")
 			}
@@ -234,7 +338,7 @@ func s3DeletePrefixCmd() cli.Command {
 				MaxRetries:               utility.ToIntPtr(c.Int("retries")),
 				Verbose:                  c.Bool("verbose"),
 			}
-			bucket, err := pail.NewS3Bucket(ctx, opts)
+			bucket, err := s3BucketFromFlags(ctx, c, opts)
 			if err != nil {
 				return errors.Wrap(err, "getting new bucket")
 			}
@@ -273,7 +377,7 @@ func s3DeleteMatchingCmd() cli.Command {
 				MaxRetries:               utility.ToIntPtr(c.Int("retries")),
 				Verbose:                  c.Bool("verbose"),
 			}
-			bucket, err := pail.NewS3Bucket(ctx, opts)
+			bucket, err := s3BucketFromFlags(ctx, c, opts)
 			if err != nil {
 				return errors.Wrap(err, "getting new bucket")
 			}
@@ -306,35 +410,24 @@ func s3SyncToCmd() cli.Command {
 				Region:                   c.String("region"),
 				Name:                     c.String("bucket"),
 				DryRun:                   c.Bool("dry-run"),
-				DeleteOnSync:             c.Bool("delete"),
 				MaxRetries:               utility.ToIntPtr(c.Int("retries")),
 				Permissions:              pail.S3Permissions(c.String("permissions")),
 				Verbose:                  c.Bool("verbose"),
 			}
-			bucket, err := pail.NewS3Bucket(ctx, opts)
+			syncOpts, err := s3SyncOptionsFromFlags(ctx, c)
 			if err != nil {
-				return errors.Wrap(err, "getting new bucket")
+				return errors.WithStack(err)
 			}
-			if c.Int("workers") > 0 {
-				parallelOpts := pail.ParallelBucketOptions{
-					Workers:      c.Int("workers"),
-					DryRun:       c.Bool("dry-run"),
-					DeleteOnSync: c.Bool("delete"),
-				}
-				bucket, err = pail.NewParallelSyncBucket(parallelOpts, bucket)
-				if err != nil {
-					return errors.Wrap(err, "constructing parallel bucket")
-				}
 
+			bucket, err := s3SyncBucketFromFlags(ctx, c, syncOpts, opts)
+			if err != nil {
+				return errors.Wrap(err, "getting new bucket")
 			}
 
-			syncOpts := pail.SyncOptions{
-				Local:   c.String("local"),
-				Remote:  c.String("prefix"),
-				Exclude: c.String("exclude"),
-			}
+			report := newS3SyncReport("push", c.String("bucket"), syncOpts)
+			err = pushS3Sync(ctx, bucket, syncOpts, report)
 			return errors.Wrapf(
-				bucket.Push(ctx, syncOpts),
+				finishS3SyncReport(report, c.String("report"), err),
 				"syncing local path '%s' to S3",
 				c.String("local"),
 			)
@@ -361,34 +454,23 @@ func s3SyncFromCmd() cli.Command {
 				Region:                   c.String("region"),
 				Name:                     c.String("bucket"),
 				DryRun:                   c.Bool("dry-run"),
-				DeleteOnSync:             c.Bool("delete"),
 				MaxRetries:               utility.ToIntPtr(c.Int("retries")),
 				Verbose:                  c.Bool("verbose"),
 			}
-			bucket, err := pail.NewS3Bucket(ctx, opts)
+			syncOpts, err := s3SyncOptionsFromFlags(ctx, c)
 			if err != nil {
-				return errors.Wrap(err, "getting new bucket")
+				return errors.WithStack(err)
 			}
-			if c.Int("workers") > 0 {
-				parallelOpts := pail.ParallelBucketOptions{
-					Workers:      c.Int("workers"),
-					DryRun:       c.Bool("dry-run"),
-					DeleteOnSync: c.Bool("delete"),
-				}
-				bucket, err = pail.NewParallelSyncBucket(parallelOpts, bucket)
-				if err != nil {
-					return errors.Wrap(err, "constructing parallel bucket")
-				}
 
+			bucket, err := s3SyncBucketFromFlags(ctx, c, syncOpts, opts)
+			if err != nil {
+				return errors.Wrap(err, "getting new bucket")
 			}
 
-			syncOpts := pail.SyncOptions{
-				Local:   c.String("local"),
-				Remote:  c.String("prefix"),
-				Exclude: c.String("exclude"),
-			}
+			report := newS3SyncReport("pull", c.String("bucket"), syncOpts)
+			err = pullS3Sync(ctx, bucket, syncOpts, report)
 			return errors.Wrapf(
-				bucket.Pull(ctx, syncOpts),
+				finishS3SyncReport(report, c.String("report"), err),
 				"syncing remote prefix '%s' from S3",
 				c.String("prefix"),
 			)
@@ -402,6 +484,93 @@ func s3SyncFromCmd() cli.Command {
 //
 /////////////////////////////////////////////
 
+// finishS3SyncReport logs a summary of the sync and, if a path is
+// given, writes the full report to it. The report is written even if
+// the sync failed.
+func finishS3SyncReport(report *s3SyncReport, path string, err error) error {
+	report.finish()
+
+	msg := report.message()
+	grip.InfoWhen(err == nil, msg)
+	grip.Error(message.WrapError(err, msg))
+
+	catcher := grip.NewBasicCatcher()
+	catcher.Add(err)
+	if path != "" {
+		catcher.Add(report.writeFile(path))
+	}
+
+	return catcher.Resolve()
+}
+
+// s3SyncOptionsFromFlags builds the options for a sync operation,
+// including its filters. Remote objects are listed with the S3 API so
+// that sizes and modification times are available for filtering.
+func s3SyncOptionsFromFlags(ctx context.Context, c *cli.Context) (s3SyncOptions, error) {
+	filter, err := newS3SyncFilter(s3SyncFilterOptions{
+		Include:      c.StringSlice("include"),
+		Exclude:      c.StringSlice("exclude-glob"),
+		ExcludeRegex: c.String("exclude"),
+		MinSize:      c.String("min-size"),
+		MaxSize:      c.String("max-size"),
+		NewerThan:    c.Duration("newer-than"),
+		OlderThan:    c.Duration("older-than"),
+	})
+	if err != nil {
+		return s3SyncOptions{}, errors.Wrap(err, "invalid sync filters")
+	}
+
+	var maxBandwidth int64
+	if bandwidth := c.String("max-bandwidth"); bandwidth != "" {
+		maxBandwidth, err = units.RAMInBytes(bandwidth)
+		if err != nil {
+			return s3SyncOptions{}, errors.Wrapf(err, "parsing maximum bandwidth '%s'", bandwidth)
+		}
+	}
+
+	client, err := s3ClientFromFlags(ctx, c)
+	if err != nil {
+		return s3SyncOptions{}, errors.WithStack(err)
+	}
+
+	opts := s3SyncOptions{
+		Local:        c.String("local"),
+		Remote:       c.String("prefix"),
+		Filter:       filter,
+		Workers:      c.Int("workers"),
+		Delete:       c.Bool("delete"),
+		DryRun:       c.Bool("dry-run"),
+		Manifest:     c.Bool("manifest"),
+		MaxBandwidth: maxBandwidth,
+		Adaptive:     c.Bool("adaptive"),
+		ListRemote:   newS3ClientLister(client, c.String("bucket")),
+	}
+
+	return opts, errors.WithStack(opts.validate())
+}
+
+// s3SyncBucketFromFlags constructs the bucket for a sync operation. In
+// adaptive mode, pail's buckets retry SlowDown responses out of sight
+// of the throttle, so the bucket uses an S3 client that reports every
+// attempt to the throttle instead.
+func s3SyncBucketFromFlags(ctx context.Context, c *cli.Context, syncOpts s3SyncOptions, opts pail.S3Options) (pail.Bucket, error) {
+	if !syncOpts.Adaptive {
+		return s3BucketFromFlags(ctx, c, opts)
+	}
+
+	endpoint, err := s3EndpointFromFlags(c)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	svc, err := newS3Client(ctx, nil, endpoint, opts, syncOpts.Throttle.observeRetries)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return newS3EndpointBucket(svc, endpoint.Workers, opts)
+}
+
 func ctxWithTimeout(timeout time.Duration) (context.Context, context.CancelFunc) {
 	ctx := context.Background()
 	if timeout > 0 {
@@ -444,6 +613,14 @@ func baseS3Flags(args ...cli.Flag) []cli.Flag {
 			Usage: "number of retry attempts",
 			Value: defaultMaxRetries,
 		},
+		cli.StringFlag{
+			Name:  "endpoint",
+			Usage: "URL of an S3-compatible service (e.g. http://localhost:9000) to use instead of AWS",
+		},
+		cli.BoolFlag{
+			Name:  "path-style",
+			Usage: "address buckets in the URL path rather than the host name, as many S3-compatible services require",
+		},
 	}
 
 	return append(flags, args...)
@@ -466,19 +643,59 @@ func s3syncFlags(args ...cli.Flag) []cli.Flag {
 			Name:  "delete",
 			Usage: "delete items from the target that do not exist in the source",
 		},
+		cli.StringSliceFlag{
+			Name:  "include",
+			Usage: "gitignore-style glob of keys to sync; may be specified more than once, and defaults to all keys",
+		},
 		cli.StringFlag{
 			Name:  "exclude",
 			Usage: "regular expression used to exclude items from the sync operation",
 		},
+		cli.StringSliceFlag{
+			Name:  "exclude-glob",
+			Usage: "gitignore-style glob of keys to exclude from the sync operation; may be specified more than once",
+		},
+		cli.StringFlag{
+			Name:  "min-size",
+			Usage: "only sync files at least this large (e.g. 512k, 10MB, 1G)",
+		},
+		cli.StringFlag{
+			Name:  "max-size",
+			Usage: "only sync files at most this large (e.g. 512k, 10MB, 1G)",
+		},
+		cli.DurationFlag{
+			Name:  "newer-than",
+			Usage: "only sync files modified within this duration (e.g. 24h)",
+		},
+		cli.DurationFlag{
+			Name:  "older-than",
+			Usage: "only sync files modified before this duration ago (e.g. 720h)",
+		},
 		cli.DurationFlag{
 			Name:  "timeout",
 			Usage: "specify a timeout for operations, defaults to unlimited timeout if not specified",
 		},
 		cli.IntFlag{
 			Name:  "workers",
-			Usage: "number of workers for parallelized sync operation",
+			Usage: "number of workers for parallelized sync operation, or the maximum number with --adaptive",
 			Value: 0,
 		},
+		cli.StringFlag{
+			Name:  "max-bandwidth",
+			Usage: "limit the transfer rate, shared across all workers, in bytes per second (e.g. 512k, 10MB)",
+		},
+		cli.BoolFlag{
+			Name:  "adaptive",
+			Usage: "scale the number of workers based on throughput and s3 SlowDown responses",
+		},
+		cli.BoolFlag{
+			Name:  "manifest",
+			Usage: "compare against a manifest stored under the prefix rather than checking each object",
+		},
+		cli.StringFlag{
+			Name:  "report",
+			Usage: "write a JSON report of the action taken for every key to this file",
+		},
 	}
 
 	return append(flags, args...)
@@ -524,6 +741,21 @@ func s3putFlags() []cli.Flag {
 	}
 }
 
+func s3getFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name: "verify",
+			Usage: "verify the download against the object's 'etag', a sidecar '<name>.sha256' " +
+				"object ('sha256'), or skip verification ('none')",
+			Value: s3VerifyETag,
+		},
+		cli.BoolTFlag{
+			Name:  "resume",
+			Usage: "resume interrupted downloads of the same object, use --resume=false to restart",
+		},
+	}
+}
+
 func setVerboseLogging(verbose bool) error {
 	if verbose {
 		sender := grip.GetSender()
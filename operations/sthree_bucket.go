@@ -0,0 +1,549 @@
+package operations
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/evergreen-ci/pail"
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+)
+
+// s3EndpointBucket is a pail bucket for an S3-compatible service. pail
+// does not allow setting the endpoint or addressing style of its S3
+// client, so this bucket implements the operations that curator uses
+// with an S3 client configured for the endpoint. Uploads go through the
+// SDK's upload manager, which uses multipart uploads for large objects.
+type s3EndpointBucket struct {
+	client       *s3.Client
+	uploader     *manager.Uploader
+	workers      int
+	verbose      bool
+	name         string
+	prefix       string
+	permissions  types.ObjectCannedACL
+	contentType  string
+	compress     bool
+	dryRun       bool
+	deleteOnPush bool
+	deleteOnPull bool
+}
+
+// newS3EndpointBucket returns a bucket that uses the client. Push and
+// Pull transfer as many objects at once as there are workers, or one
+// at a time, as pail's S3 buckets do, if there are none.
+func newS3EndpointBucket(client *s3.Client, workers int, opts pail.S3Options) (*s3EndpointBucket, error) {
+	catcher := grip.NewBasicCatcher()
+	catcher.NewWhen(opts.Name == "", "must specify a bucket name")
+	if opts.Permissions != "" {
+		catcher.Add(opts.Permissions.Validate())
+	}
+	catcher.NewWhen(opts.AssumeRoleARN != "", "assuming a role is not supported with a custom endpoint")
+	catcher.NewWhen(opts.UseSingleFileChecksums || opts.ExpectedChecksumSHA256 != "" || opts.UploadChecksumSHA256,
+		"checksum options are not supported with a custom endpoint")
+	catcher.NewWhen(opts.IfNotExists, "conditional writes are not supported with a custom endpoint")
+	if catcher.HasErrors() {
+		return nil, catcher.Resolve()
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	return &s3EndpointBucket{
+		client:       client,
+		uploader:     manager.NewUploader(client),
+		workers:      workers,
+		verbose:      opts.Verbose,
+		name:         opts.Name,
+		prefix:       opts.Prefix,
+		permissions:  types.ObjectCannedACL(opts.Permissions),
+		contentType:  opts.ContentType,
+		compress:     opts.Compress,
+		dryRun:       opts.DryRun,
+		deleteOnPush: opts.DeleteOnPush || opts.DeleteOnSync,
+		deleteOnPull: opts.DeleteOnPull || opts.DeleteOnSync,
+	}, nil
+}
+
+func (b *s3EndpointBucket) String() string { return b.name }
+
+func (b *s3EndpointBucket) Join(elems ...string) string {
+	return filepath.ToSlash(filepath.Join(elems...))
+}
+
+func (b *s3EndpointBucket) normalizeKey(key string) string { return b.Join(b.prefix, key) }
+
+func (b *s3EndpointBucket) denormalizeKey(key string) string {
+	if b.prefix == "" {
+		return key
+	}
+	return strings.TrimPrefix(key, b.prefix+"/")
+}
+
+func (b *s3EndpointBucket) Check(ctx context.Context) error {
+	_, err := b.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(b.name)})
+	return errors.Wrapf(err, "checking bucket '%s'", b.name)
+}
+
+func (b *s3EndpointBucket) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := b.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(b.normalizeKey(key)),
+	})
+	if isS3NotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "checking for '%s'", key)
+	}
+
+	return true, nil
+}
+
+// Writer streams the content to the upload manager, which uploads it
+// as it is written. The upload completes when the writer is closed.
+func (b *s3EndpointBucket) Writer(ctx context.Context, key string) (io.WriteCloser, error) {
+	return b.writer(ctx, key), nil
+}
+
+func (b *s3EndpointBucket) writer(ctx context.Context, key string) *s3EndpointWriter {
+	pr, pw := io.Pipe()
+	w := &s3EndpointWriter{pipe: pw, done: make(chan struct{})}
+	if b.compress {
+		w.gzip = gzip.NewWriter(pw)
+	}
+
+	go func() {
+		defer close(w.done)
+		w.err = b.upload(ctx, key, pr)
+		// fail any further writes if the upload stopped early
+		pr.CloseWithError(errors.Wrap(w.err, "upload stopped"))
+	}()
+
+	return w
+}
+
+type s3EndpointWriter struct {
+	pipe   *io.PipeWriter
+	gzip   *gzip.Writer
+	done   chan struct{}
+	err    error
+	closed bool
+}
+
+func (w *s3EndpointWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("writer already closed")
+	}
+	if w.gzip != nil {
+		return w.gzip.Write(p)
+	}
+	return w.pipe.Write(p)
+}
+
+func (w *s3EndpointWriter) Close() error {
+	if w.closed {
+		return errors.New("writer already closed")
+	}
+	w.closed = true
+
+	if w.gzip != nil {
+		if err := w.gzip.Close(); err != nil {
+			w.abort(err)
+			return errors.Wrap(err, "compressing content")
+		}
+	}
+	grip.Warning(w.pipe.Close())
+	<-w.done
+
+	return errors.WithStack(w.err)
+}
+
+// abort stops the upload without storing the content written so far.
+func (w *s3EndpointWriter) abort(err error) {
+	w.closed = true
+	grip.Warning(w.pipe.CloseWithError(err))
+	<-w.done
+}
+
+// upload uploads the content, using a multipart upload if it is larger
+// than one part. If reading the content fails, the upload fails and
+// nothing is stored.
+func (b *s3EndpointBucket) upload(ctx context.Context, key string, body io.Reader) error {
+	grip.DebugWhen(b.verbose, message.Fields{
+		"type":          "s3-endpoint",
+		"dry_run":       b.dryRun,
+		"operation":     "put",
+		"bucket":        b.name,
+		"bucket_prefix": b.prefix,
+		"key":           key,
+	})
+
+	if b.dryRun {
+		_, err := io.Copy(io.Discard, body)
+		return errors.WithStack(err)
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(b.normalizeKey(key)),
+		Body:   body,
+		ACL:    b.permissions,
+	}
+	if b.contentType != "" {
+		input.ContentType = aws.String(b.contentType)
+	}
+	if b.compress {
+		input.ContentEncoding = aws.String("gzip")
+	}
+
+	_, err := b.uploader.Upload(ctx, input)
+	return errors.Wrapf(err, "putting '%s'", key)
+}
+
+func (b *s3EndpointBucket) Reader(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := b.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(b.normalizeKey(key)),
+	})
+	if isS3NotFound(err) {
+		return nil, pail.MakeKeyNotFoundError(err)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting '%s'", key)
+	}
+
+	if aws.ToString(out.ContentEncoding) == "gzip" {
+		gr, err := gzip.NewReader(out.Body)
+		if err != nil {
+			grip.Warning(out.Body.Close())
+			return nil, errors.Wrapf(err, "decompressing '%s'", key)
+		}
+		return &s3EndpointGzipReader{Reader: gr, body: out.Body}, nil
+	}
+
+	return out.Body, nil
+}
+
+// s3EndpointGzipReader decompresses an object, and closes the response
+// body along with the decompressor.
+type s3EndpointGzipReader struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+func (r *s3EndpointGzipReader) Close() error {
+	catcher := grip.NewBasicCatcher()
+	catcher.Add(r.Reader.Close())
+	catcher.Add(r.body.Close())
+	return catcher.Resolve()
+}
+
+func (b *s3EndpointBucket) Put(ctx context.Context, key string, r io.Reader) error {
+	if !b.compress {
+		return errors.WithStack(b.upload(ctx, key, r))
+	}
+
+	// discard the upload if reading fails, rather than storing the
+	// content read so far
+	w := b.writer(ctx, key)
+	if _, err := io.Copy(w, r); err != nil {
+		w.abort(err)
+		return errors.Wrapf(err, "reading content for '%s'", key)
+	}
+
+	return errors.WithStack(w.Close())
+}
+
+func (b *s3EndpointBucket) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return b.Reader(ctx, key)
+}
+
+func (b *s3EndpointBucket) Upload(ctx context.Context, key, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "opening file '%s'", path)
+	}
+	defer func() { grip.Warning(f.Close()) }()
+
+	return errors.Wrapf(b.Put(ctx, key, f), "uploading '%s'", path)
+}
+
+func (b *s3EndpointBucket) Download(ctx context.Context, key, path string) error {
+	reader, err := b.Reader(ctx, key)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() { grip.Warning(reader.Close()) }()
+
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Wrapf(err, "creating enclosing directory for file '%s'", path)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Wrapf(err, "creating file '%s'", path)
+	}
+	if _, err = io.Copy(f, reader); err != nil {
+		grip.Warning(f.Close())
+		return errors.Wrapf(err, "downloading '%s'", key)
+	}
+
+	return errors.WithStack(f.Close())
+}
+
+// sync returns a bucket that implements Push and Pull using this
+// bucket's other operations.
+func (b *s3EndpointBucket) sync() (pail.Bucket, error) {
+	return pail.NewParallelSyncBucket(pail.ParallelBucketOptions{
+		Workers:      b.workers,
+		DryRun:       b.dryRun,
+		DeleteOnPush: b.deleteOnPush,
+		DeleteOnPull: b.deleteOnPull,
+	}, b)
+}
+
+func (b *s3EndpointBucket) Push(ctx context.Context, opts pail.SyncOptions) error {
+	b.logSync("push", opts)
+	sb, err := b.sync()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return sb.Push(ctx, opts)
+}
+
+func (b *s3EndpointBucket) Pull(ctx context.Context, opts pail.SyncOptions) error {
+	b.logSync("pull", opts)
+	sb, err := b.sync()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return sb.Pull(ctx, opts)
+}
+
+func (b *s3EndpointBucket) logSync(operation string, opts pail.SyncOptions) {
+	grip.DebugWhen(b.verbose, message.Fields{
+		"type":          "s3-endpoint",
+		"dry_run":       b.dryRun,
+		"operation":     operation,
+		"bucket":        b.name,
+		"bucket_prefix": b.prefix,
+		"remote":        opts.Remote,
+		"local":         opts.Local,
+		"exclude":       opts.Exclude,
+		"workers":       b.workers,
+	})
+}
+
+// Copy copies objects server-side when the destination is another
+// bucket for the endpoint, and otherwise through this process.
+func (b *s3EndpointBucket) Copy(ctx context.Context, opts pail.CopyOptions) error {
+	if b.dryRun {
+		return nil
+	}
+
+	if dst, ok := opts.DestinationBucket.(*s3EndpointBucket); ok {
+		return errors.WithStack(copyS3Object(ctx, b.client, s3ObjectCopy{
+			SourceBucket: b.name,
+			SourceKey:    b.normalizeKey(opts.SourceKey),
+			Bucket:       dst.name,
+			Key:          dst.normalizeKey(opts.DestinationKey),
+			ACL:          dst.permissions,
+		}))
+	}
+
+	reader, err := b.Reader(ctx, opts.SourceKey)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() { grip.Warning(reader.Close()) }()
+
+	return errors.Wrapf(opts.DestinationBucket.Put(ctx, opts.DestinationKey, reader),
+		"copying '%s' to '%s'", opts.SourceKey, opts.DestinationKey)
+}
+
+func (b *s3EndpointBucket) Remove(ctx context.Context, key string) error {
+	return b.RemoveMany(ctx, key)
+}
+
+func (b *s3EndpointBucket) RemoveMany(ctx context.Context, keys ...string) error {
+	grip.DebugWhen(b.verbose, message.Fields{
+		"type":          "s3-endpoint",
+		"dry_run":       b.dryRun,
+		"operation":     "remove",
+		"bucket":        b.name,
+		"bucket_prefix": b.prefix,
+		"keys":          len(keys),
+	})
+	if b.dryRun {
+		return nil
+	}
+
+	catcher := grip.NewBasicCatcher()
+	for start := 0; start < len(keys); start += s3MaxDeleteObjects {
+		end := start + s3MaxDeleteObjects
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		ids := make([]types.ObjectIdentifier, 0, end-start)
+		for _, key := range keys[start:end] {
+			ids = append(ids, types.ObjectIdentifier{Key: aws.String(b.normalizeKey(key))})
+		}
+
+		out, err := b.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(b.name),
+			Delete: &types.Delete{Objects: ids, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			catcher.Wrap(err, "deleting objects")
+			continue
+		}
+		for _, e := range out.Errors {
+			catcher.Errorf("deleting '%s': %s", aws.ToString(e.Key), aws.ToString(e.Message))
+		}
+	}
+
+	return catcher.Resolve()
+}
+
+func (b *s3EndpointBucket) RemovePrefix(ctx context.Context, prefix string) error {
+	return b.removeMatching(ctx, prefix, nil)
+}
+
+func (b *s3EndpointBucket) RemoveMatching(ctx context.Context, expression string) error {
+	re, err := regexp.Compile(expression)
+	if err != nil {
+		return errors.Wrap(err, "compiling regular expression")
+	}
+
+	return b.removeMatching(ctx, "", re)
+}
+
+func (b *s3EndpointBucket) removeMatching(ctx context.Context, prefix string, re *regexp.Regexp) error {
+	iter, err := b.List(ctx, prefix)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	keys := []string{}
+	for iter.Next(ctx) {
+		if re == nil || re.MatchString(iter.Item().Name()) {
+			keys = append(keys, iter.Item().Name())
+		}
+	}
+	if err = iter.Err(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(b.RemoveMany(ctx, keys...))
+}
+
+func (b *s3EndpointBucket) MoveObjects(ctx context.Context, destBucket pail.Bucket, sourceKeys, destKeys []string) error {
+	if len(sourceKeys) != len(destKeys) {
+		return errors.New("sourceKeys and destKeys must have the same length")
+	}
+
+	catcher := grip.NewBasicCatcher()
+	moved := []string{}
+	for idx, key := range sourceKeys {
+		err := b.Copy(ctx, pail.CopyOptions{SourceKey: key, DestinationKey: destKeys[idx], DestinationBucket: destBucket})
+		if err != nil {
+			catcher.Wrapf(err, "copying object to destination bucket as '%s'", destKeys[idx])
+			continue
+		}
+		moved = append(moved, key)
+	}
+	catcher.Wrap(b.RemoveMany(ctx, moved...), "removing moved objects")
+
+	return catcher.Resolve()
+}
+
+func (b *s3EndpointBucket) List(ctx context.Context, prefix string) (pail.BucketIterator, error) {
+	return &s3EndpointIterator{
+		bucket: b,
+		paginator: s3.NewListObjectsV2Paginator(b.client, &s3.ListObjectsV2Input{
+			Bucket: aws.String(b.name),
+			Prefix: aws.String(b.normalizeKey(prefix)),
+		}),
+	}, nil
+}
+
+type s3EndpointIterator struct {
+	bucket    *s3EndpointBucket
+	paginator *s3.ListObjectsV2Paginator
+	page      []types.Object
+	item      *s3EndpointItem
+	err       error
+}
+
+func (it *s3EndpointIterator) Next(ctx context.Context) bool {
+	for len(it.page) == 0 {
+		if it.err != nil || !it.paginator.HasMorePages() {
+			return false
+		}
+
+		out, err := it.paginator.NextPage(ctx)
+		if err != nil {
+			it.err = errors.Wrapf(err, "listing bucket '%s'", it.bucket.name)
+			return false
+		}
+		it.page = out.Contents
+	}
+
+	obj := it.page[0]
+	it.page = it.page[1:]
+	it.item = &s3EndpointItem{
+		bucket: it.bucket,
+		key:    it.bucket.denormalizeKey(aws.ToString(obj.Key)),
+		hash:   strings.Trim(aws.ToString(obj.ETag), `"`),
+	}
+
+	return true
+}
+
+func (it *s3EndpointIterator) Err() error { return it.err }
+
+func (it *s3EndpointIterator) Item() pail.BucketItem { return it.item }
+
+type s3EndpointItem struct {
+	bucket *s3EndpointBucket
+	key    string
+	hash   string
+}
+
+func (i *s3EndpointItem) Bucket() string { return i.bucket.name }
+func (i *s3EndpointItem) Name() string   { return i.key }
+func (i *s3EndpointItem) Hash() string   { return i.hash }
+
+func (i *s3EndpointItem) Get(ctx context.Context) (io.ReadCloser, error) {
+	return i.bucket.Get(ctx, i.key)
+}
+
+// isS3NotFound reports whether the error is S3 reporting that an
+// object does not exist.
+func isS3NotFound(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	switch apiErr.ErrorCode() {
+	case "NotFound", "NoSuchKey":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,307 @@
+package operations
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/evergreen-ci/pail"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3Server serves the subset of the S3 API that the endpoint bucket
+// uses, with path-style addressing, and records the hosts and paths
+// of the requests it receives.
+type fakeS3Server struct {
+	mu        sync.Mutex
+	objects   map[string][]byte
+	encoding  map[string]string
+	parts     map[string]map[int][]byte
+	multipart int
+	paths     []string
+}
+
+func newFakeS3Server(t *testing.T) (*fakeS3Server, *httptest.Server) {
+	fake := &fakeS3Server{objects: map[string][]byte{}, encoding: map[string]string{}, parts: map[string]map[int][]byte{}}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	return fake, srv
+}
+
+func (f *fakeS3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paths = append(f.paths, r.URL.Path)
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	name := bucket + "/" + key
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		prefix := bucket + "/" + r.URL.Query().Get("prefix")
+		out := struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Contents []struct {
+				Key  string
+				ETag string
+				Size int
+			}
+		}{}
+		for _, obj := range f.sortedKeys() {
+			if strings.HasPrefix(obj, prefix) {
+				out.Contents = append(out.Contents, struct {
+					Key  string
+					ETag string
+					Size int
+				}{strings.TrimPrefix(obj, bucket+"/"), `"` + fakeETag(f.objects[obj]) + `"`, len(f.objects[obj])})
+			}
+		}
+		writeFakeS3XML(w, out)
+	case key == "" && r.Method == http.MethodPost:
+		in := struct {
+			Object []struct{ Key string }
+		}{}
+		if err := xml.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, obj := range in.Object {
+			delete(f.objects, bucket+"/"+obj.Key)
+		}
+		writeFakeS3XML(w, struct {
+			XMLName xml.Name `xml:"DeleteResult"`
+		}{})
+	case key == "" && r.Method == http.MethodHead:
+	case r.Method == http.MethodPost && r.URL.Query().Has("uploads"):
+		f.multipart++
+		uploadID := fmt.Sprint("upload-", f.multipart)
+		f.parts[uploadID] = map[int][]byte{}
+		writeFakeS3XML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: uploadID})
+	case r.Method == http.MethodPut && r.URL.Query().Has("uploadId"):
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var part int
+		_, _ = fmt.Sscan(r.URL.Query().Get("partNumber"), &part)
+		f.parts[r.URL.Query().Get("uploadId")][part] = data
+		w.Header().Set("ETag", `"`+fakeETag(data)+`"`)
+	case r.Method == http.MethodPost && r.URL.Query().Has("uploadId"):
+		parts := f.parts[r.URL.Query().Get("uploadId")]
+		delete(f.parts, r.URL.Query().Get("uploadId"))
+		var data []byte
+		for idx := 1; idx <= len(parts); idx++ {
+			data = append(data, parts[idx]...)
+		}
+		f.objects[name] = data
+		writeFakeS3XML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			ETag    string
+		}{ETag: fakeETag(data)})
+	case r.Method == http.MethodDelete && r.URL.Query().Has("uploadId"):
+		delete(f.parts, r.URL.Query().Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		source := strings.SplitN(r.Header.Get("X-Amz-Copy-Source"), "?", 2)[0]
+		srcBucket, srcKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+		srcKey = strings.ReplaceAll(srcKey, "%2F", "/")
+		f.objects[name] = f.objects[srcBucket+"/"+srcKey]
+		writeFakeS3XML(w, struct {
+			XMLName xml.Name `xml:"CopyObjectResult"`
+			ETag    string
+		}{ETag: fakeETag(f.objects[name])})
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.objects[name] = data
+		f.encoding[name] = r.Header.Get("Content-Encoding")
+		w.Header().Set("ETag", `"`+fakeETag(data)+`"`)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := f.objects[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				writeFakeS3XML(w, struct {
+					XMLName xml.Name `xml:"Error"`
+					Code    string
+				}{Code: "NoSuchKey"})
+			}
+			return
+		}
+		w.Header().Set("ETag", `"`+fakeETag(data)+`"`)
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		if f.encoding[name] != "" {
+			w.Header().Set("Content-Encoding", f.encoding[name])
+		}
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+	default:
+		http.Error(w, "unsupported request", http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3Server) sortedKeys() []string {
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func fakeETag(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func writeFakeS3XML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+func newTestEndpointBucket(t *testing.T, srv *httptest.Server, name string) pail.Bucket {
+	// use a host name rather than an address, which the SDK would
+	// address with path-style requests regardless of the option.
+	endpoint := s3EndpointOptions{Endpoint: strings.Replace(srv.URL, "127.0.0.1", "localhost", 1), PathStyle: true}
+	require.NoError(t, endpoint.validate())
+
+	bucket, err := newS3Bucket(context.Background(), nil, endpoint, pail.S3Options{
+		Name:        name,
+		Region:      "us-east-1",
+		Credentials: pail.CreateAWSStaticCredentials("key", "secret", ""),
+	})
+	require.NoError(t, err)
+
+	return bucket
+}
+
+func TestS3EndpointBucket(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, hasEndpoint := os.LookupEnv("AWS_ENDPOINT_URL_S3")
+	fake, srv := newFakeS3Server(t)
+	bucket := newTestEndpointBucket(t, srv, "bucket")
+	_, stillHasEndpoint := os.LookupEnv("AWS_ENDPOINT_URL_S3")
+	assert.Equal(t, hasEndpoint, stillHasEndpoint, "the environment is not changed")
+
+	require.NoError(t, bucket.Put(ctx, "dir/one", strings.NewReader("one")))
+	require.NoError(t, bucket.Put(ctx, "dir/two", strings.NewReader("two")))
+	require.NoError(t, bucket.Put(ctx, "other", strings.NewReader("other")))
+	assert.Contains(t, fake.paths, "/bucket/dir/one", "requests are path-style")
+
+	assert.Equal(t, "one", readTestKey(t, bucket, "dir/one"))
+	exists, err := bucket.Exists(ctx, "dir/one")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	exists, err = bucket.Exists(ctx, "missing")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	_, err = bucket.Get(ctx, "missing")
+	assert.True(t, pail.IsKeyNotFoundError(err))
+
+	iter, err := bucket.List(ctx, "dir")
+	require.NoError(t, err)
+	names := []string{}
+	for iter.Next(ctx) {
+		names = append(names, iter.Item().Name())
+		assert.Equal(t, fakeETag([]byte(strings.TrimPrefix(iter.Item().Name(), "dir/"))), iter.Item().Hash())
+	}
+	require.NoError(t, iter.Err())
+	assert.Equal(t, []string{"dir/one", "dir/two"}, names)
+
+	dst := newTestEndpointBucket(t, srv, "dst")
+	require.NoError(t, bucket.Copy(ctx, pail.CopyOptions{SourceKey: "other", DestinationKey: "copied", DestinationBucket: dst}))
+	assert.Equal(t, "other", readTestKey(t, dst, "copied"))
+
+	local := t.TempDir()
+	require.NoError(t, bucket.Pull(ctx, pail.SyncOptions{Local: local, Remote: "dir"}))
+	data, err := os.ReadFile(filepath.Join(local, "two"))
+	require.NoError(t, err)
+	assert.Equal(t, "two", string(data))
+
+	require.NoError(t, bucket.RemovePrefix(ctx, "dir"))
+	exists, err = bucket.Exists(ctx, "dir/two")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	exists, err = bucket.Exists(ctx, "other")
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+// failingReader returns some content and then an error.
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, errors.New("read failed")
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestS3EndpointBucketUploads(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fake, srv := newFakeS3Server(t)
+	bucket := newTestEndpointBucket(t, srv, "bucket")
+
+	t.Run("Multipart", func(t *testing.T) {
+		// a reader that can't seek, like the throttled sync reader
+		data := bytes.Repeat([]byte("curator"), 2*1024*1024)
+		require.NoError(t, bucket.Put(ctx, "large", io.MultiReader(bytes.NewReader(data))))
+		assert.Equal(t, 1, fake.multipart)
+		assert.Equal(t, fakeETag(data), fakeETag([]byte(readTestKey(t, bucket, "large"))))
+	})
+	t.Run("FailedRead", func(t *testing.T) {
+		require.Error(t, bucket.Put(ctx, "partial", &failingReader{data: []byte("partial")}))
+		exists, err := bucket.Exists(ctx, "partial")
+		require.NoError(t, err)
+		assert.False(t, exists, "nothing is stored when reading fails")
+	})
+	t.Run("Compressed", func(t *testing.T) {
+		compressed, err := newS3Bucket(ctx, nil, s3EndpointOptions{Endpoint: strings.Replace(srv.URL, "127.0.0.1", "localhost", 1), PathStyle: true}, pail.S3Options{
+			Name:        "bucket",
+			Region:      "us-east-1",
+			Credentials: pail.CreateAWSStaticCredentials("key", "secret", ""),
+			Compress:    true,
+		})
+		require.NoError(t, err)
+
+		require.Error(t, compressed.Put(ctx, "compressed-partial", &failingReader{data: []byte("partial")}))
+		exists, err := compressed.Exists(ctx, "compressed-partial")
+		require.NoError(t, err)
+		assert.False(t, exists)
+
+		require.NoError(t, compressed.Put(ctx, "compressed", strings.NewReader("content")))
+		assert.Equal(t, "content", readTestKey(t, compressed, "compressed"))
+	})
+}
@@ -0,0 +1,194 @@
+package operations
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/evergreen-ci/pail"
+	"github.com/evergreen-ci/utility"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// s3EndpointOptions describe an S3-compatible service, such as MinIO,
+// to use instead of AWS.
+type s3EndpointOptions struct {
+	Endpoint  string
+	PathStyle bool
+	// Workers is the number of objects that buckets for the endpoint
+	// transfer at once when pushing and pulling.
+	Workers int
+}
+
+func s3EndpointFromFlags(c *cli.Context) (s3EndpointOptions, error) {
+	opts := s3EndpointOptions{
+		Endpoint:  c.String("endpoint"),
+		PathStyle: c.Bool("path-style"),
+		Workers:   c.Int("workers"),
+	}
+
+	return opts, errors.WithStack(opts.validate())
+}
+
+func (opts *s3EndpointOptions) validate() error {
+	if opts.Endpoint == "" {
+		return nil
+	}
+
+	u, err := url.Parse(opts.Endpoint)
+	if err != nil {
+		return errors.Wrapf(err, "parsing endpoint '%s'", opts.Endpoint)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.Errorf("endpoint '%s' must be an http or https URL", opts.Endpoint)
+	}
+	opts.Endpoint = strings.TrimSuffix(opts.Endpoint, "/")
+
+	return nil
+}
+
+// apply configures an S3 client to use the endpoint.
+func (opts s3EndpointOptions) apply(o *s3.Options) {
+	if opts.Endpoint != "" {
+		o.BaseEndpoint = aws.String(opts.Endpoint)
+	}
+	o.UsePathStyle = opts.PathStyle
+}
+
+// objectURL returns the URL of the key in the bucket.
+func (opts s3EndpointOptions) objectURL(bucket, key string) string {
+	if opts.Endpoint == "" {
+		if opts.PathStyle || strings.Contains(bucket, ".") {
+			return fmt.Sprintf("https://s3.amazonaws.com/%s/%s", bucket, key)
+		}
+		return fmt.Sprintf("https://%s.s3.amazonaws.com/%s", bucket, key)
+	}
+
+	u, err := url.Parse(opts.Endpoint)
+	if opts.PathStyle || err != nil {
+		return fmt.Sprintf("%s/%s/%s", opts.Endpoint, bucket, key)
+	}
+	return fmt.Sprintf("%s://%s.%s%s/%s", u.Scheme, bucket, u.Host, u.Path, key)
+}
+
+// s3BucketFromFlags constructs a pail bucket using the endpoint
+// settings from baseS3Flags.
+func s3BucketFromFlags(ctx context.Context, c *cli.Context, opts pail.S3Options) (pail.Bucket, error) {
+	endpoint, err := s3EndpointFromFlags(c)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return newS3Bucket(ctx, nil, endpoint, opts)
+}
+
+// newS3Bucket constructs a pail bucket that uses the endpoint. If the
+// HTTP client is nil, the default client is used.
+func newS3Bucket(ctx context.Context, client *http.Client, endpoint s3EndpointOptions, opts pail.S3Options) (pail.Bucket, error) {
+	if endpoint.Endpoint == "" {
+		if client == nil {
+			return pail.NewS3Bucket(ctx, opts)
+		}
+		return pail.NewS3BucketWithHTTPClient(ctx, client, opts)
+	}
+
+	svc, err := newS3Client(ctx, client, endpoint, opts)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return newS3EndpointBucket(svc, endpoint.Workers, opts)
+}
+
+// s3ClientFromFlags builds an S3 client using the credential, region,
+// retry and endpoint settings from baseS3Flags. It supports the operations
+// that pail's Bucket interface does not expose, such as listing
+// object metadata.
+func s3ClientFromFlags(ctx context.Context, c *cli.Context) (*s3.Client, error) {
+	endpoint, err := s3EndpointFromFlags(c)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return newS3Client(ctx, nil, endpoint, pail.S3Options{
+		Region:                   c.String("region"),
+		SharedCredentialsProfile: c.String("profile"),
+		MaxRetries:               utility.ToIntPtr(c.Int("retries")),
+	})
+}
+
+// newS3Client builds an S3 client for the endpoint, using the
+// credential, region and retry settings of the bucket options, and
+// then the option functions. If the HTTP client is nil, the SDK's
+// default client is used.
+func newS3Client(ctx context.Context, client *http.Client, endpoint s3EndpointOptions, opts pail.S3Options, optFns ...func(*s3.Options)) (*s3.Client, error) {
+	var cfgOpts []func(*config.LoadOptions) error
+	if opts.Region != "" {
+		cfgOpts = append(cfgOpts, config.WithRegion(opts.Region))
+	}
+	if opts.SharedCredentialsProfile != "" {
+		cfgOpts = append(cfgOpts, config.WithSharedConfigProfile(opts.SharedCredentialsProfile))
+	}
+	if opts.SharedCredentialsFilepath != "" {
+		cfgOpts = append(cfgOpts, config.WithSharedCredentialsFiles([]string{opts.SharedCredentialsFilepath}))
+	}
+	if opts.Credentials != nil {
+		cfgOpts = append(cfgOpts, config.WithCredentialsProvider(opts.Credentials))
+	}
+	if retries := aws.ToInt(opts.MaxRetries); retries > 0 {
+		cfgOpts = append(cfgOpts, config.WithRetryMaxAttempts(retries))
+	}
+	if client != nil {
+		cfgOpts = append(cfgOpts, config.WithHTTPClient(client))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, cfgOpts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading AWS config")
+	}
+
+	return s3.NewFromConfig(cfg, append([]func(*s3.Options){endpoint.apply}, optFns...)...), nil
+}
+
+// s3ObjectInfo describes a single object in a bucket.
+type s3ObjectInfo struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	ETag         string    `json:"etag"`
+}
+
+// listS3Objects returns all objects in the bucket with the given
+// prefix, in lexicographical order by key.
+func listS3Objects(ctx context.Context, client *s3.Client, bucket, prefix string) ([]s3ObjectInfo, error) {
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	out := []s3ObjectInfo{}
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "listing objects with prefix '%s' in bucket '%s'", prefix, bucket)
+		}
+
+		for _, obj := range page.Contents {
+			out = append(out, s3ObjectInfo{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				LastModified: aws.ToTime(obj.LastModified),
+				ETag:         strings.Trim(aws.ToString(obj.ETag), `"`),
+			})
+		}
+	}
+
+	return out, nil
+}
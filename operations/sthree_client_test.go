@@ -0,0 +1,67 @@
+package operations
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestS3EndpointValidation(t *testing.T) {
+	opts := s3EndpointOptions{Endpoint: "http://localhost:9000/"}
+	require.NoError(t, opts.validate())
+	assert.Equal(t, "http://localhost:9000", opts.Endpoint)
+
+	opts = s3EndpointOptions{}
+	assert.NoError(t, opts.validate())
+
+	for _, endpoint := range []string{"localhost:9000", "ftp://localhost", "http://"} {
+		opts = s3EndpointOptions{Endpoint: endpoint}
+		assert.Error(t, opts.validate(), endpoint)
+	}
+}
+
+func TestS3EndpointObjectURL(t *testing.T) {
+	for name, test := range map[string]struct {
+		opts     s3EndpointOptions
+		bucket   string
+		expected string
+	}{
+		"AWS": {
+			bucket:   "bucket",
+			expected: "https://bucket.s3.amazonaws.com/dir/key",
+		},
+		"AWSDottedBucket": {
+			bucket:   "repo.mongodb.org",
+			expected: "https://s3.amazonaws.com/repo.mongodb.org/dir/key",
+		},
+		"Endpoint": {
+			opts:     s3EndpointOptions{Endpoint: "https://s3.example.net"},
+			bucket:   "bucket",
+			expected: "https://bucket.s3.example.net/dir/key",
+		},
+		"EndpointPathStyle": {
+			opts:     s3EndpointOptions{Endpoint: "http://localhost:9000", PathStyle: true},
+			bucket:   "bucket",
+			expected: "http://localhost:9000/bucket/dir/key",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expected, test.opts.objectURL(test.bucket, "dir/key"))
+		})
+	}
+}
+
+func TestS3EndpointApply(t *testing.T) {
+	o := &s3.Options{}
+	s3EndpointOptions{Endpoint: "http://localhost:9000", PathStyle: true}.apply(o)
+	assert.Equal(t, "http://localhost:9000", aws.ToString(o.BaseEndpoint))
+	assert.True(t, o.UsePathStyle)
+
+	o = &s3.Options{}
+	s3EndpointOptions{}.apply(o)
+	assert.Nil(t, o.BaseEndpoint)
+	assert.False(t, o.UsePathStyle)
+}
@@ -0,0 +1,428 @@
+package operations
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/evergreen-ci/pail"
+	"github.com/evergreen-ci/utility"
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+func s3CopyCmd() cli.Command {
+	return cli.Command{
+		Name:    "copy",
+		Aliases: []string{"cp"},
+		Usage:   "copy an object or a prefix between buckets or prefixes without downloading it",
+		Flags:   baseS3Flags(s3copyFlags()...),
+		Action: func(c *cli.Context) error {
+			return errors.WithStack(runS3CopyCmd(c, false))
+		},
+	}
+}
+
+func s3MoveCmd() cli.Command {
+	return cli.Command{
+		Name:    "move",
+		Aliases: []string{"mv"},
+		Usage:   "move an object or a prefix between buckets or prefixes without downloading it",
+		Flags:   baseS3Flags(s3copyFlags()...),
+		Action: func(c *cli.Context) error {
+			return errors.WithStack(runS3CopyCmd(c, true))
+		},
+	}
+}
+
+// s3CopyOptions describes a server-side copy of either a single key
+// or of every key under a prefix.
+type s3CopyOptions struct {
+	SourceKey         string
+	DestinationKey    string
+	SourcePrefix      string
+	DestinationPrefix string
+	Workers           int
+	Move              bool
+	DryRun            bool
+
+	// copier copies each object, if set, instead of pail, which
+	// cannot copy objects larger than s3MaxCopyObjectSize.
+	copier *s3Copier
+}
+
+func (opts *s3CopyOptions) validate() error {
+	catcher := grip.NewBasicCatcher()
+	catcher.NewWhen(opts.SourceKey == "" && opts.SourcePrefix == "", "must specify either a source key or a source prefix")
+	catcher.NewWhen(opts.SourceKey != "" && opts.SourcePrefix != "", "cannot specify both a source key and a source prefix")
+	catcher.NewWhen(opts.SourceKey == "" && opts.DestinationKey != "", "cannot specify a destination key when copying a prefix")
+	catcher.NewWhen(opts.SourcePrefix == "" && opts.DestinationPrefix != "", "cannot specify a destination prefix when copying a single key")
+
+	if opts.SourceKey != "" && opts.DestinationKey == "" {
+		opts.DestinationKey = opts.SourceKey
+	}
+	// prefixes name directories, so that copying "build" doesn't also
+	// copy "build2/".
+	if opts.SourcePrefix != "" && !strings.HasSuffix(opts.SourcePrefix, "/") {
+		opts.SourcePrefix += "/"
+	}
+	if opts.DestinationPrefix != "" && !strings.HasSuffix(opts.DestinationPrefix, "/") {
+		opts.DestinationPrefix += "/"
+	}
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+
+	return catcher.Resolve()
+}
+
+func runS3CopyCmd(c *cli.Context, move bool) error {
+	ctx, cancel := ctxWithTimeout(c.Duration("timeout"))
+	defer cancel()
+
+	if err := setVerboseLogging(c.Bool("verbose")); err != nil {
+		return err
+	}
+
+	opts := s3CopyOptions{
+		SourceKey:         c.String("name"),
+		DestinationKey:    c.String("dest-name"),
+		SourcePrefix:      c.String("prefix"),
+		DestinationPrefix: c.String("dest-prefix"),
+		Workers:           c.Int("workers"),
+		Move:              move,
+		DryRun:            c.Bool("dry-run"),
+	}
+	if err := opts.validate(); err != nil {
+		return errors.Wrap(err, "invalid copy options")
+	}
+
+	srcOpts := pail.S3Options{
+		SharedCredentialsProfile: c.String("profile"),
+		Region:                   c.String("region"),
+		Name:                     c.String("bucket"),
+		DryRun:                   c.Bool("dry-run"),
+		MaxRetries:               utility.ToIntPtr(c.Int("retries")),
+		Verbose:                  c.Bool("verbose"),
+	}
+	src, err := s3BucketFromFlags(ctx, c, srcOpts)
+	if err != nil {
+		return errors.Wrap(err, "getting source bucket")
+	}
+
+	dstOpts := srcOpts
+	if name := c.String("dest-bucket"); name != "" {
+		dstOpts.Name = name
+	}
+	dstOpts.Permissions = pail.S3Permissions(c.String("permissions"))
+	dst, err := s3BucketFromFlags(ctx, c, dstOpts)
+	if err != nil {
+		return errors.Wrap(err, "getting destination bucket")
+	}
+
+	client, err := s3ClientFromFlags(ctx, c)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	opts.copier = &s3Copier{
+		client:      client,
+		source:      srcOpts.Name,
+		destination: dstOpts.Name,
+		acl:         types.ObjectCannedACL(dstOpts.Permissions),
+	}
+
+	return errors.Wrapf(copyS3Objects(ctx, src, dst, opts),
+		"copying from bucket '%s' to bucket '%s'", srcOpts.Name, dstOpts.Name)
+}
+
+// copyS3Objects performs server-side copies from the source bucket to
+// the destination bucket. When moving, source objects are removed
+// once every copy has succeeded.
+func copyS3Objects(ctx context.Context, src, dst pail.Bucket, opts s3CopyOptions) error {
+	if err := opts.validate(); err != nil {
+		return errors.Wrap(err, "invalid copy options")
+	}
+
+	targets := map[string]string{}
+	if opts.SourceKey != "" {
+		targets[opts.SourceKey] = opts.DestinationKey
+	} else {
+		iter, err := src.List(ctx, opts.SourcePrefix)
+		if err != nil {
+			return errors.Wrapf(err, "listing prefix '%s'", opts.SourcePrefix)
+		}
+		for iter.Next(ctx) {
+			key := iter.Item().Name()
+			targets[key] = opts.DestinationPrefix + strings.TrimPrefix(key, opts.SourcePrefix)
+		}
+		if err = iter.Err(); err != nil {
+			return errors.Wrapf(err, "iterating prefix '%s'", opts.SourcePrefix)
+		}
+	}
+
+	keys := make([]string, 0, len(targets))
+	for key := range targets {
+		if src.String() == dst.String() && key == targets[key] {
+			return errors.Errorf("source and destination of '%s' are the same", key)
+		}
+		keys = append(keys, key)
+	}
+
+	grip.Info(message.Fields{
+		"message":     "copying objects",
+		"source":      src.String(),
+		"destination": dst.String(),
+		"objects":     len(keys),
+		"move":        opts.Move,
+		"dry_run":     opts.DryRun,
+	})
+
+	copied := []string{}
+	mu := &sync.Mutex{}
+	err := runS3SyncWorkers(ctx, opts.Workers, keys, func(ctx context.Context, key string) error {
+		if opts.DryRun {
+			grip.Info(message.Fields{
+				"message":         "would copy object",
+				"source_key":      key,
+				"destination_key": targets[key],
+				"move":            opts.Move,
+			})
+			return nil
+		}
+
+		var err error
+		if opts.copier != nil {
+			err = opts.copier.copy(ctx, key, targets[key])
+		} else {
+			err = src.Copy(ctx, pail.CopyOptions{
+				SourceKey:         key,
+				DestinationKey:    targets[key],
+				DestinationBucket: dst,
+			})
+		}
+		if err != nil {
+			return errors.Wrapf(err, "copying '%s' to '%s'", key, targets[key])
+		}
+
+		mu.Lock()
+		copied = append(copied, key)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if opts.Move && len(copied) > 0 {
+		return errors.Wrap(src.RemoveMany(ctx, copied...), "removing source objects after copy")
+	}
+
+	return nil
+}
+
+const (
+	// s3MaxCopyObjectSize is the largest object that S3 copies with a
+	// single CopyObject request.
+	s3MaxCopyObjectSize = 5 * 1024 * 1024 * 1024
+	// s3CopyPartSize is the size of each part of a multipart copy,
+	// unless the object has too many parts at that size.
+	s3CopyPartSize = 512 * 1024 * 1024
+	// s3MaxParts is the largest number of parts that S3 accepts in a
+	// multipart upload.
+	s3MaxParts = 10000
+)
+
+// s3CopyClient is the subset of the S3 client used for server-side
+// copies, which allows the logic to be tested without S3.
+type s3CopyClient interface {
+	HeadObject(context.Context, *s3.HeadObjectInput, ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	CopyObject(context.Context, *s3.CopyObjectInput, ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	CreateMultipartUpload(context.Context, *s3.CreateMultipartUploadInput, ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPartCopy(context.Context, *s3.UploadPartCopyInput, ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error)
+	CompleteMultipartUpload(context.Context, *s3.CompleteMultipartUploadInput, ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(context.Context, *s3.AbortMultipartUploadInput, ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+}
+
+// s3Copier copies objects from the source bucket to the destination
+// bucket with the S3 client.
+type s3Copier struct {
+	client      s3CopyClient
+	source      string
+	destination string
+	acl         types.ObjectCannedACL
+}
+
+func (c *s3Copier) copy(ctx context.Context, srcKey, dstKey string) error {
+	return errors.WithStack(copyS3Object(ctx, c.client, s3ObjectCopy{
+		SourceBucket: c.source,
+		SourceKey:    srcKey,
+		Bucket:       c.destination,
+		Key:          dstKey,
+		ACL:          c.acl,
+	}))
+}
+
+// s3ObjectCopy describes a server-side copy of a single object, or of
+// a single version of it.
+type s3ObjectCopy struct {
+	SourceBucket  string
+	SourceKey     string
+	SourceVersion string
+	Bucket        string
+	Key           string
+	ACL           types.ObjectCannedACL
+}
+
+func (in s3ObjectCopy) source() string {
+	source := fmt.Sprintf("%s/%s", in.SourceBucket, url.PathEscape(in.SourceKey))
+	if in.SourceVersion != "" {
+		source += "?versionId=" + url.QueryEscape(in.SourceVersion)
+	}
+	return source
+}
+
+// copyS3Object copies an object with a single CopyObject request, or,
+// for objects larger than S3 copies in one request, with a multipart
+// upload of UploadPartCopy requests, which keeps the content type and
+// metadata of the source.
+func copyS3Object(ctx context.Context, client s3CopyClient, in s3ObjectCopy) error {
+	head, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:    aws.String(in.SourceBucket),
+		Key:       aws.String(in.SourceKey),
+		VersionId: awsStringOrNil(in.SourceVersion),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "getting size of '%s'", in.SourceKey)
+	}
+
+	size := aws.ToInt64(head.ContentLength)
+	if size <= s3MaxCopyObjectSize {
+		_, err = client.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:     aws.String(in.Bucket),
+			Key:        aws.String(in.Key),
+			CopySource: aws.String(in.source()),
+			ACL:        in.ACL,
+		})
+		return errors.Wrapf(err, "copying '%s' to '%s'", in.SourceKey, in.Key)
+	}
+
+	create, err := client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:             aws.String(in.Bucket),
+		Key:                aws.String(in.Key),
+		ACL:                in.ACL,
+		CacheControl:       head.CacheControl,
+		ContentDisposition: head.ContentDisposition,
+		ContentEncoding:    head.ContentEncoding,
+		ContentType:        head.ContentType,
+		Metadata:           head.Metadata,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "starting multipart copy of '%s' to '%s'", in.SourceKey, in.Key)
+	}
+
+	partSize := int64(s3CopyPartSize)
+	if minPartSize := (size + s3MaxParts - 1) / s3MaxParts; minPartSize > partSize {
+		partSize = minPartSize
+	}
+
+	parts := []types.CompletedPart{}
+	for offset, num := int64(0), int32(1); offset < size; offset, num = offset+partSize, num+1 {
+		end := offset + partSize
+		if end > size {
+			end = size
+		}
+
+		var out *s3.UploadPartCopyOutput
+		out, err = client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(in.Bucket),
+			Key:             aws.String(in.Key),
+			UploadId:        create.UploadId,
+			PartNumber:      aws.Int32(num),
+			CopySource:      aws.String(in.source()),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, end-1)),
+		})
+		if err != nil {
+			err = errors.Wrapf(err, "copying part %d of '%s' to '%s'", num, in.SourceKey, in.Key)
+			break
+		}
+		parts = append(parts, types.CompletedPart{ETag: out.CopyPartResult.ETag, PartNumber: aws.Int32(num)})
+	}
+
+	if err == nil {
+		_, err = client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(in.Bucket),
+			Key:             aws.String(in.Key),
+			UploadId:        create.UploadId,
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+		})
+		if err == nil {
+			return nil
+		}
+		err = errors.Wrapf(err, "finishing multipart copy of '%s' to '%s'", in.SourceKey, in.Key)
+	}
+
+	_, abortErr := client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(in.Bucket),
+		Key:      aws.String(in.Key),
+		UploadId: create.UploadId,
+	})
+	grip.Warning(message.WrapError(abortErr, message.Fields{
+		"message":   "problem aborting multipart copy",
+		"key":       in.Key,
+		"upload_id": aws.ToString(create.UploadId),
+	}))
+
+	return err
+}
+
+func awsStringOrNil(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
+
+func s3copyFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "name",
+			Usage: "the source s3 resource name, to copy a single object",
+		},
+		cli.StringFlag{
+			Name:  "dest-name",
+			Usage: "the destination s3 resource name, defaults to the source name",
+		},
+		cli.StringFlag{
+			Name:  "prefix",
+			Usage: "the source prefix of s3 key names, to copy every object under it as a directory",
+		},
+		cli.StringFlag{
+			Name:  "dest-prefix",
+			Usage: "the destination prefix, which replaces the source prefix in each key name",
+		},
+		cli.StringFlag{
+			Name:  "dest-bucket",
+			Usage: "the name of the destination s3 bucket, defaults to the source bucket",
+		},
+		cli.StringFlag{
+			Name:  "permissions",
+			Usage: "canned ACL to apply to the copied objects",
+		},
+		cli.IntFlag{
+			Name:  "workers",
+			Usage: "number of workers for parallelized copy operation",
+			Value: 1,
+		},
+		cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "specify a timeout for operations, defaults to unlimited timeout if not specified",
+		},
+	}
+}
@@ -0,0 +1,239 @@
+package operations
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/evergreen-ci/pail"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLocalBucket(t *testing.T, contents map[string]string) pail.Bucket {
+	bucket, err := pail.NewLocalBucket(pail.LocalOptions{Path: t.TempDir(), UseSlash: true})
+	require.NoError(t, err)
+
+	for key, content := range contents {
+		require.NoError(t, bucket.Put(context.Background(), key, strings.NewReader(content)))
+	}
+
+	return bucket
+}
+
+func readTestKey(t *testing.T, bucket pail.Bucket, key string) string {
+	reader, err := bucket.Get(context.Background(), key)
+	require.NoError(t, err)
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestS3CopyOptionsValidation(t *testing.T) {
+	for name, opts := range map[string]s3CopyOptions{
+		"Empty":               {},
+		"KeyAndPrefix":        {SourceKey: "a", SourcePrefix: "b"},
+		"DestinationKeyOnly":  {SourcePrefix: "a", DestinationKey: "b"},
+		"DestinationPrefixOf": {SourceKey: "a", DestinationPrefix: "b"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Error(t, opts.validate())
+		})
+	}
+
+	opts := s3CopyOptions{SourceKey: "a"}
+	require.NoError(t, opts.validate())
+	assert.Equal(t, "a", opts.DestinationKey)
+	assert.Equal(t, 1, opts.Workers)
+}
+
+func TestCopyS3Objects(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	contents := map[string]string{
+		"staging/one":     "one",
+		"staging/sub/two": "two",
+		"other/three":     "three",
+	}
+
+	t.Run("SingleKey", func(t *testing.T) {
+		src := newTestLocalBucket(t, contents)
+		dst := newTestLocalBucket(t, nil)
+
+		require.NoError(t, copyS3Objects(ctx, src, dst, s3CopyOptions{SourceKey: "other/three", DestinationKey: "release/three"}))
+		assert.Equal(t, "three", readTestKey(t, dst, "release/three"))
+	})
+	t.Run("Prefix", func(t *testing.T) {
+		src := newTestLocalBucket(t, contents)
+		dst := newTestLocalBucket(t, nil)
+
+		require.NoError(t, copyS3Objects(ctx, src, dst, s3CopyOptions{SourcePrefix: "staging/", DestinationPrefix: "release/", Workers: 2}))
+		assert.Equal(t, "one", readTestKey(t, dst, "release/one"))
+		assert.Equal(t, "two", readTestKey(t, dst, "release/sub/two"))
+
+		exists, err := dst.Exists(ctx, "release/three")
+		require.NoError(t, err)
+		assert.False(t, exists)
+		exists, err = src.Exists(ctx, "staging/one")
+		require.NoError(t, err)
+		assert.True(t, exists)
+	})
+	t.Run("Move", func(t *testing.T) {
+		src := newTestLocalBucket(t, contents)
+		dst := newTestLocalBucket(t, nil)
+
+		require.NoError(t, copyS3Objects(ctx, src, dst, s3CopyOptions{SourcePrefix: "staging/", DestinationPrefix: "release/", Move: true}))
+		assert.Equal(t, "one", readTestKey(t, dst, "release/one"))
+
+		exists, err := src.Exists(ctx, "staging/one")
+		require.NoError(t, err)
+		assert.False(t, exists)
+		exists, err = src.Exists(ctx, "other/three")
+		require.NoError(t, err)
+		assert.True(t, exists)
+	})
+	t.Run("DryRun", func(t *testing.T) {
+		src := newTestLocalBucket(t, contents)
+		dst := newTestLocalBucket(t, nil)
+
+		require.NoError(t, copyS3Objects(ctx, src, dst, s3CopyOptions{SourcePrefix: "staging/", Move: true, DryRun: true}))
+		exists, err := dst.Exists(ctx, "staging/one")
+		require.NoError(t, err)
+		assert.False(t, exists)
+		exists, err = src.Exists(ctx, "staging/one")
+		require.NoError(t, err)
+		assert.True(t, exists)
+	})
+	t.Run("PrefixIsDirectory", func(t *testing.T) {
+		src := newTestLocalBucket(t, map[string]string{"build/one": "one", "build2/two": "two"})
+		dst := newTestLocalBucket(t, nil)
+
+		require.NoError(t, copyS3Objects(ctx, src, dst, s3CopyOptions{SourcePrefix: "build", DestinationPrefix: "release"}))
+		assert.Equal(t, "one", readTestKey(t, dst, "release/one"))
+		exists, err := dst.Exists(ctx, "release2/two")
+		require.NoError(t, err)
+		assert.False(t, exists)
+		exists, err = dst.Exists(ctx, "release/2/two")
+		require.NoError(t, err)
+		assert.False(t, exists)
+	})
+	t.Run("Copier", func(t *testing.T) {
+		src := newTestLocalBucket(t, contents)
+		dst := newTestLocalBucket(t, nil)
+		client := &mockS3CopyClient{size: 1024}
+
+		require.NoError(t, copyS3Objects(ctx, src, dst, s3CopyOptions{
+			SourcePrefix:      "staging",
+			DestinationPrefix: "release",
+			Workers:           2,
+			Move:              true,
+			copier:            &s3Copier{client: client, source: "src-bucket", destination: "dst-bucket"},
+		}))
+		assert.ElementsMatch(t, []string{"src-bucket/staging%2Fone", "src-bucket/staging%2Fsub%2Ftwo"}, client.copied)
+		assert.ElementsMatch(t, []string{"dst-bucket/release/one", "dst-bucket/release/sub/two"}, client.keys)
+
+		exists, err := src.Exists(ctx, "staging/one")
+		require.NoError(t, err)
+		assert.False(t, exists, "moved objects are removed from the source")
+		exists, err = dst.Exists(ctx, "release/one")
+		require.NoError(t, err)
+		assert.False(t, exists, "the copier copies instead of the destination bucket")
+	})
+	t.Run("SameSourceAndDestination", func(t *testing.T) {
+		src := newTestLocalBucket(t, contents)
+		assert.Error(t, copyS3Objects(ctx, src, src, s3CopyOptions{SourceKey: "other/three", Move: true}))
+	})
+}
+
+type mockS3CopyClient struct {
+	size      int64
+	failPart  int32
+	copied    []string
+	keys      []string
+	ranges    []string
+	completed int
+	aborted   int
+	mu        sync.Mutex
+}
+
+func (m *mockS3CopyClient) HeadObject(_ context.Context, _ *s3.HeadObjectInput, _ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(m.size), ContentType: aws.String("application/x-gzip")}, nil
+}
+
+func (m *mockS3CopyClient) CopyObject(_ context.Context, in *s3.CopyObjectInput, _ ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.copied = append(m.copied, aws.ToString(in.CopySource))
+	m.keys = append(m.keys, aws.ToString(in.Bucket)+"/"+aws.ToString(in.Key))
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (m *mockS3CopyClient) CreateMultipartUpload(_ context.Context, in *s3.CreateMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	if aws.ToString(in.ContentType) != "application/x-gzip" {
+		return nil, errors.New("content type not kept")
+	}
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload")}, nil
+}
+
+func (m *mockS3CopyClient) UploadPartCopy(_ context.Context, in *s3.UploadPartCopyInput, _ ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error) {
+	if aws.ToInt32(in.PartNumber) == m.failPart {
+		return nil, errors.New("part failed")
+	}
+	m.ranges = append(m.ranges, aws.ToString(in.CopySourceRange))
+	return &s3.UploadPartCopyOutput{CopyPartResult: &types.CopyPartResult{ETag: aws.String("etag")}}, nil
+}
+
+func (m *mockS3CopyClient) CompleteMultipartUpload(_ context.Context, in *s3.CompleteMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	if len(in.MultipartUpload.Parts) != len(m.ranges) {
+		return nil, errors.New("wrong number of parts")
+	}
+	m.completed++
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (m *mockS3CopyClient) AbortMultipartUpload(_ context.Context, _ *s3.AbortMultipartUploadInput, _ ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	m.aborted++
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func TestCopyS3Object(t *testing.T) {
+	ctx := context.Background()
+	in := s3ObjectCopy{SourceBucket: "src", SourceKey: "dir/key", Bucket: "dst", Key: "dir/key"}
+
+	t.Run("Small", func(t *testing.T) {
+		client := &mockS3CopyClient{size: 1024}
+		require.NoError(t, copyS3Object(ctx, client, in))
+		assert.Equal(t, []string{"src/dir%2Fkey"}, client.copied)
+		assert.Empty(t, client.ranges)
+	})
+	t.Run("Large", func(t *testing.T) {
+		client := &mockS3CopyClient{size: s3MaxCopyObjectSize + 1}
+		require.NoError(t, copyS3Object(ctx, client, in))
+		assert.Empty(t, client.copied)
+		require.Len(t, client.ranges, 11)
+		assert.Equal(t, fmt.Sprintf("bytes=0-%d", s3CopyPartSize-1), client.ranges[0])
+		assert.Equal(t, fmt.Sprintf("bytes=%d-%d", s3MaxCopyObjectSize, s3MaxCopyObjectSize), client.ranges[10])
+		assert.Equal(t, 1, client.completed)
+	})
+	t.Run("VeryLarge", func(t *testing.T) {
+		client := &mockS3CopyClient{size: 5 * 1024 * 1024 * 1024 * 1024}
+		require.NoError(t, copyS3Object(ctx, client, in))
+		assert.LessOrEqual(t, len(client.ranges), s3MaxParts)
+	})
+	t.Run("PartFails", func(t *testing.T) {
+		client := &mockS3CopyClient{size: s3MaxCopyObjectSize + 1, failPart: 3}
+		assert.Error(t, copyS3Object(ctx, client, in))
+		assert.Equal(t, 0, client.completed)
+		assert.Equal(t, 1, client.aborted)
+	})
+}
@@ -0,0 +1,137 @@
+package operations
+
+import (
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/mongodb/grip"
+	ignore "github.com/sabhiram/go-gitignore"
+)
+
+// s3SyncFilterOptions describe which keys a sync operation considers.
+// Include and Exclude hold gitignore-style glob patterns, and sizes
+// may have a unit suffix.
+type s3SyncFilterOptions struct {
+	Include      []string
+	Exclude      []string
+	ExcludeRegex string
+	MinSize      string
+	MaxSize      string
+	NewerThan    time.Duration
+	OlderThan    time.Duration
+}
+
+// s3SyncFilter selects the keys that a sync operation transfers or
+// deletes. A nil filter selects every key.
+type s3SyncFilter struct {
+	include      *ignore.GitIgnore
+	exclude      *ignore.GitIgnore
+	excludeRegex *regexp.Regexp
+	minSize      int64
+	maxSize      int64
+	newerThan    time.Time
+	olderThan    time.Time
+}
+
+func newS3SyncFilter(opts s3SyncFilterOptions) (*s3SyncFilter, error) {
+	catcher := grip.NewBasicCatcher()
+	for _, pattern := range append(append([]string{}, opts.Include...), opts.Exclude...) {
+		_, err := path.Match(strings.TrimPrefix(pattern, "!"), "")
+		catcher.Wrapf(err, "invalid pattern '%s'", pattern)
+	}
+	catcher.NewWhen(opts.NewerThan < 0 || opts.OlderThan < 0, "ages must not be negative")
+
+	filter := &s3SyncFilter{}
+	if len(opts.Include) > 0 {
+		filter.include = ignore.CompileIgnoreLines(opts.Include...)
+	}
+	if len(opts.Exclude) > 0 {
+		filter.exclude = ignore.CompileIgnoreLines(opts.Exclude...)
+	}
+	if opts.ExcludeRegex != "" {
+		re, err := regexp.Compile(opts.ExcludeRegex)
+		catcher.Wrap(err, "compiling exclude regex")
+		filter.excludeRegex = re
+	}
+
+	var err error
+	if opts.MinSize != "" {
+		filter.minSize, err = units.RAMInBytes(opts.MinSize)
+		catcher.Wrapf(err, "parsing minimum size '%s'", opts.MinSize)
+	}
+	if opts.MaxSize != "" {
+		filter.maxSize, err = units.RAMInBytes(opts.MaxSize)
+		catcher.Wrapf(err, "parsing maximum size '%s'", opts.MaxSize)
+	}
+	catcher.NewWhen(filter.maxSize > 0 && filter.minSize > filter.maxSize, "minimum size must not exceed maximum size")
+
+	now := time.Now()
+	if opts.NewerThan > 0 {
+		filter.newerThan = now.Add(-opts.NewerThan)
+	}
+	if opts.OlderThan > 0 {
+		filter.olderThan = now.Add(-opts.OlderThan)
+	}
+
+	if catcher.HasErrors() {
+		return nil, catcher.Resolve()
+	}
+
+	return filter, nil
+}
+
+// matchesKey reports whether the key passes the pattern filters.
+func (f *s3SyncFilter) matchesKey(key string) bool {
+	if key == s3ManifestName {
+		return false
+	}
+	if f == nil {
+		return true
+	}
+	if f.include != nil && !f.include.MatchesPath(key) {
+		return false
+	}
+	if f.exclude != nil && f.exclude.MatchesPath(key) {
+		return false
+	}
+	if f.excludeRegex != nil && f.excludeRegex.MatchString(key) {
+		return false
+	}
+
+	return true
+}
+
+// matches reports whether the key and its metadata pass all filters.
+// Sizes and modification times that are unknown (negative or zero)
+// are not filtered on.
+func (f *s3SyncFilter) matches(key string, entry s3ManifestEntry) bool {
+	if !f.matchesKey(key) {
+		return false
+	}
+	if f == nil {
+		return true
+	}
+
+	if entry.Size >= 0 {
+		if f.minSize > 0 && entry.Size < f.minSize {
+			return false
+		}
+		if f.maxSize > 0 && entry.Size > f.maxSize {
+			return false
+		}
+	}
+
+	if !entry.ModTime.IsZero() {
+		if !f.newerThan.IsZero() && entry.ModTime.Before(f.newerThan) {
+			return false
+		}
+		if !f.olderThan.IsZero() && entry.ModTime.After(f.olderThan) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,109 @@
+package operations
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/pail"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestS3SyncFilterPatterns(t *testing.T) {
+	filter, err := newS3SyncFilter(s3SyncFilterOptions{
+		Include:      []string{"*.txt", "bin/"},
+		Exclude:      []string{"tmp/", "!tmp/keep.txt"},
+		ExcludeRegex: `^secret`,
+	})
+	require.NoError(t, err)
+
+	for key, expected := range map[string]bool{
+		"a.txt":          true,
+		"dir/b.txt":      true,
+		"bin/curator":    true,
+		"c.log":          false,
+		"tmp/d.txt":      false,
+		"secret.txt":     false,
+		s3ManifestName:   false,
+		"dir/sub/e.json": false,
+	} {
+		assert.Equal(t, expected, filter.matchesKey(key), key)
+	}
+
+	var none *s3SyncFilter
+	assert.True(t, none.matchesKey("anything"))
+	assert.False(t, none.matchesKey(s3ManifestName))
+}
+
+func TestS3SyncFilterSizeAndAge(t *testing.T) {
+	filter, err := newS3SyncFilter(s3SyncFilterOptions{
+		MinSize:   "1k",
+		MaxSize:   "1MB",
+		NewerThan: 48 * time.Hour,
+		OlderThan: time.Hour,
+	})
+	require.NoError(t, err)
+
+	now := time.Now()
+	assert.True(t, filter.matches("a", s3ManifestEntry{Size: 2048, ModTime: now.Add(-2 * time.Hour)}))
+	assert.False(t, filter.matches("a", s3ManifestEntry{Size: 512, ModTime: now.Add(-2 * time.Hour)}))
+	assert.False(t, filter.matches("a", s3ManifestEntry{Size: 2 << 20, ModTime: now.Add(-2 * time.Hour)}))
+	assert.False(t, filter.matches("a", s3ManifestEntry{Size: 2048, ModTime: now.Add(-72 * time.Hour)}))
+	assert.False(t, filter.matches("a", s3ManifestEntry{Size: 2048, ModTime: now}))
+	assert.True(t, filter.matches("a", s3ManifestEntry{Size: -1}), "unknown metadata is not filtered")
+}
+
+func TestS3SyncFilterValidation(t *testing.T) {
+	for name, opts := range map[string]s3SyncFilterOptions{
+		"BadGlob":     {Include: []string{"[a-"}},
+		"BadRegex":    {ExcludeRegex: "("},
+		"BadSize":     {MinSize: "lots"},
+		"SizeRange":   {MinSize: "2M", MaxSize: "1M"},
+		"NegativeAge": {OlderThan: -time.Hour},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := newS3SyncFilter(opts)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestS3SyncFilterDelete(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src := t.TempDir()
+	bucket, err := pail.NewLocalBucket(pail.LocalOptions{Path: t.TempDir(), UseSlash: true})
+	require.NoError(t, err)
+
+	writeTestFiles(t, src, map[string]string{
+		"keep.txt":   "keep",
+		"remove.txt": "remove",
+		"other.log":  "other",
+	})
+	opts := s3SyncOptions{Local: src, Remote: "prefix", Delete: true, Manifest: true}
+	require.NoError(t, pushS3Sync(ctx, bucket, opts, newS3SyncReport("push", "test", opts)))
+
+	require.NoError(t, os.Remove(filepath.Join(src, "remove.txt")))
+	require.NoError(t, os.Remove(filepath.Join(src, "other.log")))
+	opts.Filter, err = newS3SyncFilter(s3SyncFilterOptions{Include: []string{"*.txt"}})
+	require.NoError(t, err)
+	report := newS3SyncReport("push", "test", opts)
+	require.NoError(t, pushS3Sync(ctx, bucket, opts, report))
+	assert.Equal(t, 1, report.Totals[s3SyncDeleted].Count)
+	assert.Equal(t, 1, report.Totals[s3SyncSkipped].Count)
+
+	exists, err := bucket.Exists(ctx, "prefix/remove.txt")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	exists, err = bucket.Exists(ctx, "prefix/other.log")
+	require.NoError(t, err)
+	assert.True(t, exists, "keys that do not pass the filter are not deleted")
+
+	manifest, err := fetchRemoteManifest(ctx, bucket, "prefix")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"keep.txt", "other.log"}, manifest.keys())
+}
@@ -0,0 +1,379 @@
+package operations
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/evergreen-ci/utility"
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+)
+
+const (
+	// s3ChecksumMismatchExitCode is the exit code of "s3 get" when the
+	// downloaded file does not match the expected checksum.
+	s3ChecksumMismatchExitCode = 3
+
+	s3VerifyETag   = "etag"
+	s3VerifySHA256 = "sha256"
+	s3VerifyNone   = "none"
+)
+
+// s3ObjectGetter is the subset of the S3 client used to download
+// objects, which allows the download logic to be tested without S3.
+type s3ObjectGetter interface {
+	HeadObject(context.Context, *s3.HeadObjectInput, ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	GetObject(context.Context, *s3.GetObjectInput, ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// checksumMismatchError reports that a downloaded file does not
+// match the checksum published for the object.
+type checksumMismatchError struct {
+	key      string
+	method   string
+	expected string
+	actual   string
+}
+
+func (e *checksumMismatchError) Error() string {
+	return fmt.Sprintf("checksum mismatch for '%s' using %s: expected '%s', got '%s'", e.key, e.method, e.expected, e.actual)
+}
+
+type s3DownloadOptions struct {
+	Bucket string
+	Key    string
+	Path   string
+	Verify string
+	Resume bool
+	DryRun bool
+}
+
+func (opts *s3DownloadOptions) validate() error {
+	catcher := grip.NewBasicCatcher()
+	catcher.NewWhen(opts.Bucket == "", "must specify a bucket")
+	catcher.NewWhen(opts.Key == "", "must specify an object name")
+	catcher.NewWhen(opts.Path == "", "must specify a local file")
+
+	switch opts.Verify {
+	case "":
+		opts.Verify = s3VerifyETag
+	case s3VerifyETag, s3VerifySHA256, s3VerifyNone:
+	default:
+		catcher.Errorf("invalid verification method '%s'", opts.Verify)
+	}
+
+	return catcher.Resolve()
+}
+
+// verifiedS3Download downloads an object into a partial file named
+// after its ETag, resuming from the end of an existing partial file
+// with a ranged GET. The file is moved into place only once it passes
+// verification.
+func verifiedS3Download(ctx context.Context, client s3ObjectGetter, opts s3DownloadOptions) error {
+	if err := opts.validate(); err != nil {
+		return errors.Wrap(err, "invalid download options")
+	}
+
+	head, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(opts.Bucket),
+		Key:    aws.String(opts.Key),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "getting metadata for '%s'", opts.Key)
+	}
+	etag := strings.Trim(aws.ToString(head.ETag), `"`)
+	size := aws.ToInt64(head.ContentLength)
+
+	if opts.DryRun {
+		grip.Info(message.Fields{
+			"message": "would download object",
+			"bucket":  opts.Bucket,
+			"key":     opts.Key,
+			"path":    opts.Path,
+			"size":    size,
+		})
+		return nil
+	}
+
+	partial := fmt.Sprintf("%s.%s.partial", opts.Path, etag)
+	removeStaleS3Partials(opts.Path, partial)
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	var offset int64
+	if info, err := os.Stat(partial); opts.Resume && etag != "" && err == nil && info.Size() <= size {
+		offset = info.Size()
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+
+	if offset < size || size == 0 {
+		if err = downloadS3Range(ctx, client, opts, etag, partial, flags, offset); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	verify := func(path string) error {
+		err := verifyS3Download(ctx, client, opts, head, path)
+		if _, ok := errors.Cause(err).(*checksumMismatchError); ok {
+			grip.Warning(message.WrapError(os.Remove(path), message.Fields{
+				"message": "removing partial download that failed verification",
+				"path":    path,
+			}))
+		}
+		return errors.WithStack(err)
+	}
+
+	// objects stored with gzip content encoding, such as the ones
+	// that "s3 put" compresses, are decoded like pail did. The ETag is
+	// the checksum of the stored bytes, so it's verified before
+	// decoding, while a sidecar checksum is of the decoded file.
+	if !strings.EqualFold(aws.ToString(head.ContentEncoding), "gzip") {
+		if err = verify(partial); err != nil {
+			return err
+		}
+		return errors.Wrapf(os.Rename(partial, opts.Path), "moving download into place at '%s'", opts.Path)
+	}
+
+	if opts.Verify == s3VerifyETag {
+		if err = verify(partial); err != nil {
+			return err
+		}
+	}
+	decoded := fmt.Sprintf("%s.%s.decoded", opts.Path, etag)
+	if err = decodeS3Download(partial, decoded); err != nil {
+		return errors.WithStack(err)
+	}
+	if opts.Verify == s3VerifySHA256 {
+		if err = verify(decoded); err != nil {
+			return err
+		}
+	}
+	if err = os.Rename(decoded, opts.Path); err != nil {
+		return errors.Wrapf(err, "moving download into place at '%s'", opts.Path)
+	}
+
+	return errors.Wrapf(os.Remove(partial), "removing partial download '%s'", partial)
+}
+
+// removeStaleS3Partials removes the partial and decoded downloads for
+// the path that were left behind by an earlier attempt, such as for an
+// earlier version of the object, which can never be resumed.
+func removeStaleS3Partials(path, current string) {
+	prefix := filepath.Base(path) + "."
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		fn := filepath.Join(filepath.Dir(path), name)
+		stale := strings.HasSuffix(name, ".partial") || strings.HasSuffix(name, ".decoded")
+		if entry.IsDir() || fn == current || !strings.HasPrefix(name, prefix) || !stale {
+			continue
+		}
+
+		grip.Info(message.WrapError(os.Remove(fn), message.Fields{
+			"message": "removing partial download of an earlier version of the object",
+			"path":    fn,
+		}))
+	}
+}
+
+// decodeS3Download writes the gzip encoded content of the file to the
+// path.
+func decodeS3Download(path, decoded string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "opening file '%s'", path)
+	}
+	defer func() { grip.Warning(in.Close()) }()
+
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return errors.Wrapf(err, "decoding '%s'", path)
+	}
+
+	out, err := os.Create(decoded)
+	if err != nil {
+		return errors.Wrapf(err, "creating file '%s'", decoded)
+	}
+
+	catcher := grip.NewBasicCatcher()
+	_, err = io.Copy(out, gz)
+	catcher.Wrapf(err, "decoding '%s'", path)
+	catcher.Wrapf(gz.Close(), "decoding '%s'", path)
+	catcher.Wrapf(out.Close(), "closing file '%s'", decoded)
+	if catcher.HasErrors() {
+		grip.Warning(os.Remove(decoded))
+	}
+
+	return catcher.Resolve()
+}
+
+func downloadS3Range(ctx context.Context, client s3ObjectGetter, opts s3DownloadOptions, etag, path string, flags int, offset int64) error {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(opts.Bucket),
+		Key:    aws.String(opts.Key),
+	}
+	if etag != "" {
+		input.IfMatch = aws.String(etag)
+	}
+	if offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+		grip.Info(message.Fields{
+			"message": "resuming partial download",
+			"key":     opts.Key,
+			"path":    path,
+			"offset":  offset,
+		})
+	}
+
+	out, err := client.GetObject(ctx, input)
+	if err != nil {
+		return errors.Wrapf(err, "getting object '%s'", opts.Key)
+	}
+	defer func() { grip.Warning(out.Body.Close()) }()
+
+	file, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "opening file '%s'", path)
+	}
+
+	catcher := grip.NewBasicCatcher()
+	_, err = io.Copy(file, out.Body)
+	catcher.Wrapf(err, "writing object '%s' to '%s'", opts.Key, path)
+	catcher.Wrapf(file.Close(), "closing file '%s'", path)
+
+	return catcher.Resolve()
+}
+
+func verifyS3Download(ctx context.Context, client s3ObjectGetter, opts s3DownloadOptions, head *s3.HeadObjectOutput, path string) error {
+	switch opts.Verify {
+	case s3VerifyNone:
+		return nil
+	case s3VerifySHA256:
+		expected, err := getS3SidecarChecksum(ctx, client, opts.Bucket, opts.Key+".sha256")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		actual, err := utility.ChecksumFile(sha256.New(), path)
+		if err != nil {
+			return errors.Wrapf(err, "computing sha256 checksum of '%s'", path)
+		}
+		if !strings.EqualFold(expected, actual) {
+			return &checksumMismatchError{key: opts.Key, method: s3VerifySHA256, expected: expected, actual: actual}
+		}
+		return nil
+	default:
+		if head.ServerSideEncryption == types.ServerSideEncryptionAwsKms || head.ServerSideEncryption == types.ServerSideEncryptionAwsKmsDsse {
+			grip.Warning(message.Fields{
+				"message": "cannot verify the etag of a KMS encrypted object",
+				"key":     opts.Key,
+			})
+			return nil
+		}
+
+		expected := strings.Trim(aws.ToString(head.ETag), `"`)
+		actual, err := computeS3ETag(ctx, client, opts, expected, path)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if expected != actual {
+			return &checksumMismatchError{key: opts.Key, method: s3VerifyETag, expected: expected, actual: actual}
+		}
+		return nil
+	}
+}
+
+// computeS3ETag computes the ETag S3 would report for the file. For
+// multipart uploads, the ETag is the MD5 of the concatenated part
+// MD5s followed by the number of parts, so the part size is read from
+// the metadata of the first part.
+func computeS3ETag(ctx context.Context, client s3ObjectGetter, opts s3DownloadOptions, etag, path string) (string, error) {
+	idx := strings.LastIndex(etag, "-")
+	if idx < 0 {
+		sum, err := utility.MD5SumFile(path)
+		return sum, errors.Wrapf(err, "computing md5 checksum of '%s'", path)
+	}
+
+	parts, err := strconv.Atoi(etag[idx+1:])
+	if err != nil || parts < 1 {
+		return "", errors.Errorf("invalid part count in etag '%s'", etag)
+	}
+
+	head, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:     aws.String(opts.Bucket),
+		Key:        aws.String(opts.Key),
+		PartNumber: aws.Int32(1),
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "getting part metadata for '%s'", opts.Key)
+	}
+	partSize := aws.ToInt64(head.ContentLength)
+	if partSize <= 0 {
+		return "", errors.Errorf("invalid part size %d for '%s'", partSize, opts.Key)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "opening file '%s'", path)
+	}
+	defer func() { grip.Warning(file.Close()) }()
+
+	digests := md5.New()
+	count := 0
+	for {
+		part := md5.New()
+		n, err := io.CopyN(part, file, partSize)
+		if err != nil && err != io.EOF {
+			return "", errors.Wrapf(err, "reading file '%s'", path)
+		}
+		if n == 0 {
+			break
+		}
+		_, _ = digests.Write(part.Sum(nil))
+		count++
+		if n < partSize {
+			break
+		}
+	}
+
+	return fmt.Sprintf("%x-%d", digests.Sum(nil), count), nil
+}
+
+// getS3SidecarChecksum reads a checksum file in the format written by
+// sha256sum, where the digest is the first field.
+func getS3SidecarChecksum(ctx context.Context, client s3ObjectGetter, bucket, key string) (string, error) {
+	out, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "getting checksum file '%s'", key)
+	}
+	defer func() { grip.Warning(out.Body.Close()) }()
+
+	scanner := bufio.NewScanner(out.Body)
+	if !scanner.Scan() && scanner.Err() != nil {
+		return "", errors.Wrapf(scanner.Err(), "reading checksum file '%s'", key)
+	}
+	fields := strings.Fields(scanner.Text())
+	if len(fields) == 0 {
+		return "", errors.Errorf("checksum file '%s' is empty", key)
+	}
+
+	return fields[0], nil
+}
@@ -0,0 +1,207 @@
+package operations
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockS3Object struct {
+	data     []byte
+	etag     string
+	partSize int64
+	encoding string
+}
+
+type mockS3ObjectGetter struct {
+	objects map[string]mockS3Object
+	ranges  []string
+}
+
+func (m *mockS3ObjectGetter) HeadObject(_ context.Context, in *s3.HeadObjectInput, _ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	obj, ok := m.objects[aws.ToString(in.Key)]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+
+	size := int64(len(obj.data))
+	if in.PartNumber != nil && obj.partSize > 0 {
+		size = obj.partSize
+	}
+	out := &s3.HeadObjectOutput{ETag: aws.String(`"` + obj.etag + `"`), ContentLength: aws.Int64(size)}
+	if obj.encoding != "" {
+		out.ContentEncoding = aws.String(obj.encoding)
+	}
+	return out, nil
+}
+
+func (m *mockS3ObjectGetter) GetObject(_ context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	obj, ok := m.objects[aws.ToString(in.Key)]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	if in.IfMatch != nil && aws.ToString(in.IfMatch) != obj.etag {
+		return nil, errors.New("precondition failed")
+	}
+
+	data := obj.data
+	if in.Range != nil {
+		m.ranges = append(m.ranges, aws.ToString(in.Range))
+		var offset int
+		_, err := fmt.Sscanf(aws.ToString(in.Range), "bytes=%d-", &offset)
+		if err != nil {
+			return nil, err
+		}
+		data = data[offset:]
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func newMockS3Object(data string) mockS3Object {
+	return mockS3Object{data: []byte(data), etag: fmt.Sprintf("%x", md5.Sum([]byte(data)))}
+}
+
+func TestVerifiedS3Download(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	content := strings.Repeat("curator", 100)
+	sha := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+
+	t.Run("ETag", func(t *testing.T) {
+		client := &mockS3ObjectGetter{objects: map[string]mockS3Object{"key": newMockS3Object(content)}}
+		path := filepath.Join(t.TempDir(), "out")
+
+		require.NoError(t, verifiedS3Download(ctx, client, s3DownloadOptions{Bucket: "b", Key: "key", Path: path, Resume: true}))
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(data))
+		assert.Empty(t, client.ranges)
+	})
+	t.Run("Resume", func(t *testing.T) {
+		obj := newMockS3Object(content)
+		client := &mockS3ObjectGetter{objects: map[string]mockS3Object{"key": obj}}
+		path := filepath.Join(t.TempDir(), "out")
+		require.NoError(t, os.WriteFile(fmt.Sprintf("%s.%s.partial", path, obj.etag), []byte(content[:100]), 0644))
+
+		require.NoError(t, verifiedS3Download(ctx, client, s3DownloadOptions{Bucket: "b", Key: "key", Path: path, Resume: true}))
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(data))
+		assert.Equal(t, []string{"bytes=100-"}, client.ranges)
+	})
+	t.Run("RemovesStalePartials", func(t *testing.T) {
+		obj := newMockS3Object(content)
+		client := &mockS3ObjectGetter{objects: map[string]mockS3Object{"key": obj}}
+		dir := t.TempDir()
+		path := filepath.Join(dir, "out")
+		stale := filepath.Join(dir, "out.0123456789abcdef.partial")
+		unrelated := filepath.Join(dir, "other.0123456789abcdef.partial")
+		require.NoError(t, os.WriteFile(stale, []byte("old"), 0644))
+		require.NoError(t, os.WriteFile(unrelated, []byte("old"), 0644))
+
+		require.NoError(t, verifiedS3Download(ctx, client, s3DownloadOptions{Bucket: "b", Key: "key", Path: path, Resume: true}))
+		assert.NoFileExists(t, stale)
+		assert.FileExists(t, unrelated)
+	})
+	t.Run("Gzip", func(t *testing.T) {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		_, err := gz.Write([]byte(content))
+		require.NoError(t, err)
+		require.NoError(t, gz.Close())
+
+		obj := newMockS3Object(buf.String())
+		obj.encoding = "gzip"
+		client := &mockS3ObjectGetter{objects: map[string]mockS3Object{
+			"key":        obj,
+			"key.sha256": newMockS3Object(sha + "  key\n"),
+		}}
+
+		for _, verify := range []string{s3VerifyETag, s3VerifySHA256} {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "out")
+			require.NoError(t, verifiedS3Download(ctx, client, s3DownloadOptions{Bucket: "b", Key: "key", Path: path, Verify: verify}), verify)
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+			assert.Equal(t, content, string(data), verify)
+
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			assert.Len(t, entries, 1, "no partial or decoded files are left behind")
+		}
+	})
+	t.Run("NoResumeRestarts", func(t *testing.T) {
+		obj := newMockS3Object(content)
+		client := &mockS3ObjectGetter{objects: map[string]mockS3Object{"key": obj}}
+		path := filepath.Join(t.TempDir(), "out")
+		require.NoError(t, os.WriteFile(fmt.Sprintf("%s.%s.partial", path, obj.etag), []byte("garbage"), 0644))
+
+		require.NoError(t, verifiedS3Download(ctx, client, s3DownloadOptions{Bucket: "b", Key: "key", Path: path}))
+		assert.Empty(t, client.ranges)
+	})
+	t.Run("Mismatch", func(t *testing.T) {
+		obj := newMockS3Object(content)
+		obj.etag = "0123456789abcdef"
+		client := &mockS3ObjectGetter{objects: map[string]mockS3Object{"key": obj}}
+		path := filepath.Join(t.TempDir(), "out")
+
+		err := verifiedS3Download(ctx, client, s3DownloadOptions{Bucket: "b", Key: "key", Path: path})
+		require.Error(t, err)
+		_, ok := errors.Cause(err).(*checksumMismatchError)
+		assert.True(t, ok)
+
+		_, err = os.Stat(path)
+		assert.True(t, os.IsNotExist(err))
+		_, err = os.Stat(fmt.Sprintf("%s.%s.partial", path, obj.etag))
+		assert.True(t, os.IsNotExist(err))
+	})
+	t.Run("SHA256Sidecar", func(t *testing.T) {
+		client := &mockS3ObjectGetter{objects: map[string]mockS3Object{
+			"key":        {data: []byte(content), etag: "not-an-md5"},
+			"key.sha256": newMockS3Object(sha + "  key\n"),
+		}}
+		path := filepath.Join(t.TempDir(), "out")
+
+		require.NoError(t, verifiedS3Download(ctx, client, s3DownloadOptions{Bucket: "b", Key: "key", Path: path, Verify: s3VerifySHA256}))
+
+		client.objects["key.sha256"] = newMockS3Object("deadbeef")
+		err := verifiedS3Download(ctx, client, s3DownloadOptions{Bucket: "b", Key: "key", Path: path, Verify: s3VerifySHA256})
+		_, ok := errors.Cause(err).(*checksumMismatchError)
+		assert.True(t, ok)
+	})
+	t.Run("MultipartETag", func(t *testing.T) {
+		digests := md5.New()
+		for i := 0; i < len(content); i += 256 {
+			end := i + 256
+			if end > len(content) {
+				end = len(content)
+			}
+			sum := md5.Sum([]byte(content[i:end]))
+			_, _ = digests.Write(sum[:])
+		}
+		obj := mockS3Object{data: []byte(content), etag: fmt.Sprintf("%x-3", digests.Sum(nil)), partSize: 256}
+		client := &mockS3ObjectGetter{objects: map[string]mockS3Object{"key": obj}}
+		path := filepath.Join(t.TempDir(), "out")
+
+		require.NoError(t, verifiedS3Download(ctx, client, s3DownloadOptions{Bucket: "b", Key: "key", Path: path}))
+	})
+	t.Run("InvalidVerify", func(t *testing.T) {
+		client := &mockS3ObjectGetter{}
+		assert.Error(t, verifiedS3Download(ctx, client, s3DownloadOptions{Bucket: "b", Key: "key", Path: "out", Verify: "crc"}))
+	})
+}
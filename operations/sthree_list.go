@@ -0,0 +1,223 @@
+package operations
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+func s3ListCmd() cli.Command {
+	return cli.Command{
+		Name:    "ls",
+		Aliases: []string{"list"},
+		Usage:   "list objects in s3 with their size, modification time and etag",
+		Flags:   baseS3Flags(s3listFlags()...),
+		Action: func(c *cli.Context) error {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			if err := setVerboseLogging(c.Bool("verbose")); err != nil {
+				return err
+			}
+
+			objects, err := listMatchingS3Objects(ctx, c)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			if c.Bool("json") {
+				return errors.WithStack(writeJSON(os.Stdout, objects))
+			}
+			return errors.WithStack(writeS3ObjectTable(os.Stdout, objects))
+		},
+	}
+}
+
+func s3DiskUsageCmd() cli.Command {
+	return cli.Command{
+		Name:  "du",
+		Usage: "summarize the size of objects in s3, grouped by prefix",
+		Flags: baseS3Flags(s3listFlags(
+			cli.IntFlag{
+				Name:  "depth",
+				Usage: "number of key path components below the prefix to group sizes by",
+			})...),
+		Action: func(c *cli.Context) error {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			if err := setVerboseLogging(c.Bool("verbose")); err != nil {
+				return err
+			}
+
+			if c.Int("depth") < 0 {
+				return errors.New("depth must not be negative")
+			}
+
+			objects, err := listMatchingS3Objects(ctx, c)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			usage := summarizeS3Usage(objects, c.String("prefix"), c.Int("depth"))
+			if c.Bool("json") {
+				return errors.WithStack(writeJSON(os.Stdout, usage))
+			}
+			return errors.WithStack(writeS3UsageTable(os.Stdout, usage))
+		},
+	}
+}
+
+// s3UsageSummary reports the total size and number of objects under
+// a key prefix.
+type s3UsageSummary struct {
+	Prefix  string `json:"prefix"`
+	Objects int    `json:"objects"`
+	Size    int64  `json:"size"`
+}
+
+func listMatchingS3Objects(ctx context.Context, c *cli.Context) ([]s3ObjectInfo, error) {
+	var match *regexp.Regexp
+	if expr := c.String("match"); expr != "" {
+		var err error
+		match, err = regexp.Compile(expr)
+		if err != nil {
+			return nil, errors.Wrap(err, "compiling match regex")
+		}
+	}
+
+	client, err := s3ClientFromFlags(ctx, c)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	objects, err := listS3Objects(ctx, client, c.String("bucket"), c.String("prefix"))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return filterS3Objects(objects, match), nil
+}
+
+// filterS3Objects returns only the objects whose keys match the
+// expression. A nil expression matches every object.
+func filterS3Objects(objects []s3ObjectInfo, match *regexp.Regexp) []s3ObjectInfo {
+	if match == nil {
+		return objects
+	}
+
+	out := []s3ObjectInfo{}
+	for _, obj := range objects {
+		if match.MatchString(obj.Key) {
+			out = append(out, obj)
+		}
+	}
+	return out
+}
+
+// summarizeS3Usage groups objects by their key, truncated to the
+// given number of path components after the prefix. Objects that
+// have fewer components are counted in their containing prefix.
+func summarizeS3Usage(objects []s3ObjectInfo, prefix string, depth int) []s3UsageSummary {
+	groups := map[string]*s3UsageSummary{}
+	for _, obj := range objects {
+		rest := strings.TrimPrefix(obj.Key, prefix)
+		idx := 0
+		if strings.HasPrefix(rest, "/") {
+			idx = 1
+		}
+		for i := 0; i < depth; i++ {
+			next := strings.Index(rest[idx:], "/")
+			if next < 0 {
+				break
+			}
+			idx += next + 1
+		}
+
+		group := obj.Key[:len(obj.Key)-len(rest)+idx]
+		summary, ok := groups[group]
+		if !ok {
+			summary = &s3UsageSummary{Prefix: group}
+			groups[group] = summary
+		}
+		summary.Objects++
+		summary.Size += obj.Size
+	}
+
+	out := make([]s3UsageSummary, 0, len(groups))
+	for _, summary := range groups {
+		out = append(out, *summary)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Prefix < out[j].Prefix })
+
+	return out
+}
+
+func writeJSON(w io.Writer, data interface{}) error {
+	out, err := json.MarshalIndent(data, "", "   ")
+	if err != nil {
+		return errors.Wrap(err, "marshalling JSON")
+	}
+
+	_, err = fmt.Fprintln(w, string(out))
+	return errors.WithStack(err)
+}
+
+func writeS3ObjectTable(w io.Writer, objects []s3ObjectInfo) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tSIZE\tLAST MODIFIED\tETAG")
+
+	var total int64
+	for _, obj := range objects {
+		total += obj.Size
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", obj.Key, obj.Size, obj.LastModified.UTC().Format(time.RFC3339), obj.ETag)
+	}
+	fmt.Fprintf(tw, "total: %d objects\t%d\t\t\n", len(objects), total)
+
+	return errors.WithStack(tw.Flush())
+}
+
+func writeS3UsageTable(w io.Writer, usage []s3UsageSummary) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SIZE\tOBJECTS\tPREFIX")
+
+	var total int64
+	var count int
+	for _, summary := range usage {
+		total += summary.Size
+		count += summary.Objects
+		fmt.Fprintf(tw, "%d\t%d\t%s\n", summary.Size, summary.Objects, summary.Prefix)
+	}
+	fmt.Fprintf(tw, "%d\t%d\ttotal\n", total, count)
+
+	return errors.WithStack(tw.Flush())
+}
+
+func s3listFlags(args ...cli.Flag) []cli.Flag {
+	flags := []cli.Flag{
+		cli.StringFlag{
+			Name:  "prefix",
+			Usage: "prefix of s3 key names",
+		},
+		cli.StringFlag{
+			Name:  "match",
+			Usage: "a regular expression definition, to select keys as with delete-match",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "specify this option to output data as JSON",
+		},
+	}
+
+	return append(flags, args...)
+}
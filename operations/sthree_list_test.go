@@ -0,0 +1,76 @@
+package operations
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testS3Objects() []s3ObjectInfo {
+	now := time.Now()
+	return []s3ObjectInfo{
+		{Key: "builds/a/one.tgz", Size: 10, LastModified: now, ETag: "1"},
+		{Key: "builds/a/sub/two.tgz", Size: 20, LastModified: now, ETag: "2"},
+		{Key: "builds/b/three.txt", Size: 30, LastModified: now, ETag: "3"},
+		{Key: "builds/top.json", Size: 40, LastModified: now, ETag: "4"},
+	}
+}
+
+func TestFilterS3Objects(t *testing.T) {
+	objects := testS3Objects()
+	assert.Equal(t, objects, filterS3Objects(objects, nil))
+
+	filtered := filterS3Objects(objects, regexp.MustCompile(`\.tgz$`))
+	require.Len(t, filtered, 2)
+	assert.Equal(t, "builds/a/one.tgz", filtered[0].Key)
+	assert.Equal(t, "builds/a/sub/two.tgz", filtered[1].Key)
+}
+
+func TestSummarizeS3Usage(t *testing.T) {
+	objects := testS3Objects()
+
+	t.Run("ZeroDepth", func(t *testing.T) {
+		usage := summarizeS3Usage(objects, "builds", 0)
+		assert.Equal(t, []s3UsageSummary{{Prefix: "builds/", Objects: 4, Size: 100}}, usage)
+	})
+	t.Run("OneLevel", func(t *testing.T) {
+		usage := summarizeS3Usage(objects, "builds", 1)
+		assert.Equal(t, []s3UsageSummary{
+			{Prefix: "builds/", Objects: 1, Size: 40},
+			{Prefix: "builds/a/", Objects: 2, Size: 30},
+			{Prefix: "builds/b/", Objects: 1, Size: 30},
+		}, usage)
+	})
+	t.Run("TrailingSlashPrefix", func(t *testing.T) {
+		usage := summarizeS3Usage(objects, "builds/", 2)
+		assert.Equal(t, []s3UsageSummary{
+			{Prefix: "builds/", Objects: 1, Size: 40},
+			{Prefix: "builds/a/", Objects: 1, Size: 10},
+			{Prefix: "builds/a/sub/", Objects: 1, Size: 20},
+			{Prefix: "builds/b/", Objects: 1, Size: 30},
+		}, usage)
+	})
+}
+
+func TestS3ListingOutput(t *testing.T) {
+	objects := testS3Objects()
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, writeS3ObjectTable(buf, objects))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, len(objects)+2)
+	assert.Contains(t, lines[len(lines)-1], "100")
+
+	buf.Reset()
+	require.NoError(t, writeJSON(buf, objects))
+	var decoded []s3ObjectInfo
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Len(t, decoded, len(objects))
+	assert.Equal(t, objects[0].Key, decoded[0].Key)
+}
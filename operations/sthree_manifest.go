@@ -0,0 +1,371 @@
+package operations
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/evergreen-ci/pail"
+	"github.com/evergreen-ci/utility"
+	"github.com/mongodb/grip"
+	"github.com/pkg/errors"
+)
+
+// s3ManifestName is the name of the manifest object, which is stored
+// directly under the remote prefix of a manifest-mode sync.
+const s3ManifestName = ".curator-manifest.json"
+
+// s3Manifest records the state of a synced tree, so that sync
+// operations can find changed files by fetching a single object
+// rather than checking every key in the prefix.
+type s3Manifest struct {
+	CreatedAt time.Time                  `json:"created_at"`
+	Entries   map[string]s3ManifestEntry `json:"entries"`
+}
+
+type s3ManifestEntry struct {
+	Size    int64     `json:"size"`
+	MD5     string    `json:"md5"`
+	ModTime time.Time `json:"mtime"`
+}
+
+func newS3Manifest() *s3Manifest {
+	return &s3Manifest{
+		CreatedAt: time.Now(),
+		Entries:   map[string]s3ManifestEntry{},
+	}
+}
+
+// keys returns the names of all entries in the manifest in sorted
+// order.
+func (m *s3Manifest) keys() []string {
+	out := make([]string, 0, len(m.Entries))
+	for k := range m.Entries {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// changed returns the keys in this manifest that are either missing
+// from or have a different checksum in the other manifest. Entries
+// without a checksum are always considered changed.
+func (m *s3Manifest) changed(other *s3Manifest) []string {
+	out := []string{}
+	for _, k := range m.keys() {
+		entry, ok := other.Entries[k]
+		if !ok || entry.MD5 == "" || entry.MD5 != m.Entries[k].MD5 {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// unchanged returns the keys in this manifest that have the same
+// checksum in the other manifest.
+func (m *s3Manifest) unchanged(other *s3Manifest) []string {
+	out := []string{}
+	for _, k := range m.keys() {
+		entry, ok := other.Entries[k]
+		if ok && entry.MD5 != "" && entry.MD5 == m.Entries[k].MD5 {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// filter returns a manifest with only the entries that pass the
+// filter.
+func (m *s3Manifest) filter(f *s3SyncFilter) *s3Manifest {
+	out := &s3Manifest{
+		CreatedAt: m.CreatedAt,
+		Entries:   make(map[string]s3ManifestEntry, len(m.Entries)),
+	}
+	for k, entry := range m.Entries {
+		if f.matches(k, entry) {
+			out.Entries[k] = entry
+		}
+	}
+	return out
+}
+
+// filterKeys returns a manifest with only the entries whose keys pass
+// the filter's patterns, regardless of their size and age.
+func (m *s3Manifest) filterKeys(f *s3SyncFilter) *s3Manifest {
+	out := &s3Manifest{
+		CreatedAt: m.CreatedAt,
+		Entries:   make(map[string]s3ManifestEntry, len(m.Entries)),
+	}
+	for k, entry := range m.Entries {
+		if f.matchesKey(k) {
+			out.Entries[k] = entry
+		}
+	}
+	return out
+}
+
+// missing returns the keys in the other manifest that do not exist in
+// this manifest.
+func (m *s3Manifest) missing(other *s3Manifest) []string {
+	out := []string{}
+	for _, k := range other.keys() {
+		if _, ok := m.Entries[k]; !ok {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// s3MultipartPartSizes are the part sizes that common S3 clients use
+// for multipart uploads, to try when checking a file against a
+// multipart ETag.
+var s3MultipartPartSizes = []int64{5 << 20, 8 << 20, 15 << 20, 16 << 20, 64 << 20, 100 << 20}
+
+// matchMultipartETags replaces the multipart ETag of each entry with
+// the MD5 checksum of the file in the local tree, if the file has the
+// content that the ETag describes. The ETags of objects uploaded in
+// parts are not checksums of their content, so the entries would
+// otherwise never match the local tree.
+func (m *s3Manifest) matchMultipartETags(local *s3Manifest, root string) error {
+	for _, key := range m.keys() {
+		entry := m.Entries[key]
+		parts := s3MultipartETagParts(entry.MD5)
+		if parts == 0 {
+			continue
+		}
+
+		localEntry, ok := local.Entries[key]
+		if !ok || localEntry.MD5 == "" || (entry.Size >= 0 && entry.Size != localEntry.Size) {
+			continue
+		}
+
+		match, err := matchesMultipartETag(filepath.Join(root, filepath.FromSlash(key)), localEntry.Size, entry.MD5, parts)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if match {
+			entry.MD5 = localEntry.MD5
+			m.Entries[key] = entry
+		}
+	}
+
+	return nil
+}
+
+// s3MultipartETagParts returns the number of parts in a multipart
+// ETag, which has the form "<checksum>-<parts>", or 0 if the ETag is
+// a checksum of the content.
+func s3MultipartETagParts(etag string) int64 {
+	idx := strings.LastIndex(etag, "-")
+	if idx < 0 {
+		return 0
+	}
+
+	parts, err := strconv.ParseInt(etag[idx+1:], 10, 64)
+	if err != nil || parts < 1 {
+		return 0
+	}
+
+	return parts
+}
+
+// matchesMultipartETag reports whether the file, uploaded in the
+// number of parts with any likely part size, would have the ETag.
+func matchesMultipartETag(path string, size int64, etag string, parts int64) (bool, error) {
+	// also try the smallest part size, in whole megabytes, that
+	// splits the file into that many parts
+	candidates := append([]int64{}, s3MultipartPartSizes...)
+	candidates = append(candidates, ((size+parts-1)/parts+(1<<20)-1)>>20<<20)
+
+	seen := map[int64]bool{}
+	for _, partSize := range candidates {
+		if partSize <= 0 || seen[partSize] || (size+partSize-1)/partSize != parts {
+			continue
+		}
+		seen[partSize] = true
+
+		sum, err := multipartETag(path, partSize)
+		if err != nil {
+			return false, errors.WithStack(err)
+		}
+		if sum == etag {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// multipartETag computes the ETag that S3 gives the file when it's
+// uploaded in parts of the size: the checksum of the checksums of the
+// parts, followed by the number of parts.
+func multipartETag(path string, partSize int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "opening '%s'", path)
+	}
+	defer func() { grip.Warning(f.Close()) }()
+
+	sums := md5.New()
+	var parts int
+	for {
+		h := md5.New()
+		n, err := io.CopyN(h, f, partSize)
+		if err != nil && err != io.EOF {
+			return "", errors.Wrapf(err, "reading '%s'", path)
+		}
+		if n == 0 && parts > 0 {
+			break
+		}
+		_, _ = sums.Write(h.Sum(nil))
+		parts++
+		if n < partSize {
+			break
+		}
+	}
+
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sums.Sum(nil)), parts), nil
+}
+
+// buildLocalManifest walks the local tree and produces a manifest of
+// every file whose name passes the filter, following symbolic links.
+// Files are only checksummed if they also pass the size and age
+// filters, so other entries have an empty checksum. Keys always use
+// "/" as a separator.
+func buildLocalManifest(ctx context.Context, local string, filter *s3SyncFilter) (*s3Manifest, error) {
+	manifest := newS3Manifest()
+	if err := walkLocalManifest(ctx, manifest, local, "", filter); err != nil {
+		return nil, errors.Wrapf(err, "walking local tree '%s'", local)
+	}
+
+	return manifest, nil
+}
+
+func walkLocalManifest(ctx context.Context, manifest *s3Manifest, root, base string, filter *s3SyncFilter) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if ctx.Err() != nil {
+			return errors.New("operation canceled")
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return errors.Wrap(err, "getting relative path")
+		}
+		key := filepath.ToSlash(filepath.Join(base, rel))
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			info, err = os.Stat(path)
+			if err != nil {
+				return errors.Wrapf(err, "resolving symlink '%s'", path)
+			}
+			if info.IsDir() {
+				resolved, err := filepath.EvalSymlinks(path)
+				if err != nil {
+					return errors.Wrapf(err, "resolving symlink '%s'", path)
+				}
+				return walkLocalManifest(ctx, manifest, resolved, key, filter)
+			}
+		}
+		if info.IsDir() {
+			return nil
+		}
+		entry := s3ManifestEntry{
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}
+		if !filter.matchesKey(key) {
+			return nil
+		}
+		if !filter.matches(key, entry) {
+			manifest.Entries[key] = entry
+			return nil
+		}
+
+		entry.MD5, err = utility.MD5SumFile(path)
+		if err != nil {
+			return errors.Wrapf(err, "computing checksum for '%s'", path)
+		}
+
+		manifest.Entries[key] = entry
+		return nil
+	})
+}
+
+// listRemoteState builds a manifest from a listing of the objects
+// under the prefix, using each object's ETag as its checksum. Sizes
+// and modification times are not available from the listing, so
+// sizes are recorded as unknown.
+func listRemoteState(ctx context.Context, bucket pail.Bucket, remote string) (*s3Manifest, error) {
+	iter, err := bucket.List(ctx, remote)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing prefix '%s'", remote)
+	}
+
+	manifest := newS3Manifest()
+	for iter.Next(ctx) {
+		key := strings.TrimPrefix(strings.TrimPrefix(iter.Item().Name(), remote), "/")
+		if key == "" {
+			continue
+		}
+		manifest.Entries[key] = s3ManifestEntry{Size: -1, MD5: iter.Item().Hash()}
+	}
+	if err = iter.Err(); err != nil {
+		return nil, errors.Wrapf(err, "iterating prefix '%s'", remote)
+	}
+
+	return manifest, nil
+}
+
+// fetchRemoteManifest retrieves the manifest stored under the
+// prefix. If no manifest exists, it returns an empty manifest.
+func fetchRemoteManifest(ctx context.Context, bucket pail.Bucket, remote string) (*s3Manifest, error) {
+	key := bucket.Join(remote, s3ManifestName)
+
+	exists, err := bucket.Exists(ctx, key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "checking for manifest '%s'", key)
+	}
+	if !exists {
+		return newS3Manifest(), nil
+	}
+
+	reader, err := bucket.Get(ctx, key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting manifest '%s'", key)
+	}
+	defer func() { grip.Warning(reader.Close()) }()
+
+	manifest := &s3Manifest{}
+	if err = json.NewDecoder(reader).Decode(manifest); err != nil {
+		return nil, errors.Wrapf(err, "decoding manifest '%s'", key)
+	}
+	if manifest.Entries == nil {
+		manifest.Entries = map[string]s3ManifestEntry{}
+	}
+
+	return manifest, nil
+}
+
+func writeRemoteManifest(ctx context.Context, bucket pail.Bucket, remote string, manifest *s3Manifest) error {
+	key := bucket.Join(remote, s3ManifestName)
+
+	payload, err := json.MarshalIndent(manifest, "", "   ")
+	if err != nil {
+		return errors.Wrap(err, "encoding manifest")
+	}
+
+	return errors.Wrapf(bucket.Put(ctx, key, bytes.NewReader(payload)), "putting manifest '%s'", key)
+}
@@ -0,0 +1,102 @@
+package operations
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/evergreen-ci/pail"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestFiles(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+}
+
+func TestManifestDiff(t *testing.T) {
+	local := newS3Manifest()
+	local.Entries["a"] = s3ManifestEntry{Size: 1, MD5: "one"}
+	local.Entries["b"] = s3ManifestEntry{Size: 2, MD5: "two"}
+	local.Entries["c"] = s3ManifestEntry{Size: 3, MD5: "three"}
+
+	remote := newS3Manifest()
+	remote.Entries["a"] = s3ManifestEntry{Size: 1, MD5: "one"}
+	remote.Entries["b"] = s3ManifestEntry{Size: 2, MD5: "other"}
+	remote.Entries["d"] = s3ManifestEntry{Size: 4, MD5: "four"}
+
+	assert.Equal(t, []string{"b", "c"}, local.changed(remote))
+	assert.Equal(t, []string{"a"}, local.unchanged(remote))
+	assert.Equal(t, []string{"d"}, local.missing(remote))
+	assert.Equal(t, []string{"b", "d"}, remote.changed(local))
+	assert.Equal(t, []string{"c"}, remote.missing(local))
+}
+
+func TestManifestSyncRoundTrip(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src := t.TempDir()
+	dst := t.TempDir()
+	bucket, err := pail.NewLocalBucket(pail.LocalOptions{Path: t.TempDir(), UseSlash: true})
+	require.NoError(t, err)
+
+	writeTestFiles(t, src, map[string]string{
+		"one.txt":         "one",
+		"dir/two.txt":     "two",
+		"dir/skip.log":    "excluded",
+		"dir/sub/three":   "three",
+		"removed-later.x": "gone",
+	})
+
+	filter, err := newS3SyncFilter(s3SyncFilterOptions{Exclude: []string{"*.log"}})
+	require.NoError(t, err)
+	opts := s3SyncOptions{Local: src, Remote: "prefix", Filter: filter, Workers: 2, Delete: true, Manifest: true}
+	require.NoError(t, pushS3Sync(ctx, bucket, opts, newS3SyncReport("push", "test", opts)))
+
+	manifest, err := fetchRemoteManifest(ctx, bucket, "prefix")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"dir/sub/three", "dir/two.txt", "one.txt", "removed-later.x"}, manifest.keys())
+	assert.Equal(t, int64(3), manifest.Entries["one.txt"].Size)
+
+	exists, err := bucket.Exists(ctx, "prefix/dir/skip.log")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	require.NoError(t, os.Remove(filepath.Join(src, "removed-later.x")))
+	writeTestFiles(t, src, map[string]string{"one.txt": "changed"})
+	report := newS3SyncReport("push", "test", opts)
+	require.NoError(t, pushS3Sync(ctx, bucket, opts, report))
+	assert.Equal(t, 1, report.Totals[s3SyncUploaded].Count)
+	assert.Equal(t, 2, report.Totals[s3SyncSkipped].Count)
+	assert.Equal(t, 1, report.Totals[s3SyncDeleted].Count)
+
+	exists, err = bucket.Exists(ctx, "prefix/removed-later.x")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	opts.Local = dst
+	require.NoError(t, pullS3Sync(ctx, bucket, opts, newS3SyncReport("pull", "test", opts)))
+	for name, content := range map[string]string{"one.txt": "changed", "dir/two.txt": "two", "dir/sub/three": "three"} {
+		data, err := os.ReadFile(filepath.Join(dst, filepath.FromSlash(name)))
+		require.NoError(t, err)
+		assert.Equal(t, content, string(data))
+	}
+	_, err = os.Stat(filepath.Join(dst, "removed-later.x"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestManifestPullRequiresManifest(t *testing.T) {
+	bucket, err := pail.NewLocalBucket(pail.LocalOptions{Path: t.TempDir(), UseSlash: true})
+	require.NoError(t, err)
+
+	opts := s3SyncOptions{Local: t.TempDir(), Remote: "prefix", Manifest: true}
+	require.NoError(t, opts.validate())
+	assert.Equal(t, 1, opts.Workers)
+	assert.Error(t, pullS3Sync(context.Background(), bucket, opts, newS3SyncReport("pull", "test", opts)))
+}
@@ -0,0 +1,188 @@
+package operations
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/mongodb/grip"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+const (
+	defaultS3PresignExpiry = time.Hour
+	// maxS3PresignExpiry is the longest expiry S3 accepts for URLs
+	// signed with signature version 4.
+	maxS3PresignExpiry = 7 * 24 * time.Hour
+)
+
+func s3PresignCmd() cli.Command {
+	return cli.Command{
+		Name:  "presign",
+		Usage: "generate time-limited URLs to download (or upload) objects without credentials",
+		Flags: baseS3Flags(
+			cli.StringFlag{
+				Name:  "name",
+				Usage: "the remote s3 resource name, to presign a single object",
+			},
+			cli.StringFlag{
+				Name:  "prefix",
+				Usage: "a prefix of s3 key names, to presign every object under it",
+			},
+			cli.DurationFlag{
+				Name:  "expires",
+				Usage: "how long the URLs remain valid, up to 168h",
+				Value: defaultS3PresignExpiry,
+			},
+			cli.BoolFlag{
+				Name:  "put",
+				Usage: "also generate URLs to upload to each key",
+			},
+			cli.BoolFlag{
+				Name:  "json",
+				Usage: "specify this option to output data as JSON",
+			},
+		),
+		Action: func(c *cli.Context) error {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			if err := setVerboseLogging(c.Bool("verbose")); err != nil {
+				return err
+			}
+
+			opts := s3PresignOptions{
+				Bucket:  c.String("bucket"),
+				Key:     c.String("name"),
+				Prefix:  c.String("prefix"),
+				Expires: c.Duration("expires"),
+				Put:     c.Bool("put"),
+			}
+			if err := opts.validate(); err != nil {
+				return errors.Wrap(err, "invalid presign options")
+			}
+
+			client, err := s3ClientFromFlags(ctx, c)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			keys := []string{opts.Key}
+			if opts.Key == "" {
+				objects, err := listS3Objects(ctx, client, opts.Bucket, opts.Prefix)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				keys = make([]string, 0, len(objects))
+				for _, obj := range objects {
+					keys = append(keys, obj.Key)
+				}
+			}
+
+			urls, err := presignS3Objects(ctx, s3.NewPresignClient(client), keys, opts)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			if c.Bool("json") {
+				return errors.WithStack(writeJSON(os.Stdout, urls))
+			}
+			return errors.WithStack(writeS3PresignTable(os.Stdout, urls))
+		},
+	}
+}
+
+// s3Presigner is the subset of the S3 presign client used to sign
+// URLs, which allows signing to be tested without credentials.
+type s3Presigner interface {
+	PresignGetObject(context.Context, *s3.GetObjectInput, ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error)
+	PresignPutObject(context.Context, *s3.PutObjectInput, ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error)
+}
+
+type s3PresignOptions struct {
+	Bucket  string
+	Key     string
+	Prefix  string
+	Expires time.Duration
+	Put     bool
+}
+
+func (opts *s3PresignOptions) validate() error {
+	catcher := grip.NewBasicCatcher()
+	catcher.NewWhen(opts.Bucket == "", "must specify a bucket")
+	catcher.NewWhen(opts.Key == "" && opts.Prefix == "", "must specify either an object name or a prefix")
+	catcher.NewWhen(opts.Key != "" && opts.Prefix != "", "cannot specify both an object name and a prefix")
+	catcher.NewWhen(opts.Expires < 0, "expiry must not be negative")
+	catcher.ErrorfWhen(opts.Expires > maxS3PresignExpiry, "expiry must not be longer than %s", maxS3PresignExpiry)
+
+	if opts.Expires == 0 {
+		opts.Expires = defaultS3PresignExpiry
+	}
+
+	return catcher.Resolve()
+}
+
+// s3PresignedURL is a URL that grants access to a single operation on
+// an object until it expires.
+type s3PresignedURL struct {
+	Key       string    `json:"key"`
+	Method    string    `json:"method"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// presignS3Objects signs a GET URL, and optionally a PUT URL, for each
+// of the keys.
+func presignS3Objects(ctx context.Context, presigner s3Presigner, keys []string, opts s3PresignOptions) ([]s3PresignedURL, error) {
+	if err := opts.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid presign options")
+	}
+
+	expires := s3.WithPresignExpires(opts.Expires)
+	expiresAt := time.Now().Add(opts.Expires).UTC().Truncate(time.Second)
+
+	out := []s3PresignedURL{}
+	for _, key := range keys {
+		req, err := presigner.PresignGetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(opts.Bucket),
+			Key:    aws.String(key),
+		}, expires)
+		if err != nil {
+			return nil, errors.Wrapf(err, "presigning download of '%s'", key)
+		}
+		out = append(out, s3PresignedURL{Key: key, Method: http.MethodGet, URL: req.URL, ExpiresAt: expiresAt})
+
+		if !opts.Put {
+			continue
+		}
+
+		req, err = presigner.PresignPutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(opts.Bucket),
+			Key:    aws.String(key),
+		}, expires)
+		if err != nil {
+			return nil, errors.Wrapf(err, "presigning upload of '%s'", key)
+		}
+		out = append(out, s3PresignedURL{Key: key, Method: http.MethodPut, URL: req.URL, ExpiresAt: expiresAt})
+	}
+
+	return out, nil
+}
+
+func writeS3PresignTable(w io.Writer, urls []s3PresignedURL) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "METHOD\tKEY\tEXPIRES\tURL")
+	for _, u := range urls {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", u.Method, u.Key, u.ExpiresAt.Format(time.RFC3339), u.URL)
+	}
+
+	return errors.WithStack(tw.Flush())
+}
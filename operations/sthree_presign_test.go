@@ -0,0 +1,81 @@
+package operations
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPresignClient() *s3.PresignClient {
+	return s3.NewPresignClient(s3.New(s3.Options{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+	}))
+}
+
+func TestPresignS3Objects(t *testing.T) {
+	ctx := context.Background()
+	opts := s3PresignOptions{Bucket: "bucket", Prefix: "builds/", Expires: 2 * time.Hour, Put: true}
+
+	urls, err := presignS3Objects(ctx, newTestPresignClient(), []string{"builds/a.tgz", "builds/b.tgz"}, opts)
+	require.NoError(t, err)
+	require.Len(t, urls, 4)
+
+	assert.Equal(t, "GET", urls[0].Method)
+	assert.Equal(t, "PUT", urls[1].Method)
+	assert.Equal(t, "builds/b.tgz", urls[2].Key)
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), urls[0].ExpiresAt, time.Minute)
+
+	u, err := url.Parse(urls[0].URL)
+	require.NoError(t, err)
+	assert.Equal(t, "/builds/a.tgz", u.Path)
+	assert.Equal(t, "7200", u.Query().Get("X-Amz-Expires"))
+	assert.NotEmpty(t, u.Query().Get("X-Amz-Signature"))
+
+	opts.Put = false
+	urls, err = presignS3Objects(ctx, newTestPresignClient(), []string{"builds/a.tgz"}, opts)
+	require.NoError(t, err)
+	require.Len(t, urls, 1)
+
+	var buf bytes.Buffer
+	require.NoError(t, writeJSON(&buf, urls))
+	decoded := []map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, "builds/a.tgz", decoded[0]["key"])
+	assert.Equal(t, urls[0].URL, decoded[0]["url"])
+
+	buf.Reset()
+	require.NoError(t, writeS3PresignTable(&buf, urls))
+	assert.True(t, strings.HasPrefix(buf.String(), "METHOD"))
+	assert.Contains(t, buf.String(), urls[0].URL)
+}
+
+func TestPresignS3OptionsValidation(t *testing.T) {
+	opts := s3PresignOptions{Bucket: "bucket", Key: "key"}
+	require.NoError(t, opts.validate())
+	assert.Equal(t, defaultS3PresignExpiry, opts.Expires)
+
+	for name, opts := range map[string]s3PresignOptions{
+		"NoBucket":      {Key: "key"},
+		"NoKeyOrPrefix": {Bucket: "bucket"},
+		"KeyAndPrefix":  {Bucket: "bucket", Key: "key", Prefix: "prefix"},
+		"TooLong":       {Bucket: "bucket", Key: "key", Expires: 8 * 24 * time.Hour},
+		"Negative":      {Bucket: "bucket", Key: "key", Expires: -time.Minute},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Error(t, opts.validate())
+		})
+	}
+
+	_, err := presignS3Objects(context.Background(), newTestPresignClient(), []string{"key"}, s3PresignOptions{Key: "key"})
+	assert.Error(t, err)
+}
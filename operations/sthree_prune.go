@@ -0,0 +1,293 @@
+package operations
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evergreen-ci/lru"
+	"github.com/evergreen-ci/pail"
+	"github.com/evergreen-ci/utility"
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+func s3PruneCmd() cli.Command {
+	return cli.Command{
+		Name:  "prune",
+		Usage: "removes the least recently modified objects under a prefix, as prune does for local caches",
+		Flags: baseS3Flags(
+			cli.StringFlag{
+				Name:  "prefix",
+				Usage: "prefix of s3 key names",
+			},
+			cli.IntFlag{
+				Name:  "max-size",
+				Usage: "specify the max size of the prefix to prune to in megabytes",
+			},
+			cli.DurationFlag{
+				Name:  "max-age",
+				Usage: "remove objects last modified longer ago than this duration (e.g. 720h)",
+			},
+			cli.IntFlag{
+				Name:  "keep-latest",
+				Usage: "never remove the most recently modified N objects",
+			},
+			cli.StringSliceFlag{
+				Name:  "exclude",
+				Usage: "never remove objects whose keys end with this suffix, in addition to full.json",
+			},
+			cli.IntFlag{
+				Name:  "workers",
+				Usage: "number of workers for parallelized delete operation",
+				Value: 1,
+			},
+			cli.BoolFlag{
+				Name:  "json",
+				Usage: "specify this option to output the objects removed as JSON",
+			},
+		),
+		Action: func(c *cli.Context) error {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			if err := setVerboseLogging(c.Bool("verbose")); err != nil {
+				return err
+			}
+
+			opts := s3PruneOptions{
+				Prefix:     c.String("prefix"),
+				MaxSize:    int64(c.Int("max-size")) * 1024 * 1024,
+				MaxAge:     c.Duration("max-age"),
+				KeepLatest: c.Int("keep-latest"),
+				Exclude:    append([]string{"full.json"}, c.StringSlice("exclude")...),
+				Workers:    c.Int("workers"),
+				DryRun:     c.Bool("dry-run"),
+			}
+			if err := opts.validate(); err != nil {
+				return errors.Wrap(err, "invalid prune options")
+			}
+
+			client, err := s3ClientFromFlags(ctx, c)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			objects, err := listS3Objects(ctx, client, c.String("bucket"), opts.Prefix)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			bucket, err := s3BucketFromFlags(ctx, c, pail.S3Options{
+				SharedCredentialsProfile: c.String("profile"),
+				Region:                   c.String("region"),
+				Name:                     c.String("bucket"),
+				DryRun:                   c.Bool("dry-run"),
+				MaxRetries:               utility.ToIntPtr(c.Int("retries")),
+				Verbose:                  c.Bool("verbose"),
+			})
+			if err != nil {
+				return errors.Wrap(err, "getting new bucket")
+			}
+
+			result, err := pruneS3Objects(ctx, bucket, objects, opts)
+			if err != nil {
+				return errors.Wrapf(err, "pruning prefix '%s'", opts.Prefix)
+			}
+
+			if c.Bool("json") {
+				return errors.WithStack(writeJSON(os.Stdout, result))
+			}
+			return nil
+		},
+	}
+}
+
+type s3PruneOptions struct {
+	Prefix     string
+	MaxSize    int64
+	MaxAge     time.Duration
+	KeepLatest int
+	Exclude    []string
+	Workers    int
+	DryRun     bool
+}
+
+func (opts *s3PruneOptions) validate() error {
+	catcher := grip.NewBasicCatcher()
+	catcher.NewWhen(opts.MaxSize <= 0 && opts.MaxAge <= 0, "must specify a maximum size or a maximum age")
+	catcher.NewWhen(opts.MaxSize < 0, "maximum size must not be negative")
+	catcher.NewWhen(opts.MaxAge < 0, "maximum age must not be negative")
+	catcher.NewWhen(opts.KeepLatest < 0, "number of objects to keep must not be negative")
+
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+
+	return catcher.Resolve()
+}
+
+func (opts *s3PruneOptions) isExcluded(key string) bool {
+	for _, ex := range opts.Exclude {
+		if strings.HasSuffix(key, ex) {
+			return true
+		}
+	}
+	return false
+}
+
+// s3PruneResult describes the objects that a prune removed, or would
+// remove in dry-run mode.
+type s3PruneResult struct {
+	Prefix      string           `json:"prefix"`
+	DryRun      bool             `json:"dry_run"`
+	Objects     int              `json:"objects"`
+	Size        int64            `json:"size"`
+	Removed     []s3PruneRemoval `json:"removed"`
+	RemovedSize int64            `json:"removed_size"`
+
+	mu sync.Mutex
+}
+
+type s3PruneRemoval struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	Reason       string    `json:"reason"`
+}
+
+// selectS3PruneCandidates uses an LRU cache to pick the objects to
+// remove, oldest first: every object older than the maximum age, and
+// then more objects until the total size is under the maximum. The
+// newest objects and those with excluded suffixes are never picked.
+func selectS3PruneCandidates(objects []s3ObjectInfo, opts s3PruneOptions) ([]s3PruneRemoval, error) {
+	newest := make([]s3ObjectInfo, 0, len(objects))
+	for _, obj := range objects {
+		if !opts.isExcluded(obj.Key) {
+			newest = append(newest, obj)
+		}
+	}
+	sort.SliceStable(newest, func(i, j int) bool { return newest[i].LastModified.After(newest[j].LastModified) })
+
+	protected := map[string]bool{}
+	for i := 0; i < opts.KeepLatest && i < len(newest); i++ {
+		protected[newest[i].Key] = true
+	}
+
+	cache := lru.NewCache()
+	for _, obj := range objects {
+		if err := cache.Add(&lru.FileObject{Path: obj.Key, Size: int(obj.Size), Time: obj.LastModified}); err != nil {
+			return nil, errors.Wrapf(err, "adding '%s' to cache", obj.Key)
+		}
+	}
+
+	cutoff := time.Now().Add(-opts.MaxAge)
+	total := int64(cache.Size())
+	out := []s3PruneRemoval{}
+	for cache.Count() > 0 {
+		f, err := cache.Pop()
+		if err != nil {
+			return nil, errors.Wrap(err, "retrieving item from cache")
+		}
+
+		if opts.isExcluded(f.Path) {
+			grip.Infof("object '%s' is excluded from pruning", f.Path)
+			continue
+		}
+		if protected[f.Path] {
+			continue
+		}
+
+		removal := s3PruneRemoval{Key: f.Path, Size: int64(f.Size), LastModified: f.Time}
+		if opts.MaxAge > 0 && f.Time.Before(cutoff) {
+			removal.Reason = "max-age"
+		} else if opts.MaxSize > 0 && total > opts.MaxSize {
+			removal.Reason = "max-size"
+		} else {
+			// objects come out of the cache oldest first, so no
+			// later object is older or needed to get under quota.
+			break
+		}
+
+		total -= removal.Size
+		out = append(out, removal)
+	}
+
+	return out, nil
+}
+
+// pruneS3Objects removes the objects picked by selectS3PruneCandidates
+// in parallel.
+func pruneS3Objects(ctx context.Context, bucket pail.Bucket, objects []s3ObjectInfo, opts s3PruneOptions) (*s3PruneResult, error) {
+	if err := opts.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid prune options")
+	}
+
+	removals, err := selectS3PruneCandidates(objects, opts)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	result := &s3PruneResult{
+		Prefix:  opts.Prefix,
+		DryRun:  opts.DryRun,
+		Objects: len(objects),
+		Removed: []s3PruneRemoval{},
+	}
+	for _, obj := range objects {
+		result.Size += obj.Size
+	}
+
+	keys := make([]string, 0, len(removals))
+	byKey := map[string]s3PruneRemoval{}
+	for _, removal := range removals {
+		keys = append(keys, removal.Key)
+		byKey[removal.Key] = removal
+	}
+
+	err = runS3SyncWorkers(ctx, opts.Workers, keys, func(ctx context.Context, key string) error {
+		removal := byKey[key]
+		if opts.DryRun {
+			grip.Notice(message.Fields{
+				"message": "would remove object",
+				"key":     key,
+				"size":    removal.Size,
+				"reason":  removal.Reason,
+			})
+		} else if err := bucket.Remove(ctx, key); err != nil {
+			return errors.Wrapf(err, "removing '%s'", key)
+		} else {
+			grip.Info(message.Fields{
+				"message": "removed object",
+				"key":     key,
+				"size":    removal.Size,
+				"reason":  removal.Reason,
+			})
+		}
+
+		result.mu.Lock()
+		defer result.mu.Unlock()
+		result.Removed = append(result.Removed, removal)
+		result.RemovedSize += removal.Size
+		return nil
+	})
+
+	sort.Slice(result.Removed, func(i, j int) bool { return result.Removed[i].Key < result.Removed[j].Key })
+	msg := message.Fields{
+		"message":      "pruned prefix",
+		"prefix":       opts.Prefix,
+		"dry_run":      opts.DryRun,
+		"objects":      result.Objects,
+		"size":         result.Size,
+		"removed":      len(result.Removed),
+		"removed_size": result.RemovedSize,
+	}
+	grip.InfoWhen(err == nil, msg)
+	grip.Error(message.WrapError(err, msg))
+
+	return result, errors.WithStack(err)
+}
@@ -0,0 +1,107 @@
+package operations
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testPruneObjects() []s3ObjectInfo {
+	now := time.Now()
+	return []s3ObjectInfo{
+		{Key: "nightly/full.json", Size: 10, LastModified: now.Add(-100 * time.Hour)},
+		{Key: "nightly/a.tgz", Size: 100, LastModified: now.Add(-72 * time.Hour)},
+		{Key: "nightly/b.tgz", Size: 100, LastModified: now.Add(-48 * time.Hour)},
+		{Key: "nightly/c.tgz", Size: 100, LastModified: now.Add(-24 * time.Hour)},
+		{Key: "nightly/d.tgz", Size: 100, LastModified: now.Add(-time.Hour)},
+	}
+}
+
+func removedKeys(removals []s3PruneRemoval) []string {
+	keys := []string{}
+	for _, removal := range removals {
+		keys = append(keys, removal.Key)
+	}
+	return keys
+}
+
+func TestSelectS3PruneCandidates(t *testing.T) {
+	for name, test := range map[string]struct {
+		opts     s3PruneOptions
+		expected []string
+	}{
+		"MaxAge": {
+			opts:     s3PruneOptions{MaxAge: 36 * time.Hour, Exclude: []string{"full.json"}},
+			expected: []string{"nightly/a.tgz", "nightly/b.tgz"},
+		},
+		"MaxSize": {
+			opts:     s3PruneOptions{MaxSize: 250, Exclude: []string{"full.json"}},
+			expected: []string{"nightly/a.tgz", "nightly/b.tgz"},
+		},
+		"KeepLatest": {
+			opts:     s3PruneOptions{MaxAge: time.Minute, KeepLatest: 3, Exclude: []string{"full.json"}},
+			expected: []string{"nightly/a.tgz"},
+		},
+		"NoExclusions": {
+			opts:     s3PruneOptions{MaxAge: 80 * time.Hour},
+			expected: []string{"nightly/full.json"},
+		},
+		"UnderQuota": {
+			opts:     s3PruneOptions{MaxSize: 1000, Exclude: []string{"full.json"}},
+			expected: []string{},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			removals, err := selectS3PruneCandidates(testPruneObjects(), test.opts)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, removedKeys(removals))
+		})
+	}
+}
+
+func TestPruneS3Objects(t *testing.T) {
+	ctx := context.Background()
+	contents := map[string]string{}
+	for _, obj := range testPruneObjects() {
+		contents[obj.Key] = obj.Key
+	}
+
+	t.Run("DryRun", func(t *testing.T) {
+		bucket := newTestLocalBucket(t, contents)
+		opts := s3PruneOptions{Prefix: "nightly", MaxSize: 250, Exclude: []string{"full.json"}, Workers: 2, DryRun: true}
+		result, err := pruneS3Objects(ctx, bucket, testPruneObjects(), opts)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"nightly/a.tgz", "nightly/b.tgz"}, removedKeys(result.Removed))
+		assert.Equal(t, int64(200), result.RemovedSize)
+		assert.Equal(t, int64(410), result.Size)
+
+		exists, err := bucket.Exists(ctx, "nightly/a.tgz")
+		require.NoError(t, err)
+		assert.True(t, exists)
+	})
+	t.Run("Remove", func(t *testing.T) {
+		bucket := newTestLocalBucket(t, contents)
+		opts := s3PruneOptions{Prefix: "nightly", MaxAge: 36 * time.Hour, Exclude: []string{"full.json"}, Workers: 2}
+		result, err := pruneS3Objects(ctx, bucket, testPruneObjects(), opts)
+		require.NoError(t, err)
+		assert.Len(t, result.Removed, 2)
+
+		for key, expected := range map[string]bool{
+			"nightly/a.tgz":     false,
+			"nightly/b.tgz":     false,
+			"nightly/c.tgz":     true,
+			"nightly/full.json": true,
+		} {
+			exists, err := bucket.Exists(ctx, key)
+			require.NoError(t, err)
+			assert.Equal(t, expected, exists, key)
+		}
+	})
+	t.Run("RequiresLimit", func(t *testing.T) {
+		_, err := pruneS3Objects(ctx, newTestLocalBucket(t, nil), testPruneObjects(), s3PruneOptions{KeepLatest: 1})
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,512 @@
+package operations
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/evergreen-ci/pail"
+	"github.com/evergreen-ci/utility"
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+)
+
+// s3SyncAction describes what a sync operation did with a single key.
+type s3SyncAction string
+
+const (
+	s3SyncUploaded   s3SyncAction = "uploaded"
+	s3SyncDownloaded s3SyncAction = "downloaded"
+	s3SyncSkipped    s3SyncAction = "skipped"
+	s3SyncDeleted    s3SyncAction = "deleted"
+	s3SyncFailed     s3SyncAction = "failed"
+)
+
+type s3SyncOptions struct {
+	Local    string
+	Remote   string
+	Filter   *s3SyncFilter
+	Workers  int
+	Delete   bool
+	DryRun   bool
+	Manifest bool
+	// MaxBandwidth is the number of bytes per second shared by all
+	// workers, or unlimited if zero.
+	MaxBandwidth int64
+	// Adaptive scales the number of concurrent transfers between one
+	// and Workers, based on throughput and SlowDown responses.
+	Adaptive bool
+	// Throttle limits the transfers. By default, it is built from
+	// MaxBandwidth, Workers and Adaptive. It is built before the
+	// bucket so that the bucket's S3 client can report to it.
+	Throttle *s3TransferThrottle
+	// ListRemote returns the state of the objects under the remote
+	// prefix when not using a manifest. By default, the state is
+	// listed from the bucket, which does not report sizes or
+	// modification times.
+	ListRemote s3RemoteLister
+}
+
+// s3RemoteLister returns the state of the objects under a prefix.
+type s3RemoteLister func(ctx context.Context, remote string) (*s3Manifest, error)
+
+func (opts *s3SyncOptions) validate() error {
+	if opts.Local == "" {
+		return errors.New("must specify a local path")
+	}
+	if opts.MaxBandwidth < 0 {
+		return errors.New("maximum bandwidth must not be negative")
+	}
+	if opts.Adaptive && opts.Workers < 2 {
+		opts.Workers = s3AdaptiveMaxWorkers
+	}
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+	if opts.Throttle == nil {
+		opts.Throttle = newS3TransferThrottle(opts.MaxBandwidth, opts.Workers, opts.Adaptive)
+	}
+
+	return nil
+}
+
+// remoteState returns the state of every object under the remote
+// prefix, from either the manifest or a listing.
+func (opts *s3SyncOptions) remoteState(ctx context.Context, bucket pail.Bucket) (*s3Manifest, error) {
+	if opts.Manifest {
+		return fetchRemoteManifest(ctx, bucket, opts.Remote)
+	}
+	if opts.ListRemote != nil {
+		return opts.ListRemote(ctx, opts.Remote)
+	}
+	return listRemoteState(ctx, bucket, opts.Remote)
+}
+
+// newS3ClientLister returns a lister that uses the S3 API directly, so
+// that the sizes and modification times of objects are available to
+// the sync filters.
+func newS3ClientLister(client *s3.Client, bucket string) s3RemoteLister {
+	return func(ctx context.Context, remote string) (*s3Manifest, error) {
+		prefix := remote
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+
+		objects, err := listS3Objects(ctx, client, bucket, prefix)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		manifest := newS3Manifest()
+		for _, obj := range objects {
+			key := strings.TrimPrefix(obj.Key, prefix)
+			if key == "" {
+				continue
+			}
+			manifest.Entries[key] = s3ManifestEntry{
+				Size:    obj.Size,
+				MD5:     obj.ETag,
+				ModTime: obj.LastModified,
+			}
+		}
+
+		return manifest, nil
+	}
+}
+
+// s3SyncReport records the action taken for every key in a sync
+// operation, along with totals for each action.
+type s3SyncReport struct {
+	Operation    string                        `json:"operation"`
+	Bucket       string                        `json:"bucket"`
+	Prefix       string                        `json:"prefix"`
+	Local        string                        `json:"local"`
+	DryRun       bool                          `json:"dry_run"`
+	StartedAt    time.Time                     `json:"started_at"`
+	DurationSecs float64                       `json:"dur_secs"`
+	Entries      []s3SyncReportEntry           `json:"entries"`
+	Totals       map[s3SyncAction]s3SyncTotals `json:"totals"`
+
+	mu sync.Mutex
+}
+
+type s3SyncReportEntry struct {
+	Key          string       `json:"key"`
+	Action       s3SyncAction `json:"action"`
+	Bytes        int64        `json:"bytes"`
+	DurationSecs float64      `json:"dur_secs"`
+	Error        string       `json:"error,omitempty"`
+}
+
+type s3SyncTotals struct {
+	Count int   `json:"count"`
+	Bytes int64 `json:"bytes"`
+}
+
+func newS3SyncReport(operation, bucket string, opts s3SyncOptions) *s3SyncReport {
+	return &s3SyncReport{
+		Operation: operation,
+		Bucket:    bucket,
+		Prefix:    opts.Remote,
+		Local:     opts.Local,
+		DryRun:    opts.DryRun,
+		StartedAt: time.Now(),
+		Entries:   []s3SyncReportEntry{},
+		Totals:    map[s3SyncAction]s3SyncTotals{},
+	}
+}
+
+func (r *s3SyncReport) add(key string, action s3SyncAction, bytes int64, startAt time.Time, err error) {
+	entry := s3SyncReportEntry{
+		Key:    key,
+		Action: action,
+		Bytes:  bytes,
+	}
+	if !startAt.IsZero() {
+		entry.DurationSecs = time.Since(startAt).Seconds()
+	}
+	if entry.Bytes < 0 {
+		entry.Bytes = 0
+	}
+	if err != nil {
+		entry.Action = s3SyncFailed
+		entry.Error = err.Error()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Entries = append(r.Entries, entry)
+	totals := r.Totals[entry.Action]
+	totals.Count++
+	totals.Bytes += entry.Bytes
+	r.Totals[entry.Action] = totals
+}
+
+// succeeded reports whether the report records the key without an
+// error.
+func (r *s3SyncReport) succeeded(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, entry := range r.Entries {
+		if entry.Key == key {
+			return entry.Action != s3SyncFailed
+		}
+	}
+	return false
+}
+
+// finish sorts the entries and records the duration of the operation.
+func (r *s3SyncReport) finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sort.SliceStable(r.Entries, func(i, j int) bool { return r.Entries[i].Key < r.Entries[j].Key })
+	r.DurationSecs = time.Since(r.StartedAt).Seconds()
+}
+
+func (r *s3SyncReport) message() message.Fields {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	msg := message.Fields{
+		"message":   "sync complete",
+		"operation": r.Operation,
+		"bucket":    r.Bucket,
+		"prefix":    r.Prefix,
+		"local":     r.Local,
+		"dry_run":   r.DryRun,
+		"dur_secs":  r.DurationSecs,
+	}
+	for action, totals := range r.Totals {
+		msg[string(action)] = totals.Count
+		msg[string(action)+"_bytes"] = totals.Bytes
+	}
+
+	return msg
+}
+
+// writeFile writes the report as JSON to the given path.
+func (r *s3SyncReport) writeFile(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return errors.Wrapf(utility.WriteJSONFile(path, r), "writing sync report to '%s'", path)
+}
+
+// pushS3Sync uploads files from the local tree that differ from the
+// objects under the remote prefix, recording the outcome for every
+// key in the report. Files are only uploaded, and objects are only
+// deleted, if they pass the filter.
+func pushS3Sync(ctx context.Context, bucket pail.Bucket, opts s3SyncOptions, report *s3SyncReport) error {
+	if err := opts.validate(); err != nil {
+		return errors.Wrap(err, "invalid sync options")
+	}
+
+	localAll, err := buildLocalManifest(ctx, opts.Local, opts.Filter)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	local := localAll.filter(opts.Filter)
+
+	remoteAll, err := opts.remoteState(ctx, bucket)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err = remoteAll.matchMultipartETags(localAll, opts.Local); err != nil {
+		return errors.WithStack(err)
+	}
+
+	toUpload := local.changed(remoteAll)
+	for _, key := range local.unchanged(remoteAll) {
+		report.add(key, s3SyncSkipped, 0, time.Time{}, nil)
+	}
+	var toDelete []string
+	if opts.Delete {
+		toDelete = localAll.missing(remoteAll.filter(opts.Filter))
+	}
+
+	grip.Info(message.Fields{
+		"message":   "pushing changes",
+		"local":     opts.Local,
+		"remote":    opts.Remote,
+		"manifest":  opts.Manifest,
+		"files":     len(local.Entries),
+		"uploading": len(toUpload),
+		"deleting":  len(toDelete),
+		"dry_run":   opts.DryRun,
+	})
+
+	throttle := opts.Throttle
+	err = runS3SyncReportWorkers(ctx, opts.Workers, toUpload, report, func(ctx context.Context, key string) error {
+		startAt := time.Now()
+		if opts.DryRun {
+			report.add(key, s3SyncUploaded, local.Entries[key].Size, startAt, nil)
+			return nil
+		}
+
+		err := throttle.upload(ctx, bucket, bucket.Join(opts.Remote, key), filepath.Join(opts.Local, filepath.FromSlash(key)))
+		report.add(key, s3SyncUploaded, local.Entries[key].Size, startAt, err)
+		return errors.Wrapf(err, "uploading '%s'", key)
+	})
+	if err != nil {
+		// don't delete anything unless the local tree is in place
+		reportS3SyncNotAttempted(report, toDelete, err)
+		return errors.WithStack(err)
+	}
+
+	catcher := grip.NewBasicCatcher()
+	catcher.Add(deleteS3Sync(ctx, opts, toDelete, report, func(ctx context.Context, key string) (int64, error) {
+		size := remoteAll.Entries[key].Size
+		if opts.DryRun {
+			return size, nil
+		}
+		return size, errors.Wrapf(bucket.Remove(ctx, bucket.Join(opts.Remote, key)), "deleting remote object '%s' not in local tree", key)
+	}))
+
+	if !opts.Manifest || opts.DryRun {
+		return catcher.Resolve()
+	}
+
+	// objects that were filtered out or not deleted remain in the
+	// prefix, so they must stay in the manifest.
+	for key, entry := range local.Entries {
+		remoteAll.Entries[key] = entry
+	}
+	for _, key := range toDelete {
+		if report.succeeded(key) {
+			delete(remoteAll.Entries, key)
+		}
+	}
+	remoteAll.CreatedAt = time.Now()
+	catcher.Add(writeRemoteManifest(ctx, bucket, opts.Remote, remoteAll))
+
+	return catcher.Resolve()
+}
+
+// pullS3Sync downloads the objects under the remote prefix that differ
+// from the contents of the local tree, recording the outcome for
+// every key in the report. Objects are only downloaded, and files are
+// only deleted, if they pass the filter.
+func pullS3Sync(ctx context.Context, bucket pail.Bucket, opts s3SyncOptions, report *s3SyncReport) error {
+	if err := opts.validate(); err != nil {
+		return errors.Wrap(err, "invalid sync options")
+	}
+
+	remoteAll, err := opts.remoteState(ctx, bucket)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if opts.Manifest && len(remoteAll.Entries) == 0 {
+		return errors.Errorf("no manifest found for prefix '%s'", opts.Remote)
+	}
+	remoteAll = remoteAll.filterKeys(opts.Filter)
+
+	// keys are untrusted, so refuse to write outside of the local
+	// directory.
+	catcher := grip.NewBasicCatcher()
+	for _, key := range remoteAll.keys() {
+		_, err = archiveEntryPath(opts.Local, key)
+		catcher.Wrapf(err, "invalid remote key '%s'", key)
+	}
+	if catcher.HasErrors() {
+		return catcher.Resolve()
+	}
+
+	if err = os.MkdirAll(opts.Local, 0755); err != nil {
+		return errors.Wrapf(err, "creating local directory '%s'", opts.Local)
+	}
+
+	localAll, err := buildLocalManifest(ctx, opts.Local, opts.Filter)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err = remoteAll.matchMultipartETags(localAll, opts.Local); err != nil {
+		return errors.WithStack(err)
+	}
+	remote := remoteAll.filter(opts.Filter)
+
+	toDownload := remote.changed(localAll)
+	for _, key := range remote.unchanged(localAll) {
+		report.add(key, s3SyncSkipped, 0, time.Time{}, nil)
+	}
+	var toDelete []string
+	if opts.Delete {
+		toDelete = remoteAll.missing(localAll.filter(opts.Filter))
+	}
+
+	grip.Info(message.Fields{
+		"message":     "pulling changes",
+		"local":       opts.Local,
+		"remote":      opts.Remote,
+		"manifest":    opts.Manifest,
+		"files":       len(remote.Entries),
+		"downloading": len(toDownload),
+		"deleting":    len(toDelete),
+		"dry_run":     opts.DryRun,
+	})
+
+	throttle := opts.Throttle
+	err = runS3SyncReportWorkers(ctx, opts.Workers, toDownload, report, func(ctx context.Context, key string) error {
+		startAt := time.Now()
+		if opts.DryRun {
+			report.add(key, s3SyncDownloaded, remote.Entries[key].Size, startAt, nil)
+			return nil
+		}
+
+		path := filepath.Join(opts.Local, filepath.FromSlash(key))
+		err := throttle.download(ctx, bucket, bucket.Join(opts.Remote, key), path)
+		var size int64
+		if info, statErr := os.Stat(path); err == nil && statErr == nil {
+			size = info.Size()
+		}
+		report.add(key, s3SyncDownloaded, size, startAt, err)
+		return errors.Wrapf(err, "downloading '%s'", key)
+	})
+	if err != nil {
+		// don't delete anything unless the remote tree is in place
+		reportS3SyncNotAttempted(report, toDelete, err)
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(deleteS3Sync(ctx, opts, toDelete, report, func(ctx context.Context, key string) (int64, error) {
+		size := localAll.Entries[key].Size
+		if opts.DryRun {
+			return size, nil
+		}
+		return size, errors.Wrapf(os.Remove(filepath.Join(opts.Local, filepath.FromSlash(key))), "removing local file '%s'", key)
+	}))
+}
+
+// deleteS3Sync deletes the keys, recording the outcome for every key in
+// the report. Deleting carries on after a failure, so that one key
+// that can't be deleted doesn't leave every other stale key in place.
+// The operation returns the size of what it deleted.
+func deleteS3Sync(ctx context.Context, opts s3SyncOptions, keys []string, report *s3SyncReport, op func(context.Context, string) (int64, error)) error {
+	catcher := grip.NewBasicCatcher()
+	err := runS3SyncReportWorkers(ctx, opts.Workers, keys, report, func(ctx context.Context, key string) error {
+		startAt := time.Now()
+		size, err := op(ctx, key)
+		report.add(key, s3SyncDeleted, size, startAt, err)
+		catcher.Add(err)
+		return nil
+	})
+	catcher.Add(err)
+
+	return catcher.Resolve()
+}
+
+// runS3SyncReportWorkers runs the operation for every key like
+// runS3SyncWorkers, and records the keys that it didn't get to after
+// the first error as failed, so that the report has every key.
+func runS3SyncReportWorkers(ctx context.Context, workers int, keys []string, report *s3SyncReport, op func(context.Context, string) error) error {
+	attempted := &sync.Map{}
+	err := runS3SyncWorkers(ctx, workers, keys, func(ctx context.Context, key string) error {
+		attempted.Store(key, true)
+		return op(ctx, key)
+	})
+	if err == nil {
+		return nil
+	}
+
+	remaining := []string{}
+	for _, key := range keys {
+		if _, ok := attempted.Load(key); !ok {
+			remaining = append(remaining, key)
+		}
+	}
+	reportS3SyncNotAttempted(report, remaining, err)
+
+	return errors.WithStack(err)
+}
+
+// reportS3SyncNotAttempted records keys that were not synced because
+// of an earlier error as failed.
+func reportS3SyncNotAttempted(report *s3SyncReport, keys []string, cause error) {
+	for _, key := range keys {
+		report.add(key, s3SyncFailed, 0, time.Time{}, errors.Wrap(cause, "not attempted after an earlier failure"))
+	}
+}
+
+// runS3SyncWorkers runs the operation for every key using the given
+// number of workers, canceling outstanding work after the first
+// error.
+func runS3SyncWorkers(ctx context.Context, workers int, keys []string, op func(context.Context, string) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	in := make(chan string, len(keys))
+	for _, key := range keys {
+		in <- key
+	}
+	close(in)
+
+	wg := &sync.WaitGroup{}
+	catcher := grip.NewBasicCatcher()
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range in {
+				if ctx.Err() != nil {
+					return
+				}
+
+				if err := op(ctx, key); err != nil {
+					catcher.Add(err)
+					cancel()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return catcher.Resolve()
+}
@@ -0,0 +1,303 @@
+package operations
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/evergreen-ci/pail"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestS3SyncWithoutManifest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src := t.TempDir()
+	dst := t.TempDir()
+	bucket, err := pail.NewLocalBucket(pail.LocalOptions{Path: t.TempDir(), UseSlash: true})
+	require.NoError(t, err)
+
+	writeTestFiles(t, src, map[string]string{
+		"one.txt":     "one",
+		"dir/two.txt": "two",
+	})
+	writeTestFiles(t, dst, map[string]string{"stale": "stale"})
+
+	opts := s3SyncOptions{Local: src, Remote: "prefix", Workers: 2, Delete: true}
+	report := newS3SyncReport("push", "test", opts)
+	require.NoError(t, pushS3Sync(ctx, bucket, opts, report))
+	assert.Equal(t, s3SyncTotals{Count: 2, Bytes: 6}, report.Totals[s3SyncUploaded])
+
+	exists, err := bucket.Exists(ctx, "prefix/"+s3ManifestName)
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	opts.Local = dst
+	report = newS3SyncReport("pull", "test", opts)
+	require.NoError(t, pullS3Sync(ctx, bucket, opts, report))
+	assert.Equal(t, s3SyncTotals{Count: 2, Bytes: 6}, report.Totals[s3SyncDownloaded])
+	assert.Equal(t, 1, report.Totals[s3SyncDeleted].Count)
+
+	data, err := os.ReadFile(filepath.Join(dst, "dir", "two.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "two", string(data))
+	_, err = os.Stat(filepath.Join(dst, "stale"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestS3SyncDryRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src := t.TempDir()
+	bucket, err := pail.NewLocalBucket(pail.LocalOptions{Path: t.TempDir(), UseSlash: true})
+	require.NoError(t, err)
+	writeTestFiles(t, src, map[string]string{"one.txt": "one"})
+
+	opts := s3SyncOptions{Local: src, Remote: "prefix", DryRun: true, Manifest: true}
+	report := newS3SyncReport("push", "test", opts)
+	require.NoError(t, pushS3Sync(ctx, bucket, opts, report))
+	assert.Equal(t, 1, report.Totals[s3SyncUploaded].Count)
+
+	for _, key := range []string{"prefix/one.txt", "prefix/" + s3ManifestName} {
+		exists, err := bucket.Exists(ctx, key)
+		require.NoError(t, err)
+		assert.False(t, exists)
+	}
+}
+
+func TestS3SyncReport(t *testing.T) {
+	opts := s3SyncOptions{Local: "local", Remote: "prefix"}
+	report := newS3SyncReport("push", "bucket", opts)
+
+	report.add("b", s3SyncUploaded, 10, report.StartedAt, nil)
+	report.add("a", s3SyncSkipped, 0, report.StartedAt, nil)
+	report.add("c", s3SyncUploaded, 5, report.StartedAt, errors.New("failed"))
+
+	path := filepath.Join(t.TempDir(), "report.json")
+	err := finishS3SyncReport(report, path, errors.New("sync failed"))
+	assert.Error(t, err)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	decoded := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, "push", decoded["operation"])
+
+	require.Len(t, report.Entries, 3)
+	assert.Equal(t, "a", report.Entries[0].Key)
+	assert.Equal(t, s3SyncFailed, report.Entries[2].Action)
+	assert.Equal(t, "failed", report.Entries[2].Error)
+	assert.Equal(t, s3SyncTotals{Count: 1, Bytes: 10}, report.Totals[s3SyncUploaded])
+	assert.Equal(t, s3SyncTotals{Count: 1, Bytes: 5}, report.Totals[s3SyncFailed])
+
+	msg := report.message()
+	assert.Equal(t, 1, msg["uploaded"])
+	assert.Equal(t, 1, msg["skipped"])
+}
+
+func TestS3SyncMultipartETags(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src := t.TempDir()
+	bucket, err := pail.NewLocalBucket(pail.LocalOptions{Path: t.TempDir(), UseSlash: true})
+	require.NoError(t, err)
+	writeTestFiles(t, src, map[string]string{
+		"same.txt":    "same",
+		"changed.txt": "changed",
+	})
+
+	sameETag, err := multipartETag(filepath.Join(src, "same.txt"), 8<<20)
+	require.NoError(t, err)
+	assert.Equal(t, "-1", sameETag[len(sameETag)-2:])
+
+	opts := s3SyncOptions{
+		Local:  src,
+		Remote: "prefix",
+		ListRemote: func(context.Context, string) (*s3Manifest, error) {
+			manifest := newS3Manifest()
+			manifest.Entries["same.txt"] = s3ManifestEntry{Size: 4, MD5: sameETag}
+			manifest.Entries["changed.txt"] = s3ManifestEntry{Size: 7, MD5: sameETag}
+			return manifest, nil
+		},
+	}
+	report := newS3SyncReport("push", "test", opts)
+	require.NoError(t, pushS3Sync(ctx, bucket, opts, report))
+	assert.Equal(t, 1, report.Totals[s3SyncSkipped].Count)
+	assert.Equal(t, 1, report.Totals[s3SyncUploaded].Count)
+	report.finish()
+	require.Len(t, report.Entries, 2)
+	assert.Equal(t, "changed.txt", report.Entries[0].Key)
+	assert.Equal(t, s3SyncUploaded, report.Entries[0].Action)
+
+	t.Run("SeveralParts", func(t *testing.T) {
+		fn := filepath.Join(t.TempDir(), "large")
+		require.NoError(t, os.WriteFile(fn, make([]byte, 12<<20), 0644))
+
+		etag, err := multipartETag(fn, 5<<20)
+		require.NoError(t, err)
+		assert.Equal(t, int64(3), s3MultipartETagParts(etag))
+
+		match, err := matchesMultipartETag(fn, 12<<20, etag, 3)
+		require.NoError(t, err)
+		assert.True(t, match)
+		match, err = matchesMultipartETag(fn, 12<<20, etag[:len(etag)-1]+"2", 2)
+		require.NoError(t, err)
+		assert.False(t, match)
+	})
+	t.Run("NotMultipart", func(t *testing.T) {
+		assert.Zero(t, s3MultipartETagParts("d41d8cd98f00b204e9800998ecf8427e"))
+		assert.Zero(t, s3MultipartETagParts(""))
+	})
+}
+
+func TestS3SyncPullRejectsEscapingKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	parent := t.TempDir()
+	dst := filepath.Join(parent, "dst")
+	bucket, err := pail.NewLocalBucket(pail.LocalOptions{Path: t.TempDir(), UseSlash: true})
+	require.NoError(t, err)
+
+	for _, key := range []string{"../escape", "dir/../../escape"} {
+		opts := s3SyncOptions{
+			Local:  dst,
+			Remote: "prefix",
+			ListRemote: func(context.Context, string) (*s3Manifest, error) {
+				manifest := newS3Manifest()
+				manifest.Entries[key] = s3ManifestEntry{Size: 3, MD5: "abc"}
+				manifest.Entries["fine"] = s3ManifestEntry{Size: 3, MD5: "abc"}
+				return manifest, nil
+			},
+		}
+		assert.Error(t, pullS3Sync(ctx, bucket, opts, newS3SyncReport("pull", "test", opts)), key)
+		assert.NoFileExists(t, filepath.Join(parent, "escape"))
+		assert.NoDirExists(t, dst, "nothing is written before the keys are checked")
+	}
+}
+
+func TestS3SyncParallelDeletes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src := t.TempDir()
+	dst := t.TempDir()
+	bucket, err := pail.NewLocalBucket(pail.LocalOptions{Path: t.TempDir(), UseSlash: true})
+	require.NoError(t, err)
+
+	stale := map[string]string{}
+	for i := 0; i < 20; i++ {
+		stale[fmt.Sprintf("stale-%d", i)] = "stale"
+	}
+	writeTestFiles(t, src, stale)
+	opts := s3SyncOptions{Local: src, Remote: "prefix", Workers: 4}
+	require.NoError(t, pushS3Sync(ctx, bucket, opts, newS3SyncReport("push", "test", opts)))
+	writeTestFiles(t, dst, stale)
+
+	empty := t.TempDir()
+	opts = s3SyncOptions{Local: empty, Remote: "prefix", Workers: 4, Delete: true}
+	report := newS3SyncReport("push", "test", opts)
+	require.NoError(t, pushS3Sync(ctx, bucket, opts, report))
+	assert.Equal(t, 20, report.Totals[s3SyncDeleted].Count)
+
+	opts.Local = dst
+	report = newS3SyncReport("pull", "test", opts)
+	require.NoError(t, pullS3Sync(ctx, bucket, opts, report))
+	assert.Equal(t, 20, report.Totals[s3SyncDeleted].Count)
+	entries, err := os.ReadDir(dst)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+type failingSyncBucket struct {
+	pail.Bucket
+	failPut    map[string]bool
+	failRemove map[string]bool
+}
+
+func (b *failingSyncBucket) Put(ctx context.Context, key string, r io.Reader) error {
+	if b.failPut[key] {
+		return errors.Errorf("put '%s' failed", key)
+	}
+	return b.Bucket.Put(ctx, key, r)
+}
+
+func (b *failingSyncBucket) Remove(ctx context.Context, key string) error {
+	if b.failRemove[key] {
+		return errors.Errorf("remove '%s' failed", key)
+	}
+	return b.Bucket.Remove(ctx, key)
+}
+
+func TestS3SyncFailures(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	setup := func(t *testing.T) (*failingSyncBucket, string) {
+		local, err := pail.NewLocalBucket(pail.LocalOptions{Path: t.TempDir(), UseSlash: true})
+		require.NoError(t, err)
+		for _, key := range []string{"stale-1", "stale-2"} {
+			require.NoError(t, local.Put(ctx, "prefix/"+key, strings.NewReader("stale")))
+		}
+
+		src := t.TempDir()
+		writeTestFiles(t, src, map[string]string{"a": "a", "b": "b", "c": "c"})
+		return &failingSyncBucket{Bucket: local, failPut: map[string]bool{}, failRemove: map[string]bool{}}, src
+	}
+
+	t.Run("ReportsCancelledKeys", func(t *testing.T) {
+		bucket, src := setup(t)
+		bucket.failPut["prefix/a"] = true
+
+		opts := s3SyncOptions{Local: src, Remote: "prefix", Workers: 1, Delete: true}
+		report := newS3SyncReport("push", "test", opts)
+		assert.Error(t, pushS3Sync(ctx, bucket, opts, report))
+
+		report.finish()
+		keys := []string{}
+		for _, entry := range report.Entries {
+			keys = append(keys, entry.Key)
+			assert.Equal(t, s3SyncFailed, entry.Action, entry.Key)
+			assert.NotEmpty(t, entry.Error, entry.Key)
+		}
+		assert.ElementsMatch(t, []string{"a", "b", "c", "stale-1", "stale-2"}, keys)
+
+		exists, err := bucket.Exists(ctx, "prefix/stale-1")
+		require.NoError(t, err)
+		assert.True(t, exists, "nothing is deleted after a failed upload")
+	})
+	t.Run("PushDeletesContinue", func(t *testing.T) {
+		bucket, src := setup(t)
+		bucket.failRemove["prefix/stale-1"] = true
+		remote := newS3Manifest()
+		remote.Entries["stale-1"] = s3ManifestEntry{Size: 5, MD5: "stale"}
+		remote.Entries["stale-2"] = s3ManifestEntry{Size: 5, MD5: "stale"}
+		require.NoError(t, writeRemoteManifest(ctx, bucket, "prefix", remote))
+
+		opts := s3SyncOptions{Local: src, Remote: "prefix", Workers: 1, Delete: true, Manifest: true}
+		report := newS3SyncReport("push", "test", opts)
+		assert.Error(t, pushS3Sync(ctx, bucket, opts, report))
+		assert.Equal(t, 3, report.Totals[s3SyncUploaded].Count)
+		assert.Equal(t, 1, report.Totals[s3SyncDeleted].Count)
+		assert.Equal(t, 1, report.Totals[s3SyncFailed].Count)
+
+		exists, err := bucket.Exists(ctx, "prefix/stale-2")
+		require.NoError(t, err)
+		assert.False(t, exists)
+
+		manifest, err := fetchRemoteManifest(ctx, bucket, "prefix")
+		require.NoError(t, err)
+		assert.Contains(t, manifest.Entries, "stale-1", "the manifest keeps objects that weren't deleted")
+		assert.NotContains(t, manifest.Entries, "stale-2")
+	})
+}
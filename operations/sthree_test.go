@@ -29,16 +29,18 @@ func (s *CommandsSuite) TestSyncFlagsFactory() {
 	for _, flag := range flags {
 		flagName := flag.GetName()
 		names[flagName] = true
-		if flagName == "local" || flagName == "exclude" {
+		if flagName == "local" || flagName == "exclude" || flagName == "report" {
 			f, ok := flag.(cli.StringFlag)
 			s.True(ok)
 			if flagName == "local" {
 				s.Equal(pwd, f.Value)
 			}
-		} else if flagName == "dry-run" || flagName == "delete" {
+		} else if flagName == "dry-run" || flagName == "delete" || flagName == "manifest" || flagName == "adaptive" {
 			s.IsType(cli.BoolFlag{}, flag)
-		} else if flagName == "timeout" {
+		} else if flagName == "timeout" || flagName == "newer-than" || flagName == "older-than" {
 			s.IsType(cli.DurationFlag{}, flag)
+		} else if flagName == "include" || flagName == "exclude-glob" {
+			s.IsType(cli.StringSliceFlag{}, flag)
 		} else if flagName == "workers" {
 			s.IsType(cli.IntFlag{}, flag)
 		} else {
@@ -46,14 +48,24 @@ func (s *CommandsSuite) TestSyncFlagsFactory() {
 		}
 	}
 
-	s.Len(names, 6)
-	s.Len(flags, 6)
+	s.Len(names, 16)
+	s.Len(flags, 16)
 	s.True(names["local"])
 	s.True(names["prefix"])
 	s.True(names["delete"])
+	s.True(names["include"])
 	s.True(names["exclude"])
+	s.True(names["exclude-glob"])
+	s.True(names["min-size"])
+	s.True(names["max-size"])
+	s.True(names["newer-than"])
+	s.True(names["older-than"])
 	s.True(names["timeout"])
 	s.True(names["workers"])
+	s.True(names["manifest"])
+	s.True(names["report"])
+	s.True(names["max-bandwidth"])
+	s.True(names["adaptive"])
 }
 
 func (s *CommandsSuite) TestS3ParentCommandHasExpectedProperties() {
@@ -67,7 +79,7 @@ func (s *CommandsSuite) TestS3ParentCommandHasExpectedProperties() {
 		if sub.Name == "put" {
 			s.Equal(sub.Flags, baseS3Flags(s3opFlags(s3putFlags()...)...))
 		} else if sub.Name == "get" {
-			s.Equal(sub.Flags, baseS3Flags(s3opFlags()...))
+			s.Equal(sub.Flags, baseS3Flags(s3opFlags(s3getFlags()...)...))
 		} else if sub.Name == "sync-to" {
 			s.Equal(sub.Flags, baseS3Flags(s3syncFlags(s3synctoFlags()...)...))
 		} else if sub.Name == "sync-from" {
@@ -75,7 +87,7 @@ func (s *CommandsSuite) TestS3ParentCommandHasExpectedProperties() {
 		}
 	}
 
-	s.Len(cmd.Subcommands, 7)
+	s.Len(cmd.Subcommands, 14)
 	s.Equal(cmd.Name, "s3")
 	s.Len(cmd.Aliases, 1)
 
@@ -85,4 +97,11 @@ func (s *CommandsSuite) TestS3ParentCommandHasExpectedProperties() {
 	s.True(names["delete-prefix"])
 	s.True(names["sync-to"])
 	s.True(names["sync-from"])
+	s.True(names["ls"])
+	s.True(names["du"])
+	s.True(names["copy"])
+	s.True(names["move"])
+	s.True(names["presign"])
+	s.True(names["prune"])
+	s.True(names["versions"])
 }
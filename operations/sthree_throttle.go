@@ -0,0 +1,388 @@
+package operations
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/evergreen-ci/pail"
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+)
+
+const (
+	// s3AdaptiveMaxWorkers is the maximum number of workers in adaptive
+	// mode when no worker count is given.
+	s3AdaptiveMaxWorkers = 16
+
+	// s3SlowDownAttempts is the number of times adaptive mode attempts
+	// a transfer that S3 responds to with a SlowDown error.
+	s3SlowDownAttempts = 5
+
+	// s3ThrottleChunkSize is the largest read that waits on the
+	// bandwidth limiter at once, which keeps the transfer smooth.
+	s3ThrottleChunkSize = 32 * 1024
+
+	defaultS3AdaptiveInterval = 5 * time.Second
+)
+
+// s3TransferThrottle limits the bandwidth and concurrency of the
+// transfers in a sync operation. A nil throttle does not limit
+// anything.
+type s3TransferThrottle struct {
+	limiter     *s3BandwidthLimiter
+	concurrency *s3ConcurrencyController
+}
+
+// newS3TransferThrottle returns a throttle that shares the maximum
+// bandwidth, in bytes per second, across all workers. In adaptive
+// mode, the number of concurrent transfers is scaled between one and
+// the given number of workers.
+func newS3TransferThrottle(maxBandwidth int64, workers int, adaptive bool) *s3TransferThrottle {
+	if maxBandwidth <= 0 && !adaptive {
+		return nil
+	}
+
+	throttle := &s3TransferThrottle{}
+	if maxBandwidth > 0 {
+		throttle.limiter = &s3BandwidthLimiter{bytesPerSec: float64(maxBandwidth)}
+	}
+	if adaptive {
+		throttle.concurrency = newS3ConcurrencyController(workers, defaultS3AdaptiveInterval)
+	}
+
+	return throttle
+}
+
+// run performs a transfer once the concurrency controller allows it.
+// In adaptive mode, transfers that fail with a SlowDown error are
+// retried with a backoff after the concurrency has been reduced.
+func (t *s3TransferThrottle) run(ctx context.Context, op func(context.Context) error) error {
+	if t == nil || t.concurrency == nil {
+		return op(ctx)
+	}
+
+	for attempt := 1; ; attempt++ {
+		if err := t.concurrency.acquire(ctx); err != nil {
+			return errors.WithStack(err)
+		}
+		err := op(ctx)
+		t.concurrency.release(err)
+
+		if !isS3SlowDown(err) || attempt >= s3SlowDownAttempts {
+			return err
+		}
+
+		timer := time.NewTimer(time.Duration(attempt) * time.Second)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.WithStack(ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+// observeRetries configures an S3 client to report every attempt that
+// fails with a SlowDown error to the concurrency controller, including
+// the attempts that the SDK retries on its own, which would otherwise
+// never reach the throttle.
+func (t *s3TransferThrottle) observeRetries(o *s3.Options) {
+	if t == nil || t.concurrency == nil {
+		return
+	}
+
+	o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+		return stack.Finalize.Insert(middleware.FinalizeMiddlewareFunc("ObserveSlowDown",
+			func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+				out, metadata, err := next.HandleFinalize(ctx, in)
+				if isS3SlowDown(err) {
+					t.concurrency.slowDown()
+				}
+				return out, metadata, err
+			}), "Retry", middleware.After)
+	})
+}
+
+// reader wraps the reader so that reads are limited by the bandwidth
+// limiter and counted towards the throughput of the sync.
+func (t *s3TransferThrottle) reader(ctx context.Context, r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+
+	return &s3ThrottledReader{ctx: ctx, reader: r, throttle: t}
+}
+
+// upload writes the local file to the key in the bucket.
+func (t *s3TransferThrottle) upload(ctx context.Context, bucket pail.Bucket, key, path string) error {
+	return t.run(ctx, func(ctx context.Context) error {
+		file, err := os.Open(path)
+		if err != nil {
+			return errors.Wrapf(err, "opening file '%s'", path)
+		}
+		defer func() { grip.Warning(file.Close()) }()
+
+		return errors.Wrapf(bucket.Put(ctx, key, t.reader(ctx, file)), "putting '%s'", key)
+	})
+}
+
+// download writes the object at the key to the local file.
+func (t *s3TransferThrottle) download(ctx context.Context, bucket pail.Bucket, key, path string) error {
+	return t.run(ctx, func(ctx context.Context) error {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return errors.Wrapf(err, "creating directory for '%s'", path)
+		}
+
+		body, err := bucket.Get(ctx, key)
+		if err != nil {
+			return errors.Wrapf(err, "getting '%s'", key)
+		}
+		defer func() { grip.Warning(body.Close()) }()
+
+		file, err := os.Create(path)
+		if err != nil {
+			return errors.Wrapf(err, "creating file '%s'", path)
+		}
+
+		catcher := grip.NewBasicCatcher()
+		_, err = io.Copy(file, t.reader(ctx, body))
+		catcher.Wrapf(err, "writing '%s' to '%s'", key, path)
+		catcher.Wrapf(file.Close(), "closing file '%s'", path)
+
+		return catcher.Resolve()
+	})
+}
+
+type s3ThrottledReader struct {
+	ctx      context.Context
+	reader   io.Reader
+	throttle *s3TransferThrottle
+}
+
+func (r *s3ThrottledReader) Read(p []byte) (int, error) {
+	if r.throttle.limiter != nil && len(p) > s3ThrottleChunkSize {
+		p = p[:s3ThrottleChunkSize]
+	}
+
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.throttle.concurrency.record(int64(n))
+		if waitErr := r.throttle.limiter.wait(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+
+	return n, err
+}
+
+// s3BandwidthLimiter schedules reads so that the total rate across
+// all of its users does not exceed the limit.
+type s3BandwidthLimiter struct {
+	bytesPerSec float64
+	next        time.Time
+	mu          sync.Mutex
+}
+
+// wait blocks until the n bytes that were read are within the limit.
+func (l *s3BandwidthLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / l.bytesPerSec * float64(time.Second)))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	case <-timer.C:
+		return nil
+	}
+}
+
+// s3ConcurrencyController limits the number of concurrent transfers,
+// halving the limit when S3 responds with SlowDown and otherwise
+// moving it in whichever direction last improved the throughput.
+type s3ConcurrencyController struct {
+	limit       int
+	max         int
+	active      int
+	direction   int
+	interval    time.Duration
+	windowStart time.Time
+	windowBytes int64
+	lastRate    float64
+	slowedDown  time.Time
+	mu          sync.Mutex
+	cond        *sync.Cond
+}
+
+func newS3ConcurrencyController(max int, interval time.Duration) *s3ConcurrencyController {
+	if max < 1 {
+		max = 1
+	}
+
+	c := &s3ConcurrencyController{
+		limit:       (max + 1) / 2,
+		max:         max,
+		direction:   1,
+		interval:    interval,
+		windowStart: time.Now(),
+	}
+	c.cond = sync.NewCond(&c.mu)
+
+	return c
+}
+
+func (c *s3ConcurrencyController) acquire(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.cond.Broadcast()
+	})
+	defer stop()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.active >= c.limit {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		c.cond.Wait()
+	}
+	c.active++
+
+	return nil
+}
+
+func (c *s3ConcurrencyController) release(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.active--
+	now := time.Now()
+	if isS3SlowDown(err) {
+		c.backOff(now)
+	} else {
+		c.adjust(now)
+	}
+
+	c.cond.Broadcast()
+}
+
+// slowDown halves the limit in response to a SlowDown response that
+// the SDK retries, which otherwise never reaches release.
+func (c *s3ConcurrencyController) slowDown() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.backOff(time.Now())
+}
+
+func (c *s3ConcurrencyController) backOff(now time.Time) {
+	// only back off once per interval, since every transfer in
+	// flight is likely to see the same response.
+	if now.Sub(c.slowedDown) < c.interval {
+		return
+	}
+
+	c.slowedDown = now
+	c.setLimit(c.limit/2, 0, true)
+	c.direction = 1
+	c.lastRate = 0
+	c.windowStart = now
+	c.windowBytes = 0
+}
+
+func (c *s3ConcurrencyController) record(n int64) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.windowBytes += n
+}
+
+// adjust compares the throughput of the last interval to the one
+// before it, and reverses the direction of the change to the limit
+// if the throughput dropped.
+func (c *s3ConcurrencyController) adjust(now time.Time) {
+	elapsed := now.Sub(c.windowStart)
+	if elapsed < c.interval {
+		return
+	}
+
+	rate := float64(c.windowBytes) / elapsed.Seconds()
+	if c.lastRate > 0 && rate < c.lastRate*0.95 {
+		c.direction = -c.direction
+	}
+	c.lastRate = rate
+	c.windowStart = now
+	c.windowBytes = 0
+
+	c.setLimit(c.limit+c.direction, rate, false)
+}
+
+func (c *s3ConcurrencyController) setLimit(limit int, rate float64, slowDown bool) {
+	if limit < 1 {
+		limit = 1
+	}
+	if limit > c.max {
+		limit = c.max
+	}
+	if limit == c.limit {
+		return
+	}
+
+	grip.Debug(message.Fields{
+		"message":       "adjusting transfer concurrency",
+		"previous":      c.limit,
+		"workers":       limit,
+		"max_workers":   c.max,
+		"bytes_per_sec": rate,
+		"slow_down":     slowDown,
+	})
+	c.limit = limit
+}
+
+// isS3SlowDown reports whether the error is S3 asking the client to
+// reduce its request rate, either with a SlowDown error code or with
+// a 503 response.
+func isS3SlowDown(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "SlowDown" {
+		return true
+	}
+
+	var respErr *smithyhttp.ResponseError
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusServiceUnavailable
+}
@@ -0,0 +1,169 @@
+package operations
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/evergreen-ci/pail"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestS3BandwidthLimiter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	throttle := newS3TransferThrottle(64*1024, 1, false)
+	require.NotNil(t, throttle)
+
+	data := make([]byte, 96*1024)
+	startAt := time.Now()
+	n, err := io.Copy(io.Discard, throttle.reader(ctx, bytes.NewReader(data)))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	// the first chunk is free, and the remaining 64KiB take a second.
+	assert.True(t, time.Since(startAt) >= 900*time.Millisecond)
+
+	cancel()
+	_, err = io.Copy(io.Discard, throttle.reader(ctx, bytes.NewReader(data)))
+	assert.Error(t, err)
+}
+
+func TestS3TransferThrottleDisabled(t *testing.T) {
+	assert.Nil(t, newS3TransferThrottle(0, 4, false))
+
+	var throttle *s3TransferThrottle
+	r := bytes.NewReader([]byte("data"))
+	assert.Equal(t, r, throttle.reader(context.Background(), r))
+	assert.NoError(t, throttle.run(context.Background(), func(context.Context) error { return nil }))
+}
+
+func TestS3ConcurrencyController(t *testing.T) {
+	ctx := context.Background()
+	slowDown := errors.Wrap(&smithy.GenericAPIError{Code: "SlowDown"}, "putting object")
+
+	c := newS3ConcurrencyController(8, time.Millisecond)
+	assert.Equal(t, 4, c.limit)
+
+	require.NoError(t, c.acquire(ctx))
+	c.release(slowDown)
+	assert.Equal(t, 2, c.limit)
+
+	// the throughput increases, so the limit keeps growing.
+	for _, n := range []int64{100, 100000} {
+		time.Sleep(2 * time.Millisecond)
+		require.NoError(t, c.acquire(ctx))
+		c.record(n)
+		c.release(nil)
+	}
+	assert.Equal(t, 4, c.limit)
+
+	// the throughput drops, so the limit shrinks.
+	time.Sleep(2 * time.Millisecond)
+	require.NoError(t, c.acquire(ctx))
+	c.release(nil)
+	assert.Equal(t, 3, c.limit)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, c.acquire(ctx))
+	}
+	canceled, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	assert.Error(t, c.acquire(canceled), "acquire blocks at the limit")
+}
+
+func TestS3TransferThrottleRetriesSlowDown(t *testing.T) {
+	throttle := newS3TransferThrottle(0, 2, true)
+	require.NotNil(t, throttle)
+
+	attempts := 0
+	err := throttle.run(context.Background(), func(context.Context) error {
+		attempts++
+		if attempts == 1 {
+			return &smithy.GenericAPIError{Code: "SlowDown", Message: "please reduce your request rate"}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+
+	attempts = 0
+	err = throttle.run(context.Background(), func(context.Context) error {
+		attempts++
+		return errors.New("access denied")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestIsS3SlowDown(t *testing.T) {
+	assert.False(t, isS3SlowDown(nil))
+	assert.False(t, isS3SlowDown(errors.New("not found")))
+	assert.False(t, isS3SlowDown(&smithy.GenericAPIError{Code: "NoSuchKey"}))
+	assert.True(t, isS3SlowDown(errors.Wrap(&smithy.GenericAPIError{Code: "SlowDown"}, "context")))
+	assert.False(t, isS3SlowDown(errors.New("uploading 'builds/SlowDown.log': access denied")), "keys are not error codes")
+
+	respErr := func(status int) error {
+		return &smithyhttp.ResponseError{
+			Response: &smithyhttp.Response{Response: &http.Response{StatusCode: status}},
+			Err:      errors.New("request failed"),
+		}
+	}
+	assert.True(t, isS3SlowDown(errors.Wrap(respErr(http.StatusServiceUnavailable), "context")))
+	assert.False(t, isS3SlowDown(respErr(http.StatusForbidden)))
+}
+
+func TestS3TransferThrottleObservesRetriedSlowDown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fake, _ := newFakeS3Server(t)
+	var slowDowns int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// only the first attempt fails, so the SDK's own retry succeeds.
+		if r.Method == http.MethodPut && atomic.AddInt32(&slowDowns, 1) == 1 {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = io.WriteString(w, "<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>")
+			return
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	throttle := newS3TransferThrottle(0, 8, true)
+	require.NotNil(t, throttle)
+	assert.Equal(t, 4, throttle.concurrency.limit)
+
+	endpoint := s3EndpointOptions{Endpoint: strings.Replace(srv.URL, "127.0.0.1", "localhost", 1), PathStyle: true}
+	require.NoError(t, endpoint.validate())
+	opts := pail.S3Options{
+		Name:        "bucket",
+		Region:      "us-east-1",
+		Credentials: pail.CreateAWSStaticCredentials("key", "secret", ""),
+	}
+	svc, err := newS3Client(ctx, nil, endpoint, opts, throttle.observeRetries)
+	require.NoError(t, err)
+	bucket, err := newS3EndpointBucket(svc, 1, opts)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(path, []byte("data"), 0644))
+	require.NoError(t, throttle.upload(ctx, bucket, "key", path))
+
+	assert.EqualValues(t, 2, atomic.LoadInt32(&slowDowns))
+	assert.Equal(t, []byte("data"), fake.objects["bucket/key"])
+	assert.Equal(t, 2, throttle.concurrency.limit, "the retried SlowDown reduces the concurrency")
+}
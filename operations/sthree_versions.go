@@ -0,0 +1,507 @@
+package operations
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+const (
+	s3VersionRestore = "restore"
+	s3VersionDelete  = "delete"
+	s3VersionPurge   = "purge"
+
+	// s3MaxDeleteObjects is the largest number of keys that S3 accepts
+	// in a single DeleteObjects request.
+	s3MaxDeleteObjects = 1000
+)
+
+func s3VersionsCmd() cli.Command {
+	return cli.Command{
+		Name:  "versions",
+		Usage: "inspect and manage the versions of objects in a bucket with versioning enabled",
+		Subcommands: []cli.Command{
+			{
+				Name:  "list",
+				Usage: "list every version and delete marker of an object or of the objects under a prefix",
+				Flags: baseS3Flags(s3versionsFlags()...),
+				Action: func(c *cli.Context) error {
+					return errors.WithStack(runS3VersionsCmd(c, func(ctx context.Context, client s3VersionClient, opts s3VersionOptions) ([]s3VersionAction, error) {
+						versions, err := listS3ObjectVersions(ctx, client, opts)
+						if err != nil {
+							return nil, errors.WithStack(err)
+						}
+						if c.Bool("json") {
+							return nil, errors.WithStack(writeJSON(os.Stdout, versions))
+						}
+						return nil, errors.WithStack(writeS3VersionTable(os.Stdout, versions))
+					}))
+				},
+			},
+			{
+				Name:  "restore",
+				Usage: "make the version that was current at a point in time the current version again",
+				Flags: baseS3Flags(s3versionsFlags(
+					cli.StringFlag{
+						Name:  "at",
+						Usage: "the time to restore objects to, in RFC 3339 format (e.g. 2024-01-02T15:04:05Z)",
+					})...),
+				Action: func(c *cli.Context) error {
+					return errors.WithStack(runS3VersionsCmd(c, func(ctx context.Context, client s3VersionClient, opts s3VersionOptions) ([]s3VersionAction, error) {
+						if c.String("at") == "" {
+							return nil, errors.New("must specify a time to restore to")
+						}
+						at, err := time.Parse(time.RFC3339, c.String("at"))
+						if err != nil {
+							return nil, errors.Wrapf(err, "parsing time '%s'", c.String("at"))
+						}
+
+						return restoreS3ObjectVersions(ctx, client, opts, at)
+					}))
+				},
+			},
+			{
+				Name:  "purge",
+				Usage: "permanently delete the noncurrent versions and delete markers of objects",
+				Flags: baseS3Flags(s3versionsFlags(
+					cli.StringFlag{
+						Name:  "before",
+						Usage: "only purge versions last modified before this time, in RFC 3339 format",
+					},
+					cli.BoolFlag{
+						Name:  "all",
+						Usage: "also purge current versions, which permanently deletes the objects",
+					})...),
+				Action: func(c *cli.Context) error {
+					return errors.WithStack(runS3VersionsCmd(c, func(ctx context.Context, client s3VersionClient, opts s3VersionOptions) ([]s3VersionAction, error) {
+						var before time.Time
+						if value := c.String("before"); value != "" {
+							var err error
+							before, err = time.Parse(time.RFC3339, value)
+							if err != nil {
+								return nil, errors.Wrapf(err, "parsing time '%s'", value)
+							}
+						}
+
+						return purgeS3ObjectVersions(ctx, client, opts, before, c.Bool("all"))
+					}))
+				},
+			},
+		},
+	}
+}
+
+// s3VersionClient is the subset of the S3 client used to manage object
+// versions, which allows the logic to be tested without S3.
+type s3VersionClient interface {
+	ListObjectVersions(context.Context, *s3.ListObjectVersionsInput, ...func(*s3.Options)) (*s3.ListObjectVersionsOutput, error)
+	s3CopyClient
+	DeleteObject(context.Context, *s3.DeleteObjectInput, ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	DeleteObjects(context.Context, *s3.DeleteObjectsInput, ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+}
+
+// s3VersionOptions select the objects that a versions command operates
+// on: either a single key or every key under a prefix.
+type s3VersionOptions struct {
+	Bucket string
+	Key    string
+	Prefix string
+	DryRun bool
+}
+
+func (opts *s3VersionOptions) validate() error {
+	catcher := grip.NewBasicCatcher()
+	catcher.NewWhen(opts.Bucket == "", "must specify a bucket")
+	catcher.NewWhen(opts.Key == "" && opts.Prefix == "", "must specify either an object name or a prefix")
+	catcher.NewWhen(opts.Key != "" && opts.Prefix != "", "cannot specify both an object name and a prefix")
+
+	return catcher.Resolve()
+}
+
+// s3ObjectVersion describes a single version of an object, which may
+// be a delete marker.
+type s3ObjectVersion struct {
+	Key          string    `json:"key"`
+	VersionID    string    `json:"version_id"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	ETag         string    `json:"etag,omitempty"`
+	IsLatest     bool      `json:"is_latest"`
+	DeleteMarker bool      `json:"delete_marker"`
+}
+
+// s3VersionAction describes a change made, or in dry-run mode that
+// would be made, to a version of an object.
+type s3VersionAction struct {
+	Key          string    `json:"key"`
+	Action       string    `json:"action"`
+	VersionID    string    `json:"version_id,omitempty"`
+	LastModified time.Time `json:"last_modified,omitempty"`
+	DryRun       bool      `json:"dry_run"`
+}
+
+func runS3VersionsCmd(c *cli.Context, op func(context.Context, s3VersionClient, s3VersionOptions) ([]s3VersionAction, error)) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := setVerboseLogging(c.Bool("verbose")); err != nil {
+		return err
+	}
+
+	opts := s3VersionOptions{
+		Bucket: c.String("bucket"),
+		Key:    c.String("name"),
+		Prefix: c.String("prefix"),
+		DryRun: c.Bool("dry-run"),
+	}
+	if err := opts.validate(); err != nil {
+		return errors.Wrap(err, "invalid options")
+	}
+
+	client, err := s3ClientFromFlags(ctx, c)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	actions, err := op(ctx, client, opts)
+	if actions == nil {
+		return errors.WithStack(err)
+	}
+
+	catcher := grip.NewBasicCatcher()
+	catcher.Add(err)
+	if c.Bool("json") {
+		catcher.Add(writeJSON(os.Stdout, actions))
+	} else {
+		catcher.Add(writeS3VersionActionTable(os.Stdout, actions))
+	}
+
+	return catcher.Resolve()
+}
+
+// listS3ObjectVersions returns every version of the selected objects,
+// ordered by key and then from newest to oldest.
+func listS3ObjectVersions(ctx context.Context, client s3VersionClient, opts s3VersionOptions) ([]s3ObjectVersion, error) {
+	if err := opts.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid options")
+	}
+
+	prefix := opts.Prefix
+	if opts.Key != "" {
+		prefix = opts.Key
+	}
+
+	input := &s3.ListObjectVersionsInput{
+		Bucket: aws.String(opts.Bucket),
+		Prefix: aws.String(prefix),
+	}
+	out := []s3ObjectVersion{}
+	for {
+		page, err := client.ListObjectVersions(ctx, input)
+		if err != nil {
+			return nil, errors.Wrapf(err, "listing versions with prefix '%s' in bucket '%s'", prefix, opts.Bucket)
+		}
+
+		for _, v := range page.Versions {
+			out = append(out, s3ObjectVersion{
+				Key:          aws.ToString(v.Key),
+				VersionID:    aws.ToString(v.VersionId),
+				Size:         aws.ToInt64(v.Size),
+				LastModified: aws.ToTime(v.LastModified),
+				ETag:         strings.Trim(aws.ToString(v.ETag), `"`),
+				IsLatest:     aws.ToBool(v.IsLatest),
+			})
+		}
+		for _, m := range page.DeleteMarkers {
+			out = append(out, s3ObjectVersion{
+				Key:          aws.ToString(m.Key),
+				VersionID:    aws.ToString(m.VersionId),
+				LastModified: aws.ToTime(m.LastModified),
+				IsLatest:     aws.ToBool(m.IsLatest),
+				DeleteMarker: true,
+			})
+		}
+
+		if !aws.ToBool(page.IsTruncated) {
+			break
+		}
+		input.KeyMarker = page.NextKeyMarker
+		input.VersionIdMarker = page.NextVersionIdMarker
+	}
+
+	if opts.Key != "" {
+		exact := out[:0]
+		for _, v := range out {
+			if v.Key == opts.Key {
+				exact = append(exact, v)
+			}
+		}
+		out = exact
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Key != out[j].Key {
+			return out[i].Key < out[j].Key
+		}
+		if !out[i].LastModified.Equal(out[j].LastModified) {
+			return out[i].LastModified.After(out[j].LastModified)
+		}
+		return out[i].IsLatest && !out[j].IsLatest
+	})
+
+	return out, nil
+}
+
+// restoreS3ObjectVersions makes the version of each object that was
+// current at the given time the current version again, by copying it
+// over the current version. Objects that did not exist at that time
+// are deleted, which adds a delete marker.
+func restoreS3ObjectVersions(ctx context.Context, client s3VersionClient, opts s3VersionOptions, at time.Time) ([]s3VersionAction, error) {
+	versions, err := listS3ObjectVersions(ctx, client, opts)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	byKey := map[string][]s3ObjectVersion{}
+	keys := []string{}
+	for _, v := range versions {
+		if _, ok := byKey[v.Key]; !ok {
+			keys = append(keys, v.Key)
+		}
+		byKey[v.Key] = append(byKey[v.Key], v)
+	}
+
+	actions := []s3VersionAction{}
+	catcher := grip.NewBasicCatcher()
+	for _, key := range keys {
+		history := byKey[key]
+		var current *s3ObjectVersion
+		for idx := range history {
+			if history[idx].IsLatest {
+				current = &history[idx]
+				break
+			}
+		}
+		if current == nil {
+			catcher.Errorf("no current version of '%s'", key)
+			continue
+		}
+
+		var target *s3ObjectVersion
+		for idx := range history {
+			if !history[idx].LastModified.After(at) {
+				target = &history[idx]
+				break
+			}
+		}
+
+		var action s3VersionAction
+		switch {
+		case target != nil && !target.DeleteMarker:
+			if target.VersionID == current.VersionID {
+				continue
+			}
+			action = s3VersionAction{Key: key, Action: s3VersionRestore, VersionID: target.VersionID, LastModified: target.LastModified}
+		case !current.DeleteMarker:
+			action = s3VersionAction{Key: key, Action: s3VersionDelete, VersionID: current.VersionID, LastModified: current.LastModified}
+		default:
+			continue
+		}
+		action.DryRun = opts.DryRun
+
+		msg := message.Fields{
+			"message":       "restoring object",
+			"key":           key,
+			"action":        action.Action,
+			"version_id":    action.VersionID,
+			"last_modified": action.LastModified,
+			"dry_run":       opts.DryRun,
+		}
+		if opts.DryRun {
+			grip.Info(msg)
+			actions = append(actions, action)
+			continue
+		}
+
+		if action.Action == s3VersionRestore {
+			err = copyS3Object(ctx, client, s3ObjectCopy{
+				SourceBucket:  opts.Bucket,
+				SourceKey:     key,
+				SourceVersion: action.VersionID,
+				Bucket:        opts.Bucket,
+				Key:           key,
+			})
+		} else {
+			_, err = client.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket: aws.String(opts.Bucket),
+				Key:    aws.String(key),
+			})
+		}
+		if err != nil {
+			catcher.Wrapf(err, "restoring '%s'", key)
+			grip.Error(message.WrapError(err, msg))
+			continue
+		}
+
+		grip.Info(msg)
+		actions = append(actions, action)
+	}
+
+	return actions, catcher.Resolve()
+}
+
+// purgeS3ObjectVersions permanently deletes the noncurrent versions
+// and delete markers of the objects, and also the current versions if
+// all is set. If before is set, only versions last modified before
+// then are deleted.
+func purgeS3ObjectVersions(ctx context.Context, client s3VersionClient, opts s3VersionOptions, before time.Time, all bool) ([]s3VersionAction, error) {
+	versions, err := listS3ObjectVersions(ctx, client, opts)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// a current delete marker is only purged along with every version
+	// of its object, since purging it alone would undelete the object.
+	purge := func(v s3ObjectVersion) bool {
+		if !before.IsZero() && !v.LastModified.Before(before) {
+			return false
+		}
+		return all || !v.IsLatest || v.DeleteMarker
+	}
+	kept := map[string]bool{}
+	for _, v := range versions {
+		if !v.DeleteMarker && !purge(v) {
+			kept[v.Key] = true
+		}
+	}
+
+	actions := []s3VersionAction{}
+	for _, v := range versions {
+		if !purge(v) || (v.IsLatest && v.DeleteMarker && kept[v.Key]) {
+			continue
+		}
+		actions = append(actions, s3VersionAction{
+			Key:          v.Key,
+			Action:       s3VersionPurge,
+			VersionID:    v.VersionID,
+			LastModified: v.LastModified,
+			DryRun:       opts.DryRun,
+		})
+	}
+
+	if opts.DryRun {
+		for _, action := range actions {
+			grip.Info(message.Fields{
+				"message":    "would purge version",
+				"key":        action.Key,
+				"version_id": action.VersionID,
+			})
+		}
+		return actions, nil
+	}
+
+	catcher := grip.NewBasicCatcher()
+	purged := []s3VersionAction{}
+	for start := 0; start < len(actions); start += s3MaxDeleteObjects {
+		end := start + s3MaxDeleteObjects
+		if end > len(actions) {
+			end = len(actions)
+		}
+		batch := actions[start:end]
+
+		ids := make([]types.ObjectIdentifier, 0, len(batch))
+		for _, action := range batch {
+			ids = append(ids, types.ObjectIdentifier{
+				Key:       aws.String(action.Key),
+				VersionId: aws.String(action.VersionID),
+			})
+		}
+
+		out, err := client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(opts.Bucket),
+			Delete: &types.Delete{Objects: ids},
+		})
+		if err != nil {
+			catcher.Wrap(err, "deleting object versions")
+			continue
+		}
+
+		failed := map[string]bool{}
+		for _, e := range out.Errors {
+			failed[aws.ToString(e.Key)+"@"+aws.ToString(e.VersionId)] = true
+			catcher.Errorf("deleting version '%s' of '%s': %s", aws.ToString(e.VersionId), aws.ToString(e.Key), aws.ToString(e.Message))
+		}
+		for _, action := range batch {
+			if !failed[action.Key+"@"+action.VersionID] {
+				purged = append(purged, action)
+			}
+		}
+	}
+
+	grip.Info(message.Fields{
+		"message": "purged object versions",
+		"bucket":  opts.Bucket,
+		"key":     opts.Key,
+		"prefix":  opts.Prefix,
+		"purged":  len(purged),
+		"errors":  catcher.Len(),
+	})
+
+	return purged, catcher.Resolve()
+}
+
+func writeS3VersionTable(w io.Writer, versions []s3ObjectVersion) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tVERSION\tSIZE\tLAST MODIFIED\tLATEST\tDELETE MARKER")
+	for _, v := range versions {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%t\t%t\n", v.Key, v.VersionID, v.Size, v.LastModified.UTC().Format(time.RFC3339), v.IsLatest, v.DeleteMarker)
+	}
+
+	return errors.WithStack(tw.Flush())
+}
+
+func writeS3VersionActionTable(w io.Writer, actions []s3VersionAction) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tKEY\tVERSION\tLAST MODIFIED")
+	for _, action := range actions {
+		name := action.Action
+		if action.DryRun {
+			name = "(dry-run) " + name
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", name, action.Key, action.VersionID, action.LastModified.UTC().Format(time.RFC3339))
+	}
+
+	return errors.WithStack(tw.Flush())
+}
+
+func s3versionsFlags(args ...cli.Flag) []cli.Flag {
+	flags := []cli.Flag{
+		cli.StringFlag{
+			Name:  "name",
+			Usage: "the remote s3 resource name, to select a single object",
+		},
+		cli.StringFlag{
+			Name:  "prefix",
+			Usage: "prefix of s3 key names, to select every object under it",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "specify this option to output data as JSON",
+		},
+	}
+
+	return append(flags, args...)
+}
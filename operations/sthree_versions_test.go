@@ -0,0 +1,233 @@
+package operations
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockS3VersionClient struct {
+	versions      []types.ObjectVersion
+	deleteMarkers []types.DeleteMarkerEntry
+	pageSize      int
+	copied        []string
+	multipart     []string
+	deleted       []string
+	purged        []string
+}
+
+func (m *mockS3VersionClient) ListObjectVersions(_ context.Context, in *s3.ListObjectVersionsInput, _ ...func(*s3.Options)) (*s3.ListObjectVersionsOutput, error) {
+	start := 0
+	if in.KeyMarker != nil {
+		for idx, v := range m.versions {
+			if aws.ToString(v.VersionId) == aws.ToString(in.VersionIdMarker) {
+				start = idx + 1
+			}
+		}
+	}
+
+	out := &s3.ListObjectVersionsOutput{}
+	end := len(m.versions)
+	if m.pageSize > 0 && start+m.pageSize < end {
+		end = start + m.pageSize
+		out.IsTruncated = aws.Bool(true)
+		out.NextKeyMarker = m.versions[end-1].Key
+		out.NextVersionIdMarker = m.versions[end-1].VersionId
+	} else {
+		out.DeleteMarkers = m.deleteMarkers
+	}
+	out.Versions = m.versions[start:end]
+
+	return out, nil
+}
+
+func (m *mockS3VersionClient) CopyObject(_ context.Context, in *s3.CopyObjectInput, _ ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	m.copied = append(m.copied, aws.ToString(in.CopySource))
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (m *mockS3VersionClient) HeadObject(_ context.Context, in *s3.HeadObjectInput, _ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	for _, v := range m.versions {
+		if aws.ToString(v.Key) == aws.ToString(in.Key) && aws.ToString(v.VersionId) == aws.ToString(in.VersionId) {
+			return &s3.HeadObjectOutput{ContentLength: v.Size, VersionId: v.VersionId}, nil
+		}
+	}
+	return nil, errors.New("no such version")
+}
+
+func (m *mockS3VersionClient) CreateMultipartUpload(_ context.Context, _ *s3.CreateMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload")}, nil
+}
+
+func (m *mockS3VersionClient) UploadPartCopy(_ context.Context, in *s3.UploadPartCopyInput, _ ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error) {
+	if aws.ToInt32(in.PartNumber) == 1 {
+		m.multipart = append(m.multipart, aws.ToString(in.CopySource))
+	}
+	return &s3.UploadPartCopyOutput{CopyPartResult: &types.CopyPartResult{ETag: aws.String("etag")}}, nil
+}
+
+func (m *mockS3VersionClient) CompleteMultipartUpload(_ context.Context, _ *s3.CompleteMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (m *mockS3VersionClient) AbortMultipartUpload(_ context.Context, _ *s3.AbortMultipartUploadInput, _ ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (m *mockS3VersionClient) DeleteObject(_ context.Context, in *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	m.deleted = append(m.deleted, aws.ToString(in.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (m *mockS3VersionClient) DeleteObjects(_ context.Context, in *s3.DeleteObjectsInput, _ ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	out := &s3.DeleteObjectsOutput{}
+	for _, id := range in.Delete.Objects {
+		if aws.ToString(id.VersionId) == "locked" {
+			out.Errors = append(out.Errors, types.Error{Key: id.Key, VersionId: id.VersionId, Message: aws.String("access denied")})
+			continue
+		}
+		m.purged = append(m.purged, aws.ToString(id.Key)+"@"+aws.ToString(id.VersionId))
+	}
+	return out, nil
+}
+
+func newMockS3VersionClient(now time.Time) *mockS3VersionClient {
+	version := func(key, id string, age time.Duration, latest bool) types.ObjectVersion {
+		return types.ObjectVersion{
+			Key:          aws.String(key),
+			VersionId:    aws.String(id),
+			LastModified: aws.Time(now.Add(-age)),
+			IsLatest:     aws.Bool(latest),
+			Size:         aws.Int64(10),
+			ETag:         aws.String(`"etag"`),
+		}
+	}
+
+	return &mockS3VersionClient{
+		pageSize: 2,
+		versions: []types.ObjectVersion{
+			version("repo/a", "a3", time.Hour, true),
+			version("repo/a", "a2", 24*time.Hour, false),
+			version("repo/a", "a1", 48*time.Hour, false),
+			version("repo/b", "b2", time.Hour, true),
+			version("repo/c", "c1", 48*time.Hour, false),
+			version("repo/ab", "ab1", 48*time.Hour, true),
+		},
+		deleteMarkers: []types.DeleteMarkerEntry{{
+			Key:          aws.String("repo/c"),
+			VersionId:    aws.String("c2"),
+			LastModified: aws.Time(now.Add(-time.Hour)),
+			IsLatest:     aws.Bool(true),
+		}},
+	}
+}
+
+func TestListS3ObjectVersions(t *testing.T) {
+	ctx := context.Background()
+	client := newMockS3VersionClient(time.Now())
+
+	versions, err := listS3ObjectVersions(ctx, client, s3VersionOptions{Bucket: "bucket", Prefix: "repo/"})
+	require.NoError(t, err)
+	require.Len(t, versions, 7)
+	assert.Equal(t, "a3", versions[0].VersionID)
+	assert.Equal(t, "a1", versions[2].VersionID)
+	assert.Equal(t, "repo/ab", versions[3].Key)
+	assert.True(t, versions[5].DeleteMarker)
+	assert.Equal(t, "etag", versions[0].ETag)
+
+	versions, err = listS3ObjectVersions(ctx, client, s3VersionOptions{Bucket: "bucket", Key: "repo/a"})
+	require.NoError(t, err)
+	assert.Len(t, versions, 3, "the key does not match other keys with it as a prefix")
+
+	_, err = listS3ObjectVersions(ctx, client, s3VersionOptions{Bucket: "bucket"})
+	assert.Error(t, err)
+}
+
+func TestRestoreS3ObjectVersions(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	client := newMockS3VersionClient(now)
+	opts := s3VersionOptions{Bucket: "bucket", Prefix: "repo/", DryRun: true}
+	actions, err := restoreS3ObjectVersions(ctx, client, opts, now.Add(-36*time.Hour))
+	require.NoError(t, err)
+	require.Len(t, actions, 3, "objects whose current version was current at the time are unchanged")
+	assert.Equal(t, s3VersionAction{Key: "repo/a", Action: s3VersionRestore, VersionID: "a1", LastModified: now.Add(-48 * time.Hour), DryRun: true}, actions[0])
+	assert.Equal(t, "repo/b", actions[1].Key)
+	assert.Equal(t, s3VersionDelete, actions[1].Action, "objects that did not exist yet are deleted")
+	assert.Equal(t, "repo/c", actions[2].Key)
+	assert.Equal(t, "c1", actions[2].VersionID, "deleted objects are restored")
+	assert.Empty(t, client.copied)
+	assert.Empty(t, client.deleted)
+
+	opts.DryRun = false
+	actions, err = restoreS3ObjectVersions(ctx, client, opts, now.Add(-12*time.Hour))
+	require.NoError(t, err)
+	require.Len(t, actions, 3)
+	assert.Equal(t, []string{"bucket/repo%2Fa?versionId=a2", "bucket/repo%2Fc?versionId=c1"}, client.copied)
+	assert.Equal(t, []string{"repo/b"}, client.deleted)
+
+	t.Run("CurrentVersionIsLatest", func(t *testing.T) {
+		client := newMockS3VersionClient(now)
+		// the current version was last modified before a noncurrent
+		// version, so it isn't first when sorted by time
+		client.versions = append(client.versions,
+			types.ObjectVersion{Key: aws.String("repo/d"), VersionId: aws.String("d2"), LastModified: aws.Time(now.Add(-48 * time.Hour)), IsLatest: aws.Bool(true), Size: aws.Int64(10)},
+			types.ObjectVersion{Key: aws.String("repo/d"), VersionId: aws.String("d1"), LastModified: aws.Time(now.Add(-time.Hour)), IsLatest: aws.Bool(false), Size: aws.Int64(10)},
+		)
+
+		actions, err := restoreS3ObjectVersions(ctx, client, s3VersionOptions{Bucket: "bucket", Key: "repo/d"}, now.Add(-36*time.Hour))
+		require.NoError(t, err)
+		assert.Empty(t, actions, "the version current at the time is still current")
+		assert.Empty(t, client.copied)
+	})
+	t.Run("LargeVersion", func(t *testing.T) {
+		client := newMockS3VersionClient(now)
+		client.versions[2].Size = aws.Int64(s3MaxCopyObjectSize + 1)
+
+		actions, err := restoreS3ObjectVersions(ctx, client, s3VersionOptions{Bucket: "bucket", Key: "repo/a"}, now.Add(-36*time.Hour))
+		require.NoError(t, err)
+		require.Len(t, actions, 1)
+		assert.Empty(t, client.copied)
+		assert.Equal(t, []string{"bucket/repo%2Fa?versionId=a1"}, client.multipart)
+	})
+}
+
+func TestPurgeS3ObjectVersions(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	client := newMockS3VersionClient(now)
+	opts := s3VersionOptions{Bucket: "bucket", Prefix: "repo/", DryRun: true}
+	actions, err := purgeS3ObjectVersions(ctx, client, opts, time.Time{}, false)
+	require.NoError(t, err)
+	assert.Len(t, actions, 4)
+	assert.Equal(t, "c2", actions[2].VersionID, "delete markers are purged with the rest of their object")
+	assert.Empty(t, client.purged)
+
+	client.deleteMarkers[0].Key = aws.String("repo/b")
+	actions, err = purgeS3ObjectVersions(ctx, client, opts, time.Time{}, false)
+	require.NoError(t, err)
+	assert.Len(t, actions, 3, "a current delete marker is kept with the versions it hides")
+	client.deleteMarkers[0].Key = aws.String("repo/c")
+
+	opts.DryRun = false
+	actions, err = purgeS3ObjectVersions(ctx, client, opts, now.Add(-36*time.Hour), false)
+	require.NoError(t, err)
+	assert.Len(t, actions, 2)
+	assert.Equal(t, []string{"repo/a@a1", "repo/c@c1"}, client.purged)
+
+	client = newMockS3VersionClient(now)
+	client.versions[0].VersionId = aws.String("locked")
+	actions, err = purgeS3ObjectVersions(ctx, client, s3VersionOptions{Bucket: "bucket", Key: "repo/a"}, time.Time{}, true)
+	assert.Error(t, err)
+	assert.Len(t, actions, 2)
+	assert.Equal(t, []string{"repo/a@a2", "repo/a@a1"}, client.purged)
+}
@@ -2,11 +2,15 @@ package operations
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"context"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
+	"time"
 
 	"github.com/mongodb/grip"
 	"github.com/mongodb/grip/message"
@@ -21,6 +25,9 @@ func Archive() cli.Command {
 		Name: "archive",
 		Subcommands: []cli.Command{
 			MakeTarball(),
+			ExtractArchive(),
+			ListArchive(),
+			VerifyArchive(),
 		},
 	}
 }
@@ -47,9 +54,58 @@ func MakeTarball() cli.Command {
 				Value: "archive.tar.gz",
 				Usage: "specify the name of the archive to create",
 			},
+			cli.StringFlag{
+				Name:  "format",
+				Usage: "archive format: 'tar.gz', 'tar.zst', 'tar.xz', 'zip' or 'tar'. Defaults to the format of the name",
+			},
+			cli.IntFlag{
+				Name:  "level",
+				Usage: "compression level, defaults to the format's default level",
+			},
+			cli.IntFlag{
+				Name:  "workers",
+				Usage: "number of cores to compress with, defaults to all available cores",
+			},
+			cli.BoolFlag{
+				Name: "reproducible",
+				Usage: "write the same archive for the same contents, by sorting entries and normalizing " +
+					"modification times (to SOURCE_DATE_EPOCH, if set), owners and permissions",
+			},
+			cli.BoolFlag{
+				Name:  "skip-unreadable",
+				Usage: "leave files that cannot be read out of the archive, rather than failing",
+			},
+			cli.BoolFlag{
+				Name:  "manifest",
+				Usage: "write a JSON manifest of the archive and the checksum of every file in it alongside the archive",
+			},
+			cli.BoolFlag{
+				Name:  "directories",
+				Usage: "add entries for directories, to keep empty directories and directory permissions",
+			},
+			cli.BoolFlag{
+				Name: "preserve-links",
+				Usage: "add symbolic links, hard links and special files as such, " +
+					"rather than the contents of the files they refer to",
+			},
 		},
 		Action: func(c *cli.Context) error {
-			return errors.WithStack(createArchive(c.String("name"), c.String("prefix"), c.StringSlice("item"), c.StringSlice("exclude")))
+			opts := ArchiveOptions{
+				Name:           c.String("name"),
+				Prefix:         c.String("prefix"),
+				Items:          c.StringSlice("item"),
+				Exclude:        c.StringSlice("exclude"),
+				Format:         c.String("format"),
+				Level:          c.Int("level"),
+				Workers:        c.Int("workers"),
+				Reproducible:   c.Bool("reproducible"),
+				Directories:    c.Bool("directories"),
+				PreserveLinks:  c.Bool("preserve-links"),
+				Manifest:       c.Bool("manifest"),
+				SkipUnreadable: c.Bool("skip-unreadable"),
+			}
+
+			return errors.WithStack(CreateArchive(context.Background(), opts))
 		},
 	}
 }
@@ -61,66 +117,195 @@ type archiveWorkUnit struct {
 	stat os.FileInfo
 }
 
-func getContents(paths []string, exclusions []string) <-chan archiveWorkUnit {
-	var matchers []*regexp.Regexp
-	for _, pattern := range exclusions {
-		matchers = append(matchers, regexp.MustCompile(pattern))
-	}
-
+// getContents walks the items, sending every file to add to the
+// archive on the first channel and every error walking the file system
+// on the second. Both channels close when the walk is done or the
+// context is canceled.
+func getContents(ctx context.Context, opts ArchiveOptions) (<-chan archiveWorkUnit, <-chan error) {
 	output := make(chan archiveWorkUnit)
+	errs := make(chan error)
 
 	go func() {
-		for _, path := range paths {
+		defer close(errs)
+		defer close(output)
+
+		for _, path := range opts.Items {
 			err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
 				if err != nil {
-					return errors.WithStack(err)
+					// report the error and carry on with the rest
+					// of the walk
+					select {
+					case errs <- errors.Wrapf(err, "walking '%s'", p):
+						return nil
+					case <-ctx.Done():
+						return ctx.Err()
+					}
 				}
 
-				if info.IsDir() {
+				if info.IsDir() && !opts.Directories {
 					return nil
 				}
 
-				for _, exclude := range matchers {
+				for _, exclude := range opts.exclude {
 					if exclude.MatchString(p) {
 						return nil
 					}
 				}
-				output <- archiveWorkUnit{
-					path: p,
-					stat: info,
+
+				select {
+				case output <- archiveWorkUnit{path: p, stat: info}:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
 				}
-				return nil
 			})
-
 			if err != nil {
-				panic(errors.Wrap(err, "walking file system"))
+				return
 			}
 		}
-		close(output)
 	}()
 
-	return output
+	return output, errs
+}
+
+// archiveReadError is an error reading a file before adding any of it
+// to the archive, which leaves the archive intact.
+type archiveReadError struct {
+	path string
+	err  error
+}
+
+func (e *archiveReadError) Error() string { return fmt.Sprintf("reading '%s': %s", e.path, e.err) }
+func (e *archiveReadError) Cause() error  { return e.err }
+func (e *archiveReadError) Unwrap() error { return e.err }
+
+// ArchiveOptions describe an archive for CreateArchive to write.
+type ArchiveOptions struct {
+	// Name is the path of the archive to write.
+	Name string
+	// Prefix is prepended to the name of every entry in the archive.
+	Prefix string
+	// Items are the files and directories to add to the archive.
+	Items []string
+	// Exclude are regular expressions matching the paths to leave out
+	// of the archive.
+	Exclude []string
+	// Format is the format of the archive, which defaults to the
+	// format of the name.
+	Format string
+	// Level is the compression level, or 0 for the format's default.
+	Level int
+	// Workers is the number of goroutines to compress with, for the
+	// formats that compress in parallel.
+	Workers int
+	// Reproducible sorts the entries and clears the metadata that
+	// varies between builds, so that the same files always produce
+	// the same archive.
+	Reproducible bool
+	// Directories adds an entry for every directory, so that the
+	// archive keeps empty directories and their permissions.
+	Directories bool
+	// PreserveLinks adds symbolic links, hard links and special files
+	// as such, rather than adding the contents of the files they
+	// refer to.
+	PreserveLinks bool
+	// Manifest writes a manifest of the archive alongside it.
+	Manifest bool
+	// SkipUnreadable leaves files that cannot be read out of the
+	// archive, rather than failing.
+	SkipUnreadable bool
+	// ModTime is the modification time of every entry in reproducible
+	// archives, which defaults to SOURCE_DATE_EPOCH, or else the Unix
+	// epoch.
+	ModTime time.Time
+
+	exclude []*regexp.Regexp
+}
+
+func (opts *ArchiveOptions) validate() error {
+	catcher := grip.NewBasicCatcher()
+	catcher.NewWhen(opts.Name == "", "must specify the name of the archive")
+
+	opts.exclude = opts.exclude[:0]
+	for _, pattern := range opts.Exclude {
+		re, err := regexp.Compile(pattern)
+		catcher.Wrapf(err, "invalid exclude pattern '%s'", pattern)
+		opts.exclude = append(opts.exclude, re)
+	}
+
+	if opts.Format == "" && opts.Name != "" {
+		format, err := getArchiveFormat(opts.Name)
+		catcher.Add(err)
+		opts.Format = format
+	}
+	if opts.Format != "" {
+		catcher.Add(validateArchiveFormat(opts.Format, opts.Level))
+	}
+
+	if opts.Reproducible && opts.ModTime.IsZero() {
+		// use UTC so that formats that store local times, like zip,
+		// don't depend on the time zone of the machine
+		opts.ModTime = time.Unix(0, 0).UTC()
+		if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+			secs, err := strconv.ParseInt(epoch, 10, 64)
+			catcher.Wrapf(err, "invalid SOURCE_DATE_EPOCH '%s'", epoch)
+			opts.ModTime = time.Unix(secs, 0).UTC()
+		}
+	}
+
+	return catcher.Resolve()
 }
 
-func addFile(tw *tar.Writer, prefix string, unit archiveWorkUnit) error {
+func addFile(tw archiveWriter, opts ArchiveOptions, links map[archiveFileID]string, unit archiveWorkUnit) error {
+	name := filepath.ToSlash(filepath.Join(opts.Prefix, unit.path))
+	mode := unit.stat.Mode()
+	if mode.IsDir() || (opts.PreserveLinks && !mode.IsRegular()) {
+		return addEntry(tw, opts, name, unit)
+	}
+
+	if opts.PreserveLinks && links != nil {
+		// the first of a set of hard links has the content, and the
+		// rest link to it
+		if id, ok := getArchiveFileID(unit.stat); ok {
+			if target, ok := links[id]; ok {
+				return writeArchiveHeader(tw, opts, &tar.Header{
+					Typeflag: tar.TypeLink,
+					Name:     name,
+					Linkname: target,
+					Mode:     int64(mode.Perm()),
+					ModTime:  unit.stat.ModTime(),
+				})
+			}
+			links[id] = name
+		}
+	}
+
 	fn, err := filepath.EvalSymlinks(unit.path)
 	if err != nil {
-		return err
+		return &archiveReadError{path: unit.path, err: err}
 	}
 
 	file, err := os.Open(fn)
 	if err != nil {
-		return errors.WithStack(err)
+		return &archiveReadError{path: unit.path, err: err}
 	}
 	defer func() { grip.Error(file.Close()) }()
+
+	// describe the file that a link refers to, rather than the link
+	stat, err := file.Stat()
+	if err != nil {
+		return &archiveReadError{path: unit.path, err: err}
+	}
+
 	// now lets create the header as needed for this file within the tarball
 	header := new(tar.Header)
-	header.Name = filepath.Join(prefix, unit.path)
-	header.Size = unit.stat.Size()
-	header.Mode = int64(unit.stat.Mode())
-	header.ModTime = unit.stat.ModTime()
+	header.Typeflag = tar.TypeReg
+	header.Name = name
+	header.Size = stat.Size()
+	header.Mode = int64(stat.Mode().Perm())
+	header.ModTime = stat.ModTime()
 	// write the header to the tarball archive
-	if err := tw.WriteHeader(header); err != nil {
+	if err := writeArchiveHeader(tw, opts, header); err != nil {
 		return errors.WithStack(err)
 	}
 	// copy the file data to the tarball
@@ -128,36 +313,172 @@ func addFile(tw *tar.Writer, prefix string, unit archiveWorkUnit) error {
 		return errors.WithStack(err)
 	}
 
+	return nil
+}
+
+// addEntry adds an entry without content, such as a directory or a
+// symbolic link, to the archive.
+func addEntry(tw archiveWriter, opts ArchiveOptions, name string, unit archiveWorkUnit) error {
+	var link string
+	if unit.stat.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(unit.path); err != nil {
+			return &archiveReadError{path: unit.path, err: err}
+		}
+	}
+
+	header, err := tar.FileInfoHeader(unit.stat, link)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	header.Name = name
+	if unit.stat.IsDir() {
+		header.Name += "/"
+	}
+
+	return errors.WithStack(writeArchiveHeader(tw, opts, header))
+}
+
+func writeArchiveHeader(tw archiveWriter, opts ArchiveOptions, header *tar.Header) error {
+	if opts.Reproducible {
+		normalizeArchiveHeader(header, opts.ModTime)
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return errors.WithStack(err)
+	}
+
 	grip.Debug(message.Fields{
 		"message": "added file to archive",
 		"name":    header.Name,
+		"type":    string(header.Typeflag),
 	})
 
 	return nil
 }
 
-func createArchive(fileName, prefix string, paths []string, exclude []string) error {
-	// set up the output file
-	file, err := os.Create(fileName)
+// normalizeArchiveHeader removes everything from the header that
+// depends on the system that created the archive rather than on the
+// contents of the file.
+func normalizeArchiveHeader(header *tar.Header, modTime time.Time) {
+	header.ModTime = modTime
+	header.AccessTime = time.Time{}
+	header.ChangeTime = time.Time{}
+	header.Uid = 0
+	header.Gid = 0
+	header.Uname = ""
+	header.Gname = ""
+	if header.Mode&0111 != 0 {
+		header.Mode = 0755
+	} else {
+		header.Mode = 0644
+	}
+}
+
+// sortedContents returns the contents in the order of their names
+// within the archive, so that it does not depend on the order of the
+// items or of the file system.
+func sortedContents(contents <-chan archiveWorkUnit) <-chan archiveWorkUnit {
+	units := []archiveWorkUnit{}
+	for unit := range contents {
+		units = append(units, unit)
+	}
+	sort.Slice(units, func(i, j int) bool {
+		return filepath.ToSlash(units[i].path) < filepath.ToSlash(units[j].path)
+	})
+
+	output := make(chan archiveWorkUnit, len(units))
+	for _, unit := range units {
+		output <- unit
+	}
+	close(output)
+
+	return output
+}
+
+// CreateArchive writes the items in the options to an archive, for
+// callers that build archives without the command line. It reports
+// every file that it cannot read, and removes the archive unless
+// skipping unreadable files.
+func CreateArchive(ctx context.Context, opts ArchiveOptions) error {
+	if err := opts.validate(); err != nil {
+		return errors.Wrap(err, "invalid archive options")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// set up the output file and archive writer
+	aw, finish, err := createArchiveFile(opts)
 	if err != nil {
-		return errors.Wrapf(err, "creating file '%s'", fileName)
+		return errors.WithStack(err)
+	}
+	tw := aw
+	var manifest *manifestArchiveWriter
+	if opts.Manifest {
+		manifest = newManifestArchiveWriter(aw, opts.Format)
+		tw = manifest
 	}
-	defer func() { grip.Error(errors.Wrapf(file.Close(), "closing file '%s'", fileName)) }()
 
-	// set up the  gzip writer
-	gw := gzip.NewWriter(file)
-	defer func() { grip.Error(errors.Wrapf(gw.Close(), "closing gzip writer for file '%s'", fileName)) }()
-	tw := tar.NewWriter(gw)
-	defer func() { grip.Error(errors.Wrapf(tw.Close(), "closing tar writer for file '%s'", fileName)) }()
+	grip.Infoln("creating archive:", opts.Name)
 
-	grip.Infoln("creating archive:", fileName)
+	catcher := grip.NewBasicCatcher()
+	skip := func(err error) {
+		if opts.SkipUnreadable {
+			grip.Warning(message.WrapError(err, message.Fields{
+				"message": "skipping unreadable file",
+				"archive": opts.Name,
+			}))
+			return
+		}
+		catcher.Add(err)
+	}
 
-	for unit := range getContents(paths, exclude) {
-		err := addFile(tw, prefix, unit)
-		if err != nil {
-			return errors.Wrapf(err, "adding path: %s [%+v]",
-				unit.path, unit)
+	contents, errs := getContents(ctx, opts)
+	walked := make(chan struct{})
+	go func() {
+		defer close(walked)
+		for err := range errs {
+			skip(err)
 		}
+	}()
+	if opts.Reproducible {
+		contents = sortedContents(contents)
+	}
+
+	var links map[archiveFileID]string
+	if opts.Format != archiveFormatZip {
+		links = map[archiveFileID]string{}
+	}
+	for unit := range contents {
+		err := addFile(tw, opts, links, unit)
+		if err == nil {
+			continue
+		}
+
+		var readErr *archiveReadError
+		if errors.As(err, &readErr) {
+			skip(err)
+			continue
+		}
+
+		// the archive is incomplete after any other error
+		catcher.Wrapf(err, "adding path: %s [%+v]", unit.path, unit)
+		cancel()
+		break
+	}
+	cancel()
+	<-walked
+
+	catcher.Add(finish())
+	if catcher.HasErrors() {
+		grip.Warning(message.WrapError(os.Remove(opts.Name), "removing incomplete archive"))
+		return catcher.Resolve()
+	}
+
+	if manifest != nil {
+		manifest.finishEntry()
+		return errors.Wrapf(manifest.manifest.write(opts.Name), "writing manifest for '%s'", opts.Name)
 	}
 
 	return nil
@@ -0,0 +1,582 @@
+package operations
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// ExtractArchive unpacks a tarball or zip archive.
+func ExtractArchive() cli.Command {
+	return cli.Command{
+		Name:  "extract",
+		Usage: "extract a tarball or zip archive",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "name",
+				Value: "archive.tar.gz",
+				Usage: "specify the name of the archive to extract",
+			},
+			cli.StringFlag{
+				Name:  "target",
+				Value: ".",
+				Usage: "directory to extract the archive into",
+			},
+			cli.IntFlag{
+				Name:  "strip-components",
+				Usage: "number of leading path components to remove from the name of each entry",
+			},
+			cli.StringSliceFlag{
+				Name:  "include",
+				Usage: "regular expressions to select entries to extract, defaults to all entries",
+			},
+			cli.StringSliceFlag{
+				Name:  "exclude",
+				Usage: "regular expressions to exclude entries",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			opts := archiveExtractOptions{
+				Name:            c.String("name"),
+				Target:          c.String("target"),
+				StripComponents: c.Int("strip-components"),
+				Include:         c.StringSlice("include"),
+				Exclude:         c.StringSlice("exclude"),
+			}
+
+			return errors.WithStack(extractArchive(opts))
+		},
+	}
+}
+
+// ListArchive prints the contents of a tarball or zip archive.
+func ListArchive() cli.Command {
+	return cli.Command{
+		Name:  "list",
+		Usage: "list the contents of a tarball or zip archive",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "name",
+				Value: "archive.tar.gz",
+				Usage: "specify the name of the archive to list",
+			},
+			cli.BoolFlag{
+				Name:  "long",
+				Usage: "print the type, mode, size and modification time of each entry",
+			},
+			cli.BoolFlag{
+				Name:  "json",
+				Usage: "print the entries as JSON",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			entries, err := listArchive(c.String("name"))
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			switch {
+			case c.Bool("json"):
+				return writeJSON(os.Stdout, entries)
+			case c.Bool("long"):
+				return writeArchiveEntryTable(os.Stdout, entries)
+			default:
+				for _, entry := range entries {
+					fmt.Println(entry.Name)
+				}
+				return nil
+			}
+		},
+	}
+}
+
+const (
+	archiveEntryFile    = "file"
+	archiveEntryDir     = "dir"
+	archiveEntrySymlink = "symlink"
+	archiveEntryLink    = "link"
+	archiveEntryOther   = "other"
+)
+
+// archiveEntry describes an entry in an archive, independent of the
+// archive's format.
+type archiveEntry struct {
+	Name     string      `json:"name"`
+	Type     string      `json:"type"`
+	Size     int64       `json:"size"`
+	Mode     os.FileMode `json:"mode"`
+	ModTime  time.Time   `json:"mod_time"`
+	Linkname string      `json:"linkname,omitempty"`
+}
+
+func newTarArchiveEntry(header *tar.Header) archiveEntry {
+	entry := archiveEntry{
+		Name:     header.Name,
+		Size:     header.Size,
+		Mode:     header.FileInfo().Mode().Perm(),
+		ModTime:  header.ModTime,
+		Linkname: header.Linkname,
+	}
+
+	switch header.Typeflag {
+	case tar.TypeReg:
+		entry.Type = archiveEntryFile
+	case tar.TypeDir:
+		entry.Type = archiveEntryDir
+	case tar.TypeSymlink:
+		entry.Type = archiveEntrySymlink
+	case tar.TypeLink:
+		entry.Type = archiveEntryLink
+	default:
+		entry.Type = archiveEntryOther
+	}
+
+	return entry
+}
+
+func newZipArchiveEntry(header *zip.File) archiveEntry {
+	mode := header.Mode()
+	entry := archiveEntry{
+		Name:    header.Name,
+		Size:    int64(header.UncompressedSize64),
+		Mode:    mode.Perm(),
+		ModTime: header.Modified,
+	}
+
+	switch {
+	case mode.IsDir():
+		entry.Type = archiveEntryDir
+	case mode&os.ModeSymlink != 0:
+		entry.Type = archiveEntrySymlink
+	case mode.IsRegular():
+		entry.Type = archiveEntryFile
+	default:
+		entry.Type = archiveEntryOther
+	}
+
+	return entry
+}
+
+// walkArchive calls the function for every entry in the archive, in
+// order, with a reader for the content of the entry.
+func walkArchive(fileName string, fn func(archiveEntry, io.Reader) error) error {
+	format, err := getArchiveFormat(fileName)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if format == archiveFormatZip {
+		return errors.WithStack(walkZipArchive(fileName, fn))
+	}
+
+	return errors.WithStack(walkTarArchive(fileName, format, fn))
+}
+
+func walkTarArchive(fileName, format string, fn func(archiveEntry, io.Reader) error) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return errors.Wrapf(err, "opening file '%s'", fileName)
+	}
+	defer func() { grip.Error(errors.Wrapf(file.Close(), "closing file '%s'", fileName)) }()
+
+	r, err := newArchiveReader(file, format)
+	if err != nil {
+		return errors.Wrapf(err, "reading '%s'", fileName)
+	}
+	defer func() { grip.Error(errors.Wrapf(r.Close(), "closing reader for file '%s'", fileName)) }()
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "reading archive '%s'", fileName)
+		}
+
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		if err = fn(newTarArchiveEntry(header), tr); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+}
+
+func walkZipArchive(fileName string, fn func(archiveEntry, io.Reader) error) error {
+	zr, err := zip.OpenReader(fileName)
+	if err != nil {
+		return errors.Wrapf(err, "opening archive '%s'", fileName)
+	}
+	defer func() { grip.Error(errors.Wrapf(zr.Close(), "closing archive '%s'", fileName)) }()
+
+	for _, file := range zr.File {
+		entry := newZipArchiveEntry(file)
+		if entry.Type == archiveEntryDir {
+			if err = fn(entry, strings.NewReader("")); err != nil {
+				return errors.WithStack(err)
+			}
+			continue
+		}
+
+		rc, err := file.Open()
+		if err != nil {
+			return errors.Wrapf(err, "opening '%s' in archive '%s'", file.Name, fileName)
+		}
+
+		if entry.Type == archiveEntrySymlink {
+			// zip archives store the target of a symbolic link as
+			// its content
+			target, err := io.ReadAll(rc)
+			if err != nil {
+				grip.Error(rc.Close())
+				return errors.Wrapf(err, "reading link '%s' in archive '%s'", file.Name, fileName)
+			}
+			entry.Linkname = string(target)
+		}
+
+		err = fn(entry, rc)
+		grip.Error(errors.Wrapf(rc.Close(), "closing '%s' in archive '%s'", file.Name, fileName))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+func listArchive(fileName string) ([]archiveEntry, error) {
+	entries := []archiveEntry{}
+	err := walkArchive(fileName, func(entry archiveEntry, _ io.Reader) error {
+		entries = append(entries, entry)
+		return nil
+	})
+
+	return entries, errors.WithStack(err)
+}
+
+func writeArchiveEntryTable(w io.Writer, entries []archiveEntry) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TYPE\tMODE\tSIZE\tMODIFIED\tNAME")
+	for _, entry := range entries {
+		name := entry.Name
+		if entry.Linkname != "" {
+			name += " -> " + entry.Linkname
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n",
+			entry.Type, entry.Mode, entry.Size, entry.ModTime.Format(time.RFC3339), name)
+	}
+
+	return errors.WithStack(tw.Flush())
+}
+
+type archiveExtractOptions struct {
+	Name            string
+	Target          string
+	StripComponents int
+	Include         []string
+	Exclude         []string
+
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+func (opts *archiveExtractOptions) validate() error {
+	catcher := grip.NewBasicCatcher()
+	catcher.NewWhen(opts.Name == "", "must specify an archive")
+	catcher.NewWhen(opts.StripComponents < 0, "number of components to strip must not be negative")
+
+	if opts.Target == "" {
+		opts.Target = "."
+	}
+
+	opts.include = opts.include[:0]
+	for _, pattern := range opts.Include {
+		re, err := regexp.Compile(pattern)
+		catcher.Wrapf(err, "invalid include pattern '%s'", pattern)
+		opts.include = append(opts.include, re)
+	}
+	opts.exclude = opts.exclude[:0]
+	for _, pattern := range opts.Exclude {
+		re, err := regexp.Compile(pattern)
+		catcher.Wrapf(err, "invalid exclude pattern '%s'", pattern)
+		opts.exclude = append(opts.exclude, re)
+	}
+
+	return catcher.Resolve()
+}
+
+// selects reports whether to extract the entry with the name, which is
+// the name in the archive before stripping any components.
+func (opts *archiveExtractOptions) selects(name string) bool {
+	for _, re := range opts.exclude {
+		if re.MatchString(name) {
+			return false
+		}
+	}
+
+	if len(opts.include) == 0 {
+		return true
+	}
+	for _, re := range opts.include {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// strip removes the leading components from the name of an entry,
+// returning an empty string if nothing is left.
+func (opts *archiveExtractOptions) strip(name string) string {
+	parts := strings.Split(path.Clean(filepath.ToSlash(name)), "/")
+	if len(parts) <= opts.StripComponents {
+		return ""
+	}
+
+	return path.Join(parts[opts.StripComponents:]...)
+}
+
+// archiveEntryPath returns the path to extract the entry with the name
+// to, and returns an error if the name refers to a path outside of the
+// target directory.
+func archiveEntryPath(target, name string) (string, error) {
+	if name == "" || path.IsAbs(name) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", errors.Errorf("'%s' is not a relative path", name)
+	}
+
+	clean := path.Clean(filepath.ToSlash(name))
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", errors.Errorf("'%s' is outside of the target directory", name)
+	}
+
+	return filepath.Join(target, filepath.FromSlash(clean)), nil
+}
+
+// extractArchive extracts the archive into the target directory,
+// refusing to write any entry or follow any link outside of it.
+func extractArchive(opts archiveExtractOptions) error {
+	if err := opts.validate(); err != nil {
+		return errors.Wrap(err, "invalid extract options")
+	}
+
+	if err := os.MkdirAll(opts.Target, 0755); err != nil {
+		return errors.Wrapf(err, "creating target directory '%s'", opts.Target)
+	}
+
+	grip.Infoln("extracting archive:", opts.Name)
+
+	count := 0
+	err := walkArchive(opts.Name, func(entry archiveEntry, r io.Reader) error {
+		if !opts.selects(entry.Name) {
+			return nil
+		}
+
+		if _, err := archiveEntryPath(opts.Target, entry.Name); err != nil {
+			return errors.Wrapf(err, "extracting '%s'", entry.Name)
+		}
+
+		name := opts.strip(entry.Name)
+		if name == "" {
+			return nil
+		}
+
+		fn, err := archiveEntryPath(opts.Target, name)
+		if err != nil {
+			return errors.Wrapf(err, "extracting '%s'", entry.Name)
+		}
+		if err = checkArchiveEntryParents(opts.Target, name); err != nil {
+			return errors.Wrapf(err, "extracting '%s'", entry.Name)
+		}
+
+		if err = extractArchiveEntry(opts, fn, entry, r); err != nil {
+			return errors.Wrapf(err, "extracting '%s'", entry.Name)
+		}
+		count++
+
+		grip.Debug(message.Fields{
+			"message": "extracted archive entry",
+			"name":    entry.Name,
+			"path":    fn,
+		})
+
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "extracting archive '%s'", opts.Name)
+	}
+
+	grip.Info(message.Fields{
+		"message": "extracted archive",
+		"archive": opts.Name,
+		"target":  opts.Target,
+		"entries": count,
+	})
+
+	return nil
+}
+
+func extractArchiveEntry(opts archiveExtractOptions, fn string, entry archiveEntry, r io.Reader) error {
+	if entry.Type != archiveEntryDir {
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			return errors.Wrap(err, "creating enclosing directory")
+		}
+	}
+
+	switch entry.Type {
+	case archiveEntryDir:
+		if err := os.MkdirAll(fn, 0755); err != nil {
+			return errors.WithStack(err)
+		}
+		return errors.WithStack(os.Chmod(fn, entry.Mode|0700))
+	case archiveEntryFile:
+		if err := removeExistingEntry(fn); err != nil {
+			return errors.WithStack(err)
+		}
+
+		file, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, entry.Mode)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if _, err = io.Copy(file, r); err != nil {
+			grip.Error(file.Close())
+			return errors.WithStack(err)
+		}
+		if err = file.Close(); err != nil {
+			return errors.WithStack(err)
+		}
+		return errors.WithStack(os.Chtimes(fn, entry.ModTime, entry.ModTime))
+	case archiveEntrySymlink:
+		// absolute links are common in archives of system trees, and
+		// can't be made safe, so skip them rather than failing
+		target := filepath.FromSlash(entry.Linkname)
+		if filepath.IsAbs(target) || strings.HasPrefix(entry.Linkname, "/") {
+			grip.Warning(message.Fields{
+				"message": "skipping link to an absolute path",
+				"name":    entry.Name,
+				"link":    entry.Linkname,
+			})
+			return nil
+		}
+
+		// relative links resolve against the link's directory, and
+		// must stay within the target directory
+		if err := checkArchiveLinkTarget(opts.Target, filepath.Dir(fn), entry.Linkname); err != nil {
+			return errors.Wrapf(err, "link to '%s'", entry.Linkname)
+		}
+
+		if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+		return errors.WithStack(os.Symlink(target, fn))
+	case archiveEntryLink:
+		// hard links name another entry in the archive
+		name := opts.strip(entry.Linkname)
+		target, err := archiveEntryPath(opts.Target, name)
+		if err != nil {
+			return errors.Wrapf(err, "link to '%s'", entry.Linkname)
+		}
+		if err = checkArchiveEntryParents(opts.Target, name); err != nil {
+			return errors.Wrapf(err, "link to '%s'", entry.Linkname)
+		}
+		if stat, err := os.Lstat(target); err == nil && stat.Mode()&os.ModeSymlink != 0 {
+			return errors.Errorf("link to '%s' names a symbolic link", entry.Linkname)
+		}
+
+		if err = os.Remove(fn); err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+		return errors.WithStack(os.Link(target, fn))
+	default:
+		grip.Warning(message.Fields{
+			"message": "skipping unsupported archive entry",
+			"name":    entry.Name,
+		})
+		return nil
+	}
+}
+
+// checkArchiveEntryParents returns an error if any directory between
+// the target directory and the entry is a symbolic link, since an
+// entry written through a link could end up outside of the target.
+func checkArchiveEntryParents(target, name string) error {
+	parts := strings.Split(path.Clean(filepath.ToSlash(name)), "/")
+	dir := target
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		stat, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if stat.Mode()&os.ModeSymlink != 0 {
+			return errors.Errorf("'%s' is a symbolic link", dir)
+		}
+	}
+
+	return nil
+}
+
+// checkArchiveLinkTarget returns an error if the target of a symbolic
+// link in the directory resolves to a path outside of the target
+// directory, or goes through another symbolic link, whose own target
+// the path can't be checked against without following it.
+func checkArchiveLinkTarget(target, dir, linkname string) error {
+	cur := dir
+	parts := strings.Split(filepath.ToSlash(linkname), "/")
+	for idx, part := range parts {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			cur = filepath.Dir(cur)
+		default:
+			cur = filepath.Join(cur, part)
+		}
+
+		rel, err := filepath.Rel(target, cur)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return errors.New("link is outside of the target directory")
+		}
+
+		if idx == len(parts)-1 {
+			break
+		}
+		stat, err := os.Lstat(cur)
+		if err == nil && stat.Mode()&os.ModeSymlink != 0 {
+			return errors.Errorf("link goes through the symbolic link '%s'", cur)
+		}
+	}
+
+	return nil
+}
+
+// removeExistingEntry removes anything other than a directory at the
+// path, so that writing a file replaces a link rather than writing to
+// its target, or to the file that a hard link shares.
+func removeExistingEntry(fn string) error {
+	stat, err := os.Lstat(fn)
+	if err != nil || stat.IsDir() {
+		return nil
+	}
+
+	return errors.WithStack(os.Remove(fn))
+}
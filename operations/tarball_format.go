@@ -0,0 +1,285 @@
+package operations
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/mongodb/grip"
+	"github.com/pkg/errors"
+	"github.com/ulikunitz/xz"
+)
+
+const (
+	archiveFormatTarGz  = "tar.gz"
+	archiveFormatTarZst = "tar.zst"
+	archiveFormatTarXz  = "tar.xz"
+	archiveFormatZip    = "zip"
+	archiveFormatTar    = "tar"
+)
+
+// archiveFormatSuffixes maps file name suffixes to archive formats,
+// in the order to match them.
+var archiveFormatSuffixes = []struct {
+	suffix string
+	format string
+}{
+	{".tar.gz", archiveFormatTarGz},
+	{".tgz", archiveFormatTarGz},
+	{".tar.zst", archiveFormatTarZst},
+	{".tzst", archiveFormatTarZst},
+	{".tar.xz", archiveFormatTarXz},
+	{".txz", archiveFormatTarXz},
+	{".zip", archiveFormatZip},
+	{".tar", archiveFormatTar},
+}
+
+// getArchiveFormat returns the format of an archive from its name.
+func getArchiveFormat(fileName string) (string, error) {
+	for _, match := range archiveFormatSuffixes {
+		if strings.HasSuffix(fileName, match.suffix) {
+			return match.format, nil
+		}
+	}
+
+	return "", errors.Errorf("cannot determine the archive format of '%s', "+
+		"which must be .tar.gz, .tgz, .tar.zst, .tzst, .tar.xz, .txz, .zip or .tar", fileName)
+}
+
+// validateArchiveFormat returns an error if the archive format does not
+// exist or does not support the compression level.
+func validateArchiveFormat(format string, level int) error {
+	switch format {
+	case archiveFormatTarGz, archiveFormatZip:
+		if level < 0 || level > 9 {
+			return errors.Errorf("compression level for %s must be between 0 (default) and 9", format)
+		}
+	case archiveFormatTarZst:
+		if level < 0 || level > 22 {
+			return errors.Errorf("compression level for %s must be between 0 (default) and 22", format)
+		}
+	case archiveFormatTarXz, archiveFormatTar:
+		if level != 0 {
+			return errors.Errorf("%s does not support setting the compression level", format)
+		}
+	default:
+		return errors.Errorf("'%s' is not a valid archive format", format)
+	}
+
+	return nil
+}
+
+// archiveWriter writes entries to an archive of any format, in the
+// same way as a tar.Writer.
+type archiveWriter interface {
+	WriteHeader(*tar.Header) error
+	io.Writer
+	// Close finishes the archive without closing the underlying
+	// writer.
+	Close() error
+}
+
+// newArchiveWriter returns a writer for an archive in the format, which
+// must already be valid.
+func newArchiveWriter(w io.Writer, opts ArchiveOptions) (archiveWriter, error) {
+	workers := opts.Workers
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	var compressor io.WriteCloser
+	switch opts.Format {
+	case archiveFormatZip:
+		return newZipArchiveWriter(w, opts.Level), nil
+	case archiveFormatTar:
+		return &tarArchiveWriter{Writer: tar.NewWriter(w)}, nil
+	case archiveFormatTarGz:
+		level := opts.Level
+		if level == 0 {
+			level = pgzip.DefaultCompression
+		}
+		gw, err := pgzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, errors.Wrap(err, "creating gzip writer")
+		}
+		// compress blocks in parallel, which the output does not
+		// depend on
+		if err = gw.SetConcurrency(1<<20, workers); err != nil {
+			return nil, errors.Wrap(err, "configuring gzip writer")
+		}
+		if opts.Reproducible {
+			// leave the name and modification time out of the header
+			gw.Header = pgzip.Header{OS: 255}
+		}
+		compressor = gw
+	case archiveFormatTarZst:
+		zopts := []zstd.EOption{zstd.WithEncoderConcurrency(workers)}
+		if opts.Level != 0 {
+			zopts = append(zopts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(opts.Level)))
+		}
+		zw, err := zstd.NewWriter(w, zopts...)
+		if err != nil {
+			return nil, errors.Wrap(err, "creating zstd writer")
+		}
+		compressor = zw
+	case archiveFormatTarXz:
+		xw, err := xz.NewWriter(w)
+		if err != nil {
+			return nil, errors.Wrap(err, "creating xz writer")
+		}
+		compressor = xw
+	default:
+		return nil, errors.Errorf("'%s' is not a valid archive format", opts.Format)
+	}
+
+	return &tarArchiveWriter{Writer: tar.NewWriter(compressor), compressor: compressor}, nil
+}
+
+type tarArchiveWriter struct {
+	*tar.Writer
+	compressor io.WriteCloser
+}
+
+func (w *tarArchiveWriter) Close() error {
+	catcher := grip.NewBasicCatcher()
+	catcher.Wrap(w.Writer.Close(), "closing tar writer")
+	if w.compressor != nil {
+		catcher.Wrap(w.compressor.Close(), "closing compressor")
+	}
+
+	return catcher.Resolve()
+}
+
+// zipArchiveWriter writes tar headers as zip entries. Zip archives
+// store symbolic links as files with the target as their content, and
+// have no hard links or special files.
+type zipArchiveWriter struct {
+	zw *zip.Writer
+	w  io.Writer
+}
+
+func newZipArchiveWriter(w io.Writer, level int) *zipArchiveWriter {
+	zw := zip.NewWriter(w)
+	if level != 0 {
+		zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, level)
+		})
+	}
+
+	return &zipArchiveWriter{zw: zw}
+}
+
+func (w *zipArchiveWriter) WriteHeader(header *tar.Header) error {
+	switch header.Typeflag {
+	case tar.TypeReg, tar.TypeDir, tar.TypeSymlink:
+	default:
+		return errors.Errorf("zip archives cannot contain '%s', which is not a file, directory or symbolic link", header.Name)
+	}
+
+	fh, err := zip.FileInfoHeader(header.FileInfo())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	fh.Name = header.Name
+	fh.Modified = zipModTime(header.ModTime)
+	if header.Typeflag != tar.TypeReg {
+		fh.Method = zip.Store
+	}
+
+	w.w, err = w.zw.CreateHeader(fh)
+	if err != nil {
+		return errors.Wrapf(err, "adding '%s' to zip archive", header.Name)
+	}
+
+	if header.Typeflag == tar.TypeSymlink {
+		_, err = io.WriteString(w.w, header.Linkname)
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// zipEpoch is the earliest time that the MS-DOS timestamps in zip
+// archives can represent.
+var zipEpoch = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// zipModTime returns the modification time to store in a zip archive,
+// which stores it in the time's zone, so use UTC for every entry and
+// clamp earlier times, such as the Unix epoch that reproducible
+// archives default to, to the earliest time that zip supports.
+func zipModTime(t time.Time) time.Time {
+	t = t.UTC()
+	if t.Before(zipEpoch) {
+		return zipEpoch
+	}
+	return t
+}
+
+func (w *zipArchiveWriter) Write(b []byte) (int, error) {
+	if w.w == nil {
+		return 0, errors.New("must write a header before writing content")
+	}
+
+	return w.w.Write(b)
+}
+
+func (w *zipArchiveWriter) Close() error {
+	return errors.Wrap(w.zw.Close(), "closing zip writer")
+}
+
+// newArchiveReader returns a reader for the tar stream in a compressed
+// tarball of the format.
+func newArchiveReader(r io.Reader, format string) (io.ReadCloser, error) {
+	switch format {
+	case archiveFormatTarGz:
+		gr, err := gzip.NewReader(r)
+		return gr, errors.Wrap(err, "reading gzip header")
+	case archiveFormatTarZst:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "creating zstd reader")
+		}
+		return zr.IOReadCloser(), nil
+	case archiveFormatTarXz:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading xz header")
+		}
+		return io.NopCloser(xr), nil
+	case archiveFormatTar:
+		return io.NopCloser(r), nil
+	default:
+		return nil, errors.Errorf("'%s' is not a tarball format", format)
+	}
+}
+
+// createArchiveFile creates the file for an archive, returning the
+// archive writer and a function to finish the archive and close the
+// file.
+func createArchiveFile(opts ArchiveOptions) (archiveWriter, func() error, error) {
+	file, err := os.Create(opts.Name)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "creating file '%s'", opts.Name)
+	}
+
+	aw, err := newArchiveWriter(file, opts)
+	if err != nil {
+		grip.Error(errors.Wrapf(file.Close(), "closing file '%s'", opts.Name))
+		return nil, nil, errors.WithStack(err)
+	}
+
+	return aw, func() error {
+		catcher := grip.NewBasicCatcher()
+		catcher.Wrapf(aw.Close(), "finishing archive '%s'", opts.Name)
+		catcher.Wrapf(file.Close(), "closing file '%s'", opts.Name)
+		return catcher.Resolve()
+	}, nil
+}
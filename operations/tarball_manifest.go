@@ -0,0 +1,367 @@
+package operations
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// archiveManifestSuffix names the manifest that archive create writes
+// alongside an archive.
+const archiveManifestSuffix = ".manifest.json"
+
+// VerifyArchive checks an archive, or a tree extracted from it,
+// against the manifest written when creating the archive.
+func VerifyArchive() cli.Command {
+	return cli.Command{
+		Name:  "verify",
+		Usage: "check an archive or an extracted tree against the archive's manifest",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "name",
+				Value: "archive.tar.gz",
+				Usage: "specify the name of the archive",
+			},
+			cli.StringFlag{
+				Name:  "manifest",
+				Usage: "path to the manifest, defaults to the archive name with '" + archiveManifestSuffix + "' appended",
+			},
+			cli.StringFlag{
+				Name:  "path",
+				Usage: "check the tree extracted into this directory, rather than the archive",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			fn := c.String("manifest")
+			if fn == "" {
+				fn = c.String("name") + archiveManifestSuffix
+			}
+
+			manifest, err := readArchiveManifest(fn)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			var problems []string
+			if dir := c.String("path"); dir != "" {
+				problems, err = verifyArchiveTree(manifest, dir)
+			} else {
+				problems, err = verifyArchiveFile(manifest, c.String("name"))
+			}
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			for _, problem := range problems {
+				fmt.Println(problem)
+			}
+			if len(problems) > 0 {
+				return errors.Errorf("found %d differences from the manifest '%s'", len(problems), fn)
+			}
+
+			grip.Info(message.Fields{
+				"message":  "verified archive",
+				"manifest": fn,
+				"entries":  len(manifest.Entries),
+			})
+
+			return nil
+		},
+	}
+}
+
+// archiveManifest describes an archive and every entry in it.
+type archiveManifest struct {
+	Archive string                 `json:"archive"`
+	Format  string                 `json:"format"`
+	Size    int64                  `json:"size"`
+	SHA256  string                 `json:"sha256"`
+	Entries []archiveManifestEntry `json:"entries"`
+}
+
+type archiveManifestEntry struct {
+	Path     string      `json:"path"`
+	Type     string      `json:"type"`
+	Size     int64       `json:"size"`
+	Mode     os.FileMode `json:"mode"`
+	SHA256   string      `json:"sha256,omitempty"`
+	Linkname string      `json:"linkname,omitempty"`
+}
+
+func readArchiveManifest(fn string) (*archiveManifest, error) {
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading manifest '%s'", fn)
+	}
+
+	manifest := &archiveManifest{}
+	if err = json.Unmarshal(data, manifest); err != nil {
+		return nil, errors.Wrapf(err, "parsing manifest '%s'", fn)
+	}
+
+	return manifest, nil
+}
+
+// write records the size and checksum of the finished archive, and
+// writes the manifest alongside it.
+func (m *archiveManifest) write(fileName string) error {
+	size, sum, err := sha256File(fileName)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	m.Archive = filepath.Base(fileName)
+	m.Size = size
+	m.SHA256 = sum
+
+	f, err := os.Create(fileName + archiveManifestSuffix)
+	if err != nil {
+		return errors.Wrap(err, "creating manifest")
+	}
+	if err = writeJSON(f, m); err != nil {
+		grip.Error(f.Close())
+		return errors.Wrap(err, "writing manifest")
+	}
+
+	return errors.Wrap(f.Close(), "closing manifest")
+}
+
+func sha256File(fn string) (int64, string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return 0, "", errors.Wrapf(err, "opening '%s'", fn)
+	}
+	defer func() { grip.Error(f.Close()) }()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", errors.Wrapf(err, "reading '%s'", fn)
+	}
+
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// manifestArchiveWriter records every entry written to an archive in
+// a manifest, with a checksum of the content of each file.
+type manifestArchiveWriter struct {
+	archiveWriter
+	manifest *archiveManifest
+	hash     hash.Hash
+}
+
+func newManifestArchiveWriter(aw archiveWriter, format string) *manifestArchiveWriter {
+	return &manifestArchiveWriter{
+		archiveWriter: aw,
+		manifest:      &archiveManifest{Format: format, Entries: []archiveManifestEntry{}},
+	}
+}
+
+func (w *manifestArchiveWriter) WriteHeader(header *tar.Header) error {
+	if err := w.archiveWriter.WriteHeader(header); err != nil {
+		return errors.WithStack(err)
+	}
+	w.finishEntry()
+
+	entry := newTarArchiveEntry(header)
+	w.manifest.Entries = append(w.manifest.Entries, archiveManifestEntry{
+		Path:     entry.Name,
+		Type:     entry.Type,
+		Size:     entry.Size,
+		Mode:     entry.Mode,
+		Linkname: entry.Linkname,
+	})
+	if entry.Type == archiveEntryFile {
+		w.hash = sha256.New()
+	}
+
+	return nil
+}
+
+func (w *manifestArchiveWriter) Write(b []byte) (int, error) {
+	n, err := w.archiveWriter.Write(b)
+	if w.hash != nil {
+		_, _ = w.hash.Write(b[:n])
+	}
+
+	return n, err
+}
+
+func (w *manifestArchiveWriter) Close() error {
+	w.finishEntry()
+	return w.archiveWriter.Close()
+}
+
+func (w *manifestArchiveWriter) finishEntry() {
+	if w.hash == nil {
+		return
+	}
+
+	w.manifest.Entries[len(w.manifest.Entries)-1].SHA256 = hex.EncodeToString(w.hash.Sum(nil))
+	w.hash = nil
+}
+
+// verifyArchiveFile returns the differences between the archive and the
+// manifest.
+func verifyArchiveFile(manifest *archiveManifest, fileName string) ([]string, error) {
+	size, sum, err := sha256File(fileName)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if sum == manifest.SHA256 && size == manifest.Size {
+		return []string{}, nil
+	}
+
+	problems := []string{fmt.Sprintf("archive '%s' has sha256 '%s', but the manifest has '%s'", fileName, sum, manifest.SHA256)}
+
+	// find the entries that differ, to say what changed
+	expected := make(map[string]archiveManifestEntry, len(manifest.Entries))
+	for _, entry := range manifest.Entries {
+		expected[entry.Path] = entry
+	}
+	err = walkArchive(fileName, func(entry archiveEntry, r io.Reader) error {
+		want, ok := expected[entry.Name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("'%s' is not in the manifest", entry.Name))
+			return nil
+		}
+		delete(expected, entry.Name)
+
+		got := archiveManifestEntry{Path: entry.Name, Type: entry.Type, Size: entry.Size, Mode: entry.Mode, Linkname: entry.Linkname}
+		if entry.Type == archiveEntryFile {
+			h := sha256.New()
+			if _, err := io.Copy(h, r); err != nil {
+				return errors.Wrapf(err, "reading '%s'", entry.Name)
+			}
+			got.SHA256 = hex.EncodeToString(h.Sum(nil))
+		}
+
+		problems = append(problems, compareArchiveManifestEntries(want, got)...)
+		return nil
+	})
+	if err != nil {
+		// a damaged archive may only be readable up to the damage
+		problems = append(problems, fmt.Sprintf("cannot read archive '%s': %s", fileName, err.Error()))
+	}
+
+	for _, entry := range manifest.Entries {
+		if _, ok := expected[entry.Path]; ok {
+			problems = append(problems, fmt.Sprintf("'%s' is missing", entry.Path))
+		}
+	}
+
+	return problems, nil
+}
+
+// verifyArchiveTree returns the differences between the tree extracted
+// into the directory and the manifest. Files in the tree that are not
+// in the manifest are not differences, and neither are permissions,
+// which depend on the umask of the extracting process.
+func verifyArchiveTree(manifest *archiveManifest, dir string) ([]string, error) {
+	entries := make(map[string]archiveManifestEntry, len(manifest.Entries))
+	for _, entry := range manifest.Entries {
+		entries[path.Clean(entry.Path)] = entry
+	}
+
+	problems := []string{}
+	for _, want := range manifest.Entries {
+		name := strings.TrimSuffix(path.Clean(want.Path), "/")
+		fn, err := archiveEntryPath(dir, name)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("'%s': %s", want.Path, err.Error()))
+			continue
+		}
+
+		stat, err := os.Lstat(fn)
+		if os.IsNotExist(err) {
+			problems = append(problems, fmt.Sprintf("'%s' is missing", want.Path))
+			continue
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		got := archiveManifestEntry{Path: want.Path, Mode: want.Mode}
+		switch {
+		case stat.IsDir():
+			got.Type = archiveEntryDir
+		case stat.Mode()&os.ModeSymlink != 0:
+			got.Type = archiveEntrySymlink
+			if got.Linkname, err = os.Readlink(fn); err != nil {
+				return nil, errors.WithStack(err)
+			}
+			got.Linkname = filepath.ToSlash(got.Linkname)
+		case stat.Mode().IsRegular():
+			got.Type = archiveEntryFile
+			if got.Size, got.SHA256, err = sha256File(fn); err != nil {
+				return nil, errors.WithStack(err)
+			}
+		default:
+			got.Type = archiveEntryOther
+		}
+
+		if want.Type == archiveEntryLink && got.Type == archiveEntryFile {
+			// hard links extract as files with the content of the
+			// file they link to
+			target, ok := resolveArchiveManifestLink(entries, want)
+			if !ok {
+				problems = append(problems, fmt.Sprintf("'%s' links to '%s', which is not a file in the manifest", want.Path, want.Linkname))
+				continue
+			}
+			want.Type = archiveEntryFile
+			want.Size = target.Size
+			want.SHA256 = target.SHA256
+			want.Linkname = ""
+		}
+
+		problems = append(problems, compareArchiveManifestEntries(want, got)...)
+	}
+
+	return problems, nil
+}
+
+// resolveArchiveManifestLink returns the file entry that the hard link
+// entry names, following links to links.
+func resolveArchiveManifestLink(entries map[string]archiveManifestEntry, link archiveManifestEntry) (archiveManifestEntry, bool) {
+	for i := 0; i < len(entries); i++ {
+		target, ok := entries[path.Clean(link.Linkname)]
+		if !ok {
+			return archiveManifestEntry{}, false
+		}
+		if target.Type != archiveEntryLink {
+			return target, target.Type == archiveEntryFile
+		}
+		link = target
+	}
+
+	return archiveManifestEntry{}, false
+}
+
+func compareArchiveManifestEntries(want, got archiveManifestEntry) []string {
+	switch {
+	case want.Type != got.Type:
+		return []string{fmt.Sprintf("'%s' is a %s, but the manifest has a %s", want.Path, got.Type, want.Type)}
+	case want.Size != got.Size:
+		return []string{fmt.Sprintf("'%s' has size %d, but the manifest has %d", want.Path, got.Size, want.Size)}
+	case want.SHA256 != got.SHA256:
+		return []string{fmt.Sprintf("'%s' has sha256 '%s', but the manifest has '%s'", want.Path, got.SHA256, want.SHA256)}
+	case want.Linkname != got.Linkname:
+		return []string{fmt.Sprintf("'%s' links to '%s', but the manifest has '%s'", want.Path, got.Linkname, want.Linkname)}
+	case want.Mode != got.Mode:
+		return []string{fmt.Sprintf("'%s' has mode %s, but the manifest has %s", want.Path, got.Mode, want.Mode)}
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,620 @@
+package operations
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testArchiveEntry struct {
+	name     string
+	content  string
+	typeflag byte
+	linkname string
+}
+
+func writeTestTarball(t *testing.T, fn string, entries []testArchiveEntry) {
+	file, err := os.Create(fn)
+	require.NoError(t, err)
+	defer file.Close()
+	gw := gzip.NewWriter(file)
+	tw := tar.NewWriter(gw)
+
+	for _, entry := range entries {
+		header := &tar.Header{
+			Name:     entry.name,
+			Typeflag: entry.typeflag,
+			Linkname: entry.linkname,
+			Size:     int64(len(entry.content)),
+			Mode:     0644,
+			ModTime:  time.Unix(1600000000, 0),
+		}
+		if entry.typeflag != tar.TypeReg {
+			header.Size = 0
+		}
+		require.NoError(t, tw.WriteHeader(header))
+		if header.Size > 0 {
+			_, err = tw.Write([]byte(entry.content))
+			require.NoError(t, err)
+		}
+	}
+
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+}
+
+func writeTestZip(t *testing.T, fn string, entries []testArchiveEntry) {
+	file, err := os.Create(fn)
+	require.NoError(t, err)
+	defer file.Close()
+	zw := zip.NewWriter(file)
+
+	for _, entry := range entries {
+		w, err := zw.Create(entry.name)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(entry.content))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, zw.Close())
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "build", "bin"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "build", "bin", "mongod"), []byte("mongod"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "build", "README"), []byte("readme"), 0644))
+	fn := filepath.Join(t.TempDir(), "archive.tar.gz")
+
+	t.Chdir(src)
+	require.NoError(t, CreateArchive(context.Background(), ArchiveOptions{Name: fn, Prefix: "dist", Items: []string{"build"}}))
+
+	entries, err := listArchive(fn)
+	require.NoError(t, err)
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+		assert.Equal(t, archiveEntryFile, entry.Type)
+	}
+	assert.ElementsMatch(t, []string{"dist/build/README", "dist/build/bin/mongod"}, names)
+
+	target := t.TempDir()
+	require.NoError(t, extractArchive(archiveExtractOptions{Name: fn, Target: target, StripComponents: 2}))
+	data, err := os.ReadFile(filepath.Join(target, "bin", "mongod"))
+	require.NoError(t, err)
+	assert.Equal(t, "mongod", string(data))
+	stat, err := os.Stat(filepath.Join(target, "bin", "mongod"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), stat.Mode().Perm())
+}
+
+func TestCreateReproducibleArchive(t *testing.T) {
+	src := t.TempDir()
+	t.Chdir(src)
+	for _, name := range []string{"b", "a/c", "a/b"} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(name), 0755))
+		require.NoError(t, os.WriteFile(name, []byte(name), 0640))
+	}
+	out := t.TempDir()
+
+	create := func(name string, items ...string) []byte {
+		fn := filepath.Join(out, name)
+		require.NoError(t, CreateArchive(context.Background(), ArchiveOptions{Name: fn, Items: items, Reproducible: true}))
+		data, err := os.ReadFile(fn)
+		require.NoError(t, err)
+		return data
+	}
+
+	first := create("first.tar.gz", "b", "a")
+	require.NoError(t, os.Chtimes("a/c", time.Now(), time.Now().Add(-time.Hour)))
+	require.NoError(t, os.Chmod("b", 0600))
+	assert.Equal(t, first, create("second.tar.gz", "a", "b"))
+
+	entries, err := listArchive(filepath.Join(out, "first.tar.gz"))
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	assert.Equal(t, "a/b", entries[0].Name)
+	assert.Equal(t, "a/c", entries[1].Name)
+	assert.Equal(t, "b", entries[2].Name)
+	assert.Equal(t, os.FileMode(0644), entries[0].Mode)
+	assert.True(t, entries[0].ModTime.Equal(time.Unix(0, 0)))
+
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	assert.NotEqual(t, first, create("epoch.tar.gz", "a", "b"))
+	entries, err = listArchive(filepath.Join(out, "epoch.tar.gz"))
+	require.NoError(t, err)
+	assert.True(t, entries[0].ModTime.Equal(time.Unix(1700000000, 0)))
+
+	t.Run("ZipTimeZones", func(t *testing.T) {
+		t.Setenv("SOURCE_DATE_EPOCH", "")
+		local := time.Local
+		defer func() { time.Local = local }()
+
+		archives := [][]byte{}
+		for idx, zone := range []*time.Location{time.UTC, time.FixedZone("EST", -5*60*60)} {
+			time.Local = zone
+			archives = append(archives, create(fmt.Sprintf("zone%d.zip", idx), "a", "b"))
+		}
+		assert.Equal(t, archives[0], archives[1], "zip archives don't depend on the time zone")
+
+		zr, err := zip.NewReader(bytes.NewReader(archives[0]), int64(len(archives[0])))
+		require.NoError(t, err)
+		require.NotEmpty(t, zr.File)
+		for _, file := range zr.File {
+			assert.Equal(t, 1980, file.Modified.Year(), "times before 1980 are clamped")
+		}
+	})
+
+	t.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+	assert.Error(t, CreateArchive(context.Background(), ArchiveOptions{Name: filepath.Join(out, "invalid.tar.gz"), Items: []string{"a"}, Reproducible: true}))
+}
+
+func TestCreateArchiveFormats(t *testing.T) {
+	src := t.TempDir()
+	t.Chdir(src)
+	require.NoError(t, os.MkdirAll(filepath.Join("tree", "bin"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join("tree", "bin", "mongod"), bytes.Repeat([]byte("mongod"), 1<<18), 0755))
+	require.NoError(t, os.Symlink(filepath.Join("bin", "mongod"), filepath.Join("tree", "mongod")))
+	out := t.TempDir()
+
+	for _, test := range []struct {
+		name   string
+		format string
+		level  int
+	}{
+		{name: "archive.tar.gz", format: archiveFormatTarGz},
+		{name: "archive.tgz", format: archiveFormatTarGz, level: 1},
+		{name: "archive.tar.zst", format: archiveFormatTarZst, level: 19},
+		{name: "archive.tar.xz", format: archiveFormatTarXz},
+		{name: "archive.zip", format: archiveFormatZip, level: 9},
+		{name: "archive.tar", format: archiveFormatTar},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fn := filepath.Join(out, test.name)
+			opts := ArchiveOptions{
+				Name:          fn,
+				Items:         []string{"tree"},
+				Level:         test.level,
+				Workers:       4,
+				PreserveLinks: true,
+				Directories:   true,
+			}
+			require.NoError(t, CreateArchive(context.Background(), opts))
+			format, err := getArchiveFormat(fn)
+			require.NoError(t, err)
+			assert.Equal(t, test.format, format)
+
+			target := t.TempDir()
+			require.NoError(t, extractArchive(archiveExtractOptions{Name: fn, Target: target}))
+			data, err := os.ReadFile(filepath.Join(target, "tree", "bin", "mongod"))
+			require.NoError(t, err)
+			assert.Len(t, data, 6<<18)
+			link, err := os.Readlink(filepath.Join(target, "tree", "mongod"))
+			require.NoError(t, err)
+			assert.Equal(t, filepath.Join("bin", "mongod"), link)
+		})
+	}
+
+	t.Run("FormatOverridesName", func(t *testing.T) {
+		fn := filepath.Join(out, "archive.out")
+		require.NoError(t, CreateArchive(context.Background(), ArchiveOptions{Name: fn, Items: []string{"tree"}, Format: archiveFormatZip}))
+		_, err := zip.OpenReader(fn)
+		assert.NoError(t, err)
+	})
+	t.Run("ParallelGzipIsReproducible", func(t *testing.T) {
+		var archives [][]byte
+		for _, workers := range []int{1, 8} {
+			fn := filepath.Join(out, fmt.Sprintf("workers-%d.tar.gz", workers))
+			require.NoError(t, CreateArchive(context.Background(), ArchiveOptions{Name: fn, Items: []string{"tree"}, Workers: workers, Reproducible: true}))
+			data, err := os.ReadFile(fn)
+			require.NoError(t, err)
+			archives = append(archives, data)
+		}
+		assert.Equal(t, archives[0], archives[1])
+	})
+	t.Run("Validation", func(t *testing.T) {
+		out := t.TempDir()
+		for name, opts := range map[string]ArchiveOptions{
+			"UnknownName":   {Name: "archive.rar"},
+			"UnknownFormat": {Name: "archive.tar.gz", Format: "rar"},
+			"GzipLevel":     {Name: "archive.tar.gz", Level: 10},
+			"ZstdLevel":     {Name: "archive.tar.zst", Level: 23},
+			"XzLevel":       {Name: "archive.tar.xz", Level: 1},
+		} {
+			t.Run(name, func(t *testing.T) {
+				opts.Name = filepath.Join(out, opts.Name)
+				assert.Error(t, CreateArchive(context.Background(), opts))
+				assert.NoFileExists(t, opts.Name)
+			})
+		}
+	})
+}
+
+func TestCreateArchiveLinks(t *testing.T) {
+	src := t.TempDir()
+	t.Chdir(src)
+	require.NoError(t, os.MkdirAll(filepath.Join("tree", "bin"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join("tree", "data"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join("tree", "bin", "mongod"), []byte("mongod"), 0755))
+	require.NoError(t, os.Symlink(filepath.Join("bin", "mongod"), filepath.Join("tree", "mongod")))
+	require.NoError(t, os.Link(filepath.Join("tree", "bin", "mongod"), filepath.Join("tree", "bin", "mongod-copy")))
+	out := t.TempDir()
+
+	entryTypes := func(t *testing.T, fn string) map[string]archiveEntry {
+		entries, err := listArchive(fn)
+		require.NoError(t, err)
+		out := map[string]archiveEntry{}
+		for _, entry := range entries {
+			out[entry.Name] = entry
+		}
+		return out
+	}
+
+	t.Run("Dereference", func(t *testing.T) {
+		fn := filepath.Join(out, "dereference.tar.gz")
+		require.NoError(t, CreateArchive(context.Background(), ArchiveOptions{Name: fn, Items: []string{"tree"}}))
+
+		entries := entryTypes(t, fn)
+		assert.Len(t, entries, 3)
+		assert.Equal(t, archiveEntryFile, entries["tree/mongod"].Type)
+		assert.EqualValues(t, 6, entries["tree/mongod"].Size)
+		assert.Equal(t, archiveEntryFile, entries["tree/bin/mongod-copy"].Type)
+	})
+	t.Run("Preserve", func(t *testing.T) {
+		fn := filepath.Join(out, "preserve.tar.gz")
+		require.NoError(t, CreateArchive(context.Background(), ArchiveOptions{
+			Name:          fn,
+			Items:         []string{"tree"},
+			Directories:   true,
+			PreserveLinks: true,
+			Reproducible:  true,
+		}))
+
+		entries := entryTypes(t, fn)
+		assert.Len(t, entries, 6)
+		assert.Equal(t, archiveEntryDir, entries["tree/data/"].Type)
+		assert.Equal(t, archiveEntrySymlink, entries["tree/mongod"].Type)
+		assert.Equal(t, "bin/mongod", entries["tree/mongod"].Linkname)
+		assert.Equal(t, archiveEntryFile, entries["tree/bin/mongod"].Type)
+		assert.Equal(t, archiveEntryLink, entries["tree/bin/mongod-copy"].Type)
+		assert.Equal(t, "tree/bin/mongod", entries["tree/bin/mongod-copy"].Linkname)
+
+		target := t.TempDir()
+		require.NoError(t, extractArchive(archiveExtractOptions{Name: fn, Target: target}))
+		assert.DirExists(t, filepath.Join(target, "tree", "data"))
+		link, err := os.Readlink(filepath.Join(target, "tree", "mongod"))
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join("bin", "mongod"), link)
+
+		original, err := os.Stat(filepath.Join(target, "tree", "bin", "mongod"))
+		require.NoError(t, err)
+		copied, err := os.Stat(filepath.Join(target, "tree", "bin", "mongod-copy"))
+		require.NoError(t, err)
+		assert.True(t, os.SameFile(original, copied))
+	})
+}
+
+func TestExtractArchive(t *testing.T) {
+	entries := []testArchiveEntry{
+		{name: "root/", typeflag: tar.TypeDir},
+		{name: "root/bin/mongod", content: "mongod", typeflag: tar.TypeReg},
+		{name: "root/bin/mongos", content: "mongos", typeflag: tar.TypeReg},
+		{name: "root/LICENSE", content: "license", typeflag: tar.TypeReg},
+	}
+
+	for name, test := range map[string]struct {
+		opts     archiveExtractOptions
+		expected []string
+	}{
+		"All": {
+			expected: []string{"root/LICENSE", "root/bin/mongod", "root/bin/mongos"},
+		},
+		"Strip": {
+			opts:     archiveExtractOptions{StripComponents: 1},
+			expected: []string{"LICENSE", "bin/mongod", "bin/mongos"},
+		},
+		"Include": {
+			opts:     archiveExtractOptions{Include: []string{"/bin/"}},
+			expected: []string{"root/bin/mongod", "root/bin/mongos"},
+		},
+		"IncludeExclude": {
+			opts:     archiveExtractOptions{Include: []string{"/bin/"}, Exclude: []string{"mongos$"}, StripComponents: 2},
+			expected: []string{"mongod"},
+		},
+	} {
+		for _, ext := range []string{".tar.gz", ".zip"} {
+			t.Run(name+ext, func(t *testing.T) {
+				fn := filepath.Join(t.TempDir(), "archive"+ext)
+				if ext == ".zip" {
+					writeTestZip(t, fn, entries)
+				} else {
+					writeTestTarball(t, fn, entries)
+				}
+
+				test.opts.Name = fn
+				test.opts.Target = t.TempDir()
+				require.NoError(t, extractArchive(test.opts))
+
+				files := []string{}
+				require.NoError(t, filepath.Walk(test.opts.Target, func(p string, info os.FileInfo, err error) error {
+					require.NoError(t, err)
+					if !info.IsDir() {
+						rel, err := filepath.Rel(test.opts.Target, p)
+						require.NoError(t, err)
+						files = append(files, filepath.ToSlash(rel))
+					}
+					return nil
+				}))
+				assert.Equal(t, test.expected, files)
+			})
+		}
+	}
+
+	t.Run("Traversal", func(t *testing.T) {
+		for name, entries := range map[string][]testArchiveEntry{
+			"Parent":          {{name: "../evil", content: "x", typeflag: tar.TypeReg}},
+			"NestedParent":    {{name: "root/../../evil", content: "x", typeflag: tar.TypeReg}},
+			"Absolute":        {{name: "/tmp/evil", content: "x", typeflag: tar.TypeReg}},
+			"SymlinkOutside":  {{name: "root/link", typeflag: tar.TypeSymlink, linkname: "../../etc"}},
+			"HardlinkOutside": {{name: "root/link", typeflag: tar.TypeLink, linkname: "../evil"}},
+			"SymlinkThroughSymlink": {
+				{name: "l", typeflag: tar.TypeSymlink, linkname: "."},
+				{name: "esc", typeflag: tar.TypeSymlink, linkname: "l/.."},
+			},
+			"ThroughSymlink": {
+				{name: "link", typeflag: tar.TypeSymlink, linkname: "."},
+				{name: "link/escape", typeflag: tar.TypeSymlink, linkname: ".."},
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				dir := t.TempDir()
+				fn := filepath.Join(dir, "archive.tgz")
+				writeTestTarball(t, fn, entries)
+				target := filepath.Join(dir, "target")
+
+				assert.Error(t, extractArchive(archiveExtractOptions{Name: fn, Target: target}))
+				assert.NoFileExists(t, filepath.Join(dir, "evil"))
+				assert.NoFileExists(t, filepath.Join(target, "escape"))
+			})
+		}
+	})
+	t.Run("Links", func(t *testing.T) {
+		dir := t.TempDir()
+		fn := filepath.Join(dir, "archive.tgz")
+		writeTestTarball(t, fn, []testArchiveEntry{
+			{name: "root/bin/mongod", content: "mongod", typeflag: tar.TypeReg},
+			{name: "root/mongod", typeflag: tar.TypeSymlink, linkname: "bin/mongod"},
+			{name: "root/bin/mongod-copy", typeflag: tar.TypeLink, linkname: "root/bin/mongod"},
+		})
+		target := filepath.Join(dir, "target")
+
+		require.NoError(t, extractArchive(archiveExtractOptions{Name: fn, Target: target, StripComponents: 1}))
+		link, err := os.Readlink(filepath.Join(target, "mongod"))
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join("bin", "mongod"), link)
+		data, err := os.ReadFile(filepath.Join(target, "bin", "mongod-copy"))
+		require.NoError(t, err)
+		assert.Equal(t, "mongod", string(data))
+	})
+	t.Run("HardlinkThroughSymlink", func(t *testing.T) {
+		dir := t.TempDir()
+		victim := filepath.Join(dir, "outside", "victim")
+		require.NoError(t, os.MkdirAll(filepath.Dir(victim), 0755))
+		require.NoError(t, os.WriteFile(victim, []byte("safe"), 0644))
+		fn := filepath.Join(dir, "archive.tgz")
+		writeTestTarball(t, fn, []testArchiveEntry{
+			{name: "l", typeflag: tar.TypeSymlink, linkname: "."},
+			{name: "esc", typeflag: tar.TypeSymlink, linkname: "l/.."},
+			{name: "x", typeflag: tar.TypeLink, linkname: "esc/outside/victim"},
+			{name: "x", content: "evil", typeflag: tar.TypeReg},
+		})
+
+		assert.Error(t, extractArchive(archiveExtractOptions{Name: fn, Target: filepath.Join(dir, "target")}))
+		data, err := os.ReadFile(victim)
+		require.NoError(t, err)
+		assert.Equal(t, "safe", string(data))
+	})
+	t.Run("ReplacesHardlink", func(t *testing.T) {
+		dir := t.TempDir()
+		fn := filepath.Join(dir, "archive.tgz")
+		writeTestTarball(t, fn, []testArchiveEntry{
+			{name: "a", content: "a", typeflag: tar.TypeReg},
+			{name: "b", typeflag: tar.TypeLink, linkname: "a"},
+			{name: "b", content: "b", typeflag: tar.TypeReg},
+		})
+		target := filepath.Join(dir, "target")
+
+		require.NoError(t, extractArchive(archiveExtractOptions{Name: fn, Target: target}))
+		data, err := os.ReadFile(filepath.Join(target, "a"))
+		require.NoError(t, err)
+		assert.Equal(t, "a", string(data), "writing a file does not write through a hard link")
+	})
+	t.Run("AbsoluteSymlink", func(t *testing.T) {
+		dir := t.TempDir()
+		fn := filepath.Join(dir, "archive.tgz")
+		writeTestTarball(t, fn, []testArchiveEntry{
+			{name: "root/link", typeflag: tar.TypeSymlink, linkname: "/etc"},
+			{name: "root/bin/mongod", content: "mongod", typeflag: tar.TypeReg},
+		})
+		target := filepath.Join(dir, "target")
+
+		require.NoError(t, extractArchive(archiveExtractOptions{Name: fn, Target: target, StripComponents: 1}))
+		_, err := os.Lstat(filepath.Join(target, "link"))
+		assert.True(t, os.IsNotExist(err), "absolute links are skipped")
+		assert.FileExists(t, filepath.Join(target, "bin", "mongod"))
+	})
+	t.Run("InvalidPattern", func(t *testing.T) {
+		err := extractArchive(archiveExtractOptions{Name: "archive.tgz", Exclude: []string{"("}})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid exclude pattern")
+	})
+	t.Run("UnsupportedFormat", func(t *testing.T) {
+		_, err := listArchive("archive.rar")
+		assert.Error(t, err)
+	})
+}
+
+func TestArchiveManifest(t *testing.T) {
+	src := t.TempDir()
+	t.Chdir(src)
+	require.NoError(t, os.MkdirAll(filepath.Join("tree", "bin"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join("tree", "bin", "mongod"), []byte("mongod"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join("tree", "README"), []byte("readme"), 0644))
+	require.NoError(t, os.Symlink(filepath.Join("bin", "mongod"), filepath.Join("tree", "mongod")))
+
+	for _, ext := range []string{".tar.gz", ".zip"} {
+		t.Run(ext, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "archive"+ext)
+			require.NoError(t, CreateArchive(context.Background(), ArchiveOptions{
+				Name:          fn,
+				Items:         []string{"tree"},
+				Manifest:      true,
+				PreserveLinks: true,
+				Directories:   true,
+			}))
+
+			manifest, err := readArchiveManifest(fn + archiveManifestSuffix)
+			require.NoError(t, err)
+			assert.Equal(t, "archive"+ext, manifest.Archive)
+			size, sum, err := sha256File(fn)
+			require.NoError(t, err)
+			assert.Equal(t, size, manifest.Size)
+			assert.Equal(t, sum, manifest.SHA256)
+
+			entries := map[string]archiveManifestEntry{}
+			for _, entry := range manifest.Entries {
+				entries[entry.Path] = entry
+			}
+			require.Len(t, entries, 5)
+			assert.Equal(t, sha256Checksum([]byte("mongod")).Value, entries["tree/bin/mongod"].SHA256)
+			assert.Equal(t, os.FileMode(0755), entries["tree/bin/mongod"].Mode)
+			assert.EqualValues(t, 6, entries["tree/README"].Size)
+			assert.Equal(t, archiveEntrySymlink, entries["tree/mongod"].Type)
+			assert.Empty(t, entries["tree/mongod"].SHA256)
+
+			problems, err := verifyArchiveFile(manifest, fn)
+			require.NoError(t, err)
+			assert.Empty(t, problems)
+
+			target := t.TempDir()
+			require.NoError(t, extractArchive(archiveExtractOptions{Name: fn, Target: target}))
+			problems, err = verifyArchiveTree(manifest, target)
+			require.NoError(t, err)
+			assert.Empty(t, problems)
+
+			require.NoError(t, os.WriteFile(filepath.Join(target, "tree", "README"), []byte("README"), 0644))
+			require.NoError(t, os.Remove(filepath.Join(target, "tree", "mongod")))
+			problems, err = verifyArchiveTree(manifest, target)
+			require.NoError(t, err)
+			require.Len(t, problems, 2)
+			assert.Contains(t, problems[0]+problems[1], "'tree/README' has sha256")
+			assert.Contains(t, problems[0]+problems[1], "'tree/mongod' is missing")
+		})
+	}
+
+	t.Run("ChangedArchive", func(t *testing.T) {
+		out := t.TempDir()
+		fn := filepath.Join(out, "archive.tar.gz")
+		require.NoError(t, CreateArchive(context.Background(), ArchiveOptions{Name: fn, Items: []string{"tree"}, Manifest: true}))
+		manifest, err := readArchiveManifest(fn + archiveManifestSuffix)
+		require.NoError(t, err)
+
+		require.NoError(t, os.WriteFile(filepath.Join("tree", "README"), []byte("changed"), 0644))
+		require.NoError(t, CreateArchive(context.Background(), ArchiveOptions{Name: fn, Items: []string{"tree"}}))
+
+		problems, err := verifyArchiveFile(manifest, fn)
+		require.NoError(t, err)
+		require.Len(t, problems, 2)
+		assert.Contains(t, problems[0], "archive")
+		assert.Contains(t, problems[1], "'tree/README' has size 7")
+	})
+	t.Run("HardLink", func(t *testing.T) {
+		require.NoError(t, os.MkdirAll("links", 0755))
+		require.NoError(t, os.WriteFile(filepath.Join("links", "mongod"), []byte("mongod"), 0755))
+		require.NoError(t, os.Link(filepath.Join("links", "mongod"), filepath.Join("links", "mongod-copy")))
+
+		fn := filepath.Join(t.TempDir(), "links.tar.gz")
+		require.NoError(t, CreateArchive(context.Background(), ArchiveOptions{
+			Name:          fn,
+			Items:         []string{"links"},
+			Manifest:      true,
+			PreserveLinks: true,
+		}))
+		manifest, err := readArchiveManifest(fn + archiveManifestSuffix)
+		require.NoError(t, err)
+
+		target := t.TempDir()
+		require.NoError(t, extractArchive(archiveExtractOptions{Name: fn, Target: target}))
+		problems, err := verifyArchiveTree(manifest, target)
+		require.NoError(t, err)
+		assert.Empty(t, problems)
+
+		copyPath := filepath.Join(target, "links", "mongod-copy")
+		require.NoError(t, os.Remove(copyPath))
+		require.NoError(t, os.WriteFile(copyPath, []byte("MONGOD"), 0755))
+		problems, err = verifyArchiveTree(manifest, target)
+		require.NoError(t, err)
+		require.Len(t, problems, 1)
+		assert.Contains(t, problems[0], "'links/mongod-copy' has sha256")
+	})
+}
+
+func TestCreateArchiveErrors(t *testing.T) {
+	ctx := context.Background()
+	src := t.TempDir()
+	t.Chdir(src)
+	require.NoError(t, os.MkdirAll(filepath.Join("tree", "bin"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join("tree", "bin", "mongod"), []byte("mongod"), 0755))
+	require.NoError(t, os.Symlink("missing", filepath.Join("tree", "dangling")))
+	out := t.TempDir()
+
+	t.Run("InvalidExclude", func(t *testing.T) {
+		fn := filepath.Join(out, "invalid.tar.gz")
+		err := CreateArchive(ctx, ArchiveOptions{Name: fn, Items: []string{"tree"}, Exclude: []string{"bin/(", "["}})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid exclude pattern 'bin/('")
+		assert.Contains(t, err.Error(), "invalid exclude pattern '['")
+		assert.NoFileExists(t, fn)
+	})
+	t.Run("CollectsErrors", func(t *testing.T) {
+		fn := filepath.Join(out, "errors.tar.gz")
+		err := CreateArchive(ctx, ArchiveOptions{Name: fn, Items: []string{"tree", "missing"}, Manifest: true})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "reading 'tree/dangling'")
+		assert.Contains(t, err.Error(), "walking 'missing'")
+		assert.NoFileExists(t, fn, "incomplete archives are removed")
+		assert.NoFileExists(t, fn+archiveManifestSuffix)
+	})
+	t.Run("SkipUnreadable", func(t *testing.T) {
+		fn := filepath.Join(out, "skip.tar.gz")
+		require.NoError(t, CreateArchive(ctx, ArchiveOptions{Name: fn, Items: []string{"tree", "missing"}, SkipUnreadable: true, Reproducible: true}))
+
+		entries, err := listArchive(fn)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, "tree/bin/mongod", entries[0].Name)
+	})
+	t.Run("ExcludeUnreadable", func(t *testing.T) {
+		fn := filepath.Join(out, "exclude.tar.gz")
+		require.NoError(t, CreateArchive(ctx, ArchiveOptions{Name: fn, Items: []string{"tree"}, Exclude: []string{"dangling$"}}))
+	})
+	t.Run("Canceled", func(t *testing.T) {
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		contents, errs := getContents(canceled, ArchiveOptions{Items: []string{"tree"}})
+		for range contents {
+		}
+		for range errs {
+		}
+	})
+}
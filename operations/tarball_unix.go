@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package operations
+
+import (
+	"os"
+	"syscall"
+)
+
+// archiveFileID identifies a file independent of its name, to find
+// hard links to the same file.
+type archiveFileID struct {
+	dev uint64
+	ino uint64
+}
+
+func getArchiveFileID(info os.FileInfo) (archiveFileID, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Nlink < 2 {
+		return archiveFileID{}, false
+	}
+
+	return archiveFileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+}
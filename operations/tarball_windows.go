@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package operations
+
+import "os"
+
+// archiveFileID identifies a file independent of its name. Archives
+// created on Windows do not preserve hard links.
+type archiveFileID struct{}
+
+func getArchiveFileID(_ os.FileInfo) (archiveFileID, bool) {
+	return archiveFileID{}, false
+}